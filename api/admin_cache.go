@@ -0,0 +1,54 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AdminCacheUsersHandler - DELETE /admin/cache/users[/{id}]: удаляет из кеша одного или всех пользователей,
+// предварительно сохранив их изменения, например после исправления данных в БД вручную.
+// Значения общего баланса (-cache_backend) не сбрасываются
+func (a *API) AdminCacheUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/cache/users"), "/")
+	if rest == "" {
+		a.clearCache(w)
+		return
+	}
+
+	id, err := strconv.Atoi(rest)
+	if err != nil || id < 1 {
+		sendError(w, errors.New("invalid user id"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	evicted, err := a.Cache.Invalidate(id)
+	if err != nil {
+		log.Printf("failed to save user %d before cache invalidation: %v", id, err)
+		sendError(w, errors.New("failed to save pending changes"), http.StatusServiceUnavailable)
+		return
+	}
+	a.Responses.Invalidate(id)
+
+	sendJSON(w, map[string]bool{"evicted": evicted})
+}
+
+// clearCache - удаляет из кеша всех пользователей
+func (a *API) clearCache(w http.ResponseWriter) {
+	evicted, err := a.Cache.Clear()
+	a.Responses.Reset()
+	if err != nil {
+		log.Printf("cache clear: failed to save pending changes: %v", err)
+		sendError(w, errors.New("failed to save pending changes of some users, they were kept in cache"), http.StatusServiceUnavailable)
+		return
+	}
+
+	sendJSON(w, map[string]int{"evicted": evicted})
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/store"
+)
+
+// CashbackRuleParams - правило в PUT /admin/cashback-rules/{subject}: кешбэк в сотых долях процента
+// и лимит на пользователя за месяц, 0 - без лимита
+type CashbackRuleParams struct {
+	BasisPoints int   `json:"basis_points"`
+	MonthlyCap  int64 `json:"monthly_cap"`
+}
+
+// AdminCashbackRulesHandler - GET /admin/cashback-rules: все правила кешбэка,
+// PUT /admin/cashback-rules/{subject}: задать правило категории ("category:{tag}") или продавца ("merchant:{name}"),
+// DELETE /admin/cashback-rules/{subject}: удалить его
+func (a *API) AdminCashbackRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Cashback == nil {
+		sendError(w, errors.New("cashback is disabled"), http.StatusNotFound)
+		return
+	}
+
+	subject := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/cashback-rules"), "/")
+	if subject == "" {
+		if r.Method != http.MethodGet {
+			sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+		list := a.Cashback.List()
+		sort.Slice(list, func(i, j int) bool { return list[i].Subject < list[j].Subject })
+		sendJSON(w, map[string]interface{}{"rules": list})
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodPut:
+		var params CashbackRuleParams
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			sendError(w, err, http.StatusBadRequest)
+			return
+		}
+		rule := store.CashbackRule{Subject: subject, BasisPoints: params.BasisPoints, MonthlyCap: params.MonthlyCap}
+		if err := rule.Validate(); err != nil {
+			sendError(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+		if err := a.Cashback.Set(ctx, rule); err != nil {
+			sendStorageError(w, err, "failed to save cashback rule")
+			return
+		}
+
+		a.Audit.Record(audit.Event{
+			Actor:  callerID(r),
+			Action: "cashback_rule.set",
+			Target: subject,
+			Result: "set",
+			Fields: map[string]interface{}{
+				"basis_points": params.BasisPoints,
+				"monthly_cap":  params.MonthlyCap,
+			},
+		})
+		sendSuccess(w)
+	case http.MethodDelete:
+		err := a.Cashback.Delete(ctx, subject)
+		if errors.Is(err, store.ErrNotFound) {
+			sendError(w, errors.New("cashback rule not found"), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			sendStorageError(w, err, "failed to delete cashback rule")
+			return
+		}
+
+		a.Audit.Record(audit.Event{
+			Actor:  callerID(r),
+			Action: "cashback_rule.delete",
+			Target: subject,
+			Result: "deleted",
+		})
+		sendSuccess(w)
+	default:
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+)
+
+// AdminDeadLettersHandler - GET /admin/dead-letters: изменения, которые не удалось сохранить в БД
+func (a *API) AdminDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if a.DeadLetters == nil {
+		sendError(w, errors.New("dead letters disabled"), http.StatusNotFound)
+		return
+	}
+
+	letters, err := a.DeadLetters.List()
+	if err != nil {
+		sendError(w, errors.New("failed to read dead letters"), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"dead_letters": letters,
+		"count":        len(letters),
+	})
+}
+
+// AdminDeadLettersRedriveHandler - POST /admin/dead-letters/redrive: повторно сохраняет изменения в БД
+func (a *API) AdminDeadLettersRedriveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if a.DeadLetters == nil {
+		sendError(w, errors.New("dead letters disabled"), http.StatusNotFound)
+		return
+	}
+
+	redriven, remaining, err := a.DeadLetters.Redrive(r.Context(), a.Store)
+	if err != nil {
+		sendError(w, errors.New("failed to redrive dead letters"), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"redriven":  redriven,
+		"remaining": len(remaining),
+	})
+}
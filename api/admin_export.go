@@ -0,0 +1,258 @@
+package api
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// exportPageSize - сколько строк выгрузки читается из хранилища одним запросом: в памяти одновременно
+// не больше одной страницы, соединение с БД не занято, пока страница уходит клиенту
+const exportPageSize = 1000
+
+// форматы выгрузки
+const (
+	exportCSV    = "csv"
+	exportNDJSON = "ndjson"
+)
+
+var (
+	userExportHeader        = []string{"id", "balance", "frozen", "status", "created_at", "updated_at", "metadata"}
+	transactionExportHeader = []string{"id", "user_id", "amount", "operation", "tag", "created_at", "category", "tags"}
+)
+
+// exportStream - ответ с выгрузкой, пишется по мере чтения страниц
+type exportStream struct {
+	w      http.ResponseWriter
+	format string
+	name   string
+	header []string
+
+	buf     *bufio.Writer
+	csv     *csv.Writer
+	json    *json.Encoder
+	started bool
+}
+
+func newExportStream(w http.ResponseWriter, format, name string, header []string) *exportStream {
+	return &exportStream{w: w, format: format, name: name, header: header}
+}
+
+// begin - заголовки ответа и строка заголовка CSV, вызывается перед первой строкой: до него об ошибке
+// еще можно ответить статусом
+func (s *exportStream) begin() error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+
+	s.buf = bufio.NewWriter(s.w)
+	if s.format == exportNDJSON {
+		s.w.Header().Set("Content-Type", "application/x-ndjson")
+		s.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", s.name+".ndjson"))
+		s.json = json.NewEncoder(s.buf)
+		return nil
+	}
+	s.w.Header().Set("Content-Type", "text/csv")
+	s.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", s.name+".csv"))
+	s.csv = csv.NewWriter(s.buf)
+	return s.csv.Write(s.header)
+}
+
+// write - одна строка: record в CSV или value в NDJSON
+func (s *exportStream) write(record []string, value interface{}) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	if s.json != nil {
+		return s.json.Encode(value)
+	}
+	return s.csv.Write(record)
+}
+
+// flush - отправляет клиенту записанные строки
+func (s *exportStream) flush() error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	if s.csv != nil {
+		s.csv.Flush()
+		if err := s.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// fail - ошибка чтения: до начала ответа - статус, после - выгрузка обрывается, и клиент получает неполный ответ
+func (s *exportStream) fail(err error) {
+	if !s.started {
+		sendStorageError(s.w, err, "failed to export "+s.name)
+		return
+	}
+	log.Printf("export of %s interrupted: %v", s.name, err)
+}
+
+// exportFormat - format из query: csv (по умолчанию) или ndjson
+func exportFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", exportCSV:
+		return exportCSV, nil
+	case exportNDJSON:
+		return exportNDJSON, nil
+	default:
+		return "", errors.New("format must be csv or ndjson")
+	}
+}
+
+// AdminExportUsersHandler - GET /admin/export/users?format=csv|ndjson: все пользователи, включая удаленных,
+// по возрастанию id в состоянии из БД, без несохраненных изменений из кеша
+func (a *API) AdminExportUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	format, err := exportFormat(r)
+	if err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	stream := newExportStream(w, format, "users", userExportHeader)
+	opts := store.ListOptions{Sort: store.SortByID, Limit: exportPageSize, IncludeDeleted: true}
+	for {
+		page, err := a.Store.ListUsers(r.Context(), opts)
+		if err != nil {
+			stream.fail(err)
+			return
+		}
+		for _, u := range page.Users {
+			state := u.State()
+			metadata, _ := state.Metadata.MarshalJSON()
+			record := []string{
+				strconv.Itoa(state.ID),
+				strconv.Itoa(state.Balance),
+				strconv.FormatBool(state.Frozen),
+				state.Status,
+				state.CreatedAt.Format(time.RFC3339Nano),
+				state.UpdatedAt.Format(time.RFC3339Nano),
+				string(metadata),
+			}
+			if err := stream.write(record, state); err != nil {
+				stream.fail(err)
+				return
+			}
+		}
+		if err := stream.flush(); err != nil {
+			stream.fail(err)
+			return
+		}
+		if page.Next == nil {
+			return
+		}
+		opts.After = page.Next
+	}
+}
+
+// AdminExportTransactionsHandler - GET /admin/export/transactions?from=...&to=...&category=...&tag=...&format=csv|ndjson:
+// записи леджера за [from, to) (RFC 3339, по умолчанию - за все время) по возрастанию времени, только с категорией
+// category и со всеми тегами tag, если они заданы
+func (a *API) AdminExportTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	format, err := exportFormat(r)
+	if err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	filter := store.TransactionFilter{Limit: exportPageSize}
+	if filter.From, filter.To, err = parsePeriod(r); err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	if filter.Category, filter.Tags, err = parseLabels(r); err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	stream := newExportStream(w, format, "transactions", transactionExportHeader)
+	for {
+		txs, err := a.Store.ListTransactions(r.Context(), filter)
+		if err != nil {
+			stream.fail(err)
+			return
+		}
+		for _, tx := range txs {
+			record := []string{
+				tx.ID,
+				strconv.Itoa(tx.UserID),
+				strconv.Itoa(tx.Amount),
+				tx.Operation,
+				tx.Tag,
+				tx.CreatedAt.UTC().Format(time.RFC3339Nano),
+				tx.Category,
+				tx.Tags.String(),
+			}
+			if err := stream.write(record, tx); err != nil {
+				stream.fail(err)
+				return
+			}
+		}
+		if err := stream.flush(); err != nil {
+			stream.fail(err)
+			return
+		}
+		if len(txs) < filter.Limit {
+			return
+		}
+		filter.After = txs[len(txs)-1].Cursor()
+	}
+}
+
+// parseLabels - фильтр по категории category и тегам tag (параметр повторяется) из query
+func parseLabels(r *http.Request) (category string, tags []string, err error) {
+	query := r.URL.Query()
+	category, tags = query.Get("category"), query["tag"]
+	if err := store.ValidateCategory(category); err != nil {
+		return "", nil, err
+	}
+	if err := store.ValidateTags(tags); err != nil {
+		return "", nil, err
+	}
+	return category, tags, nil
+}
+
+// parsePeriod - from и to из query в RFC 3339, отсутствующие - нулевые
+func parsePeriod(r *http.Request) (from, to time.Time, err error) {
+	query := r.URL.Query()
+	if value := query.Get("from"); value != "" {
+		if from, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return from, to, errors.New("from must be an RFC 3339 time")
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return from, to, errors.New("to must be an RFC 3339 time")
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return from, to, errors.New("from must be before to")
+	}
+	return from, to, nil
+}
@@ -0,0 +1,22 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+)
+
+// AdminFlushHandler - POST /admin/flush: синхронно сохраняет в БД всех пользователей, ожидающих фонового сохранения
+func (a *API) AdminFlushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	res, err := a.Saver.Flush(r.Context())
+	if err != nil {
+		sendError(w, errors.New("flush interrupted"), http.StatusServiceUnavailable)
+		return
+	}
+
+	sendJSON(w, res)
+}
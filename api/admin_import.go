@@ -0,0 +1,187 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/store"
+)
+
+// ограничения POST /admin/users/import
+const (
+	MaxImportRows  = 100000
+	maxImportBytes = 64 << 20
+)
+
+// importColumns - колонки CSV импорта: id или external_ref обязателен в каждой строке, balance - всегда
+var importColumns = map[string]bool{"id": true, "external_ref": true, "balance": true, "currency": true}
+
+// ImportReport - ответ на импорт с ошибками, ничего не добавлено
+type ImportReport struct {
+	Error string                 `json:"error"`
+	Rows  []store.ImportRowError `json:"rows"`
+}
+
+// AdminImportUsersHandler - POST /admin/users/import, CSV с заголовком id,external_ref,balance,currency.
+// Все строки проверяются до записи и добавляются одной транзакцией: если хоть одна строка с ошибкой или ее id
+// и external_ref уже заняты, не добавляется ничего, а в ответе 422 - ошибки по номерам строк
+func (a *API) AdminImportUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	users, rowErrors, err := a.readImport(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	if len(rowErrors) > 0 {
+		sendImportReport(w, rowErrors)
+		return
+	}
+	if len(users) == 0 {
+		sendError(w, errors.New("no users to import"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	err = a.Store.ImportUsers(ctx, users)
+	var importErr *store.ImportError
+	if errors.As(err, &importErr) {
+		sendImportReport(w, importErr.Rows)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to import users")
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "user.import",
+		Target: "users",
+		Result: strconv.Itoa(len(users)),
+	})
+
+	sendJSON(w, map[string]int{"imported": len(users)})
+}
+
+// readImport - строки CSV в пользователей импорта. Ошибки формата файла возвращаются в err,
+// ошибки отдельных строк - в rowErrors
+func (a *API) readImport(body io.Reader) (users []store.ImportUser, rowErrors []store.ImportRowError, err error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid csv header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !importColumns[name] {
+			return nil, nil, fmt.Errorf("unknown csv column %q", name)
+		}
+		columns[name] = i
+	}
+	_, hasID := columns["id"]
+	_, hasRef := columns["external_ref"]
+	if _, ok := columns["balance"]; !ok || (!hasID && !hasRef) {
+		return nil, nil, errors.New("csv header must have balance and id or external_ref columns")
+	}
+
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	ids := make(map[int]int)
+	refs := make(map[string]int)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid csv: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+		if len(users)+len(rowErrors) >= MaxImportRows {
+			return nil, nil, fmt.Errorf("import is limited to %d rows", MaxImportRows)
+		}
+
+		u, err := a.importUser(field(record, "id"), field(record, "external_ref"), field(record, "balance"), field(record, "currency"))
+		if err == nil && u.ID > 0 && ids[u.ID] > 0 {
+			err = fmt.Errorf("duplicate id, first on line %d", ids[u.ID])
+		}
+		ref := field(record, "external_ref")
+		if err == nil && ref != "" && refs[ref] > 0 {
+			err = fmt.Errorf("duplicate external_ref, first on line %d", refs[ref])
+		}
+		if err != nil {
+			rowErrors = append(rowErrors, store.ImportRowError{Line: line, Error: err.Error()})
+			continue
+		}
+
+		u.Line = line
+		if u.ID > 0 {
+			ids[u.ID] = line
+		}
+		if ref != "" {
+			refs[ref] = line
+		}
+		users = append(users, u)
+	}
+	return users, rowErrors, nil
+}
+
+// importUser - проверяет поля одной строки импорта
+func (a *API) importUser(id, ref, balance, currency string) (store.ImportUser, error) {
+	var u store.ImportUser
+	if id == "" && ref == "" {
+		return u, errors.New("id or external_ref is required")
+	}
+	if id != "" {
+		n, err := strconv.Atoi(id)
+		if err != nil || n < 1 {
+			return u, errors.New("invalid user id")
+		}
+		u.ID = n
+	}
+	if ref != "" {
+		metadata, err := json.Marshal(map[string]string{store.ExternalRefKey: ref})
+		if err != nil {
+			return u, err
+		}
+		u.Metadata = metadata
+	}
+
+	n, err := strconv.ParseInt(balance, 10, 64)
+	if err != nil || n < 0 {
+		return u, errors.New("balance must be a non-negative integer")
+	}
+	u.Balance = n
+
+	if currency != "" && a.Currency != "" && !strings.EqualFold(currency, a.Currency) {
+		return u, fmt.Errorf("currency %s is not supported, balances are in %s", currency, a.Currency)
+	}
+	return u, nil
+}
+
+func sendImportReport(w http.ResponseWriter, rows []store.ImportRowError) {
+	response, _ := json.Marshal(ImportReport{Error: (&store.ImportError{Rows: rows}).Error(), Rows: rows})
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	w.Write(response)
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/store"
+)
+
+// AdminTrialBalanceHandler - GET /admin/ledger/trial-balance: суммы проводок двойной записи по счетам.
+// Сумма по всем счетам должна быть нулем, иначе balanced - false
+func (a *API) AdminTrialBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	balance, err := a.Store.TrialBalance(ctx)
+	if err != nil {
+		sendStorageError(w, err, "failed to load trial balance")
+		return
+	}
+	sendJSON(w, balance)
+}
+
+// MaxConsistencyProblems - сколько расхождений каждого вида возвращает и исправляет один запрос, остальные -
+// следующими запросами или подкомандой check
+const MaxConsistencyProblems = 1000
+
+// RepairReport - ответ на исправление: что сделано и проверка после него
+type RepairReport struct {
+	Repaired store.RepairResult      `json:"repaired"`
+	Report   store.ConsistencyReport `json:"report"`
+}
+
+// AdminConsistencyHandler - GET /admin/ledger/consistency: расхождения балансов с леджером и несбалансированные
+// записи как план исправления, POST /admin/ledger/consistency?trust=balance|ledger - исправляет их
+func (a *API) AdminConsistencyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	trust := r.URL.Query().Get("trust")
+	if trust == "" {
+		trust = store.TrustBalance
+	}
+	if err := store.ValidateTrust(trust); err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	// исправление не прерывается, если клиент отключился
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	report, err := a.Store.CheckConsistency(ctx, MaxConsistencyProblems)
+	if err != nil {
+		sendStorageError(w, err, "failed to check consistency")
+		return
+	}
+	if r.Method == http.MethodGet {
+		sendJSON(w, report)
+		return
+	}
+
+	res, err := a.Store.RepairConsistency(ctx, report, trust)
+	if err != nil {
+		sendStorageError(w, err, "failed to repair consistency")
+		return
+	}
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "ledger.repair",
+		Target: "trust:" + trust,
+		Result: fmt.Sprintf("adjusted=%d rebalanced=%d reposted=%d skipped=%d", res.Adjusted, res.Rebalanced, res.Reposted, res.Skipped),
+	})
+	// с trust=ledger баланс в БД изменился, кеш перечитает его
+	for _, m := range report.Mismatches {
+		if _, err := a.Cache.Invalidate(m.UserID); err != nil {
+			log.Printf("failed to save user %d before cache invalidation: %v", m.UserID, err)
+		}
+		a.Responses.Invalidate(m.UserID)
+	}
+
+	after, err := a.Store.CheckConsistency(ctx, MaxConsistencyProblems)
+	if err != nil {
+		sendStorageError(w, err, "failed to check consistency")
+		return
+	}
+	sendJSON(w, RepairReport{Repaired: res, Report: after})
+}
+
+// AdminVerifyChainHandler - GET /admin/ledger/chain/verify: проходит цепочку хешей леджера и сообщает
+// первое место, где она не сходится
+func (a *API) AdminVerifyChainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Chain == nil {
+		sendError(w, errors.New("ledger chain disabled"), http.StatusNotFound)
+		return
+	}
+
+	// проход всей цепочки дольше обычного запроса, таймаут QueryTimeout не применяется
+	res, err := a.Chain.Verify(r.Context())
+	if err != nil {
+		sendStorageError(w, err, "failed to verify ledger chain")
+		return
+	}
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "ledger.chain.verify",
+		Target: fmt.Sprintf("head:%d", res.HeadSeq),
+		Result: fmt.Sprintf("valid=%t verified=%d", res.Valid, res.Verified),
+	})
+	sendJSON(w, res)
+}
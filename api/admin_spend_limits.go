@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/store"
+)
+
+// SpendLimitParams - лимиты трат в PUT /admin/spend-limits/{subject}, 0 - без лимита
+type SpendLimitParams struct {
+	Daily  int64 `json:"daily"`
+	Weekly int64 `json:"weekly"`
+}
+
+// AdminSpendLimitsHandler - GET /admin/spend-limits: все лимиты трат,
+// PUT /admin/spend-limits/{subject}: задать лимиты пользователя ("user:{id}") или сегмента ("segment:{name}"),
+// DELETE /admin/spend-limits/{subject}: снять их
+func (a *API) AdminSpendLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	if a.SpendLimits == nil {
+		sendError(w, errors.New("spend limits disabled"), http.StatusNotFound)
+		return
+	}
+
+	subject := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/spend-limits"), "/")
+	if subject == "" {
+		if r.Method != http.MethodGet {
+			sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+		list := a.SpendLimits.List()
+		sort.Slice(list, func(i, j int) bool { return list[i].Subject < list[j].Subject })
+		sendJSON(w, map[string]interface{}{"limits": list})
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodPut:
+		var params SpendLimitParams
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			sendError(w, err, http.StatusBadRequest)
+			return
+		}
+		limit := store.SpendLimit{Subject: subject, Daily: params.Daily, Weekly: params.Weekly}
+		if err := limit.Validate(); err != nil {
+			sendError(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+		if err := a.SpendLimits.Set(ctx, limit); err != nil {
+			sendStorageError(w, err, "failed to save spend limit")
+			return
+		}
+
+		a.Audit.Record(audit.Event{
+			Actor:  callerID(r),
+			Action: "spend_limit.set",
+			Target: subject,
+			Result: "set",
+			Fields: map[string]interface{}{
+				"daily":  params.Daily,
+				"weekly": params.Weekly,
+			},
+		})
+		sendSuccess(w)
+	case http.MethodDelete:
+		err := a.SpendLimits.Delete(ctx, subject)
+		if errors.Is(err, store.ErrNotFound) {
+			sendError(w, errors.New("spend limit not found"), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			sendStorageError(w, err, "failed to delete spend limit")
+			return
+		}
+
+		a.Audit.Record(audit.Event{
+			Actor:  callerID(r),
+			Action: "spend_limit.delete",
+			Target: subject,
+			Result: "deleted",
+		})
+		sendSuccess(w)
+	default:
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+	}
+}
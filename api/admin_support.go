@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/auth"
+)
+
+// SupportTokenParams - параметры выпуска временного токена поддержки
+type SupportTokenParams struct {
+	Agent  string `json:"agent"`
+	UserID int    `json:"user_id"`
+	// TTL - время жизни, например "10m", по умолчанию и не больше auth.MaxSupportTokenTTL
+	TTL string `json:"ttl"`
+}
+
+func (p *SupportTokenParams) Validate() (time.Duration, error) {
+	if p.Agent == "" {
+		return 0, errors.New("agent is required")
+	}
+
+	if p.UserID < 1 {
+		return 0, errors.New("invalid user id")
+	}
+
+	if p.TTL == "" {
+		return auth.MaxSupportTokenTTL, nil
+	}
+
+	ttl, err := time.ParseDuration(p.TTL)
+	if err != nil || ttl <= 0 || ttl > auth.MaxSupportTokenTTL {
+		return 0, fmt.Errorf("ttl must be between 0 and %s", auth.MaxSupportTokenTTL)
+	}
+
+	return ttl, nil
+}
+
+// AdminSupportTokensHandler - POST /admin/support-tokens: выпуск токена поддержки только на чтение одного пользователя
+func (a *API) AdminSupportTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if a.SupportTokens == nil {
+		sendError(w, errors.New("support tokens disabled"), http.StatusNotFound)
+		return
+	}
+
+	var params SupportTokenParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	ttl, err := params.Validate()
+	if err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	token, err := a.SupportTokens.Issue(auth.SupportClaims{
+		Agent:     params.Agent,
+		Scope:     auth.ScopeRead,
+		UserID:    params.UserID,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		sendError(w, errors.New("failed to issue token"), http.StatusInternalServerError)
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "support_token.issue",
+		Target: fmt.Sprintf("user:%d", params.UserID),
+		Result: "issued",
+		Fields: map[string]interface{}{
+			"agent":      params.Agent,
+			"scope":      auth.ScopeRead,
+			"expires_at": expiresAt.UTC(),
+		},
+	})
+
+	sendJSON(w, map[string]interface{}{
+		"token":      token,
+		"scope":      auth.ScopeRead,
+		"user_id":    params.UserID,
+		"expires_at": expiresAt.UTC(),
+	})
+}
@@ -0,0 +1,353 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/store"
+)
+
+// AdminCreateUserHandler - POST /admin/users {"balance": 100, "metadata": {"plan": "pro"}}: создает пользователя
+func (a *API) AdminCreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var params struct {
+		Balance  int64          `json:"balance"`
+		Metadata store.Metadata `json:"metadata"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	if params.Balance < 0 {
+		sendError(w, errors.New("balance must not be negative"), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := store.ValidateMetadata(params.Metadata); err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	user, err := a.Store.CreateUser(ctx, params.Balance, params.Metadata)
+	if errors.Is(err, store.ErrExternalRefTaken) {
+		sendError(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to create user")
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "user.create",
+		Target: fmt.Sprintf("user:%d", user.ID),
+		Result: strconv.FormatInt(params.Balance, 10),
+	})
+
+	sendJSON(w, user.State())
+}
+
+// AdminUsersHandler - роуты /admin/users/{id}/...
+func (a *API) AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/users/"), "/"), "/")
+	if len(parts) != 2 {
+		sendError(w, errors.New("not found"), http.StatusNotFound)
+		return
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || id < 1 {
+		sendError(w, errors.New("invalid user id"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	switch parts[1] {
+	case "merge":
+		a.mergeUser(w, r, id)
+	case "status":
+		a.setUserStatus(w, r, id)
+	case "metadata":
+		a.setUserMetadata(w, r, id)
+	case "credit-limit":
+		a.setUserCreditLimit(w, r, id)
+	case "max-balance":
+		a.setUserMaxBalance(w, r, id)
+	default:
+		sendError(w, errors.New("not found"), http.StatusNotFound)
+	}
+}
+
+// mergeUser - POST /admin/users/{id}/merge?into={other}: переносит баланс и external_ref id на other и замораживает id
+func (a *API) mergeUser(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	intoID, err := strconv.Atoi(r.URL.Query().Get("into"))
+	if err != nil || intoID < 1 {
+		sendError(w, errors.New("invalid into user id"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	load := func(id int) (*store.User, error) {
+		return a.Store.LoadUser(ctx, id)
+	}
+
+	from, err := a.Cache.LoadUser(id, load)
+	if err != nil {
+		sendStorageError(w, err, "failed to load user")
+		return
+	}
+	into, err := a.Cache.LoadUser(intoID, load)
+	if err != nil {
+		sendStorageError(w, err, "failed to load user")
+		return
+	}
+	if from == nil || into == nil {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	writeCtx, cancelWrite := a.writeContext()
+	defer cancelWrite()
+
+	moved, err := a.Store.MergeUsers(writeCtx, from, into)
+	a.Responses.Invalidate(from.ID, into.ID)
+	switch {
+	case errors.Is(err, store.ErrSameUser), errors.Is(err, store.ErrOverdrawn), errors.Is(err, store.ErrMaxBalance):
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, store.ErrExternalRefTaken):
+		sendError(w, err, http.StatusConflict)
+		return
+	case debitErrorStatus(err) != 0:
+		sendError(w, err, debitErrorStatus(err))
+		return
+	case err != nil:
+		sendStorageError(w, err, "failed to merge users")
+		return
+	}
+
+	go a.settlePendingDebits(into)
+
+	if a.Shared != nil {
+		if err := a.Shared.Set(from.ID, 0); err != nil {
+			log.Printf("failed to reset shared balance of merged user %d: %v", from.ID, err)
+		}
+		if err := a.Shared.Refund(into.ID, moved); err != nil {
+			log.Printf("failed to credit shared balance of user %d: %v", into.ID, err)
+		}
+	}
+
+	sendJSON(w, map[string]int{
+		"from":    from.ID,
+		"into":    into.ID,
+		"moved":   moved,
+		"balance": into.State().Balance,
+	})
+}
+
+// setUserStatus - POST /admin/users/{id}/status {"status": "blocked"}: меняет состояние пользователя.
+// Списания заблокированного получают 403, удаленного - 410
+func (a *API) setUserStatus(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var params struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	if !store.ValidStatus(params.Status) {
+		sendError(w, fmt.Errorf("status must be %s, %s or %s", store.StatusActive, store.StatusBlocked, store.StatusDeleted), http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	err := store.SetStatus(ctx, a.Store, a.Cache.Peek(id), id, params.Status)
+	a.Responses.Invalidate(id)
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to change user status")
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "user.status",
+		Target: fmt.Sprintf("user:%d", id),
+		Result: params.Status,
+	})
+
+	sendJSON(w, map[string]interface{}{
+		"id":     id,
+		"status": params.Status,
+	})
+}
+
+// setUserMetadata - PUT /admin/users/{id}/metadata {"plan": "pro"}: заменяет метаданные пользователя телом запроса
+func (a *API) setUserMetadata(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPut {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var metadata store.Metadata
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, store.MaxMetadataSize+1)).Decode(&metadata); err != nil {
+		sendError(w, store.ErrInvalidMetadata, http.StatusUnprocessableEntity)
+		return
+	}
+	if err := store.ValidateMetadata(metadata); err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	err := store.SetMetadata(ctx, a.Store, a.Cache.Peek(id), id, metadata)
+	a.Responses.Invalidate(id)
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, store.ErrExternalRefTaken) {
+		sendError(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to change user metadata")
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "user.metadata",
+		Target: fmt.Sprintf("user:%d", id),
+	})
+
+	sendJSON(w, map[string]interface{}{
+		"id":       id,
+		"metadata": metadata,
+	})
+}
+
+// setUserCreditLimit - PUT /admin/users/{id}/credit-limit {"credit_limit": 500}: овердрафт, до которого списания
+// могут увести баланс в минус, 0 - без овердрафта
+func (a *API) setUserCreditLimit(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPut {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var params struct {
+		CreditLimit int64 `json:"credit_limit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	err := store.SetCreditLimit(ctx, a.Store, a.Cache.Peek(id), id, params.CreditLimit)
+	a.Responses.Invalidate(id)
+	if errors.Is(err, store.ErrInvalidCreditLimit) {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to change credit limit")
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "user.credit_limit",
+		Target: fmt.Sprintf("user:%d", id),
+		Fields: map[string]interface{}{"credit_limit": params.CreditLimit},
+	})
+
+	sendJSON(w, map[string]interface{}{
+		"id":           id,
+		"credit_limit": params.CreditLimit,
+	})
+}
+
+// setUserMaxBalance - PUT /admin/users/{id}/max-balance {"max_balance": 100000}: максимальный баланс пользователя,
+// 0 - действует общий (MaxBalance)
+func (a *API) setUserMaxBalance(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPut {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var params struct {
+		MaxBalance int64 `json:"max_balance"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	err := store.SetMaxBalance(ctx, a.Store, a.Cache.Peek(id), id, params.MaxBalance)
+	a.Responses.Invalidate(id)
+	if errors.Is(err, store.ErrInvalidMaxBalance) {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to change max balance")
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "user.max_balance",
+		Target: fmt.Sprintf("user:%d", id),
+		Fields: map[string]interface{}{"max_balance": params.MaxBalance},
+	})
+
+	sendJSON(w, map[string]interface{}{
+		"id":          id,
+		"max_balance": params.MaxBalance,
+	})
+}
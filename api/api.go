@@ -0,0 +1,237 @@
+package api
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/auth"
+	"github.com/Skat712/test_balance/cache"
+	"github.com/Skat712/test_balance/cashback"
+	"github.com/Skat712/test_balance/chain"
+	"github.com/Skat712/test_balance/denylist"
+	"github.com/Skat712/test_balance/fees"
+	"github.com/Skat712/test_balance/fraud"
+	"github.com/Skat712/test_balance/journal"
+	"github.com/Skat712/test_balance/limits"
+	"github.com/Skat712/test_balance/receipt"
+	"github.com/Skat712/test_balance/slo"
+	"github.com/Skat712/test_balance/store"
+	"github.com/Skat712/test_balance/writeback"
+)
+
+// BuildInfo - информация о сборке, отдается в /version
+type BuildInfo struct {
+	GitSHA    string
+	BuildTime string
+}
+
+// режимы записи баланса в БД
+const (
+	// PersistAsync - баланс пишется в БД в фоне (write-behind)
+	PersistAsync = "async"
+	// PersistSync - баланс пишется в БД до ответа клиенту (write-through)
+	PersistSync = "sync"
+	// PersistStrict - списание целиком идет в транзакции БД с блокировкой строки, в обход кеша
+	PersistStrict = "strict"
+)
+
+// API - зависимости обработчиков HTTP API
+type API struct {
+	Store store.Storage
+	Cache *cache.Cache
+	Saver *writeback.DelayedSave
+	Build BuildInfo
+	SLO   *slo.Tracker
+	Audit *audit.Log
+	// Journal - журнал изменений для режима PersistAsync, nil - без журнала
+	Journal *journal.Journal
+	// DeadLetters - изменения, которые фоновое сохранение не смогло записать, nil - отключено
+	DeadLetters *writeback.DeadLetters
+	// APIKeys - ключи API, обязательные для изменяющих запросов, nil - проверка отключена
+	APIKeys *auth.APIKeys
+	// Tokens - проверка JWT поставщика удостоверений OAuth2, nil - отключена
+	Tokens *auth.JWTVerifier
+	// SupportTokens - временные токены поддержки, nil - выпуск отключен
+	SupportTokens *auth.SupportTokens
+	// Responses - кеш ответов GET /user/{id}, nil - отключен
+	Responses *ResponseCache
+	// Shared - общий для реплик вид балансов, nil - у каждой реплики свой кеш
+	Shared cache.Shared
+	// InFlight - ограничение одновременных запросов, nil - без ограничения
+	InFlight *InFlightLimiter
+	// UserLimit - ограничение запросов к одному пользователю (списания и GET /user/{id}), nil - отключено
+	UserLimit *RateLimiter
+	// IPLimit - ограничение запросов с одного адреса, nil - отключено
+	IPLimit *RateLimiter
+	// TrustForwardedFor - адрес клиента для IPLimit брать из X-Forwarded-For (сервис за прокси)
+	TrustForwardedFor bool
+	// Receipts - подпись квитанций об операциях, nil - квитанции отключены
+	Receipts *receipt.Signer
+	// Chain - цепочка хешей леджера, nil - отключена
+	Chain *chain.Chain
+	// Fees - комиссии за списания, nil - без комиссий
+	Fees fees.Schedule
+	// SpendLimits - лимиты трат пользователей за сутки и неделю, nil - отключены
+	SpendLimits *limits.SpendLimits
+	// PendingDebits - очередь остатков списаний, которые ждут поступления средств, nil - отключена
+	PendingDebits *PendingDebits
+	// Schedules - регулярные списания по расписанию, nil - отключены
+	Schedules *Schedules
+	// ScheduledOperations - отложенные списания, пополнения и переводы, nil - отключены
+	ScheduledOperations *ScheduledOperations
+	// Disputes - споры по пополнениям, nil - отключены
+	Disputes *Disputes
+	// Reversals - отмены операций оператором, nil - отключены
+	Reversals *Reversals
+	// Escrows - сделки с эскроу, nil - отключены
+	Escrows *Escrows
+	// Interest - проценты на баланс, nil - отключены
+	Interest *Interest
+	// Cashback - правила кешбэка за списания, nil - кешбэк отключен
+	Cashback *cashback.Rules
+	// Referrals - приглашения с выплатами обеим сторонам, nil - отключены
+	Referrals *Referrals
+	// PromoCodes - промокоды на пополнение, nil - отключены
+	PromoCodes *PromoCodes
+	// Pockets - именованные карманы пользователей, nil - отключены
+	Pockets *Pockets
+	// Bonuses - бонусная часть баланса со сгоранием, nil - отключена
+	Bonuses *Bonuses
+	// Approvals - подтверждение крупных списаний вторым вызывающим, nil - отключено
+	Approvals *Approvals
+	// Denylist - пользователи и вызывающие, запросы к которым и от которых отклоняются, nil - отключен
+	Denylist *denylist.Denylist
+	// Fraud - правила против мошенничества, проверяемые перед списанием, nil - отключены
+	Fraud *fraud.Engine
+
+	// PersistenceMode - PersistAsync (по умолчанию), PersistSync или PersistStrict
+	PersistenceMode string
+	// Leader - ведет ли экземпляр фоновое сохранение (например, держит leader.Lease), nil - всегда.
+	// Пока нет, режим PersistAsync работает как PersistSync
+	Leader func() bool
+	// AllowFormParams - режим совместимости: принимать параметры списания из query и form, а не только JSON
+	AllowFormParams bool
+	// LocklessDebit - в режиме PersistAsync проверять и уменьшать баланс CAS без блокировки пользователя
+	LocklessDebit bool
+	// Verbose - писать в лог каждый запрос
+	Verbose bool
+	// QueryTimeout - сколько запрос ждет одного обращения к хранилищу, 0 - без ограничения
+	QueryTimeout time.Duration
+	// MaxBalance - максимальный баланс для пользователей без своего, пополнения сверх него отклоняются, 0 - без ограничения
+	MaxBalance int64
+	// Currency - валюта балансов, с ней сверяется колонка currency импорта, пусто - не проверяется
+	Currency string
+
+	// ready - 1, когда экземпляр готов принимать трафик
+	ready int32
+}
+
+// persistenceMode - режим записи для очередного списания с учетом лидерства
+func (a *API) persistenceMode() string {
+	mode := a.PersistenceMode
+	if mode == "" {
+		mode = PersistAsync
+	}
+	if mode == PersistAsync && a.Leader != nil && !a.Leader() {
+		return PersistSync
+	}
+	return mode
+}
+
+// queryContext - контекст чтения из хранилища: отменяется, когда клиент отключился, и ограничен QueryTimeout
+func (a *API) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if a.QueryTimeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), a.QueryTimeout)
+}
+
+// writeContext - контекст записи в хранилище: ограничен QueryTimeout, но не отменяется при отключении клиента,
+// потому что после прерванного коммита неизвестно, записались ли изменения
+func (a *API) writeContext() (context.Context, context.CancelFunc) {
+	if a.QueryTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), a.QueryTimeout)
+}
+
+// Register - регистрирует роуты API в mux
+func (a *API) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/user/balance", a.BalanceHandler)
+	mux.HandleFunc("/user/credit", a.CreditHandler)
+	mux.HandleFunc("/user/bonus", a.BonusHandler)
+	mux.HandleFunc("/user/", a.UserHandler)
+	mux.HandleFunc("/users", a.UsersHandler)
+	mux.HandleFunc("/transactions/", a.TransactionsHandler)
+	mux.HandleFunc("/escrows", a.EscrowsHandler)
+	mux.HandleFunc("/escrows/", a.EscrowsHandler)
+	mux.HandleFunc("/admin/stats", a.AdminStatsHandler)
+	mux.HandleFunc("/admin/slo", a.AdminSLOHandler)
+	mux.HandleFunc("/admin/users", a.AdminCreateUserHandler)
+	mux.HandleFunc("/admin/users/", a.AdminUsersHandler)
+	mux.HandleFunc("/admin/users/import", a.AdminImportUsersHandler)
+	mux.HandleFunc("/admin/export/users", a.AdminExportUsersHandler)
+	mux.HandleFunc("/admin/export/transactions", a.AdminExportTransactionsHandler)
+	mux.HandleFunc("/admin/ledger/trial-balance", a.AdminTrialBalanceHandler)
+	mux.HandleFunc("/admin/ledger/consistency", a.AdminConsistencyHandler)
+	mux.HandleFunc("/admin/ledger/chain/verify", a.AdminVerifyChainHandler)
+	mux.HandleFunc("/admin/approvals", a.AdminApprovalsHandler)
+	mux.HandleFunc("/admin/approvals/", a.AdminApprovalsHandler)
+	mux.HandleFunc("/admin/denylist", a.AdminDenylistHandler)
+	mux.HandleFunc("/admin/denylist/", a.AdminDenylistHandler)
+	mux.HandleFunc("/admin/spend-limits", a.AdminSpendLimitsHandler)
+	mux.HandleFunc("/admin/spend-limits/", a.AdminSpendLimitsHandler)
+	mux.HandleFunc("/admin/promo-codes", a.AdminPromoCodesHandler)
+	mux.HandleFunc("/admin/promo-codes/", a.AdminPromoCodesHandler)
+	mux.HandleFunc("/admin/cashback-rules", a.AdminCashbackRulesHandler)
+	mux.HandleFunc("/admin/cashback-rules/", a.AdminCashbackRulesHandler)
+	mux.HandleFunc("/admin/support-tokens", a.AdminSupportTokensHandler)
+	mux.HandleFunc("/admin/dead-letters", a.AdminDeadLettersHandler)
+	mux.HandleFunc("/admin/dead-letters/redrive", a.AdminDeadLettersRedriveHandler)
+	mux.HandleFunc("/admin/flush", a.AdminFlushHandler)
+	mux.HandleFunc("/admin/cache/users", a.AdminCacheUsersHandler)
+	mux.HandleFunc("/admin/cache/users/", a.AdminCacheUsersHandler)
+	mux.HandleFunc("/version", a.VersionHandler)
+	mux.HandleFunc("/capabilities", a.CapabilitiesHandler)
+	mux.HandleFunc("/healthz", a.HealthzHandler)
+	mux.HandleFunc("/readyz", a.ReadyzHandler)
+}
+
+// PublishMetrics - публикует метрики в expvar (/debug/vars)
+func (a *API) PublishMetrics() {
+	expvar.Publish("memory", expvar.Func(func() interface{} {
+		return a.memoryStats()
+	}))
+	expvar.Publish("cache", expvar.Func(func() interface{} {
+		return a.Cache.Stats()
+	}))
+	expvar.Publish("delayed_save_shards", expvar.Func(func() interface{} {
+		return a.Saver.ShardStats()
+	}))
+	if a.InFlight != nil {
+		expvar.Publish("in_flight", expvar.Func(func() interface{} {
+			return a.InFlight.Stats()
+		}))
+	}
+	if a.Fraud != nil {
+		expvar.Publish("fraud", expvar.Func(func() interface{} {
+			return a.Fraud.Stats()
+		}))
+	}
+	if a.SLO != nil {
+		expvar.Publish("requests", expvar.Func(func() interface{} {
+			return a.SLO.Totals()
+		}))
+	}
+}
+
+// journal - журнал как store.Journal, nil интерфейс если журнал отключен
+func (a *API) journal() store.Journal {
+	if a.Journal == nil {
+		return nil
+	}
+	return a.Journal
+}
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/store"
+)
+
+// Approvals - списания больше Threshold не выполняются сразу, а ждут подтверждения другим вызывающим
+// (maker-checker) в таблице approvals. nil - подтверждение не требуется
+type Approvals struct {
+	Sess      *dbr.Session
+	Threshold int
+}
+
+// Required - списание amount должно ждать подтверждения
+func (q *Approvals) Required(amount int) bool {
+	return q != nil && amount > q.Threshold
+}
+
+// requestApproval - сохраняет списание на подтверждение и отвечает 202 с его id
+func (a *API) requestApproval(w http.ResponseWriter, r *http.Request, params BalanceParams) {
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	approval := store.Approval{
+		ID:          store.NewTransactionID(),
+		UserID:      params.UserID,
+		Amount:      params.Amount,
+		Tag:         params.Tag,
+		Category:    params.Category,
+		Tags:        params.Tags,
+		Strict:      params.Strict,
+		Pocket:      params.Pocket,
+		Status:      store.ApprovalPending,
+		RequestedBy: callerID(r),
+		CreatedAt:   time.Now().UTC().Truncate(time.Microsecond),
+	}
+	if err := store.CreateApproval(ctx, a.Approvals.Sess, approval); err != nil {
+		sendStorageError(w, err, "failed to save approval")
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  approval.RequestedBy,
+		Action: "approval.request",
+		Target: fmt.Sprintf("user:%d", params.UserID),
+		Result: approval.ID,
+		Fields: map[string]interface{}{
+			"amount": params.Amount,
+			"tag":    params.Tag,
+		},
+	})
+
+	response, _ := json.Marshal(map[string]interface{}{
+		"success":     false,
+		"status":      "pending_approval",
+		"approval_id": approval.ID,
+	})
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(response)
+}
+
+// AdminApprovalsHandler - GET /admin/approvals?status=pending&limit=100: списания на подтверждении,
+// POST /admin/approvals/{id}/approve: подтвердить и списать, POST /admin/approvals/{id}/reject {"reason": "..."}: отклонить
+func (a *API) AdminApprovalsHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Approvals == nil {
+		sendError(w, errors.New("approvals disabled"), http.StatusNotFound)
+		return
+	}
+
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/approvals"), "/")
+	if path == "" {
+		a.listApprovals(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	id, action, _ := strings.Cut(path, "/")
+	switch action {
+	case "approve":
+		a.approve(w, r, id)
+	case "reject":
+		a.reject(w, r, id)
+	default:
+		sendError(w, errors.New("not found"), http.StatusNotFound)
+	}
+}
+
+// listApprovals - GET /admin/approvals
+func (a *API) listApprovals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	status := query.Get("status")
+	if status != "" && !store.ValidApprovalStatus(status) {
+		sendError(w, fmt.Errorf("unknown approval status %q", status), http.StatusUnprocessableEntity)
+		return
+	}
+	limit := DefaultPageSize
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MaxPageSize {
+			sendError(w, fmt.Errorf("limit must be from 1 to %d", MaxPageSize), http.StatusUnprocessableEntity)
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	approvals, err := store.ListApprovals(ctx, a.Approvals.Sess, status, limit)
+	if err != nil {
+		sendStorageError(w, err, "failed to load approvals")
+		return
+	}
+	if approvals == nil {
+		approvals = []store.Approval{}
+	}
+	sendJSON(w, map[string]interface{}{"approvals": approvals})
+}
+
+// decide - переводит ожидающее списание id в status, отвечает клиенту при ошибке. Решает только проверенный
+// вызывающий (ключ API, токен или сертификат клиента), свое списание подтвердить или отклонить нельзя
+func (a *API) decide(w http.ResponseWriter, r *http.Request, id, status, reason string) (store.Approval, bool) {
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	approval, err := store.LoadApproval(ctx, a.Approvals.Sess, id)
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("approval not found"), http.StatusNotFound)
+		return approval, false
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to load approval")
+		return approval, false
+	}
+
+	// адрес не отличает вызывающих за одним прокси и меняется с каждым соединением
+	decidedBy := authenticatedID(r)
+	if decidedBy == "" {
+		sendError(w, errors.New("approval must be decided by an authenticated caller"), http.StatusForbidden)
+		return approval, false
+	}
+	if decidedBy == approval.RequestedBy {
+		sendError(w, errors.New("approval must be decided by another caller"), http.StatusForbidden)
+		return approval, false
+	}
+
+	err = store.DecideApproval(ctx, a.Approvals.Sess, id, status, decidedBy, reason)
+	if errors.Is(err, store.ErrApprovalDecided) {
+		sendError(w, err, http.StatusConflict)
+		return approval, false
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to save approval")
+		return approval, false
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  decidedBy,
+		Action: "approval." + status,
+		Target: fmt.Sprintf("user:%d", approval.UserID),
+		Result: id,
+		Fields: map[string]interface{}{
+			"amount":       approval.Amount,
+			"requested_by": approval.RequestedBy,
+			"reason":       reason,
+		},
+	})
+	approval.Status, approval.DecidedBy, approval.Reason = status, decidedBy, reason
+	return approval, true
+}
+
+// approve - POST /admin/approvals/{id}/approve: подтверждение и списание. Если списание не прошло (в том числе
+// пользователь попал в denylist), подтверждение переходит в store.ApprovalFailed, а клиент получает ошибку списания
+func (a *API) approve(w http.ResponseWriter, r *http.Request, id string) {
+	approval, ok := a.decide(w, r, id, store.ApprovalApproved, "")
+	if !ok {
+		return
+	}
+
+	params := BalanceParams{UserID: approval.UserID, Amount: approval.Amount, Tag: approval.Tag, Category: approval.Category,
+		Tags: approval.Tags, Strict: approval.Strict, Pocket: approval.Pocket}
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	var tx store.Transaction
+	if a.Denylist.User(params.UserID) {
+		sendDenied(rec)
+		ok = false
+	} else {
+		tx, _, ok = a.debit(rec, r, params)
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+	reason := ""
+	if !ok {
+		reason = fmt.Sprintf("debit failed with status %d", rec.status)
+	}
+	if err := store.CompleteApproval(ctx, a.Approvals.Sess, id, tx.ID, reason); err != nil {
+		a.Audit.Record(audit.Event{
+			Actor:  "approvals",
+			Action: "approval.complete",
+			Target: fmt.Sprintf("user:%d", approval.UserID),
+			Result: "failed to save result: " + err.Error(),
+			Fields: map[string]interface{}{"approval_id": id, "transaction_id": tx.ID},
+		})
+	}
+	if !ok {
+		return
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"success":        true,
+		"approval_id":    id,
+		"transaction_id": tx.ID,
+	})
+}
+
+// reject - POST /admin/approvals/{id}/reject
+func (a *API) reject(w http.ResponseWriter, r *http.Request, id string) {
+	var params struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			sendError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, ok := a.decide(w, r, id, store.ApprovalRejected, params.Reason); !ok {
+		return
+	}
+	sendJSON(w, map[string]interface{}{
+		"approval_id": id,
+		"status":      store.ApprovalRejected,
+	})
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// bonusSweepBatch - сколько пользователей со сгоревшими бонусами обрабатывается за один запрос к БД
+const bonusSweepBatch = 1000
+
+// Bonuses - бонусная часть баланса: начисления в таблице bonus_grants сгорают через TTL. nil - бонусы отключены
+type Bonuses struct {
+	Sess *dbr.Session
+	// TTL - через сколько сгорают бонусы, если в запросе не задано days
+	TTL time.Duration
+}
+
+// BonusParams - параметры начисления бонусов
+type BonusParams struct {
+	CreditParams
+	// Days - через сколько дней сгорают бонусы, 0 - через Bonuses.TTL
+	Days int `json:"days"`
+}
+
+// BonusHandler - POST /user/bonus {"user_id": 1, "amount": 100, "days": 30, "tag": "promo", "partial": false}:
+// начисление бонусов, которые тратятся раньше основного баланса и сгорают через days дней
+func (a *API) BonusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Bonuses == nil {
+		sendError(w, errors.New("bonuses are disabled"), http.StatusNotFound)
+		return
+	}
+
+	var params BonusParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	if params.Days < 0 {
+		sendError(w, errors.New("invalid days"), http.StatusUnprocessableEntity)
+		return
+	}
+	user, ok := a.creditUser(w, r, params.CreditParams)
+	if !ok {
+		return
+	}
+
+	ttl := a.Bonuses.TTL
+	if params.Days > 0 {
+		ttl = time.Duration(params.Days) * 24 * time.Hour
+	}
+	expiresAt := time.Now().Add(ttl).UTC().Truncate(time.Microsecond)
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	tx, err := store.CreditBonus(ctx, a.Bonuses.Sess, user, params.Amount, expiresAt, a.creditOptions(user, params.CreditParams))
+	if !a.creditDone(w, user, err) {
+		return
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"success":        true,
+		"transaction_id": tx.ID,
+		"credited":       tx.Amount,
+		"expires_at":     expiresAt,
+	})
+}
+
+// userBonus - GET /user/{id}/bonus: еще не сгоревшие начисления бонусов, раньше сгорающие первыми
+func (a *API) userBonus(w http.ResponseWriter, r *http.Request, id int) {
+	if a.Bonuses == nil {
+		sendError(w, errors.New("bonuses are disabled"), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	grants, err := store.LoadBonusGrants(ctx, a.Bonuses.Sess, id, time.Now())
+	if err != nil {
+		sendStorageError(w, err, "failed to load bonus grants")
+		return
+	}
+	if grants == nil {
+		grants = []store.BonusGrant{}
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"grants": grants,
+	})
+}
+
+// SweepBonuses - списывает сгоревшие бонусы всех пользователей, у которых есть сгоревшие начисления.
+// Возвращает количество пользователей, у которых что-то сгорело
+func (a *API) SweepBonuses(ctx context.Context) (int, error) {
+	if a.Bonuses == nil {
+		return 0, nil
+	}
+
+	now := time.Now()
+	expired, after := 0, 0
+	for {
+		ids, err := store.ExpiredBonusUsers(ctx, a.Bonuses.Sess, now, after, bonusSweepBatch)
+		if err != nil {
+			return expired, err
+		}
+
+		for _, id := range ids {
+			after = id
+			user, err := a.Cache.LoadUser(id, func(id int) (*store.User, error) {
+				return a.Store.LoadUser(ctx, id)
+			})
+			if err != nil {
+				return expired, err
+			}
+			if user == nil {
+				continue
+			}
+
+			tx, err := store.ExpireBonus(ctx, a.Bonuses.Sess, user, now, a.creditOptions(user, CreditParams{}))
+			if err != nil {
+				return expired, err
+			}
+			if tx.Amount != 0 {
+				expired++
+			}
+		}
+		if len(ids) < bonusSweepBatch {
+			return expired, nil
+		}
+	}
+}
+
+// RunBonusSweeper - раз в interval списывает сгоревшие бонусы, пока не отменен ctx
+func (a *API) RunBonusSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expired, err := a.SweepBonuses(ctx)
+			if err != nil {
+				log.Printf("failed to expire bonuses: %v", err)
+			}
+			if expired > 0 {
+				log.Printf("Expired bonuses of %d users", expired)
+			}
+		}
+	}
+}
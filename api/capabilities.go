@@ -0,0 +1,104 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Skat712/test_balance/auth"
+	"github.com/Skat712/test_balance/store"
+)
+
+// CapabilitiesVersion - версия формата ответа /capabilities, меняется только при несовместимых изменениях
+const CapabilitiesVersion = 1
+
+// Capabilities - возможности и ограничения экземпляра для определения клиентами
+type Capabilities struct {
+	Version  int             `json:"version"`
+	Features map[string]bool `json:"features"`
+	Limits   Limits          `json:"limits"`
+	// PersistenceMode - PersistAsync, PersistSync или PersistStrict
+	PersistenceMode string `json:"persistence_mode"`
+}
+
+// Limits - ограничения запросов, 0 - без ограничения или возможность отключена
+type Limits struct {
+	MaxAmount              int64 `json:"max_amount"`
+	MaxBatchSize           int   `json:"max_batch_size"`
+	MaxTagLength           int   `json:"max_tag_length"`
+	MaxTags                int   `json:"max_tags"`
+	MaxSupportTokenSeconds int64 `json:"max_support_token_ttl_seconds"`
+	MaxMetadataBytes       int   `json:"max_metadata_bytes"`
+	MaxPageSize            int   `json:"max_page_size"`
+}
+
+// Capabilities - возможности этого экземпляра с учетом конфигурации
+func (a *API) Capabilities() Capabilities {
+	mode := a.persistenceMode()
+
+	return Capabilities{
+		Version: CapabilitiesVersion,
+		Features: map[string]bool{
+			"debit":                true,
+			"credit":               a.Shared == nil,
+			"max_balance":          true,
+			"fees":                 a.Fees != nil,
+			"bonus":                a.Bonuses != nil && a.Shared == nil,
+			"referrals":            a.Referrals != nil && a.Shared == nil,
+			"cashback":             a.Cashback != nil && a.Shared == nil,
+			"interest":             a.Interest != nil,
+			"escrows":              a.Escrows != nil && a.Shared == nil,
+			"disputes":             a.Disputes != nil && a.Shared == nil,
+			"reversals":            a.Reversals != nil && a.Shared == nil,
+			"schedules":            a.Schedules != nil,
+			"scheduled_operations": a.ScheduledOperations != nil,
+			"promo_codes":          a.PromoCodes != nil && a.Shared == nil,
+			"pockets":              a.Pockets != nil && a.Shared == nil && mode != PersistStrict,
+			"partial_debit":        a.Shared == nil && mode != PersistStrict,
+			"pending_debits":       a.PendingDebits != nil && a.Shared == nil && mode != PersistStrict,
+			"transfers":            false,
+			"holds":                false,
+			"multi_currency":       false,
+			"batch":                false,
+			"grpc":                 false,
+			"tags":                 true,
+			"receipts":             a.Receipts != nil,
+			"support_tokens":       a.SupportTokens != nil,
+			"api_keys":             a.APIKeys != nil,
+			"oauth2":               a.Tokens != nil,
+			"rate_limits":          a.UserLimit != nil || a.IPLimit != nil,
+			"journal":              a.Journal != nil,
+			"form_params":          a.AllowFormParams,
+			"user_status":          true,
+			"freeze":               true,
+			"overdraft":            true,
+			"user_metadata":        true,
+			"user_list":            true,
+			"statements":           true,
+			"balance_at":           true,
+			"double_entry":         true,
+			"ledger_chain":         a.Chain != nil,
+			"spend_limits":         a.SpendLimits != nil,
+			"fraud_rules":          a.Fraud.Len() > 0,
+			"denylist":             a.Denylist != nil,
+			"approvals":            a.Approvals != nil,
+		},
+		Limits: Limits{
+			MaxTagLength:           store.MaxTagLength,
+			MaxTags:                store.MaxTags,
+			MaxSupportTokenSeconds: int64(auth.MaxSupportTokenTTL.Seconds()),
+			MaxMetadataBytes:       store.MaxMetadataSize,
+			MaxPageSize:            MaxPageSize,
+		},
+		PersistenceMode: mode,
+	}
+}
+
+// CapabilitiesHandler - GET /capabilities
+func (a *API) CapabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	sendJSON(w, a.Capabilities())
+}
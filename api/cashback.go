@@ -0,0 +1,82 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// creditCashback - начисляет кешбэк за успешное списание tx у продавца merchant, если для него есть правило.
+// Вызывается в фоне после списания: ошибки только пишутся в лог, повтор за то же списание ничего не начислит
+func (a *API) creditCashback(tx store.Transaction, merchant string) {
+	rule, ok := a.Cashback.For(tx.Tag, merchant)
+	if !ok || rule.Amount(-tx.Amount) <= 0 {
+		return
+	}
+	// максимальный баланс проверяется по кешу экземпляра, как у пополнений
+	if a.Shared != nil {
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	user, err := a.Cache.LoadUser(tx.UserID, func(id int) (*store.User, error) {
+		return a.Store.LoadUser(ctx, id)
+	})
+	if err != nil || user == nil {
+		log.Printf("failed to load user %d for cashback of %s: %v", tx.UserID, tx.ID, err)
+		return
+	}
+
+	c, err := store.CreditCashback(ctx, a.Cashback.Sess, user, rule, tx, store.CreditOptions{
+		MaxBalance: a.MaxBalance,
+		Mark: func(u *store.User) {
+			a.Responses.Invalidate(u.ID)
+		},
+	})
+	if errors.Is(err, store.ErrCashbackPaid) {
+		return
+	}
+	if err != nil {
+		log.Printf("failed to credit cashback of %s by %s to user %d: %v", tx.ID, rule.Subject, tx.UserID, err)
+		return
+	}
+	if c.Amount > 0 {
+		a.settlePendingDebits(user)
+	}
+}
+
+// userCashback - GET /user/{id}/cashback: кешбэк пользователя за текущий календарный месяц UTC
+func (a *API) userCashback(w http.ResponseWriter, r *http.Request, id int) {
+	if a.Cashback == nil {
+		sendError(w, errors.New("cashback is disabled"), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	month := store.MonthStart(time.Now())
+	cashback, err := store.LoadCashback(ctx, a.Cashback.Sess, id, month)
+	if err != nil {
+		sendStorageError(w, err, "failed to load cashback")
+		return
+	}
+	if cashback == nil {
+		cashback = []store.Cashback{}
+	}
+	total := 0
+	for _, c := range cashback {
+		total += c.Amount
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"month":    month,
+		"total":    total,
+		"cashback": cashback,
+	})
+}
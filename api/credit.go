@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// CreditParams - параметры пополнения
+type CreditParams struct {
+	UserID int    `json:"user_id"`
+	Amount int    `json:"amount"`
+	Tag    string `json:"tag"`
+	// Category, Tags - необязательные категория и произвольные теги, как в BalanceParams
+	Category string     `json:"category"`
+	Tags     store.Tags `json:"tags"`
+	// Partial - если пополнение превысит максимальный баланс, пополнить до максимума, а не отклонять целиком
+	Partial bool `json:"partial"`
+}
+
+func (cp *CreditParams) Validate() error {
+	if cp.UserID < 1 {
+		return errors.New("invalid user id")
+	}
+
+	if cp.Amount < 1 {
+		return errors.New("invalid amount")
+	}
+
+	if err := store.ValidateCategory(cp.Category); err != nil {
+		return err
+	}
+	if err := store.ValidateTags(cp.Tags); err != nil {
+		return err
+	}
+
+	return store.ValidateTag(cp.Tag)
+}
+
+// CreditHandler - POST /user/credit {"user_id": 1, "amount": 100, "tag": "opt", "partial": false}: пополнение баланса
+// с учетом максимального баланса пользователя или MaxBalance
+func (a *API) CreditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var params CreditParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	user, ok := a.creditUser(w, r, params)
+	if !ok {
+		return
+	}
+
+	tx, err := user.ApplyCredit(params.Amount, a.creditOptions(user, params))
+	if !a.creditDone(w, user, err) {
+		return
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"success":        true,
+		"transaction_id": tx.ID,
+		"credited":       tx.Amount,
+	})
+}
+
+// creditUser - проверяет params и загружает пользователя, которого пополняют. false - ответ уже отправлен
+func (a *API) creditUser(w http.ResponseWriter, r *http.Request, params CreditParams) (*store.User, bool) {
+	if err := params.Validate(); err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return nil, false
+	}
+	if a.Denylist.User(params.UserID) {
+		sendDenied(w)
+		return nil, false
+	}
+	if !a.allowUser(w, params.UserID) {
+		return nil, false
+	}
+	// максимальный баланс проверяется по кешу экземпляра, а не по общему балансу
+	if a.Shared != nil {
+		sendError(w, errors.New("credits are not supported with a shared cache backend"), http.StatusNotImplemented)
+		return nil, false
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	user, err := a.Cache.LoadUser(params.UserID, func(id int) (*store.User, error) {
+		return a.Store.LoadUser(ctx, id)
+	})
+	if err != nil {
+		sendStorageError(w, err, "failed to load user")
+		return nil, false
+	}
+	if user == nil {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return nil, false
+	}
+	return user, true
+}
+
+// creditOptions - сохранение пополнения user по режиму сохранения: в строгом режиме пополнение тоже пишется в БД
+// до ответа, проверка средств ему не нужна
+func (a *API) creditOptions(user *store.User, params CreditParams) store.CreditOptions {
+	async := a.persistenceMode() == PersistAsync
+	opts := store.CreditOptions{
+		Tag:        params.Tag,
+		Category:   params.Category,
+		Tags:       params.Tags,
+		MaxBalance: a.MaxBalance,
+		Partial:    params.Partial,
+		Mark: func(u *store.User) {
+			a.Responses.Invalidate(u.ID)
+			if async {
+				a.Saver.Save(u)
+			}
+		},
+	}
+	if async {
+		opts.Journal = a.journal()
+		opts.Check = func(u *store.User) error {
+			return a.Saver.Admit(u.ID)
+		}
+	} else {
+		opts.Save = func(p store.Pending) error {
+			ctx, cancel := a.writeContext()
+			defer cancel()
+			return a.Store.SavePending(ctx, user.ID, p)
+		}
+	}
+	return opts
+}
+
+// creditDone - отвечает ошибкой пополнения user, если она есть, иначе отправляет поступившие средства
+// на ожидающие списания в фоне, не задерживая ответ. false - ответ уже отправлен
+func (a *API) creditDone(w http.ResponseWriter, user *store.User, err error) bool {
+	if status := debitErrorStatus(err); status != 0 {
+		sendError(w, err, status)
+		return false
+	}
+	if err != nil {
+		if a.persistenceMode() == PersistAsync {
+			sendError(w, errors.New("failed to journal balance change"), http.StatusInternalServerError)
+		} else {
+			sendStorageError(w, err, "failed to save balance")
+		}
+		return false
+	}
+	go a.settlePendingDebits(user)
+	return true
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/denylist"
+	"github.com/Skat712/test_balance/store"
+)
+
+// sendDenied - 403 для пользователя или вызывающего из denylist
+func sendDenied(w http.ResponseWriter) {
+	sendError(w, denylist.ErrDenied, http.StatusForbidden)
+}
+
+// deny - отклоняет запросы вызывающих из denylist и запросы к пользователям из denylist по id в пути /user/{id}.
+// Пользователя списания проверяет BalanceHandler после разбора тела. Роуты /admin/* с пользователями из denylist
+// работают, чтобы с ними можно было разобраться
+func (a *API) deny(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.Denylist == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if a.Denylist.Caller(callerID(r)) {
+			sendDenied(w)
+			return
+		}
+		if id, ok := pathUserID(r.URL.Path); ok && a.Denylist.User(id) {
+			sendDenied(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pathUserID - id пользователя из /user/{id}/...
+func pathUserID(path string) (int, bool) {
+	rest := strings.TrimPrefix(path, "/user/")
+	if rest == path {
+		return 0, false
+	}
+	first, _, _ := strings.Cut(rest, "/")
+	id, err := strconv.Atoi(first)
+	return id, err == nil
+}
+
+// DenyParams - запись в POST /admin/denylist
+type DenyParams struct {
+	Kind   string `json:"kind"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// AdminDenylistHandler - GET /admin/denylist: все записи, POST /admin/denylist {"kind": "user", "value": "42"}:
+// добавить пользователя или вызывающего, DELETE /admin/denylist/{kind}/{value}: убрать
+func (a *API) AdminDenylistHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Denylist == nil {
+		sendError(w, errors.New("denylist disabled"), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/denylist"), "/")
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		sendJSON(w, map[string]interface{}{"entries": a.Denylist.List()})
+	case path == "" && r.Method == http.MethodPost:
+		var params DenyParams
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			sendError(w, err, http.StatusBadRequest)
+			return
+		}
+		entry := store.DenyEntry{Kind: params.Kind, Value: params.Value, Reason: params.Reason}
+		if err := entry.Validate(); err != nil {
+			sendError(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+		if err := a.Denylist.Add(ctx, entry); err != nil {
+			sendStorageError(w, err, "failed to add denylist entry")
+			return
+		}
+
+		a.Audit.Record(audit.Event{
+			Actor:  callerID(r),
+			Action: "denylist.add",
+			Target: params.Kind + ":" + params.Value,
+			Result: "added",
+			Fields: map[string]interface{}{"reason": params.Reason},
+		})
+		sendSuccess(w)
+	case path != "" && r.Method == http.MethodDelete:
+		kind, value, _ := strings.Cut(path, "/")
+		err := a.Denylist.Remove(ctx, kind, value)
+		if errors.Is(err, store.ErrNotFound) {
+			sendError(w, errors.New("denylist entry not found"), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			sendStorageError(w, err, "failed to remove denylist entry")
+			return
+		}
+
+		a.Audit.Record(audit.Event{
+			Actor:  callerID(r),
+			Action: "denylist.remove",
+			Target: kind + ":" + value,
+			Result: "removed",
+		})
+		sendSuccess(w)
+	default:
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,241 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/store"
+)
+
+// Disputes - споры по пополнениям в таблице disputes, nil - отключены
+type Disputes struct {
+	Sess *dbr.Session
+}
+
+// DisputeParams - открытие спора в POST /transactions/{id}/dispute
+type DisputeParams struct {
+	Reason string `json:"reason"`
+}
+
+// ResolveDisputeParams - решение спора в POST /transactions/{id}/dispute/resolve
+type ResolveDisputeParams struct {
+	Resolution string `json:"resolution"`
+	Note       string `json:"note"`
+}
+
+// transactionDispute - GET /transactions/{id}/dispute: спор по операции, POST: открыть спор
+func (a *API) transactionDispute(w http.ResponseWriter, r *http.Request, id string) {
+	if a.Disputes == nil {
+		sendError(w, errors.New("disputes are disabled"), http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		a.openDispute(w, r, id)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	d, err := store.LoadDispute(ctx, a.Disputes.Sess, id)
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("dispute not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to load dispute")
+		return
+	}
+	sendJSON(w, d)
+}
+
+// openDispute - POST /transactions/{id}/dispute {"reason": "chargeback"}: открывает спор по пополнению
+// и удерживает его сумму с пользователя
+func (a *API) openDispute(w http.ResponseWriter, r *http.Request, id string) {
+	var params DisputeParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	// возврат удержанного - пополнение, максимальный баланс проверяется по кешу экземпляра
+	if a.Shared != nil {
+		sendError(w, errors.New("disputes are not supported with a shared cache backend"), http.StatusNotImplemented)
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	// в режиме PersistAsync запись леджера появляется в БД после фонового сохранения
+	credit, err := a.Store.LoadTransaction(ctx, id)
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("transaction not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to load transaction")
+		return
+	}
+	user, err := a.operationUser(ctx, credit.UserID)
+	if err != nil {
+		sendStorageError(w, err, "failed to load user")
+		return
+	}
+	if user == nil {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	d := store.Dispute{ID: store.NewTransactionID(), Reason: params.Reason, OpenedBy: callerID(r)}
+	// удержание - не трата пользователя: без лимитов трат и правил против мошенничества
+	d, err = store.OpenDispute(ctx, a.Disputes.Sess, user, credit, d, store.DebitOptions{
+		Mark: func(u *store.User) {
+			a.Responses.Invalidate(u.ID)
+		},
+	})
+	switch {
+	case errors.Is(err, store.ErrNotDisputable):
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, store.ErrDisputeExists):
+		sendError(w, err, http.StatusConflict)
+		return
+	}
+	if status := debitErrorStatus(err); status != 0 {
+		sendError(w, err, status)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to open dispute")
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  d.OpenedBy,
+		Action: "dispute.open",
+		Target: fmt.Sprintf("user:%d", d.UserID),
+		Result: d.ID,
+		Fields: map[string]interface{}{
+			"transaction_id": d.TransactionID,
+			"amount":         d.Amount,
+			"held":           d.Held,
+		},
+	})
+
+	sendJSON(w, d)
+}
+
+// resolveDispute - POST /transactions/{id}/dispute/resolve {"resolution": "uphold|reverse", "note": "..."}:
+// uphold возвращает удержанное пользователю, reverse оставляет удержание окончательным
+func (a *API) resolveDispute(w http.ResponseWriter, r *http.Request, id string) {
+	if a.Disputes == nil {
+		sendError(w, errors.New("disputes are disabled"), http.StatusNotFound)
+		return
+	}
+	var params ResolveDisputeParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	if params.Resolution != store.DisputeUphold && params.Resolution != store.DisputeReverse {
+		sendError(w, errors.New("resolution must be uphold or reverse"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	d, err := store.LoadDispute(ctx, a.Disputes.Sess, id)
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("dispute not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to load dispute")
+		return
+	}
+	if d.Status != store.DisputeOpen {
+		sendError(w, store.ErrDisputeResolved, http.StatusConflict)
+		return
+	}
+	user, err := a.operationUser(ctx, d.UserID)
+	if err != nil {
+		sendStorageError(w, err, "failed to load user")
+		return
+	}
+	if user == nil {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	// удержанное возвращается без общего максимального баланса: это деньги пользователя
+	d, err = store.ResolveDispute(ctx, a.Disputes.Sess, user, d, params.Resolution, params.Note, callerID(r), store.CreditOptions{
+		Mark: func(u *store.User) {
+			a.Responses.Invalidate(u.ID)
+		},
+	})
+	if errors.Is(err, store.ErrDisputeResolved) {
+		sendError(w, err, http.StatusConflict)
+		return
+	}
+	if status := debitErrorStatus(err); status != 0 {
+		sendError(w, err, status)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to resolve dispute")
+		return
+	}
+	if d.ReleaseTransactionID != "" {
+		go a.settlePendingDebits(user)
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  d.ResolvedBy,
+		Action: "dispute." + params.Resolution,
+		Target: fmt.Sprintf("user:%d", d.UserID),
+		Result: d.ID,
+	})
+
+	sendJSON(w, d)
+}
+
+// userDisputes - GET /user/{id}/disputes?status=open&limit=100: споры по пополнениям пользователя
+func (a *API) userDisputes(w http.ResponseWriter, r *http.Request, id int) {
+	if a.Disputes == nil {
+		sendError(w, errors.New("disputes are disabled"), http.StatusNotFound)
+		return
+	}
+
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 1000 {
+			sendError(w, errors.New("limit must be from 1 to 1000"), http.StatusUnprocessableEntity)
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	disputes, err := store.LoadDisputes(ctx, a.Disputes.Sess, id, r.URL.Query().Get("status"), limit)
+	if err != nil {
+		sendStorageError(w, err, "failed to load disputes")
+		return
+	}
+	if disputes == nil {
+		disputes = []store.Dispute{}
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"disputes": disputes,
+	})
+}
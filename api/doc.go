@@ -0,0 +1,241 @@
+// Package api - HTTP API сервиса балансов.
+//
+// Контракт v1 (обратно совместимые изменения только добавляют поля и роуты):
+//
+//	POST /user/balance  {"user_id": 1, "amount": 100, "tag": "opt", "category": "food", "tags": ["trip-2024"], "strict": false, "insufficient_funds": "reject|partial|queue", "pocket": "main", "merchant": "acme"}
+//	                    -> {"success": true, "transaction_id": "...", "fee": 2, "debited": 60, "queued": 40, "pending_debit_id": "..."} | {"error": "..."}
+//	POST /user/credit   {"user_id": 1, "amount": 100, "tag": "opt", "category": "salary", "tags": ["..."], "partial": false} -> {"success": true, "transaction_id": "...", "credited": 100}
+//	POST /user/bonus    {"user_id": 1, "amount": 100, "days": 30, "tag": "promo"} -> {"success": true, "transaction_id": "...", "credited": 100, "expires_at": "..."}
+//	GET  /user/{id}     -> {"id": 1, "balance": 100, "bonus": 20, "pocketed": 30, "credit_limit": 0, "max_balance": 0, "overdrawn": 0, "frozen": false, "status": "active", "created_at": "...", "updated_at": "...", "metadata": {}}
+//	POST /user/{id}/freeze | /user/{id}/unfreeze -> {"id": 1, "frozen": true}
+//	GET  /user/{id}/statement?from=...&to=...&category=food&tag=trip-2024 -> {"opening_balance": 100, "closing_balance": 80, "transactions": [...], ...}
+//	GET  /user/{id}/balance?at=2024-01-31T23:59:59Z -> {"user_id": 1, "at": "...", "balance": 80, "snapshot": "..."}
+//	GET  /user/{id}/pending-debits -> {"pending_debits": [{"id": "...", "user_id": 1, "amount": 40, "tag": "...", "created_at": "..."}]}
+//	GET  /user/{id}/pockets -> {"pockets": [{"name": "main", "balance": 70}, {"name": "savings", "balance": 30}]}
+//	POST /user/{id}/pockets/transfer {"from": "main", "to": "savings", "amount": 30} -> {"success": true, "transaction_ids": ["...", "..."], ...}
+//	POST /user/{id}/redeem {"code": "WELCOME"} -> {"success": true, "transaction_id": "...", "credited": 500, "code": "WELCOME"}
+//	POST /user/{id}/referral {"referrer_id": 7} -> {"success": true, "referral": {"referee_id": 1, "referrer_id": 7, ...}, "credited": {"referee": 100, "referrer": 200}}
+//	GET  /user/{id}/referrals -> {"referrals": [{"referee_id": 1, "referrer_id": 7, "referrer_transaction_id": "...", ...}]}
+//	GET  /user/{id}/disputes?status=open&limit=100 -> {"disputes": [{"id": "...", "transaction_id": "...", "status": "open", ...}]}
+//	GET  /user/{id}/escrows?status=held&limit=100 -> {"escrows": [{"id": "...", "payer_id": 1, "payee_id": 2, "amount": 100, "status": "held", ...}]}
+//	POST /escrows {"payer_id": 1, "payee_id": 2, "amount": 100, "tag": "deal", "expires_at": "...", "on_timeout": "release|return"} -> сделка
+//	GET  /escrows/{id} -> {"id": "...", "status": "held|released|returned", "reason": "...", "transaction_id": "...", "settle_transaction_id": "...", ...}
+//	POST /escrows/{id}/release -> сделка в состоянии "released"
+//	POST /escrows/{id}/return -> сделка в состоянии "returned"
+//	GET  /user/{id}/interest -> {"basis_points": 500, "threshold": 100, "month": "2024-01-01T00:00:00Z", "accrued": 1.37, "accruals": [{"day": "...", "balance": 1000, "amount": 136986, ...}], "payouts": [{"month": "...", "amount": 4, "transaction_id": "...", ...}]}
+//	GET  /user/{id}/cashback -> {"month": "2024-01-01T00:00:00Z", "total": 15, "cashback": [{"debit_transaction_id": "...", "rule": "category:food", "amount": 15, ...}]}
+//	GET  /user/{id}/schedules -> {"schedules": [{"id": "...", "amount": 990, "period": "monthly", "status": "active", "next_run_at": "...", "failures": 0, ...}]}
+//	POST /user/{id}/schedules {"amount": 990, "period": "daily|weekly|monthly", "tag": "subscription", "start_at": "..."} -> регулярное списание
+//	POST /user/{id}/schedules/{schedule_id}/pause | resume | cancel -> регулярное списание в новом состоянии
+//	GET  /user/{id}/scheduled-operations?status=pending&limit=100 -> {"scheduled_operations": [{"id": "...", "kind": "transfer", "user_id": 1, "to_user_id": 2, "amount": 100, "execute_at": "...", "status": "pending", ...}]}
+//	POST /user/{id}/scheduled-operations {"kind": "debit|credit|transfer", "amount": 100, "tag": "rent", "to_user_id": 2, "execute_at": "..."} -> отложенная операция
+//	POST /user/{id}/scheduled-operations/{operation_id}/cancel -> отложенная операция в состоянии "cancelled"
+//	GET  /user/{id}/bonus -> {"grants": [{"id": "...", "user_id": 1, "amount": 20, "expires_at": "...", "created_at": "..."}]}
+//	GET  /users?sort=id|balance&order=asc|desc&limit=100&cursor=...&total=true&metadata.{key}={value}
+//	           &min_balance=0&max_balance=100&status=blocked&updated_since=2024-01-02T15:04:05Z
+//	                    -> {"users": [...], "next_cursor": "...", "total": N}
+//	GET  /transactions/{id}/receipt[?format=pdf] -> подписанная квитанция об операции (JSON или PDF)
+//	POST /transactions/{id}/dispute {"reason": "chargeback"} -> {"id": "...", "transaction_id": "...", "amount": 100, "held": 70, "status": "open", "hold_transaction_id": "...", ...}
+//	GET  /transactions/{id}/dispute -> спор по операции
+//	POST /transactions/{id}/dispute/resolve {"resolution": "uphold|reverse", "note": "..."} -> спор в состоянии "upheld" или "reversed"
+//	POST /transactions/{id}/reverse {"reason": "..."} -> {"transaction_id": "...", "reversal_transaction_id": "...", "user_id": 1, "amount": 30, ...}
+//	GET  /version       -> {"git_sha": "...", "build_time": "...", "go_version": "..."}
+//	GET  /capabilities  -> {"version": 1, "features": {"transfers": false, ...}, "limits": {...}, "persistence_mode": "async"}
+//	GET  /healthz       -> {"status": "ok"}
+//	GET  /readyz        -> {"status": "ready"} | 503, пока идет прогрев кеша
+//	GET  /admin/stats   -> статистика памяти кеша и фонового сохранения
+//	GET  /admin/slo     -> соответствие SLO и скорость расхода бюджета ошибок
+//	POST /admin/users {"balance": 100, "metadata": {"plan": "pro"}} -> новый пользователь в формате GET /user/{id}
+//	POST /admin/users/import (CSV: id,external_ref,balance,currency) -> {"imported": N} | 422 {"error": "...", "rows": [{"line": 2, "error": "..."}]}
+//	POST /admin/users/{id}/merge?into={other} -> перенос баланса и external_ref id на other, id замораживается
+//	POST /admin/users/{id}/status {"status": "active|blocked|deleted"} -> смена состояния пользователя
+//	PUT  /admin/users/{id}/metadata {"plan": "pro", "external_id": "..."} -> замена метаданных пользователя
+//	PUT  /admin/users/{id}/credit-limit {"credit_limit": 500} -> овердрафт пользователя
+//	PUT  /admin/users/{id}/max-balance {"max_balance": 100000} -> максимальный баланс пользователя, 0 - общий
+//	GET  /admin/export/users[?format=csv|ndjson]                         -> все пользователи из БД, включая удаленных
+//	GET  /admin/export/transactions?from=...&to=...[&category=food&tag=trip-2024&format=csv|ndjson] -> записи леджера за [from, to)
+//	GET  /admin/ledger/trial-balance  -> {"accounts": [{"account": "revenue", "balance": 30}, ...], "total": 0, "balanced": true}
+//	GET  /admin/ledger/consistency    -> {"mismatches": [{"user_id": 1, "balance": 100, "ledger": 90}], "unbalanced": [...], "truncated": false}
+//	POST /admin/ledger/consistency?trust=balance|ledger -> {"repaired": {"adjusted": 1, ...}, "report": {...}}
+//	GET  /admin/ledger/chain/verify   -> {"valid": true, "verified": N, "head_seq": N, "head_hash": "..."} | {"valid": false, "broken_at": 5, "reason": "..."}
+//	GET  /admin/approvals?status=pending&limit=100 -> {"approvals": [{"id": "...", "user_id": 1, "amount": 100000, "status": "pending", ...}]}
+//	POST /admin/approvals/{id}/approve -> списание, {"success": true, "approval_id": "...", "transaction_id": "..."}
+//	POST /admin/approvals/{id}/reject {"reason": "..."} -> {"approval_id": "...", "status": "rejected"}
+//	GET  /admin/denylist              -> {"entries": [{"kind": "user", "value": "42", "reason": "...", "created_at": "..."}]}
+//	POST /admin/denylist {"kind": "user|caller", "value": "42", "reason": "..."} -> добавление в denylist
+//	DELETE /admin/denylist/{kind}/{value} -> удаление из denylist
+//	GET  /admin/spend-limits          -> {"limits": [{"subject": "user:1", "daily": 1000, "weekly": 5000, "updated_at": "..."}]}
+//	PUT  /admin/spend-limits/{subject} {"daily": 1000, "weekly": 0} -> лимиты "user:{id}" или "segment:{name}", 0 - без лимита
+//	DELETE /admin/spend-limits/{subject} -> снятие лимитов
+//	GET  /admin/promo-codes           -> {"promo_codes": [{"code": "WELCOME", "amount": 500, "max_uses": 1000, "uses": 3, ...}]}
+//	POST /admin/promo-codes {"code": "WELCOME", "amount": 500, "tag": "promo", "max_uses": 1000, "valid_from": "...", "valid_until": "..."} -> промокод
+//	DELETE /admin/promo-codes/{code}  -> удаление промокода
+//	GET  /admin/cashback-rules        -> {"rules": [{"subject": "category:food", "basis_points": 150, "monthly_cap": 1000, "updated_at": "..."}]}
+//	PUT  /admin/cashback-rules/{subject} {"basis_points": 150, "monthly_cap": 1000} -> правило "category:{tag}" или "merchant:{name}"
+//	DELETE /admin/cashback-rules/{subject} -> удаление правила
+//	POST /admin/support-tokens {"agent": "...", "user_id": 1, "ttl": "15m"} -> временный токен поддержки
+//	GET  /admin/dead-letters          -> изменения, которые не удалось сохранить в БД
+//	POST /admin/dead-letters/redrive  -> повторное сохранение, {"redriven": N, "remaining": M}
+//	POST /admin/flush                 -> немедленное сохранение ожидающих пользователей, {"written": N, "pending": M}
+//	DELETE /admin/cache/users/{id}    -> сохранение изменений и удаление пользователя из кеша, {"evicted": true}
+//	DELETE /admin/cache/users         -> то же для всех пользователей, {"evicted": N}
+//
+// Токен поддержки передается в Authorization: Bearer и дает только GET /user/{user_id} до истечения срока.
+//
+// С включенными ключами API или JWT все запросы, кроме GET, HEAD и OPTIONS, требуют ключ в заголовке X-API-Key
+// или JWT поставщика удостоверений в Authorization: Bearer, без них или с неверными - 401. Имя ключа или subject
+// токена записывается в журнал аудита как вызывающий. Изменяющие запросы, а /user/balance, /user/credit
+// и /user/bonus любым методом, требуют право service, роуты /admin/* (включая GET) - право admin, которое включает
+// service; без нужного права - 403.
+//
+// С включенным AllowFormParams POST /user/balance также принимает user_id и amount из query
+// и application/x-www-form-urlencoded тела.
+//
+// "strict": true (или режим PersistStrict) списывает в транзакции БД с блокировкой строки, проверяя баланс по БД:
+// медленнее, но без расхождений между экземплярами.
+//
+// С кредитным лимитом (овердрафтом) списание может увести баланс в минус до -credit_limit, ушедшая в минус сумма
+// отдается в overdrawn. Пользователя в минусе нельзя слить с другим (422).
+//
+// С комиссиями (-fees) списание проверяет баланс на сумму вместе с комиссией и пишет комиссию в леджер отдельной
+// записью с operation "fee" и тем же тегом, ее сумма отдается в fee. При частичном списании комиссия считается
+// со списанной суммы.
+//
+// При нехватке средств списание по умолчанию отклоняется (400). "insufficient_funds" в запросе или строковое
+// значение metadata.insufficient_funds пользователя меняют политику: "partial" списывает сколько есть (до нуля или
+// кредитного лимита) и отдает списанное в debited, "queue" вдобавок ставит остаток в очередь (нужен -pending_debits),
+// он списывается при следующих пополнениях. Если не списано ничего, "queue" отвечает 202
+// {"success": false, "status": "queued", "pending_debit_id": "...", "queued": 100}. В строгом режиме и с общим кешем
+// балансов политики, кроме "reject", в запросе возвращают 501, а политика пользователя не применяется.
+//
+// Пополнение, с которым баланс превысил бы максимальный (свой у пользователя или общий -max_balance), возвращает
+// 400 с "code": "max_balance_exceeded", а с "partial": true пополняет до максимума и отдает сумму в credited.
+// Слияние, с которым баланс into превысил бы его максимальный, возвращает 422, если external_ref есть у обоих - 409.
+// Пополнения не поддерживаются с общим кешем балансов (501).
+//
+// Карманы (-pockets) делят balance на основной карман "main" и именованные, сумма именованных отдается в pocketed.
+// Списания без "pocket" и переводы из "main" не трогают именованные карманы, списание с "pocket" идет только из него
+// (без политик нехватки средств и бонусов). Переводы и списания из именованных карманов сохраняются в БД до ответа
+// и пишутся в леджер парой "pocket_out" и "pocket_in" с именами карманов в tag; в строгом режиме и с общим кешем
+// балансов они возвращают 501.
+//
+// Промокоды (-promo_codes) не различают регистр. Погашение пополняет баланс на сумму промокода с его тегом
+// и забирает одно использование в одной транзакции БД в любом режиме записи; каждый пользователь гасит промокод
+// один раз. Неизвестный промокод - 404, не начавшийся, истекший или исчерпанный - 410, уже погашенный
+// пользователем - 409, пополнение сверх максимального баланса - 400.
+//
+// Приглашения (-referral_referrer_amount, -referral_referee_amount): каждого пользователя приглашают один раз,
+// приглашение другим пользователем - 409. Выплаты сторонам пишутся в одной транзакции БД с отметкой о выплате,
+// поэтому повтор запроса не платит дважды, а доплачивает только сторону, выплата которой не прошла
+// (например, из-за максимального баланса); уже выплаченная сторона получает 0 в credited.
+//
+// Кешбэк (-cashback): после успешного списания в фоне начисляется basis_points сотых долей процента от списанной
+// суммы (без комиссии, с округлением вниз) по правилу продавца "merchant" из запроса, а без него - по правилу
+// категории, тега списания. Начисление пишется в леджер отдельной записью с operation "cashback" и тегом списания,
+// за одно списание - не больше одного раза, и урезается до остатка monthly_cap правила за календарный месяц UTC.
+// Продавец не сохраняется, поэтому для подтвержденных списаний и остатков из очереди действуют только правила
+// категорий. Кешбэк не начисляется с общим кешем балансов и сверх максимального баланса.
+//
+// Категория (в формате тега) и до 10 произвольных тегов (до 64 символов, без повторов) списания и пополнения пишутся
+// в запись леджера и переходят на ее комиссию, остаток из очереди, подтвержденное списание, отмену и удержание по спору.
+// Выписка и выгрузка леджера фильтруются по category и tag (параметр повторяется, нужны все теги); балансы выписки -
+// по всему счету. В CSV выгрузке теги - JSON массив в последней колонке.
+//
+// Отмена операций (-reversals) - исправление оператора, только с правом admin: запись "reversal_<operation>"
+// на противоположную сумму с тегом операции на системном счете отмененной операции. Отмена пополнения списывается
+// только с основного баланса без комиссии и лимитов трат, отмена списания зачисляется как возврат (без максимального
+// баланса и проверки состояния счета), оплаченное бонусами - обратно в бонусы. Отменяются debit, credit, fee,
+// cashback, interest, transfer_out и transfer_in (иначе 422), один раз (повтор - 409); пополнение со спором, кроме
+// решенного "uphold", - 409. В выписке у отмененной операции есть reversed_by, у записи отмены - reverses.
+// В режиме PersistAsync операцию можно отменить после того, как она сохранена в БД. С общим кешем - 501.
+//
+// Споры (-disputes) открываются только по пополнениям (operation "credit"), по одному на пополнение (повтор - 409).
+// Открытие удерживает сумму пополнения с пользователя записью "dispute_hold" без лимитов трат: если часть уже
+// потрачена - сколько есть (held), если ничего нет - спор открывается без удержания. Решение "uphold" возвращает
+// удержанное записью "dispute_release", "reverse" оставляет удержание окончательным; решенный спор - 409.
+// Удержание и возврат пишутся в одной транзакции БД с состоянием спора. В выписке у оспоренного пополнения
+// и записей удержания и возврата есть dispute_id и dispute_status. В режиме PersistAsync пополнение можно оспорить
+// после того, как оно сохранено в БД. С общим кешем балансов - 501.
+//
+// Сделки с эскроу (-escrows): POST /escrows списывает amount у плательщика записью "escrow_hold" без комиссии,
+// но с лимитами трат и правилами против мошенничества, и сохраняет сделку в одной транзакции БД со списанием.
+// Release зачисляет сумму получателю записью "escrow_release", return возвращает плательщику записью
+// "escrow_return"; новое состояние пишется вместе с пополнением, поэтому сделка завершается один раз, а повтор - 409.
+// Если выплата не прошла (максимальный баланс, блокировка получателя), сделка остается "held"; возврат проходит
+// без проверки максимального баланса, состояния счета и denylist плательщика. Сделку без решения
+// к expires_at (по умолчанию через -escrow_timeout) фоновый обработчик завершает по on_timeout с reason "timeout";
+// если выплата получателю при этом не прошла, сумма возвращается плательщику. С общим кешем балансов - 501.
+//
+// Проценты (-interest_rate) начисляются раз в день UTC по годовой ставке в сотых долях процента (год - 365 дней)
+// на весь основной баланс в БД (без бонусов), если он больше -interest_threshold, и хранятся в миллионных долях
+// единицы (amount у начислений, accrued - в единицах). Раз в месяц начисленное за прошлый месяц выплачивается
+// целыми единицами записью с operation "interest", остаток переходит на следующий. Начисление за день и выплата
+// за месяц пишутся не больше одного раза, поэтому задачу можно перезапускать и запускать на нескольких
+// экземплярах; пропущенные за простой дни не начисляются. Если выплата не прошла (блокировка, максимальный
+// баланс), проценты переходят на следующий месяц. С общим кешем балансов проценты только копятся.
+//
+// Регулярные списания (-schedules) выполняет фоновый обработчик с теми же проверками, комиссиями и режимом записи,
+// что и POST /user/balance, но без подтверждения крупных списаний; в строгом режиме они сохраняются синхронно через
+// кеш. Месячные списания идут в день start_at, в коротких месяцах - в последний день. Следующее списание
+// назначается до выполнения текущего, поэтому списание не повторяется, но может быть потеряно при падении
+// экземпляра; пропущенные за простой периоды не списываются задним числом. Неудачное списание повторяется через
+// -schedule_retry_interval (но не позже следующего по расписанию), после -schedule_max_failures неудач подряд
+// регулярное списание приостанавливается, причина отдается в last_error. Возобновление сбрасывает неудачи
+// и списывает сразу, если срок уже прошел. Отмененное нельзя возобновить (409).
+//
+// Отложенные операции (-scheduled_operations) выполняет фоновый обработчик не раньше execute_at: списание - с теми же
+// проверками и комиссиями, что и POST /user/balance, пополнение - с проверкой максимального баланса. Перевод
+// списывается у user_id записью "transfer_out" без комиссии и пополняет to_user_id записью "transfer_in"; если
+// пополнение не прошло (максимальный баланс, блокировка получателя), деньги возвращаются отправителю записью
+// "transfer_in" без проверки его максимального баланса и состояния счета, а операция становится "failed" с причиной
+// в reason. Каждый шаг пишется в БД одной транзакцией с состоянием операции, поэтому после перезапуска
+// и на нескольких экземплярах он не повторяется, а перевод, прерванный между списанием и пополнением ("debited"),
+// доводится до конца. Отменить можно только операцию в состоянии "pending" (иначе 409). Пополнения и переводы
+// не поддерживаются с общим кешем балансов (501).
+//
+// Бонусы (-bonus_ttl) - часть balance, которая отдается в bonus, тратится раньше основного баланса и сгорает через
+// days дней после начисления (по умолчанию через -bonus_ttl). Начисление пишется в леджер с operation "bonus_credit",
+// сгорание - "bonus_expiry", а трата бонусов перед списанием - парой "bonus_out" и "bonus_in" на ту же сумму.
+// Бонусы тратят только списания: переводы, эскроу, удержания по спорам и отмены пополнений берут только основной
+// баланс.
+//
+// Списание с заблокированного пользователя возвращает 403, с удаленного - 410, с замороженного счета - 423.
+// Заморозка хранится в БД и сразу применяется к кешу экземпляра, который ее выполнил, другие экземпляры узнают
+// о ней при следующем сохранении пользователя.
+// С включенными лимитами трат списание, с которым сумма списаний за последние 24 часа или 7 дней превысила бы лимит,
+// возвращает 403 с "code": "spend_limit_exceeded". Лимит пользователя заменяет лимит его сегмента (строковое
+// значение metadata.segment). Под нагрузкой и в строгом режиме лимит может быть немного превышен.
+//
+// С включенным подтверждением списание больше порога не выполняется, а возвращает 202
+// {"success": false, "status": "pending_approval", "approval_id": "..."} и ждет, пока другой вызывающий подтвердит
+// или отклонит его в /admin/approvals. Решает только вызывающий с ключом API, токеном или сертификатом клиента,
+// иначе 403. Проверки средств, лимитов и правил выполняются при подтверждении.
+//
+// Списание, отклоненное правилом против мошенничества (например, слишком много списаний за минуту), возвращает
+// 403 с "code": "fraud_rejected", помеченные правилом списания проходят и попадают в журнал аудита.
+//
+// С включенным denylist запросы к пользователям из него (/user/{id}/... и списания) и от вызывающих из него
+// ("key:<имя ключа>", "jwt:<subject>", "cert:<CN>") получают 403 с "code": "denied" до обращения к кешу и БД.
+//
+// Удаленные пользователи остаются в БД и GET /user/{id}, но не попадают в прогрев кеша.
+//
+// Выписка считается по леджеру и балансу в БД: списания, которые еще не сохранены фоновым сохранением,
+// в нее не попадают.
+//
+// GET /users отдает страницы по курсору: next_cursor передается в cursor следующего запроса с той же сортировкой.
+// Удаленные пользователи попадают в список только со status=deleted, metadata.{key} оставляет пользователей
+// с таким строковым значением в метаданных. Фильтры применяются к состоянию в БД.
+//
+// Выгрузки отдаются потоком по мере чтения из БД: если чтение прервалось после начала ответа, ответ обрывается.
+//
+// metadata.external_ref уникален: создание и смена метаданных с занятым external_ref возвращают 409.
+// Импорт применяется целиком или не применяется вовсе.
+//
+// С включенным кешем ответов GET /user/{id} может отдаваться из кеша, но не после изменения пользователя.
+//
+// При превышении ограничения запросов к пользователю или с адреса - 429 с Retry-After в секундах,
+// при превышении предела одновременных запросов экземпляра - 503 с Retry-After.
+//
+// Ошибки всегда возвращаются в виде {"error": "<текст>"} с соответствующим HTTP статусом, ошибки, которые
+// нужно отличать от других с тем же статусом, - еще и с машиночитаемым "code".
+package api
@@ -0,0 +1,347 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/denylist"
+	"github.com/Skat712/test_balance/store"
+)
+
+// escrowBatch - сколько истекших сделок завершается за один запрос к БД
+const escrowBatch = 100
+
+// Escrows - сделки с эскроу в таблице escrows, nil - отключены
+type Escrows struct {
+	Sess *dbr.Session
+	// Timeout - через сколько сделка без решения завершается по on_timeout, если в запросе не задан expires_at
+	Timeout time.Duration
+}
+
+// EscrowParams - новая сделка в POST /escrows, on_timeout по умолчанию - return
+type EscrowParams struct {
+	PayerID   int        `json:"payer_id"`
+	PayeeID   int        `json:"payee_id"`
+	Amount    int        `json:"amount"`
+	Tag       string     `json:"tag"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	OnTimeout string     `json:"on_timeout"`
+}
+
+// EscrowsHandler - POST /escrows: новая сделка, GET /escrows/{id}: сделка,
+// POST /escrows/{id}/release: выплатить получателю, POST /escrows/{id}/return: вернуть плательщику
+func (a *API) EscrowsHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Escrows == nil {
+		sendError(w, errors.New("escrows are disabled"), http.StatusNotFound)
+		return
+	}
+
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/escrows"), "/"), "/")
+	method := http.MethodPost
+	if id != "" && action == "" {
+		method = http.MethodGet
+	}
+	if r.Method != method {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case id == "":
+		a.createEscrow(w, r)
+	case action == "":
+		a.getEscrow(w, r, id)
+	case action == store.EscrowRelease || action == store.EscrowReturn:
+		a.escrowAction(w, r, id, action)
+	default:
+		sendError(w, errors.New("not found"), http.StatusNotFound)
+	}
+}
+
+// createEscrow - POST /escrows {"payer_id": 1, "payee_id": 2, "amount": 100, "expires_at": "...", "on_timeout": "release"}:
+// списывает amount у плательщика на счет эскроу
+func (a *API) createEscrow(w http.ResponseWriter, r *http.Request) {
+	var params EscrowParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	e := store.Escrow{
+		ID:        store.NewTransactionID(),
+		PayerID:   params.PayerID,
+		PayeeID:   params.PayeeID,
+		Amount:    params.Amount,
+		Tag:       params.Tag,
+		OnTimeout: params.OnTimeout,
+		ExpiresAt: now.Add(a.Escrows.Timeout),
+		CreatedBy: callerID(r),
+	}
+	if e.OnTimeout == "" {
+		e.OnTimeout = store.EscrowReturn
+	}
+	if err := e.Validate(); err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	if params.ExpiresAt != nil {
+		if !params.ExpiresAt.After(now) {
+			sendError(w, errors.New("expires_at must be in the future"), http.StatusUnprocessableEntity)
+			return
+		}
+		e.ExpiresAt = params.ExpiresAt.UTC().Truncate(time.Microsecond)
+	}
+	if a.Denylist.User(e.PayerID) || a.Denylist.User(e.PayeeID) {
+		sendDenied(w)
+		return
+	}
+	// выплата и возврат - пополнения, максимальный баланс проверяется по кешу экземпляра
+	if a.Shared != nil {
+		sendError(w, errors.New("escrows are not supported with a shared cache backend"), http.StatusNotImplemented)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	payee, err := a.operationUser(ctx, e.PayeeID)
+	if err != nil {
+		sendStorageError(w, err, "failed to load user")
+		return
+	}
+	if payee == nil {
+		sendError(w, fmt.Errorf("user %d not found", e.PayeeID), http.StatusNotFound)
+		return
+	}
+	payer, err := a.operationUser(ctx, e.PayerID)
+	if err != nil {
+		sendStorageError(w, err, "failed to load user")
+		return
+	}
+	if payer == nil {
+		sendError(w, fmt.Errorf("user %d not found", e.PayerID), http.StatusNotFound)
+		return
+	}
+
+	wctx, wcancel := a.writeContext()
+	defer wcancel()
+
+	debit := BalanceParams{UserID: e.PayerID, Amount: e.Amount, Tag: e.Tag}
+	e, err = store.HoldEscrow(wctx, a.Escrows.Sess, payer, e, a.debitOptions(wctx, payer, debit, PersistSync))
+	if status := debitErrorStatus(err); status != 0 {
+		sendError(w, err, status)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to save escrow")
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  e.CreatedBy,
+		Action: "escrow.create",
+		Target: fmt.Sprintf("user:%d", e.PayerID),
+		Result: e.ID,
+		Fields: map[string]interface{}{
+			"payee_id":   e.PayeeID,
+			"amount":     e.Amount,
+			"expires_at": e.ExpiresAt,
+			"on_timeout": e.OnTimeout,
+		},
+	})
+
+	sendJSON(w, e)
+}
+
+// getEscrow - GET /escrows/{id}
+func (a *API) getEscrow(w http.ResponseWriter, r *http.Request, id string) {
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	e, err := store.LoadEscrow(ctx, a.Escrows.Sess, id)
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("escrow not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to load escrow")
+		return
+	}
+	sendJSON(w, e)
+}
+
+// escrowAction - POST /escrows/{id}/release|return: завершение сделки по запросу, 409 - уже завершена
+func (a *API) escrowAction(w http.ResponseWriter, r *http.Request, id, action string) {
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	e, err := store.LoadEscrow(ctx, a.Escrows.Sess, id)
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("escrow not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to load escrow")
+		return
+	}
+	if e.Status != store.EscrowHeld {
+		sendError(w, store.ErrEscrowSettled, http.StatusConflict)
+		return
+	}
+
+	e, err = a.settleEscrow(ctx, e, action, "")
+	if errors.Is(err, store.ErrEscrowSettled) {
+		sendError(w, err, http.StatusConflict)
+		return
+	}
+	if errors.Is(err, denylist.ErrDenied) {
+		sendDenied(w)
+		return
+	}
+	if status := debitErrorStatus(err); status != 0 {
+		sendError(w, err, status)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to settle escrow")
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "escrow." + action,
+		Target: fmt.Sprintf("user:%d", e.PayerID),
+		Result: e.ID,
+	})
+
+	sendJSON(w, e)
+}
+
+// settleEscrow - выплачивает сумму сделки e получателю или возвращает плательщику (action) с причиной reason.
+// Получатель из denylist - denylist.ErrDenied, плательщику удержанное возвращается всегда
+func (a *API) settleEscrow(ctx context.Context, e store.Escrow, action, reason string) (store.Escrow, error) {
+	userID := e.PayeeID
+	if action == store.EscrowReturn {
+		userID = e.PayerID
+	} else if a.Denylist.User(userID) {
+		return e, denylist.ErrDenied
+	}
+	user, err := a.operationUser(ctx, userID)
+	if err != nil {
+		return e, err
+	}
+	if user == nil {
+		return e, fmt.Errorf("user %d not found", userID)
+	}
+
+	e, err = store.SettleEscrow(ctx, a.Escrows.Sess, user, e, action, reason, a.operationCreditOptions())
+	if err == nil {
+		go a.settlePendingDebits(user)
+	}
+	return e, err
+}
+
+// userEscrows - GET /user/{id}/escrows?status=held&limit=100: сделки, в которых пользователь плательщик или получатель
+func (a *API) userEscrows(w http.ResponseWriter, r *http.Request, id int) {
+	if a.Escrows == nil {
+		sendError(w, errors.New("escrows are disabled"), http.StatusNotFound)
+		return
+	}
+
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 1000 {
+			sendError(w, errors.New("limit must be from 1 to 1000"), http.StatusUnprocessableEntity)
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	escrows, err := store.LoadEscrows(ctx, a.Escrows.Sess, id, r.URL.Query().Get("status"), limit)
+	if err != nil {
+		sendStorageError(w, err, "failed to load escrows")
+		return
+	}
+	if escrows == nil {
+		escrows = []store.Escrow{}
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"escrows": escrows,
+	})
+}
+
+// SettleExpiredEscrows - завершает истекшие сделки по их on_timeout. Если выплата получателю не прошла
+// по бизнес-причине, сумма возвращается плательщику; не прошедший возврат повторяется при следующем запуске.
+// Возвращает количество завершенных сделок
+func (a *API) SettleExpiredEscrows(ctx context.Context) (int, error) {
+	if a.Escrows == nil || a.Shared != nil {
+		return 0, nil
+	}
+
+	settled := 0
+	now := time.Now()
+	var after *store.Escrow
+	for {
+		expired, err := store.ExpiredEscrows(ctx, a.Escrows.Sess, now, after, escrowBatch)
+		if err != nil {
+			return settled, err
+		}
+
+		for _, e := range expired {
+			_, err := a.settleEscrow(ctx, e, e.OnTimeout, "timeout")
+			if err != nil && e.OnTimeout == store.EscrowRelease && (debitErrorStatus(err) != 0 || errors.Is(err, denylist.ErrDenied)) {
+				_, err = a.settleEscrow(ctx, e, store.EscrowReturn, "timeout: release failed: "+err.Error())
+			}
+			if errors.Is(err, store.ErrEscrowSettled) {
+				continue
+			}
+			if err != nil {
+				// сделка повторится при следующем запуске, следующие за ней завершаются со следующей страницы
+				log.Printf("failed to settle expired escrow %s: %v", e.ID, err)
+				continue
+			}
+			settled++
+		}
+		if len(expired) < escrowBatch || ctx.Err() != nil {
+			return settled, nil
+		}
+		after = &expired[len(expired)-1]
+	}
+}
+
+// RunEscrowSweeper - раз в interval завершает истекшие сделки, пока не отменен ctx
+func (a *API) RunEscrowSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			settled, err := a.SettleExpiredEscrows(ctx)
+			if err != nil {
+				log.Printf("failed to settle expired escrows: %v", err)
+			}
+			if settled > 0 {
+				log.Printf("Settled %d expired escrows", settled)
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/store"
+)
+
+// setUserFrozen - POST /user/{id}/freeze и /user/{id}/unfreeze: заморозка и разморозка счета.
+// Замороженный пользователь читается как обычно, списания с него получают 423
+func (a *API) setUserFrozen(w http.ResponseWriter, r *http.Request, id int, frozen bool) {
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	err := store.SetFrozen(ctx, a.Store, a.Cache.Peek(id), id, frozen)
+	a.Responses.Invalidate(id)
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to change frozen state")
+		return
+	}
+
+	action := "user.unfreeze"
+	if frozen {
+		action = "user.freeze"
+	}
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: action,
+		Target: fmt.Sprintf("user:%d", id),
+	})
+
+	sendJSON(w, map[string]interface{}{
+		"id":     id,
+		"frozen": frozen,
+	})
+}
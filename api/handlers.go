@@ -0,0 +1,477 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/fraud"
+	"github.com/Skat712/test_balance/store"
+	"github.com/Skat712/test_balance/writeback"
+)
+
+// BalanceHandler - обработчик роута
+func (a *API) BalanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	params, err := a.readBalanceParams(r)
+	if err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := params.Validate(); err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	if a.Denylist.User(params.UserID) {
+		sendDenied(w)
+		return
+	}
+	if !a.allowUser(w, params.UserID) {
+		return
+	}
+	if a.Approvals.Required(params.Amount) {
+		a.requestApproval(w, r, params)
+		return
+	}
+
+	if tx, queued, ok := a.debit(w, r, params); ok {
+		sendDebitSuccess(w, params, tx, a.debitFee(params.Tag, -tx.Amount), queued)
+	}
+}
+
+// debit - списание в текущем режиме записи, при ошибке отвечает клиенту сам и возвращает false.
+// С политикой store.FundsQueue возвращает и поставленный в очередь остаток, tx без ID - не списано ничего
+func (a *API) debit(w http.ResponseWriter, r *http.Request, params BalanceParams) (store.Transaction, *store.PendingDebit, bool) {
+	if err := a.checkFundsPolicy(params); err != nil {
+		sendError(w, err, http.StatusNotImplemented)
+		return store.Transaction{}, nil, false
+	}
+	if pocketDebit(params) {
+		if err := a.checkPockets(params.Strict); err != nil {
+			sendError(w, err, http.StatusNotImplemented)
+			return store.Transaction{}, nil, false
+		}
+	}
+
+	mode := a.persistenceMode()
+	if params.Strict || mode == PersistStrict {
+		tx, ok := a.strictDebit(w, params)
+		return tx, nil, ok
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	user, err := a.Cache.LoadUser(params.UserID, func(id int) (*store.User, error) {
+		return a.Store.LoadUser(ctx, id)
+	})
+	if err != nil {
+		sendStorageError(w, err, "failed to load user")
+		return store.Transaction{}, nil, false
+	}
+	if user == nil {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return store.Transaction{}, nil, false
+	}
+
+	policy := a.fundsPolicy(params, user)
+	if pocketDebit(params) {
+		// именованный карман проверяется по БД, поэтому списание из него сохраняется до ответа
+		mode = PersistSync
+	}
+	opts := a.debitOptions(ctx, user, params, mode)
+	opts.Partial = policy != store.FundsReject
+	tx, err := user.ApplyDebit(params.Amount, opts)
+	if errors.Is(err, store.ErrNotEnoughMoney) && policy == store.FundsQueue {
+		// списать нечего, в очередь встает все списание
+		return tx, a.queueRemainder(params, params.Amount), true
+	}
+	if status := debitErrorStatus(err); status != 0 {
+		sendError(w, err, status)
+		return tx, nil, false
+	}
+	if err != nil {
+		if mode == PersistSync {
+			sendStorageError(w, err, "failed to save balance")
+		} else {
+			sendError(w, errors.New("failed to journal balance change"), http.StatusInternalServerError)
+		}
+		return tx, nil, false
+	}
+	a.recordDebit(tx, params)
+
+	var queued *store.PendingDebit
+	if rest := params.Amount + tx.Amount; rest > 0 && policy == store.FundsQueue {
+		queued = a.queueRemainder(params, rest)
+	}
+	return tx, queued, true
+}
+
+// debitOptions - шаги списания с user в режиме mode: сохранение или журнал, лимиты трат и правила против мошенничества
+func (a *API) debitOptions(ctx context.Context, user *store.User, params BalanceParams, mode string) store.DebitOptions {
+	// проверки, списание и запись в журнал - один шаг под блокировкой пользователя, затем постановка в очередь
+	opts := store.DebitOptions{
+		Tag:      params.Tag,
+		Category: params.Category,
+		Tags:     params.Tags,
+		Pocket:   params.Pocket,
+		Mark: func(u *store.User) {
+			a.Responses.Invalidate(u.ID)
+			if mode != PersistSync {
+				a.Saver.Save(u)
+			}
+		},
+	}
+	if a.Shared != nil {
+		opts.Shared = a.Shared
+	}
+	if a.Fees != nil {
+		opts.Fee = func(amount int) int {
+			return a.debitFee(params.Tag, amount)
+		}
+	}
+	if mode == PersistSync {
+		opts.Save = func(p store.Pending) error {
+			ctx, cancel := a.writeContext()
+			defer cancel()
+			return a.Store.SavePending(ctx, user.ID, p)
+		}
+	} else {
+		opts.Journal = a.journal()
+		opts.Lockless = a.LocklessDebit
+		opts.Check = func(u *store.User) error {
+			return a.Saver.Admit(u.ID)
+		}
+	}
+	if a.SpendLimits != nil || a.Fraud.Len() > 0 {
+		admit := opts.Check
+		opts.Check = func(u *store.User) error {
+			if err := a.checkDebit(ctx, u, params); err != nil {
+				return err
+			}
+			if admit != nil {
+				return admit(u)
+			}
+			return nil
+		}
+	}
+	return opts
+}
+
+// checkDebit - лимиты трат и правила против мошенничества для списания с пользователя u
+// (под блокировкой или только что прочитанного из хранилища)
+func (a *API) checkDebit(ctx context.Context, u *store.User, params BalanceParams) error {
+	if err := a.SpendLimits.Check(ctx, a.Store, u, params.Amount); err != nil {
+		return err
+	}
+
+	err := a.Fraud.Check(ctx, fraud.Debit{UserID: u.ID, Amount: params.Amount, Tag: params.Tag, At: time.Now().UTC()})
+	var rejected *fraud.RejectedError
+	if errors.As(err, &rejected) {
+		a.Audit.Record(audit.Event{
+			Actor:  "fraud",
+			Action: "debit.reject",
+			Target: fmt.Sprintf("user:%d", u.ID),
+			Result: rejected.Rule,
+			Fields: map[string]interface{}{
+				"amount": params.Amount,
+				"reason": rejected.Reason,
+			},
+		})
+	}
+	return err
+}
+
+// debitFee - комиссия за списание amount с тегом tag по Fees
+func (a *API) debitFee(tag string, amount int) int {
+	if amount <= 0 {
+		return 0
+	}
+	return a.Fees.Amount(store.OperationDebit, tag, amount)
+}
+
+// recordDebit - передает успешное списание правилам против мошенничества с историей и в фоне начисляет за него кешбэк
+func (a *API) recordDebit(tx store.Transaction, params BalanceParams) {
+	a.Fraud.Record(fraud.Debit{UserID: params.UserID, Amount: -tx.Amount, Tag: params.Tag, At: tx.CreatedAt})
+	if a.Cashback != nil && tx.Amount < 0 {
+		go a.creditCashback(tx, params.Merchant)
+	}
+}
+
+// strictDebit - списание в транзакции БД с блокировкой строки, см. store.DebitStrict
+func (a *API) strictDebit(w http.ResponseWriter, params BalanceParams) (store.Transaction, bool) {
+	// проверка средств по общему балансу и по БД противоречат друг другу
+	if a.Shared != nil {
+		sendError(w, errors.New("strict debits are not supported with a shared cache backend"), http.StatusNotImplemented)
+		return store.Transaction{}, false
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	// лимиты и правила проверяются до транзакции, поэтому параллельные строгие списания могут лимит немного превысить
+	if a.SpendLimits != nil || a.Fraud.Len() > 0 {
+		user, err := a.Store.LoadUser(ctx, params.UserID)
+		if err != nil {
+			sendStorageError(w, err, "failed to load user")
+			return store.Transaction{}, false
+		}
+		if user == nil {
+			sendError(w, errors.New("user not found"), http.StatusNotFound)
+			return store.Transaction{}, false
+		}
+		if err := a.checkDebit(ctx, user, params); err != nil {
+			if status := debitErrorStatus(err); status != 0 {
+				sendError(w, err, status)
+			} else {
+				sendStorageError(w, err, "failed to check debit")
+			}
+			return store.Transaction{}, false
+		}
+	}
+
+	fee := a.debitFee(params.Tag, params.Amount)
+	tx, err := store.DebitStrict(ctx, a.Store, a.Cache.Peek(params.UserID), params.UserID, params.Amount, fee,
+		params.Tag, params.Category, params.Tags)
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return store.Transaction{}, false
+	}
+	if status := debitErrorStatus(err); status != 0 {
+		sendError(w, err, status)
+		return store.Transaction{}, false
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to save balance")
+		return store.Transaction{}, false
+	}
+	a.Responses.Invalidate(params.UserID)
+	a.recordDebit(tx, params)
+	return tx, true
+}
+
+// debitErrorStatus - HTTP статус для бизнес-ошибки списания или пополнения, 0 - ошибка не бизнесовая
+func debitErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, store.ErrNotEnoughMoney), errors.Is(err, store.ErrMaxBalance):
+		return http.StatusBadRequest
+	case errors.Is(err, store.ErrFrozen):
+		return http.StatusLocked
+	case errors.Is(err, store.ErrBlocked), errors.Is(err, store.ErrSpendLimitExceeded), errors.Is(err, fraud.ErrRejected):
+		return http.StatusForbidden
+	case errors.Is(err, store.ErrDeleted):
+		return http.StatusGone
+	case errors.Is(err, writeback.ErrSaveQueueFull):
+		return http.StatusServiceUnavailable
+	}
+	return 0
+}
+
+// UserHandler - GET /user/{id}: текущее состояние пользователя, GET /user/{id}/statement: выписка,
+// GET /user/{id}/balance?at=...: баланс на момент, GET /user/{id}/pending-debits: остатки списаний в очереди,
+// GET /user/{id}/bonus: начисления бонусов, GET /user/{id}/pockets и POST /user/{id}/pockets/transfer: карманы,
+// POST /user/{id}/redeem: погашение промокода, POST /user/{id}/referral и GET /user/{id}/referrals: приглашения,
+// GET /user/{id}/cashback: кешбэк за месяц, GET /user/{id}/interest: проценты на баланс, GET /user/{id}/escrows:
+// сделки с эскроу, GET /user/{id}/disputes: споры, GET и POST /user/{id}/schedules,
+// POST /user/{id}/schedules/{id}/pause|resume|cancel: регулярные списания, GET и POST /user/{id}/scheduled-operations,
+// POST /user/{id}/scheduled-operations/{id}/cancel: отложенные операции, POST /user/{id}/freeze и /unfreeze:
+// заморозка счета
+func (a *API) UserHandler(w http.ResponseWriter, r *http.Request) {
+	path, route, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/user/"), "/")
+	method := http.MethodGet
+	if route == "freeze" || route == "unfreeze" || route == "pockets/transfer" || route == "redeem" || route == "referral" ||
+		strings.HasPrefix(route, "schedules/") || strings.HasPrefix(route, "scheduled-operations/") ||
+		(route == "schedules" || route == "scheduled-operations") && r.Method == http.MethodPost {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(path)
+	if err != nil || id < 1 {
+		sendError(w, errors.New("invalid user id"), http.StatusUnprocessableEntity)
+		return
+	}
+	if !a.allowUser(w, id) {
+		return
+	}
+	switch route {
+	case "":
+	case "freeze", "unfreeze":
+		a.setUserFrozen(w, r, id, route == "freeze")
+		return
+	case "statement":
+		a.userStatement(w, r, id)
+		return
+	case "balance":
+		a.userBalanceAt(w, r, id)
+		return
+	case "pending-debits":
+		a.userPendingDebits(w, r, id)
+		return
+	case "bonus":
+		a.userBonus(w, r, id)
+		return
+	case "pockets":
+		a.userPockets(w, r, id)
+		return
+	case "pockets/transfer":
+		a.transferPocket(w, r, id)
+		return
+	case "redeem":
+		a.redeemPromoCode(w, r, id)
+		return
+	case "referral":
+		a.registerReferral(w, r, id)
+		return
+	case "referrals":
+		a.userReferrals(w, r, id)
+		return
+	case "cashback":
+		a.userCashback(w, r, id)
+		return
+	case "interest":
+		a.userInterest(w, r, id)
+		return
+	case "escrows":
+		a.userEscrows(w, r, id)
+		return
+	case "disputes":
+		a.userDisputes(w, r, id)
+		return
+	case "schedules":
+		a.userSchedules(w, r, id)
+		return
+	case "scheduled-operations":
+		a.userScheduledOperations(w, r, id)
+		return
+	default:
+		if strings.HasPrefix(route, "schedules/") {
+			a.scheduleAction(w, r, id, route)
+			return
+		}
+		if strings.HasPrefix(route, "scheduled-operations/") {
+			a.cancelScheduledOperation(w, r, id, route)
+			return
+		}
+		sendError(w, errors.New("not found"), http.StatusNotFound)
+		return
+	}
+
+	cached, token, ok := a.Responses.Get(id)
+	if ok {
+		sendJSON(w, cached)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	user, err := a.Cache.LoadUser(id, func(id int) (*store.User, error) {
+		return a.Store.LoadUser(ctx, id)
+	})
+	if err != nil {
+		sendStorageError(w, err, "failed to load user")
+		return
+	}
+	if user == nil {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	state := user.State()
+	if a.Shared != nil {
+		balance, ok, err := a.Shared.Get(id)
+		if err != nil {
+			sendError(w, errors.New("failed to read shared balance"), http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			state.Balance, state.Overdrawn = balance, store.Overdrawn(balance)
+		}
+	}
+	a.Responses.Put(id, token, state)
+	sendJSON(w, state)
+}
+
+// readBalanceParams - читает параметры списания из JSON тела, либо из query/form в режиме совместимости
+func (a *API) readBalanceParams(r *http.Request) (BalanceParams, error) {
+	var params BalanceParams
+
+	// параметры из query принимаются только у POST: GET не должен списывать
+	if a.AllowFormParams && r.Method == http.MethodPost && !isJSON(r) {
+		if err := r.ParseForm(); err != nil {
+			return params, err
+		}
+		return parseBalanceForm(r.Form)
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&params)
+	return params, err
+}
+
+// isJSON - тело запроса в JSON: явно указан тип, либо тип не указан и нет query параметров
+func isJSON(r *http.Request) bool {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/json":
+		return true
+	case "":
+		return r.URL.RawQuery == ""
+	}
+	return false
+}
+
+// VersionHandler - информация о запущенной сборке
+func (a *API) VersionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	sendJSON(w, map[string]string{
+		"git_sha":    a.Build.GitSHA,
+		"build_time": a.Build.BuildTime,
+		"go_version": runtime.Version(),
+	})
+}
+
+// AdminStatsHandler - статистика использования памяти кешем и фоновым сохранением
+func (a *API) AdminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, a.memoryStats())
+}
+
+// AdminSLOHandler - соответствие SLO и скорость расхода бюджета ошибок
+func (a *API) AdminSLOHandler(w http.ResponseWriter, r *http.Request) {
+	if a.SLO == nil {
+		sendError(w, errors.New("slo tracking disabled"), http.StatusNotFound)
+		return
+	}
+
+	sendJSON(w, a.SLO.Report())
+}
+
+// memoryStats - примерное потребление памяти кешем и очередью сохранения
+func (a *API) memoryStats() map[string]int64 {
+	return map[string]int64{
+		"cache_entries":              int64(a.Cache.Len()),
+		"cache_memory_bytes":         a.Cache.MemoryUsage(),
+		"cache_memory_limit_bytes":   a.Cache.MemoryLimit,
+		"pending_saves":              a.Saver.Pending(),
+		"pending_saves_memory_bytes": a.Saver.MemoryUsage(),
+	}
+}
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// SetReady - готовность принимать трафик, отдается в /readyz
+func (a *API) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&a.ready, v)
+}
+
+// HealthzHandler - GET /healthz: процесс жив
+func (a *API) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, map[string]string{"status": "ok"})
+}
+
+// ReadyzHandler - GET /readyz: 503, пока экземпляр не готов (например идет прогрев кеша)
+func (a *API) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&a.ready) == 0 {
+		sendError(w, errors.New("not ready"), http.StatusServiceUnavailable)
+		return
+	}
+
+	sendJSON(w, map[string]string{"status": "ready"})
+}
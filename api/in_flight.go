@@ -0,0 +1,62 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// InFlightLimiter - семафор на одновременно обрабатываемые запросы: лишние сразу получают 503,
+// а не ждут в горутинах, раздувая задержки. nil - без ограничения
+type InFlightLimiter struct {
+	slots chan struct{}
+	// shed - отклоненные запросы с запуска
+	shed int64
+}
+
+func NewInFlightLimiter(max int) *InFlightLimiter {
+	return &InFlightLimiter{slots: make(chan struct{}, max)}
+}
+
+// acquire - занимает место, false - мест нет
+func (l *InFlightLimiter) acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		atomic.AddInt64(&l.shed, 1)
+		return false
+	}
+}
+
+func (l *InFlightLimiter) release() {
+	<-l.slots
+}
+
+// Stats - текущие запросы, предел и отклоненные запросы для expvar
+func (l *InFlightLimiter) Stats() map[string]int64 {
+	return map[string]int64{
+		"in_flight": int64(len(l.slots)),
+		"limit":     int64(cap(l.slots)),
+		"shed":      atomic.LoadInt64(&l.shed),
+	}
+}
+
+// shedLoad - отклоняет запросы сверх InFlight с 503 и Retry-After. Пробы и метрики не ограничиваются,
+// чтобы перегруженный экземпляр не выглядел мертвым
+func (a *API) shedLoad(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.InFlight == nil || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == "/debug/vars" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !a.InFlight.acquire() {
+			w.Header().Set("Retry-After", "1")
+			sendError(w, errors.New("server is overloaded"), http.StatusServiceUnavailable)
+			return
+		}
+		defer a.InFlight.release()
+		next.ServeHTTP(w, r)
+	})
+}
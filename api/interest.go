@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// interestPayoutBatch - сколько пользователей с процентами к выплате обрабатывается за один запрос к БД
+const interestPayoutBatch = 1000
+
+// Interest - проценты на баланс: начисляются раз в день в таблицу interest_accruals и выплачиваются
+// раз в месяц. nil - отключены
+type Interest struct {
+	Sess *dbr.Session
+	// BasisPoints - годовая ставка в сотых долях процента
+	BasisPoints int
+	// Threshold - проценты начисляются только на баланс больше этого
+	Threshold int64
+}
+
+// userInterest - GET /user/{id}/interest: начисления процентов за текущий календарный месяц UTC и последние выплаты
+func (a *API) userInterest(w http.ResponseWriter, r *http.Request, id int) {
+	if a.Interest == nil {
+		sendError(w, errors.New("interest is disabled"), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	month := store.MonthStart(time.Now())
+	accruals, err := store.LoadInterestAccruals(ctx, a.Interest.Sess, id, month)
+	if err != nil {
+		sendStorageError(w, err, "failed to load interest accruals")
+		return
+	}
+	if accruals == nil {
+		accruals = []store.InterestAccrual{}
+	}
+	payouts, err := store.LoadInterestPayouts(ctx, a.Interest.Sess, id, 12)
+	if err != nil {
+		sendStorageError(w, err, "failed to load interest payouts")
+		return
+	}
+	if payouts == nil {
+		payouts = []store.InterestPayout{}
+	}
+	var accrued int64
+	for _, acc := range accruals {
+		accrued += acc.Amount
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"basis_points": a.Interest.BasisPoints,
+		"threshold":    a.Interest.Threshold,
+		"month":        month,
+		"accrued":      float64(accrued) / store.InterestScale,
+		"accruals":     accruals,
+		"payouts":      payouts,
+	})
+}
+
+// AccrueInterest - начисляет проценты за сегодня и выплачивает проценты за прошлый месяц тем, кому они еще
+// не выплачены. Повторный запуск в тот же день ничего не начисляет и не выплачивает повторно. Возвращает
+// количество начислений и выплат
+func (a *API) AccrueInterest(ctx context.Context) (accrued, paid int, err error) {
+	if a.Interest == nil {
+		return 0, 0, nil
+	}
+
+	now := time.Now()
+	accrued, err = store.AccrueInterest(ctx, a.Interest.Sess, now, a.Interest.BasisPoints, a.Interest.Threshold)
+	if err != nil {
+		return accrued, 0, err
+	}
+	// пополнения проверяют максимальный баланс по кешу экземпляра: с общим кешем проценты копятся до его отключения
+	if a.Shared != nil {
+		return accrued, 0, nil
+	}
+
+	month := store.MonthStart(now).AddDate(0, -1, 0)
+	after := 0
+	for {
+		ids, err := store.InterestPayoutUsers(ctx, a.Interest.Sess, month, after, interestPayoutBatch)
+		if err != nil {
+			return accrued, paid, err
+		}
+
+		for _, id := range ids {
+			after = id
+			ok, err := a.payInterest(ctx, id, month)
+			if err != nil {
+				return accrued, paid, err
+			}
+			if ok {
+				paid++
+			}
+		}
+		if len(ids) < interestPayoutBatch {
+			return accrued, paid, nil
+		}
+	}
+}
+
+// payInterest - выплачивает пользователю id проценты за месяц month. Если пополнение не прошло по бизнес-причине
+// (блокировка, максимальный баланс), выплата за месяц сохраняется пустой и проценты переходят на следующий месяц.
+// false - выплачивать было нечего или выплату уже сделал другой экземпляр
+func (a *API) payInterest(ctx context.Context, id int, month time.Time) (bool, error) {
+	user, err := a.Cache.LoadUser(id, func(id int) (*store.User, error) {
+		return a.Store.LoadUser(ctx, id)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	reason := ""
+	switch {
+	case user == nil:
+		reason = "user not found"
+	case a.Denylist.User(id):
+		reason = "user is denied"
+	}
+	if reason == "" {
+		payout, err := store.PayInterest(ctx, a.Interest.Sess, user, month, store.CreditOptions{
+			MaxBalance: a.MaxBalance,
+			Mark: func(u *store.User) {
+				a.Responses.Invalidate(u.ID)
+			},
+		})
+		if errors.Is(err, store.ErrInterestPaid) {
+			return false, nil
+		}
+		if err == nil {
+			if payout.Amount > 0 {
+				a.settlePendingDebits(user)
+			}
+			return payout.Amount > 0, nil
+		}
+		if debitErrorStatus(err) == 0 {
+			return false, err
+		}
+		reason = err.Error()
+	}
+
+	log.Printf("interest of user %d for %s is carried over to the next month: %s", id, month.Format("2006-01"), reason)
+	if err := store.SkipInterestPayout(ctx, a.Interest.Sess, id, month); err != nil && !errors.Is(err, store.ErrInterestPaid) {
+		return false, err
+	}
+	return false, nil
+}
+
+// RunInterest - раз в interval начисляет проценты за текущий день и выплачивает за прошлый месяц, пока не отменен ctx.
+// Начисление за день одно, сколько бы раз за день ни запускалась задача
+func (a *API) RunInterest(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			accrued, paid, err := a.AccrueInterest(ctx)
+			if err != nil {
+				log.Printf("failed to accrue interest: %v", err)
+			}
+			if accrued > 0 || paid > 0 {
+				log.Printf("Accrued interest to %d users, paid interest to %d users", accrued, paid)
+			}
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/auth"
+)
+
+// statusRecorder - запоминает HTTP статус ответа
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush - для потоковых ответов (выгрузки)
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Middleware - оборачивает обработчик общими для всех роутов проверками и метриками
+func (a *API) Middleware(next http.Handler) http.Handler {
+	return a.instrument(a.shedLoad(a.limitIP(a.supportAuth(a.authenticate(a.deny(a.authorize(next)))))))
+}
+
+// instrument - сбор метрик запросов и лог запросов в режиме Verbose
+func (a *API) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (a.SLO == nil || isServiceRoute(r.URL.Path)) && !a.Verbose {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+
+		if a.Verbose {
+			log.Printf("%s %s %d %s", r.Method, r.URL.Path, rec.status, elapsed)
+		}
+		if a.SLO != nil && !isServiceRoute(r.URL.Path) {
+			a.SLO.Record(rec.status, elapsed)
+		}
+	})
+}
+
+// isServiceRoute - служебные роуты не учитываются в SLO
+func isServiceRoute(path string) bool {
+	return strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/debug/") || path == "/healthz" || path == "/readyz"
+}
+
+// supportAuth - ограничивает запросы с временным токеном поддержки его правами и пишет их в аудит
+func (a *API) supportAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if a.SupportTokens == nil || !strings.HasPrefix(token, auth.SupportTokenPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, err := a.SupportTokens.Verify(token)
+		if err != nil {
+			sendError(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		event := audit.Event{
+			Actor:  "support:" + claims.Agent,
+			Action: r.Method + " " + r.URL.Path,
+			Target: fmt.Sprintf("user:%d", claims.UserID),
+		}
+
+		if !supportAllowed(claims, r) {
+			event.Result = "denied"
+			a.Audit.Record(event)
+			sendError(w, errors.New("token scope does not allow this request"), http.StatusForbidden)
+			return
+		}
+
+		event.Result = "allowed"
+		a.Audit.Record(event)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// supportAllowed - токен поддержки дает только чтение своего пользователя
+func supportAllowed(claims *auth.SupportClaims, r *http.Request) bool {
+	return claims.Scope == auth.ScopeRead &&
+		r.Method == http.MethodGet &&
+		r.URL.Path == fmt.Sprintf("/user/%d", claims.UserID)
+}
+
+// Caller - вызывающий, прошедший проверку ключом API или JWT
+type Caller struct {
+	// ID - "key:<имя ключа>" или "jwt:<subject>", попадает в журнал аудита
+	ID string
+	// Scopes - права ключа или токена, см. auth.ScopeService и auth.ScopeAdmin
+	Scopes []string
+}
+
+// HasScope - у вызывающего есть право scope, auth.ScopeAdmin включает остальные
+func (c *Caller) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope || s == auth.ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// callerKey - ключ контекста запроса с Caller
+type callerKey struct{}
+
+// authenticate - проверяет ключ API из заголовка auth.APIKeyHeader или JWT из Authorization: Bearer и кладет
+// вызывающего в контекст запроса, см. callerID. Если включен хотя бы один способ, запросы, которым нужно право
+// (см. requiredScope), без них отклоняются, остальные читающие проходят. Токены поддержки проверяет supportAuth
+func (a *API) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.APIKeys == nil && a.Tokens == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var caller *Caller
+		if key := r.Header.Get(auth.APIKeyHeader); key != "" && a.APIKeys != nil {
+			identity, ok := a.APIKeys.Verify(key)
+			if !ok {
+				sendError(w, errors.New("invalid api key"), http.StatusUnauthorized)
+				return
+			}
+			caller = &Caller{ID: "key:" + identity.Subject, Scopes: identity.Scopes}
+		} else if token := bearerToken(r); token != "" && a.Tokens != nil && !strings.HasPrefix(token, auth.SupportTokenPrefix) {
+			identity, err := a.Tokens.Verify(r.Context(), token)
+			if err != nil {
+				sendError(w, err, http.StatusUnauthorized)
+				return
+			}
+			caller = &Caller{ID: "jwt:" + identity.Subject, Scopes: identity.Scopes}
+		}
+
+		if caller == nil {
+			if requiredScope(r) == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			sendError(w, errors.New("api key or bearer token is required"), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, caller)))
+	})
+}
+
+// authorize - роли вызывающих: /admin/* и отмены операций только с правом auth.ScopeAdmin, списания, пополнения
+// и остальные изменяющие запросы - с auth.ScopeService.
+// Работает, только если включены ключи API или JWT
+func (a *API) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.APIKeys == nil && a.Tokens == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scope := requiredScope(r)
+		if scope == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		caller := callerFrom(r)
+		if caller == nil {
+			sendError(w, errors.New("api key or bearer token is required"), http.StatusUnauthorized)
+			return
+		}
+		if !caller.HasScope(scope) {
+			a.Audit.Record(audit.Event{
+				Actor:  caller.ID,
+				Action: r.Method + " " + r.URL.Path,
+				Result: "denied: " + scope + " scope required",
+			})
+			sendError(w, fmt.Errorf("%s scope is required", scope), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// moneyRoutes - роуты, которые двигают деньги: право auth.ScopeService нужно при любом методе, чтобы списание
+// не прошло без ключа как читающий запрос
+var moneyRoutes = map[string]bool{"/user/balance": true, "/user/credit": true, "/user/bonus": true}
+
+// requiredScope - право, без которого запрос не выполняется, пусто - запрос доступен всем
+func requiredScope(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/admin/"),
+		strings.HasPrefix(r.URL.Path, "/transactions/") && strings.HasSuffix(r.URL.Path, "/reverse"):
+		return auth.ScopeAdmin
+	case moneyRoutes[r.URL.Path], !isReadOnly(r.Method):
+		return auth.ScopeService
+	}
+	return ""
+}
+
+// isReadOnly - метод не меняет состояние
+func isReadOnly(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// bearerToken - токен из заголовка Authorization: Bearer <token>
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
+
+// callerFrom - вызывающий, проверенный authenticate, nil - запрос без ключа и токена
+func callerFrom(r *http.Request) *Caller {
+	caller, _ := r.Context().Value(callerKey{}).(*Caller)
+	return caller
+}
+
+// callerID - идентификатор вызывающего для аудита: authenticatedID, без него - адрес
+func callerID(r *http.Request) string {
+	if id := authenticatedID(r); id != "" {
+		return id
+	}
+	return r.RemoteAddr
+}
+
+// authenticatedID - проверенный идентификатор вызывающего: ключ API или subject токена, без них - сертификат
+// клиента (mTLS). Пусто - вызывающий не прошел проверку
+func authenticatedID(r *http.Request) string {
+	if caller := callerFrom(r); caller != nil {
+		return caller.ID
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return "cert:" + r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	return ""
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+//// ВХОДНЫЕ ПАРАМЕТРЫ РОУТА /////
+
+type BalanceParams struct {
+	UserID int `json:"user_id"`
+	Amount int `json:"amount"`
+	// Tag - необязательный тег операции для биллинга
+	Tag string `json:"tag"`
+	// Category, Tags - необязательные категория в формате тега и произвольные теги для отчетов и фильтров
+	Category string     `json:"category"`
+	Tags     store.Tags `json:"tags"`
+	// Strict - списать в транзакции БД в обход кеша, как в режиме PersistStrict
+	Strict bool `json:"strict"`
+	// InsufficientFunds - политика при нехватке средств (store.FundsReject, FundsPartial, FundsQueue),
+	// пусто - политика пользователя из метаданных
+	InsufficientFunds string `json:"insufficient_funds"`
+	// Pocket - карман, из которого идет списание, пусто - основной (store.PocketMain)
+	Pocket string `json:"pocket"`
+	// Merchant - необязательный продавец для правил кешбэка, в том же формате, что и тег
+	Merchant string `json:"merchant"`
+}
+
+func (bp *BalanceParams) Validate() error {
+	if bp.UserID < 1 {
+		return errors.New("invalid user id")
+	}
+
+	if bp.Amount < 1 {
+		return errors.New("invalid amount")
+	}
+
+	if bp.InsufficientFunds != "" && !store.ValidFundsPolicy(bp.InsufficientFunds) {
+		return errors.New("invalid insufficient_funds policy")
+	}
+
+	if bp.Pocket != "" {
+		if err := store.ValidatePocket(bp.Pocket); err != nil {
+			return err
+		}
+		if pocketDebit(*bp) && bp.InsufficientFunds != "" && bp.InsufficientFunds != store.FundsReject {
+			return errors.New("insufficient_funds policies are not supported with pockets")
+		}
+	}
+
+	if store.ValidateTag(bp.Merchant) != nil {
+		return errors.New("invalid merchant")
+	}
+
+	if err := store.ValidateCategory(bp.Category); err != nil {
+		return err
+	}
+	if err := store.ValidateTags(bp.Tags); err != nil {
+		return err
+	}
+
+	return store.ValidateTag(bp.Tag)
+}
+
+// parseBalanceForm - читает параметры из query и application/x-www-form-urlencoded тела
+func parseBalanceForm(form url.Values) (BalanceParams, error) {
+	var params BalanceParams
+	var err error
+
+	if params.UserID, err = strconv.Atoi(form.Get("user_id")); err != nil {
+		return params, errors.New("invalid user id")
+	}
+
+	if params.Amount, err = strconv.Atoi(form.Get("amount")); err != nil {
+		return params, errors.New("invalid amount")
+	}
+
+	params.Tag = form.Get("tag")
+	params.Category = form.Get("category")
+	params.Tags = form["tags"]
+	params.InsufficientFunds = form.Get("insufficient_funds")
+	params.Pocket = form.Get("pocket")
+	params.Merchant = form.Get("merchant")
+
+	return params, nil
+}
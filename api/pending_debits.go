@@ -0,0 +1,154 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/store"
+)
+
+// PendingDebits - очередь остатков списаний с политикой store.FundsQueue в таблице pending_debits,
+// они списываются при поступлении средств. nil - политика FundsQueue недоступна
+type PendingDebits struct {
+	Sess *dbr.Session
+}
+
+// checkFundsPolicy - политику из запроса можно применить: частичные списания идут только через кеш экземпляра
+func (a *API) checkFundsPolicy(params BalanceParams) error {
+	if params.InsufficientFunds == "" || params.InsufficientFunds == store.FundsReject {
+		return nil
+	}
+	if params.Strict || a.persistenceMode() == PersistStrict || a.Shared != nil {
+		return errors.New("insufficient funds policies are not supported in strict mode or with a shared cache backend")
+	}
+	if params.InsufficientFunds == store.FundsQueue && a.PendingDebits == nil {
+		return errors.New("pending debits are disabled")
+	}
+	return nil
+}
+
+// fundsPolicy - политика при нехватке средств для списания: из запроса, иначе из метаданных пользователя.
+// Политика пользователя, которую здесь не применить (в том числе к списанию из кармана), считается store.FundsReject
+func (a *API) fundsPolicy(params BalanceParams, user *store.User) string {
+	if params.InsufficientFunds != "" {
+		return params.InsufficientFunds
+	}
+	if a.Shared != nil || pocketDebit(params) {
+		return store.FundsReject
+	}
+
+	policy := user.State().Metadata.String(store.FundsPolicyKey)
+	if !store.ValidFundsPolicy(policy) || policy == store.FundsQueue && a.PendingDebits == nil {
+		return store.FundsReject
+	}
+	return policy
+}
+
+// queueRemainder - ставит в очередь amount, не списанные по params. Списание к этому моменту уже прошло,
+// поэтому ошибка не отдается клиенту, а попадает в лог и журнал аудита
+func (a *API) queueRemainder(params BalanceParams, amount int) *store.PendingDebit {
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	d := store.PendingDebit{
+		ID:        store.NewTransactionID(),
+		UserID:    params.UserID,
+		Amount:    amount,
+		Tag:       params.Tag,
+		Category:  params.Category,
+		Tags:      params.Tags,
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+	if err := store.CreatePendingDebit(ctx, a.PendingDebits.Sess, d); err != nil {
+		log.Printf("failed to queue %d of debit for user %d: %v", amount, params.UserID, err)
+		a.Audit.Record(audit.Event{
+			Actor:  "pending_debits",
+			Action: "debit.queue",
+			Target: fmt.Sprintf("user:%d", params.UserID),
+			Result: "failed: " + err.Error(),
+			Fields: map[string]interface{}{"amount": amount, "tag": params.Tag},
+		})
+		return nil
+	}
+	return &d
+}
+
+// settlePendingDebits - списывает ожидающие остатки user, старые первыми, пока хватает средств.
+// Вызывается после поступления средств. Остаток, который снова списан не целиком, возвращается в очередь
+func (a *API) settlePendingDebits(user *store.User) {
+	if a.PendingDebits == nil {
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	debits, err := store.LoadPendingDebits(ctx, a.PendingDebits.Sess, user.ID)
+	if err != nil {
+		log.Printf("failed to load pending debits of user %d: %v", user.ID, err)
+		return
+	}
+
+	mode := a.persistenceMode()
+	if mode == PersistStrict {
+		mode = PersistSync
+	}
+	for _, d := range debits {
+		claimed, err := store.ClaimPendingDebit(ctx, a.PendingDebits.Sess, d.ID)
+		if err != nil {
+			log.Printf("failed to claim pending debit %s: %v", d.ID, err)
+			return
+		}
+		if !claimed {
+			continue
+		}
+
+		params := BalanceParams{UserID: user.ID, Amount: d.Amount, Tag: d.Tag, Category: d.Category, Tags: d.Tags}
+		opts := a.debitOptions(ctx, user, params, mode)
+		opts.Partial = true
+		tx, err := user.ApplyDebit(d.Amount, opts)
+		if err == nil {
+			a.recordDebit(tx, params)
+			d.Amount += tx.Amount
+		}
+		if d.Amount == 0 {
+			continue
+		}
+
+		// средства кончились или списание не прошло: остаток ждет следующего поступления
+		if err := store.CreatePendingDebit(ctx, a.PendingDebits.Sess, d); err != nil {
+			log.Printf("failed to requeue %d of pending debit %s for user %d: %v", d.Amount, d.ID, user.ID, err)
+		}
+		return
+	}
+}
+
+// userPendingDebits - GET /user/{id}/pending-debits: остатки списаний в очереди
+func (a *API) userPendingDebits(w http.ResponseWriter, r *http.Request, id int) {
+	if a.PendingDebits == nil {
+		sendError(w, errors.New("pending debits are disabled"), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	debits, err := store.LoadPendingDebits(ctx, a.PendingDebits.Sess, id)
+	if err != nil {
+		sendStorageError(w, err, "failed to load pending debits")
+		return
+	}
+	if debits == nil {
+		debits = []store.PendingDebit{}
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"pending_debits": debits,
+	})
+}
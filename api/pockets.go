@@ -0,0 +1,156 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// Pockets - именованные карманы пользователей в таблице pockets, nil - доступен только основной карман
+type Pockets struct {
+	Sess *dbr.Session
+}
+
+// PocketTransferParams - параметры перевода между карманами
+type PocketTransferParams struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount int    `json:"amount"`
+}
+
+func (pp *PocketTransferParams) Validate() error {
+	if pp.Amount < 1 {
+		return errors.New("invalid amount")
+	}
+	if err := store.ValidatePocket(pp.From); err != nil {
+		return err
+	}
+	if err := store.ValidatePocket(pp.To); err != nil {
+		return err
+	}
+	if pp.From == pp.To {
+		return store.ErrSamePocket
+	}
+	return nil
+}
+
+// pocketDebit - списание идет из именованного кармана
+func pocketDebit(params BalanceParams) bool {
+	return params.Pocket != "" && params.Pocket != store.PocketMain
+}
+
+// checkPockets - операции с именованными карманами можно выполнить: они сохраняются синхронно через кеш экземпляра
+func (a *API) checkPockets(strict bool) error {
+	if a.Pockets == nil {
+		return errors.New("pockets are disabled")
+	}
+	if strict || a.persistenceMode() == PersistStrict || a.Shared != nil {
+		return errors.New("pockets are not supported in strict mode or with a shared cache backend")
+	}
+	return nil
+}
+
+// userPockets - GET /user/{id}/pockets: основной карман и именованные
+func (a *API) userPockets(w http.ResponseWriter, r *http.Request, id int) {
+	if a.Pockets == nil {
+		sendError(w, errors.New("pockets are disabled"), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	user, err := a.Cache.LoadUser(id, func(id int) (*store.User, error) {
+		return a.Store.LoadUser(ctx, id)
+	})
+	if err != nil {
+		sendStorageError(w, err, "failed to load user")
+		return
+	}
+	if user == nil {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	named, err := store.LoadPockets(ctx, a.Pockets.Sess, id)
+	if err != nil {
+		sendStorageError(w, err, "failed to load pockets")
+		return
+	}
+	state := user.State()
+	pockets := append([]store.Pocket{{Name: store.PocketMain, Balance: int64(state.Balance) - state.Pocketed}}, named...)
+
+	sendJSON(w, map[string]interface{}{
+		"pockets": pockets,
+	})
+}
+
+// transferPocket - POST /user/{id}/pockets/transfer {"from": "main", "to": "savings", "amount": 100}: перевод
+// между карманами, баланс не меняется
+func (a *API) transferPocket(w http.ResponseWriter, r *http.Request, id int) {
+	if err := a.checkPockets(false); err != nil {
+		sendError(w, err, http.StatusNotImplemented)
+		return
+	}
+
+	var params PocketTransferParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := params.Validate(); err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	if a.Denylist.User(id) {
+		sendDenied(w)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	user, err := a.Cache.LoadUser(id, func(id int) (*store.User, error) {
+		return a.Store.LoadUser(ctx, id)
+	})
+	if err != nil {
+		sendStorageError(w, err, "failed to load user")
+		return
+	}
+	if user == nil {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	// перевод всегда сохраняется до ответа: именованный карман проверяется по БД
+	txs, err := user.TransferPocket(params.From, params.To, params.Amount, store.CreditOptions{
+		Save: func(p store.Pending) error {
+			ctx, cancel := a.writeContext()
+			defer cancel()
+			return a.Store.SavePending(ctx, user.ID, p)
+		},
+		Mark: func(u *store.User) {
+			a.Responses.Invalidate(u.ID)
+		},
+	})
+	if status := debitErrorStatus(err); status != 0 {
+		sendError(w, err, status)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to save pocket transfer")
+		return
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"success":         true,
+		"transaction_ids": []string{txs[0].ID, txs[1].ID},
+		"from":            params.From,
+		"to":              params.To,
+		"amount":          params.Amount,
+	})
+}
@@ -0,0 +1,233 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/store"
+)
+
+// PromoCodes - промокоды на пополнение в таблице promo_codes, nil - отключены
+type PromoCodes struct {
+	Sess *dbr.Session
+}
+
+// PromoCodeParams - новый промокод в POST /admin/promo-codes, valid_from по умолчанию - сейчас
+type PromoCodeParams struct {
+	Code       string     `json:"code"`
+	Amount     int        `json:"amount"`
+	Tag        string     `json:"tag"`
+	MaxUses    int        `json:"max_uses"`
+	ValidFrom  *time.Time `json:"valid_from"`
+	ValidUntil *time.Time `json:"valid_until"`
+}
+
+// promoErrorStatus - HTTP статус ошибки погашения промокода, 0 - не ошибка промокода
+func promoErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, store.ErrPromoNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, store.ErrPromoInactive), errors.Is(err, store.ErrPromoExhausted):
+		return http.StatusGone
+	case errors.Is(err, store.ErrPromoRedeemed), errors.Is(err, store.ErrPromoExists):
+		return http.StatusConflict
+	}
+	return 0
+}
+
+// redeemPromoCode - POST /user/{id}/redeem {"code": "WELCOME"}: пополнение на сумму промокода и погашение одного
+// его использования одной транзакцией БД
+func (a *API) redeemPromoCode(w http.ResponseWriter, r *http.Request, id int) {
+	if a.PromoCodes == nil {
+		sendError(w, errors.New("promo codes are disabled"), http.StatusNotFound)
+		return
+	}
+
+	var params struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	code := store.NormalizePromoCode(params.Code)
+	if code == "" {
+		sendError(w, errors.New("invalid code"), http.StatusUnprocessableEntity)
+		return
+	}
+	if a.Denylist.User(id) {
+		sendDenied(w)
+		return
+	}
+	// максимальный баланс проверяется по кешу экземпляра, как у пополнений
+	if a.Shared != nil {
+		sendError(w, errors.New("credits are not supported with a shared cache backend"), http.StatusNotImplemented)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	user, err := a.Cache.LoadUser(id, func(id int) (*store.User, error) {
+		return a.Store.LoadUser(ctx, id)
+	})
+	if err != nil {
+		sendStorageError(w, err, "failed to load user")
+		return
+	}
+	if user == nil {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	wctx, wcancel := a.writeContext()
+	defer wcancel()
+
+	// погашение всегда сохраняется до ответа, в любом режиме записи
+	tx, promo, err := store.RedeemPromoCode(wctx, a.PromoCodes.Sess, user, code, store.CreditOptions{
+		MaxBalance: a.MaxBalance,
+		Mark: func(u *store.User) {
+			a.Responses.Invalidate(u.ID)
+		},
+	})
+	if status := promoErrorStatus(err); status != 0 {
+		sendError(w, err, status)
+		return
+	}
+	if status := debitErrorStatus(err); status != 0 {
+		sendError(w, err, status)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to redeem promo code")
+		return
+	}
+	go a.settlePendingDebits(user)
+
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "promo.redeem",
+		Target: fmt.Sprintf("user:%d", id),
+		Result: "redeemed",
+		Fields: map[string]interface{}{
+			"code":   promo.Code,
+			"amount": tx.Amount,
+		},
+	})
+
+	sendJSON(w, map[string]interface{}{
+		"success":        true,
+		"transaction_id": tx.ID,
+		"credited":       tx.Amount,
+		"code":           promo.Code,
+	})
+}
+
+// AdminPromoCodesHandler - GET /admin/promo-codes: все промокоды, POST /admin/promo-codes: новый промокод,
+// DELETE /admin/promo-codes/{code}: удаление промокода
+func (a *API) AdminPromoCodesHandler(w http.ResponseWriter, r *http.Request) {
+	if a.PromoCodes == nil {
+		sendError(w, errors.New("promo codes are disabled"), http.StatusNotFound)
+		return
+	}
+
+	code := store.NormalizePromoCode(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/promo-codes"), "/"))
+	switch {
+	case code == "" && r.Method == http.MethodGet:
+		ctx, cancel := a.queryContext(r)
+		defer cancel()
+
+		codes, err := store.ListPromoCodes(ctx, a.PromoCodes.Sess)
+		if err != nil {
+			sendStorageError(w, err, "failed to load promo codes")
+			return
+		}
+		if codes == nil {
+			codes = []store.PromoCode{}
+		}
+		sendJSON(w, map[string]interface{}{"promo_codes": codes})
+	case code == "" && r.Method == http.MethodPost:
+		a.createPromoCode(w, r)
+	case code != "" && r.Method == http.MethodDelete:
+		ctx, cancel := a.writeContext()
+		defer cancel()
+
+		if err := store.DeletePromoCode(ctx, a.PromoCodes.Sess, code); err != nil {
+			if status := promoErrorStatus(err); status != 0 {
+				sendError(w, err, status)
+				return
+			}
+			sendStorageError(w, err, "failed to delete promo code")
+			return
+		}
+
+		a.Audit.Record(audit.Event{
+			Actor:  callerID(r),
+			Action: "promo.delete",
+			Target: "promo:" + code,
+			Result: "deleted",
+		})
+		sendSuccess(w)
+	default:
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+	}
+}
+
+// createPromoCode - POST /admin/promo-codes {"code": "WELCOME", "amount": 500, "max_uses": 1000, "valid_until": "..."}
+func (a *API) createPromoCode(w http.ResponseWriter, r *http.Request) {
+	var params PromoCodeParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	promo := store.PromoCode{
+		Code:       store.NormalizePromoCode(params.Code),
+		Amount:     params.Amount,
+		Tag:        params.Tag,
+		MaxUses:    params.MaxUses,
+		ValidFrom:  now,
+		ValidUntil: params.ValidUntil,
+		CreatedAt:  now,
+	}
+	if params.ValidFrom != nil {
+		promo.ValidFrom = params.ValidFrom.UTC()
+	}
+	if err := promo.Validate(); err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	if err := store.CreatePromoCode(ctx, a.PromoCodes.Sess, promo); err != nil {
+		if status := promoErrorStatus(err); status != 0 {
+			sendError(w, err, status)
+			return
+		}
+		sendStorageError(w, err, "failed to save promo code")
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "promo.create",
+		Target: "promo:" + promo.Code,
+		Result: "created",
+		Fields: map[string]interface{}{
+			"amount":   promo.Amount,
+			"max_uses": promo.MaxUses,
+		},
+	})
+
+	sendJSON(w, promo)
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter - token bucket на каждый ключ (пользователь, адрес): ведро на Burst запросов пополняется
+// со скоростью Rate в секунду. Полные ведра удаляет Run. nil - ограничение отключено
+type RateLimiter struct {
+	Rate  float64
+	Burst int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// bucket - остаток запросов на момент last
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{Rate: rate, Burst: burst, buckets: make(map[string]*bucket)}
+}
+
+// Allow - забирает запрос из ведра key. false - ведро пусто, запрос можно повторить через retryAfter
+func (l *RateLimiter) Allow(key string) (ok bool, retryAfter time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+// Run - раз в interval удаляет ведра, которые успели наполниться, пока не отменен ctx
+func (l *RateLimiter) Run(ctx context.Context, interval time.Duration) {
+	if l == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// за это время пустое ведро наполняется целиком
+	full := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			for key, b := range l.buckets {
+				if now.Sub(b.last) >= full {
+					delete(l.buckets, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// Len - количество ведер
+func (l *RateLimiter) Len() int {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// sendRateLimited - 429 с Retry-After в целых секундах
+func sendRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	sendError(w, errors.New("rate limit exceeded"), http.StatusTooManyRequests)
+}
+
+// allowUser - ограничение запросов к пользователю id, при превышении отвечает 429
+func (a *API) allowUser(w http.ResponseWriter, id int) bool {
+	ok, retryAfter := a.UserLimit.Allow(strconv.Itoa(id))
+	if !ok {
+		sendRateLimited(w, retryAfter)
+	}
+	return ok
+}
+
+// limitIP - ограничение запросов с одного адреса, служебные роуты не ограничиваются
+func (a *API) limitIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.IPLimit == nil || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if ok, retryAfter := a.IPLimit.Allow(a.clientIP(r)); !ok {
+			sendRateLimited(w, retryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP - адрес клиента: за прокси с TrustForwardedFor - первый адрес X-Forwarded-For
+func (a *API) clientIP(r *http.Request) string {
+	if a.TrustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
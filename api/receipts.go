@@ -0,0 +1,75 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Skat712/test_balance/receipt"
+	"github.com/Skat712/test_balance/store"
+)
+
+// TransactionsHandler - GET /transactions/{id}/receipt: квитанция, GET и POST /transactions/{id}/dispute,
+// POST /transactions/{id}/dispute/resolve: спор по операции, POST /transactions/{id}/reverse: отмена операции
+func (a *API) TransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, route, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/transactions/"), "/")
+	method := http.MethodGet
+	if route == "dispute/resolve" || route == "reverse" || route == "dispute" && r.Method == http.MethodPost {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	if id == "" {
+		sendError(w, errors.New("not found"), http.StatusNotFound)
+		return
+	}
+
+	switch route {
+	case "receipt":
+		a.transactionReceipt(w, r, id)
+	case "dispute":
+		a.transactionDispute(w, r, id)
+	case "dispute/resolve":
+		a.resolveDispute(w, r, id)
+	case "reverse":
+		a.reverseTransaction(w, r, id)
+	default:
+		sendError(w, errors.New("not found"), http.StatusNotFound)
+	}
+}
+
+// transactionReceipt - GET /transactions/{id}/receipt: подписанная квитанция об операции.
+// PDF отдается при ?format=pdf или Accept: application/pdf, иначе JSON
+func (a *API) transactionReceipt(w http.ResponseWriter, r *http.Request, id string) {
+	if a.Receipts == nil {
+		sendError(w, errors.New("receipts disabled"), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	// в режиме PersistAsync запись леджера появляется в БД после фонового сохранения
+	tx, err := a.Store.LoadTransaction(ctx, id)
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("transaction not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to load transaction")
+		return
+	}
+
+	rcpt := a.Receipts.Issue(tx)
+	if r.URL.Query().Get("format") == "pdf" || strings.Contains(r.Header.Get("Accept"), "application/pdf") {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", `inline; filename="receipt-`+tx.ID+`.pdf"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write(receipt.PDF(rcpt))
+		return
+	}
+
+	sendJSON(w, rcpt)
+}
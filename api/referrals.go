@@ -0,0 +1,180 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/store"
+)
+
+// Referrals - приглашения в таблице referrals и выплаты за них: ReferrerAmount пригласившему и RefereeAmount
+// приглашенному, 0 - стороне не платится. nil - приглашения отключены
+type Referrals struct {
+	Sess           *dbr.Session
+	ReferrerAmount int
+	RefereeAmount  int
+}
+
+// amount - выплата стороне side
+func (q *Referrals) amount(side string) int {
+	if side == store.ReferralReferrer {
+		return q.ReferrerAmount
+	}
+	return q.RefereeAmount
+}
+
+// referralErrorStatus - HTTP статус ошибки регистрации приглашения, 0 - не ошибка приглашения
+func referralErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, store.ErrSelfReferral):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, store.ErrReferralExists):
+		return http.StatusConflict
+	}
+	return 0
+}
+
+// registerReferral - POST /user/{id}/referral {"referrer_id": 7}: приглашение пользователя id пользователем
+// referrer_id и выплаты обоим. Повтор запроса доплачивает только то, что не было выплачено
+func (a *API) registerReferral(w http.ResponseWriter, r *http.Request, id int) {
+	if a.Referrals == nil {
+		sendError(w, errors.New("referrals are disabled"), http.StatusNotFound)
+		return
+	}
+
+	var params struct {
+		ReferrerID int `json:"referrer_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	if params.ReferrerID < 1 {
+		sendError(w, errors.New("invalid referrer id"), http.StatusUnprocessableEntity)
+		return
+	}
+	if a.Denylist.User(id) || a.Denylist.User(params.ReferrerID) {
+		sendDenied(w)
+		return
+	}
+	// максимальный баланс проверяется по кешу экземпляра, как у пополнений
+	if a.Shared != nil {
+		sendError(w, errors.New("credits are not supported with a shared cache backend"), http.StatusNotImplemented)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	users := make(map[string]*store.User, 2)
+	for _, side := range []string{store.ReferralReferee, store.ReferralReferrer} {
+		userID := id
+		if side == store.ReferralReferrer {
+			userID = params.ReferrerID
+		}
+		user, err := a.Cache.LoadUser(userID, func(id int) (*store.User, error) {
+			return a.Store.LoadUser(ctx, id)
+		})
+		if err != nil {
+			sendStorageError(w, err, "failed to load user")
+			return
+		}
+		if user == nil {
+			sendError(w, fmt.Errorf("%s not found", side), http.StatusNotFound)
+			return
+		}
+		users[side] = user
+	}
+
+	wctx, wcancel := a.writeContext()
+	defer wcancel()
+
+	referral, err := store.RegisterReferral(wctx, a.Referrals.Sess, params.ReferrerID, id)
+	if status := referralErrorStatus(err); status != 0 {
+		sendError(w, err, status)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to save referral")
+		return
+	}
+
+	// выплаты всегда сохраняются до ответа; не прошедшую выплату доплатит повтор запроса
+	credited := make(map[string]int, 2)
+	for _, side := range []string{store.ReferralReferee, store.ReferralReferrer} {
+		amount := a.Referrals.amount(side)
+		if amount <= 0 {
+			continue
+		}
+		user := users[side]
+		tx, err := store.PayReferral(wctx, a.Referrals.Sess, user, referral, side, amount, store.CreditOptions{
+			MaxBalance: a.MaxBalance,
+			Mark: func(u *store.User) {
+				a.Responses.Invalidate(u.ID)
+			},
+		})
+		if status := debitErrorStatus(err); status != 0 {
+			sendError(w, fmt.Errorf("%s: %w", side, err), status)
+			return
+		}
+		if err != nil {
+			sendStorageError(w, err, "failed to credit referral")
+			return
+		}
+		if side == store.ReferralReferrer {
+			referral.ReferrerTransactionID = tx.ID
+		} else {
+			referral.RefereeTransactionID = tx.ID
+		}
+		credited[side] = tx.Amount
+		if tx.Amount > 0 {
+			go a.settlePendingDebits(user)
+		}
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "referral.register",
+		Target: fmt.Sprintf("user:%d", id),
+		Result: "registered",
+		Fields: map[string]interface{}{
+			"referrer_id": params.ReferrerID,
+			"credited":    credited,
+		},
+	})
+
+	sendJSON(w, map[string]interface{}{
+		"success":  true,
+		"referral": referral,
+		"credited": credited,
+	})
+}
+
+// userReferrals - GET /user/{id}/referrals: приглашения, сделанные пользователем
+func (a *API) userReferrals(w http.ResponseWriter, r *http.Request, id int) {
+	if a.Referrals == nil {
+		sendError(w, errors.New("referrals are disabled"), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	referrals, err := store.LoadReferrals(ctx, a.Referrals.Sess, id)
+	if err != nil {
+		sendStorageError(w, err, "failed to load referrals")
+		return
+	}
+	if referrals == nil {
+		referrals = []store.Referral{}
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"referrals": referrals,
+	})
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Skat712/test_balance/denylist"
+	"github.com/Skat712/test_balance/fraud"
+	"github.com/Skat712/test_balance/store"
+)
+
+// sendError - отправляет сообщение об ошибке клиенту, с кодом, если он есть у ошибки (см. errorCode)
+func sendError(w http.ResponseWriter, err error, status int) {
+	body := map[string]string{
+		"error": err.Error(),
+	}
+	if code := errorCode(err); code != "" {
+		body["code"] = code
+	}
+	response, _ := json.Marshal(body)
+	//log.Println(err.Error())
+	w.WriteHeader(status)
+	w.Write(response)
+}
+
+// errorCode - машиночитаемый код ошибки для тех, которые клиенту нужно отличать от других с тем же статусом
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, store.ErrSpendLimitExceeded):
+		return "spend_limit_exceeded"
+	case errors.Is(err, store.ErrMaxBalance):
+		return "max_balance_exceeded"
+	case errors.Is(err, fraud.ErrRejected):
+		return "fraud_rejected"
+	case errors.Is(err, denylist.ErrDenied):
+		return "denied"
+	}
+	return ""
+}
+
+// sendStorageError - ошибка обращения к хранилищу: 503, если оно недоступно (см. store.CircuitBreaker), иначе 500 с message
+func sendStorageError(w http.ResponseWriter, err error, message string) {
+	if errors.Is(err, store.ErrUnavailable) {
+		sendError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	sendError(w, errors.New(message), http.StatusInternalServerError)
+}
+
+// sendSuccess - отправка успешного ответа клиенту
+func sendSuccess(w http.ResponseWriter) {
+	response, _ := json.Marshal(map[string]bool{
+		"success": true,
+	})
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// sendDebitSuccess - успешный ответ на списание с id транзакции и комиссией fee, если она есть. Если списано меньше
+// params.Amount (политика при нехватке средств) - еще и списанная сумма и остаток в очереди, а если не списано
+// ничего - 202
+func sendDebitSuccess(w http.ResponseWriter, params BalanceParams, tx store.Transaction, fee int, queued *store.PendingDebit) {
+	if tx.ID == "" && queued != nil {
+		response, _ := json.Marshal(map[string]interface{}{
+			"success":          false,
+			"status":           "queued",
+			"pending_debit_id": queued.ID,
+			"queued":           queued.Amount,
+		})
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(response)
+		return
+	}
+
+	response := map[string]interface{}{
+		"success":        true,
+		"transaction_id": tx.ID,
+	}
+	if debited := -tx.Amount; debited < params.Amount {
+		response["debited"] = debited
+	}
+	if fee != 0 {
+		response["fee"] = fee
+	}
+	if queued != nil {
+		response["pending_debit_id"] = queued.ID
+		response["queued"] = queued.Amount
+	}
+	sendJSON(w, response)
+}
+
+// sendJSON - отправка произвольного ответа клиенту
+func sendJSON(w http.ResponseWriter, data interface{}) {
+	response, _ := json.Marshal(data)
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
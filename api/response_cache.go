@@ -0,0 +1,110 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// ResponseCache - короткоживущий кеш ответов GET /user/{id}, чтобы частые опросы дашбордов
+// не брали блокировки пользователя. Изменение пользователя сразу инвалидирует его ответ.
+// nil - кеш отключен
+type ResponseCache struct {
+	TTL time.Duration
+	// MaxEntries - при превышении кеш очищается целиком, 0 - без ограничения
+	MaxEntries int
+
+	mu      sync.Mutex
+	epoch   uint64
+	entries map[int]*cachedResponse
+}
+
+// cachedResponse - ответ и поколение пользователя; Invalidate увеличивает поколение и убирает ответ
+type cachedResponse struct {
+	gen     uint64
+	body    interface{}
+	expires time.Time
+}
+
+// responseToken - поколение, при котором читалось состояние: ответ сохраняется, только если оно не изменилось
+type responseToken struct {
+	epoch, gen uint64
+}
+
+func NewResponseCache(ttl time.Duration, maxEntries int) *ResponseCache {
+	return &ResponseCache{
+		TTL:        ttl,
+		MaxEntries: maxEntries,
+		entries:    make(map[int]*cachedResponse),
+	}
+}
+
+// Get - закешированный ответ, либо токен для Put после чтения состояния
+func (c *ResponseCache) Get(userID int) (interface{}, responseToken, bool) {
+	if c == nil {
+		return nil, responseToken{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[userID]
+	if !ok {
+		if c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries {
+			c.entries = make(map[int]*cachedResponse)
+			c.epoch++
+		}
+		entry = &cachedResponse{}
+		c.entries[userID] = entry
+	}
+	if entry.body != nil && time.Now().Before(entry.expires) {
+		return entry.body, responseToken{}, true
+	}
+	return nil, responseToken{epoch: c.epoch, gen: entry.gen}, false
+}
+
+// Put - сохраняет ответ, если с момента Get пользователя не меняли
+func (c *ResponseCache) Put(userID int, token responseToken, body interface{}) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[userID]
+	if !ok || token.epoch != c.epoch || token.gen != entry.gen {
+		return
+	}
+	entry.body = body
+	entry.expires = time.Now().Add(c.TTL)
+}
+
+// Invalidate - сбрасывает ответы пользователей, вызывается после каждого изменения до ответа клиенту
+func (c *ResponseCache) Invalidate(userIDs ...int) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, id := range userIDs {
+		if entry, ok := c.entries[id]; ok {
+			entry.gen++
+			entry.body = nil
+		}
+	}
+}
+
+// Reset - сбрасывает все ответы
+func (c *ResponseCache) Reset() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[int]*cachedResponse)
+	c.epoch++
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/store"
+)
+
+// Reversals - отмены операций оператором в таблице reversals, nil - отключены
+type Reversals struct {
+	Sess *dbr.Session
+}
+
+// ReverseParams - отмена операции в POST /transactions/{id}/reverse
+type ReverseParams struct {
+	Reason string `json:"reason"`
+}
+
+// reverseTransaction - POST /transactions/{id}/reverse {"reason": "operator error"}: отменяет операцию компенсирующей
+// записью, 409 - уже отменена
+func (a *API) reverseTransaction(w http.ResponseWriter, r *http.Request, id string) {
+	if a.Reversals == nil {
+		sendError(w, errors.New("reversals are disabled"), http.StatusNotFound)
+		return
+	}
+	var params ReverseParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+	// отмена списания - пополнение, баланс меняется в кеше экземпляра
+	if a.Shared != nil {
+		sendError(w, errors.New("reversals are not supported with a shared cache backend"), http.StatusNotImplemented)
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	// в режиме PersistAsync запись леджера появляется в БД после фонового сохранения
+	original, err := a.Store.LoadTransaction(ctx, id)
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("transaction not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to load transaction")
+		return
+	}
+	if !store.Reversible(original.Operation) {
+		sendError(w, fmt.Errorf("%w: %s", store.ErrNotReversible, original.Operation), http.StatusUnprocessableEntity)
+		return
+	}
+	if _, err := store.LoadReversal(ctx, a.Reversals.Sess, id); err == nil {
+		sendError(w, store.ErrReversed, http.StatusConflict)
+		return
+	} else if !errors.Is(err, store.ErrNotFound) {
+		sendStorageError(w, err, "failed to load reversal")
+		return
+	}
+	// открытый или решенный reverse спор уже удерживает сумму пополнения
+	if a.Disputes != nil && original.Operation == store.OperationCredit {
+		d, err := store.LoadDispute(ctx, a.Disputes.Sess, id)
+		if err == nil && d.Status != store.DisputeUpheld {
+			sendError(w, errors.New("transaction is disputed, resolve the dispute instead"), http.StatusConflict)
+			return
+		}
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			sendStorageError(w, err, "failed to load dispute")
+			return
+		}
+	}
+	user, err := a.operationUser(ctx, original.UserID)
+	if err != nil {
+		sendStorageError(w, err, "failed to load user")
+		return
+	}
+	if user == nil {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	rev, err := store.ReverseTransaction(ctx, a.Reversals.Sess, user, original, params.Reason, callerID(r), func(u *store.User) {
+		a.Responses.Invalidate(u.ID)
+	})
+	switch {
+	case errors.Is(err, store.ErrNotReversible):
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, store.ErrReversed):
+		sendError(w, err, http.StatusConflict)
+		return
+	}
+	if status := debitErrorStatus(err); status != 0 {
+		sendError(w, err, status)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to reverse transaction")
+		return
+	}
+	if rev.Amount > 0 {
+		go a.settlePendingDebits(user)
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  rev.ReversedBy,
+		Action: "transaction.reverse",
+		Target: fmt.Sprintf("user:%d", rev.UserID),
+		Result: rev.ReversalTransactionID,
+		Fields: map[string]interface{}{
+			"transaction_id": rev.TransactionID,
+			"operation":      original.Operation,
+			"amount":         rev.Amount,
+			"reason":         rev.Reason,
+		},
+	})
+
+	sendJSON(w, rev)
+}
@@ -0,0 +1,372 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/store"
+)
+
+// scheduledOperationBatch - сколько отложенных операций выполняется за один запрос к БД
+const scheduledOperationBatch = 100
+
+// ScheduledOperations - отложенные списания, пополнения и переводы в таблице scheduled_operations, nil - отключены
+type ScheduledOperations struct {
+	Sess *dbr.Session
+}
+
+// ScheduledOperationParams - новая отложенная операция в POST /user/{id}/scheduled-operations
+type ScheduledOperationParams struct {
+	Kind      string     `json:"kind"`
+	Amount    int        `json:"amount"`
+	Tag       string     `json:"tag"`
+	ToUserID  int        `json:"to_user_id"`
+	ExecuteAt *time.Time `json:"execute_at"`
+}
+
+// userScheduledOperations - GET /user/{id}/scheduled-operations?status=pending&limit=100: отложенные операции,
+// в которых участвует пользователь, POST /user/{id}/scheduled-operations: новая
+func (a *API) userScheduledOperations(w http.ResponseWriter, r *http.Request, id int) {
+	if a.ScheduledOperations == nil {
+		sendError(w, errors.New("scheduled operations are disabled"), http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		a.createScheduledOperation(w, r, id)
+		return
+	}
+
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 1000 {
+			sendError(w, errors.New("limit must be from 1 to 1000"), http.StatusUnprocessableEntity)
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	ops, err := store.LoadScheduledOperations(ctx, a.ScheduledOperations.Sess, id, r.URL.Query().Get("status"), limit)
+	if err != nil {
+		sendStorageError(w, err, "failed to load scheduled operations")
+		return
+	}
+	if ops == nil {
+		ops = []store.ScheduledOperation{}
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"scheduled_operations": ops,
+	})
+}
+
+// createScheduledOperation - POST /user/{id}/scheduled-operations {"kind": "transfer", "amount": 100, "to_user_id": 2,
+// "execute_at": "..."}: операция, которая выполнится в execute_at
+func (a *API) createScheduledOperation(w http.ResponseWriter, r *http.Request, id int) {
+	var params ScheduledOperationParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	op := store.ScheduledOperation{
+		ID:        store.NewTransactionID(),
+		Kind:      params.Kind,
+		UserID:    id,
+		ToUserID:  params.ToUserID,
+		Amount:    params.Amount,
+		Tag:       params.Tag,
+		Status:    store.ScheduledPending,
+		CreatedBy: callerID(r),
+		CreatedAt: now,
+	}
+	if err := op.Validate(); err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	if params.ExecuteAt == nil || !params.ExecuteAt.After(now) {
+		sendError(w, errors.New("execute_at must be in the future"), http.StatusUnprocessableEntity)
+		return
+	}
+	op.ExecuteAt = params.ExecuteAt.UTC().Truncate(time.Microsecond)
+	if a.Denylist.User(id) || op.ToUserID != 0 && a.Denylist.User(op.ToUserID) {
+		sendDenied(w)
+		return
+	}
+	// максимальный баланс проверяется по кешу экземпляра, как у пополнений
+	if op.Kind != store.ScheduledDebit && a.Shared != nil {
+		sendError(w, errors.New("credits are not supported with a shared cache backend"), http.StatusNotImplemented)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	for _, userID := range []int{op.UserID, op.ToUserID} {
+		if userID == 0 {
+			continue
+		}
+		user, err := a.Cache.LoadUser(userID, func(id int) (*store.User, error) {
+			return a.Store.LoadUser(ctx, id)
+		})
+		if err != nil {
+			sendStorageError(w, err, "failed to load user")
+			return
+		}
+		if user == nil {
+			sendError(w, fmt.Errorf("user %d not found", userID), http.StatusNotFound)
+			return
+		}
+	}
+
+	wctx, wcancel := a.writeContext()
+	defer wcancel()
+
+	if err := store.CreateScheduledOperation(wctx, a.ScheduledOperations.Sess, op); err != nil {
+		sendStorageError(w, err, "failed to save scheduled operation")
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  op.CreatedBy,
+		Action: "scheduled_operation.create",
+		Target: fmt.Sprintf("user:%d", id),
+		Result: op.ID,
+		Fields: map[string]interface{}{
+			"kind":       op.Kind,
+			"amount":     op.Amount,
+			"to_user_id": op.ToUserID,
+			"execute_at": op.ExecuteAt,
+		},
+	})
+
+	sendJSON(w, op)
+}
+
+// cancelScheduledOperation - POST /user/{id}/scheduled-operations/{operation_id}/cancel: отмена операции
+// пользователя, которая еще не начала выполняться
+func (a *API) cancelScheduledOperation(w http.ResponseWriter, r *http.Request, id int, route string) {
+	if a.ScheduledOperations == nil {
+		sendError(w, errors.New("scheduled operations are disabled"), http.StatusNotFound)
+		return
+	}
+	opID, action, _ := strings.Cut(strings.TrimPrefix(route, "scheduled-operations/"), "/")
+	if action != "cancel" {
+		sendError(w, errors.New("not found"), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	op, err := store.CancelScheduledOperation(ctx, a.ScheduledOperations.Sess, id, opID)
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("scheduled operation not found"), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, store.ErrScheduledStarted) {
+		sendError(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to cancel scheduled operation")
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "scheduled_operation.cancel",
+		Target: fmt.Sprintf("user:%d", id),
+		Result: opID,
+	})
+
+	sendJSON(w, op)
+}
+
+// ExecuteScheduledOperations - выполняет отложенные операции, срок которых наступил, и доводит до конца
+// списанные переводы. Возвращает количество выполненных операций
+func (a *API) ExecuteScheduledOperations(ctx context.Context) (int, error) {
+	if a.ScheduledOperations == nil {
+		return 0, nil
+	}
+
+	executed := 0
+	now := time.Now()
+	var after *store.ScheduledOperation
+	for {
+		due, err := store.DueScheduledOperations(ctx, a.ScheduledOperations.Sess, now, after, scheduledOperationBatch)
+		if err != nil {
+			return executed, err
+		}
+
+		for _, op := range due {
+			done, err := a.executeScheduled(ctx, op)
+			if err != nil {
+				// ошибка хранилища: операция останется в своем состоянии и повторится при следующем запуске,
+				// а следующие за ней выполняются со следующей страницы
+				log.Printf("failed to execute scheduled operation %s: %v", op.ID, err)
+				continue
+			}
+			if done {
+				executed++
+			}
+		}
+		if len(due) < scheduledOperationBatch || ctx.Err() != nil {
+			return executed, nil
+		}
+		after = &due[len(due)-1]
+	}
+}
+
+// executeScheduled - выполняет отложенную операцию op или ее оставшийся шаг. true - операция выполнена,
+// false без ошибки - не прошла или ее выполнил другой экземпляр
+func (a *API) executeScheduled(ctx context.Context, op store.ScheduledOperation) (bool, error) {
+	if op.Status == store.ScheduledPending && op.Kind != store.ScheduledCredit {
+		debited, err := a.operationDebit(ctx, op)
+		if err != nil || !debited || op.Kind == store.ScheduledDebit {
+			return debited, err
+		}
+		op.Status = store.ScheduledDebited
+	}
+	return a.operationCredit(ctx, op)
+}
+
+// operationUser - пользователь из кеша или хранилища, nil - его нет
+func (a *API) operationUser(ctx context.Context, id int) (*store.User, error) {
+	return a.Cache.LoadUser(id, func(id int) (*store.User, error) {
+		return a.Store.LoadUser(ctx, id)
+	})
+}
+
+// operationDebit - списание отложенного списания или перевода op с теми же проверками, что и POST /user/balance.
+// Списание не прошло по бизнес-причине - операция становится store.ScheduledFailed
+func (a *API) operationDebit(ctx context.Context, op store.ScheduledOperation) (bool, error) {
+	user, err := a.operationUser(ctx, op.UserID)
+	if err != nil {
+		return false, err
+	}
+	reason := ""
+	switch {
+	case user == nil:
+		reason = "user not found"
+	case a.Denylist.User(op.UserID):
+		reason = "user is denied"
+	}
+	if reason != "" {
+		return false, store.FailScheduledOperation(ctx, a.ScheduledOperations.Sess, op.ID, reason)
+	}
+
+	params := BalanceParams{UserID: op.UserID, Amount: op.Amount, Tag: op.Tag}
+	tx, ok, err := store.RunScheduledDebit(ctx, a.ScheduledOperations.Sess, user, op, a.debitOptions(ctx, user, params, PersistSync))
+	if status := debitErrorStatus(err); status != 0 {
+		return false, store.FailScheduledOperation(ctx, a.ScheduledOperations.Sess, op.ID, err.Error())
+	}
+	if err != nil || !ok {
+		return false, err
+	}
+	if op.Kind == store.ScheduledDebit {
+		a.recordDebit(tx, params)
+	}
+	return true, nil
+}
+
+// operationCredit - пополнение по отложенному пополнению или получателя списанного перевода op. Если оно
+// не прошло по бизнес-причине, пополнение становится store.ScheduledFailed, а перевод возвращается отправителю
+func (a *API) operationCredit(ctx context.Context, op store.ScheduledOperation) (bool, error) {
+	userID := op.UserID
+	if op.Kind == store.ScheduledTransfer {
+		userID = op.ToUserID
+	}
+	user, err := a.operationUser(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	reason := ""
+	switch {
+	case user == nil:
+		reason = "user not found"
+	case a.Denylist.User(userID):
+		reason = "user is denied"
+	case a.Shared != nil:
+		reason = "credits are not supported with a shared cache backend"
+	}
+
+	if reason == "" {
+		_, ok, err := store.RunScheduledCredit(ctx, a.ScheduledOperations.Sess, user, op, a.operationCreditOptions())
+		if err == nil {
+			if ok {
+				a.settlePendingDebits(user)
+			}
+			return ok, nil
+		}
+		if debitErrorStatus(err) == 0 {
+			return false, err
+		}
+		reason = err.Error()
+	}
+
+	if op.Kind == store.ScheduledCredit {
+		return false, store.FailScheduledOperation(ctx, a.ScheduledOperations.Sess, op.ID, reason)
+	}
+
+	// перевод не дошел до получателя: деньги возвращаются отправителю
+	sender, err := a.operationUser(ctx, op.UserID)
+	if err != nil {
+		return false, err
+	}
+	if sender == nil {
+		return false, fmt.Errorf("sender %d of transfer not found for refund", op.UserID)
+	}
+	// возврат - не пополнение: максимальный баланс и состояние счета отправителя не проверяются
+	_, ok, err := store.RefundScheduledTransfer(ctx, a.ScheduledOperations.Sess, sender, op, reason, a.operationCreditOptions())
+	if err != nil || !ok {
+		return false, err
+	}
+	a.settlePendingDebits(sender)
+	return false, nil
+}
+
+// operationCreditOptions - пополнение отложенной операцией: сохраняется синхронно вместе с ее состоянием
+func (a *API) operationCreditOptions() store.CreditOptions {
+	return store.CreditOptions{
+		MaxBalance: a.MaxBalance,
+		Mark: func(u *store.User) {
+			a.Responses.Invalidate(u.ID)
+		},
+	}
+}
+
+// RunOperationScheduler - раз в interval выполняет отложенные операции, срок которых наступил, пока не отменен ctx
+func (a *API) RunOperationScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			executed, err := a.ExecuteScheduledOperations(ctx)
+			if err != nil {
+				log.Printf("failed to execute scheduled operations: %v", err)
+			}
+			if executed > 0 {
+				log.Printf("Executed %d scheduled operations", executed)
+			}
+		}
+	}
+}
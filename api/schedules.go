@@ -0,0 +1,284 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/store"
+)
+
+// scheduleBatch - сколько регулярных списаний выполняется за один запрос к БД
+const scheduleBatch = 100
+
+// Schedules - регулярные списания в таблице schedules, nil - отключены
+type Schedules struct {
+	Sess *dbr.Session
+	// Retry - через сколько повторить неудачное списание (но не позже следующего по расписанию)
+	Retry time.Duration
+	// MaxFailures - после скольких неудачных списаний подряд регулярное списание приостанавливается, 0 - никогда
+	MaxFailures int
+}
+
+// ScheduleParams - новое регулярное списание в POST /user/{id}/schedules, start_at по умолчанию - сейчас
+type ScheduleParams struct {
+	Amount  int        `json:"amount"`
+	Tag     string     `json:"tag"`
+	Period  string     `json:"period"`
+	StartAt *time.Time `json:"start_at"`
+}
+
+// userSchedules - GET /user/{id}/schedules: регулярные списания пользователя, POST /user/{id}/schedules: новое
+func (a *API) userSchedules(w http.ResponseWriter, r *http.Request, id int) {
+	if a.Schedules == nil {
+		sendError(w, errors.New("schedules are disabled"), http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		a.createSchedule(w, r, id)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	schedules, err := store.LoadSchedules(ctx, a.Schedules.Sess, id)
+	if err != nil {
+		sendStorageError(w, err, "failed to load schedules")
+		return
+	}
+	if schedules == nil {
+		schedules = []store.Schedule{}
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"schedules": schedules,
+	})
+}
+
+// createSchedule - POST /user/{id}/schedules {"amount": 990, "period": "monthly", "tag": "subscription", "start_at": "..."}
+func (a *API) createSchedule(w http.ResponseWriter, r *http.Request, id int) {
+	var params ScheduleParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		sendError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	schedule := store.Schedule{
+		ID:        store.NewTransactionID(),
+		UserID:    id,
+		Amount:    params.Amount,
+		Tag:       params.Tag,
+		Period:    params.Period,
+		Status:    store.ScheduleActive,
+		StartAt:   now,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if params.StartAt != nil {
+		schedule.StartAt = params.StartAt.UTC().Truncate(time.Microsecond)
+	}
+	schedule.NextRunAt = schedule.StartAt
+	if err := schedule.Validate(); err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	if a.Denylist.User(id) {
+		sendDenied(w)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	user, err := a.Cache.LoadUser(id, func(id int) (*store.User, error) {
+		return a.Store.LoadUser(ctx, id)
+	})
+	if err != nil {
+		sendStorageError(w, err, "failed to load user")
+		return
+	}
+	if user == nil {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+
+	wctx, wcancel := a.writeContext()
+	defer wcancel()
+
+	if err := store.CreateSchedule(wctx, a.Schedules.Sess, schedule); err != nil {
+		sendStorageError(w, err, "failed to save schedule")
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "schedule.create",
+		Target: fmt.Sprintf("user:%d", id),
+		Result: schedule.ID,
+		Fields: map[string]interface{}{
+			"amount": schedule.Amount,
+			"period": schedule.Period,
+		},
+	})
+
+	sendJSON(w, schedule)
+}
+
+// scheduleAction - POST /user/{id}/schedules/{schedule_id}/pause|resume|cancel: смена состояния регулярного списания
+func (a *API) scheduleAction(w http.ResponseWriter, r *http.Request, id int, route string) {
+	if a.Schedules == nil {
+		sendError(w, errors.New("schedules are disabled"), http.StatusNotFound)
+		return
+	}
+
+	scheduleID, action, _ := strings.Cut(strings.TrimPrefix(route, "schedules/"), "/")
+	var status string
+	switch action {
+	case "pause":
+		status = store.SchedulePaused
+	case "resume":
+		status = store.ScheduleActive
+	case "cancel":
+		status = store.ScheduleCancelled
+	default:
+		sendError(w, errors.New("not found"), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := a.writeContext()
+	defer cancel()
+
+	schedule, err := store.SetScheduleStatus(ctx, a.Schedules.Sess, id, scheduleID, status)
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("schedule not found"), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, store.ErrScheduleCancelled) {
+		sendError(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to save schedule")
+		return
+	}
+
+	a.Audit.Record(audit.Event{
+		Actor:  callerID(r),
+		Action: "schedule." + action,
+		Target: fmt.Sprintf("user:%d", id),
+		Result: scheduleID,
+	})
+
+	sendJSON(w, schedule)
+}
+
+// RunDueSchedules - выполняет регулярные списания, которые пора выполнить. Возвращает количество прошедших списаний
+func (a *API) RunDueSchedules(ctx context.Context) (int, error) {
+	if a.Schedules == nil {
+		return 0, nil
+	}
+
+	debited := 0
+	for {
+		now := time.Now().UTC()
+		due, err := store.DueSchedules(ctx, a.Schedules.Sess, now, scheduleBatch)
+		if err != nil {
+			return debited, err
+		}
+
+		claimed := 0
+		for _, s := range due {
+			// следующее списание переносится до выполнения этого: взятое списание не повторится
+			next := s.NextAfter(now)
+			ok, err := store.ClaimSchedule(ctx, a.Schedules.Sess, s, next)
+			if err != nil {
+				return debited, err
+			}
+			if !ok {
+				continue
+			}
+			claimed++
+
+			tx, err := a.scheduledDebit(ctx, s)
+			if err != nil {
+				retry := now.Add(a.Schedules.Retry)
+				if retry.After(next) {
+					retry = next
+				}
+				log.Printf("scheduled debit %s of user %d failed: %v", s.ID, s.UserID, err)
+				if err := store.FailScheduleRun(ctx, a.Schedules.Sess, s.ID, err.Error(), retry, a.Schedules.MaxFailures); err != nil {
+					return debited, err
+				}
+				continue
+			}
+			debited++
+			if err := store.CompleteScheduleRun(ctx, a.Schedules.Sess, s.ID, tx.ID); err != nil {
+				return debited, err
+			}
+		}
+		// остальные взяли другие экземпляры или их больше нет
+		if len(due) < scheduleBatch || claimed == 0 {
+			return debited, nil
+		}
+	}
+}
+
+// scheduledDebit - списание по регулярному списанию s с теми же проверками, комиссиями и режимом записи, что
+// и POST /user/balance (строгий режим - синхронно через кеш), но без подтверждения крупных списаний
+func (a *API) scheduledDebit(ctx context.Context, s store.Schedule) (store.Transaction, error) {
+	if a.Denylist.User(s.UserID) {
+		return store.Transaction{}, errors.New("user is denied")
+	}
+	user, err := a.Cache.LoadUser(s.UserID, func(id int) (*store.User, error) {
+		return a.Store.LoadUser(ctx, id)
+	})
+	if err != nil {
+		return store.Transaction{}, err
+	}
+	if user == nil {
+		return store.Transaction{}, store.ErrNotFound
+	}
+
+	mode := a.persistenceMode()
+	if mode == PersistStrict {
+		mode = PersistSync
+	}
+	params := BalanceParams{UserID: s.UserID, Amount: s.Amount, Tag: s.Tag}
+	tx, err := user.ApplyDebit(s.Amount, a.debitOptions(ctx, user, params, mode))
+	if err != nil {
+		return tx, err
+	}
+	a.recordDebit(tx, params)
+	return tx, nil
+}
+
+// RunScheduler - раз в interval выполняет регулярные списания, которые пора выполнить, пока не отменен ctx
+func (a *API) RunScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			debited, err := a.RunDueSchedules(ctx)
+			if err != nil {
+				log.Printf("failed to run schedules: %v", err)
+			}
+			if debited > 0 {
+				log.Printf("Executed %d scheduled debits", debited)
+			}
+		}
+	}
+}
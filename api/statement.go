@@ -0,0 +1,156 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// MaxStatementTransactions - сколько записей леджера может быть в одной выписке, для больших периодов
+// есть /admin/export/transactions
+const MaxStatementTransactions = 10000
+
+// userStatement - GET /user/{id}/statement?from=...&to=...&category=...&tag=...: баланс на начало и конец периода
+// [from, to) и все операции в нем по леджеру в БД, со спорами и отменами у относящихся к ним операций.
+// to по умолчанию - сейчас. С category и tag в выписке только операции с этой категорией и всеми этими тегами,
+// балансы по-прежнему по всему счету
+func (a *API) userStatement(w http.ResponseWriter, r *http.Request, id int) {
+	from, to, err := parsePeriod(r)
+	if err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	category, tags, err := parseLabels(r)
+	if err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	if from.IsZero() {
+		sendError(w, errors.New("from is required"), http.StatusUnprocessableEntity)
+		return
+	}
+	if to.IsZero() {
+		to = time.Now().UTC()
+		if !from.Before(to) {
+			sendError(w, errors.New("from must be in the past"), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	statement, err := a.Store.Statement(ctx, id, from, to, category, tags, MaxStatementTransactions)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	case errors.Is(err, store.ErrTooManyTransactions):
+		sendError(w, fmt.Errorf("%w: more than %d, choose a shorter period", err, MaxStatementTransactions), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		sendStorageError(w, err, "failed to load statement")
+		return
+	}
+	if a.Disputes != nil || a.Reversals != nil {
+		annotated, err := a.annotatedStatement(ctx, statement)
+		if err != nil {
+			sendStorageError(w, err, "failed to load statement")
+			return
+		}
+		sendJSON(w, annotated)
+		return
+	}
+	sendJSON(w, statement)
+}
+
+// statementTransaction - запись выписки со спором, к которому она относится (оспоренное пополнение, удержание
+// или возврат удержанного), и с отменой
+type statementTransaction struct {
+	store.Transaction
+	DisputeID     string `json:"dispute_id,omitempty"`
+	DisputeStatus string `json:"dispute_status,omitempty"`
+	// ReversedBy - запись, которой операция отменена, Reverses - операция, которую отменяет эта запись
+	ReversedBy string `json:"reversed_by,omitempty"`
+	Reverses   string `json:"reverses,omitempty"`
+}
+
+// annotatedStatement - выписка s, в которой у записей указаны споры и отмены, к которым они относятся
+func (a *API) annotatedStatement(ctx context.Context, s store.Statement) (interface{}, error) {
+	txs := make([]statementTransaction, len(s.Transactions))
+	index := make(map[string]int, len(s.Transactions))
+	for i, tx := range s.Transactions {
+		txs[i].Transaction = tx
+		index[tx.ID] = i
+	}
+
+	if a.Disputes != nil {
+		disputes, err := store.LoadDisputes(ctx, a.Disputes.Sess, s.UserID, "", MaxStatementTransactions)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range disputes {
+			for _, id := range []string{d.TransactionID, d.HoldTransactionID, d.ReleaseTransactionID} {
+				if i, ok := index[id]; ok && id != "" {
+					txs[i].DisputeID, txs[i].DisputeStatus = d.ID, d.Status
+				}
+			}
+		}
+	}
+	if a.Reversals != nil {
+		reversals, err := store.LoadReversals(ctx, a.Reversals.Sess, s.UserID, MaxStatementTransactions)
+		if err != nil {
+			return nil, err
+		}
+		for _, rev := range reversals {
+			if i, ok := index[rev.TransactionID]; ok {
+				txs[i].ReversedBy = rev.ReversalTransactionID
+			}
+			if i, ok := index[rev.ReversalTransactionID]; ok {
+				txs[i].Reverses = rev.TransactionID
+			}
+		}
+	}
+
+	return struct {
+		store.Statement
+		Transactions []statementTransaction `json:"transactions"`
+	}{s, txs}, nil
+}
+
+// userBalanceAt - GET /user/{id}/balance?at=...: баланс на прошедший момент at (RFC 3339) по снимкам
+// и леджеру в БД, для разбора спорных операций
+func (a *API) userBalanceAt(w http.ResponseWriter, r *http.Request, id int) {
+	value := r.URL.Query().Get("at")
+	if value == "" {
+		sendError(w, errors.New("at is required"), http.StatusUnprocessableEntity)
+		return
+	}
+	at, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		sendError(w, errors.New("at must be an RFC 3339 time"), http.StatusUnprocessableEntity)
+		return
+	}
+	if at.After(time.Now()) {
+		sendError(w, errors.New("at must be in the past"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	balance, err := a.Store.BalanceAt(ctx, id, at)
+	if errors.Is(err, store.ErrNotFound) {
+		sendError(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendStorageError(w, err, "failed to load balance")
+		return
+	}
+	sendJSON(w, balance)
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// размер страницы GET /users
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// metadataParamPrefix - префикс параметров фильтра по метаданным: metadata.plan=pro
+const metadataParamPrefix = "metadata."
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// UserList - ответ GET /users
+type UserList struct {
+	Users []store.UserState `json:"users"`
+	// NextCursor - курсор следующей страницы, пусто - страница последняя
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Total - число пользователей по фильтру, только с total=true
+	Total *int `json:"total,omitempty"`
+}
+
+// UsersHandler - GET /users?sort=balance&order=desc&limit=50&cursor=...&total=true&metadata.plan=pro,
+// фильтры min_balance, max_balance, status и updated_since (RFC 3339).
+// Страница читается из БД, а пользователи, которые есть в кеше, отдаются в состоянии из кеша: их несохраненные
+// списания уже видны, но порядок по балансу на странице может отличаться от порядка в БД
+func (a *API) UsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts, err := parseListParams(r.URL.Query())
+	if err != nil {
+		sendError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := a.queryContext(r)
+	defer cancel()
+
+	page, err := a.Store.ListUsers(ctx, opts)
+	if err != nil {
+		sendStorageError(w, err, "failed to list users")
+		return
+	}
+
+	list := UserList{Users: make([]store.UserState, len(page.Users))}
+	for i, u := range page.Users {
+		if cached := a.Cache.Peek(u.ID); cached != nil {
+			u = cached
+		}
+		list.Users[i] = u.State()
+	}
+	if page.Next != nil {
+		list.NextCursor = encodeCursor(opts, page.Next)
+	}
+	if opts.Total {
+		list.Total = &page.Total
+	}
+	sendJSON(w, list)
+}
+
+// parseListParams - параметры страницы из query
+func parseListParams(query url.Values) (store.ListOptions, error) {
+	opts := store.ListOptions{Sort: store.SortByID, Limit: DefaultPageSize}
+
+	if sort := query.Get("sort"); sort != "" {
+		opts.Sort = sort
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, errors.New("order must be asc or desc")
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > MaxPageSize {
+			return opts, fmt.Errorf("limit must be from 1 to %d", MaxPageSize)
+		}
+		opts.Limit = n
+	}
+	var err error
+	if total := query.Get("total"); total != "" {
+		if opts.Total, err = strconv.ParseBool(total); err != nil {
+			return opts, errors.New("invalid total")
+		}
+	}
+	if opts.MinBalance, err = parseBalanceBound(query, "min_balance"); err != nil {
+		return opts, err
+	}
+	if opts.MaxBalance, err = parseBalanceBound(query, "max_balance"); err != nil {
+		return opts, err
+	}
+	opts.Status = query.Get("status")
+	if since := query.Get("updated_since"); since != "" {
+		if opts.UpdatedSince, err = time.Parse(time.RFC3339Nano, since); err != nil {
+			return opts, errors.New("updated_since must be an RFC 3339 time")
+		}
+	}
+
+	for key, values := range query {
+		if !strings.HasPrefix(key, metadataParamPrefix) {
+			continue
+		}
+		if opts.Metadata == nil {
+			opts.Metadata = make(map[string]string)
+		}
+		opts.Metadata[strings.TrimPrefix(key, metadataParamPrefix)] = values[0]
+	}
+
+	if err := opts.Validate(); err != nil {
+		return opts, err
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := decodeCursor(opts, cursor)
+		if err != nil {
+			return opts, err
+		}
+		opts.After = after
+	}
+	return opts, nil
+}
+
+// parseBalanceBound - граница баланса из параметра name, nil если его нет
+func parseBalanceBound(query url.Values, name string) (*int64, error) {
+	value := query.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s", name)
+	}
+	return &n, nil
+}
+
+// cursorOrder - сортировка, для которой выдан курсор: курсор другой сортировки указывал бы не на ту позицию
+func cursorOrder(opts store.ListOptions) string {
+	if opts.Desc {
+		return "-" + opts.Sort
+	}
+	return opts.Sort
+}
+
+// encodeCursor - непрозрачный для клиента курсор: base64 от "сортировка:баланс:id"
+func encodeCursor(opts store.ListOptions, c *store.UserCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d:%d", cursorOrder(opts), c.Balance, c.ID)))
+}
+
+func decodeCursor(opts store.ListOptions, cursor string) (*store.UserCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 3 || parts[0] != cursorOrder(opts) {
+		return nil, errInvalidCursor
+	}
+
+	var c store.UserCursor
+	if c.Balance, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return nil, errInvalidCursor
+	}
+	if c.ID, err = strconv.Atoi(parts[2]); err != nil {
+		return nil, errInvalidCursor
+	}
+	return &c, nil
+}
@@ -0,0 +1,54 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Event - запись журнала аудита
+type Event struct {
+	Time   time.Time              `json:"time"`
+	Actor  string                 `json:"actor"`
+	Action string                 `json:"action"`
+	Target string                 `json:"target,omitempty"`
+	Result string                 `json:"result,omitempty"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Log - журнал аудита, пишет каждое событие отдельной JSON строкой
+type Log struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func New(w io.Writer) *Log {
+	return &Log{w: w}
+}
+
+// Record - записывает событие, время проставляется, если не задано
+func (l *Log) Record(e Event) {
+	if l == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.w.Write(line); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
@@ -0,0 +1,2 @@
+// Package audit - журнал аудита действий с деньгами и доступом (JSON строки).
+package audit
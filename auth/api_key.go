@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// APIKeyHeader - заголовок, в котором вызывающий передает ключ API
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyPrefix - префикс ключей API, чтобы их было видно в конфигурации и при утечке
+const APIKeyPrefix = "bk_"
+
+// NewAPIKey - случайный ключ API
+func NewAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return APIKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashAPIKey - хеш ключа, который хранится в БД. Ключи случайные и длинные, поэтому соль не нужна
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeys - действующие ключи API, загруженные из БД. Новые и отозванные ключи начинают действовать
+// после следующей перезагрузки, не позже чем через Interval
+type APIKeys struct {
+	// Load - действующие ключи из хранилища, см. store.LoadAPIKeys
+	Load func(ctx context.Context) ([]store.APIKey, error)
+	// Interval - как часто перечитывать ключи
+	Interval time.Duration
+
+	mu sync.RWMutex
+	// callers - вызывающий по хешу ключа
+	callers map[string]*Identity
+}
+
+// Reload - перечитывает ключи, при ошибке остаются прежние
+func (k *APIKeys) Reload(ctx context.Context) error {
+	keys, err := k.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	callers := make(map[string]*Identity, len(keys))
+	for _, key := range keys {
+		callers[key.Hash] = &Identity{Subject: key.Name, Scopes: key.ScopeList()}
+	}
+
+	k.mu.Lock()
+	k.callers = callers
+	k.mu.Unlock()
+	return nil
+}
+
+// Run - перечитывает ключи раз в Interval, пока не отменен ctx
+func (k *APIKeys) Run(ctx context.Context) {
+	ticker := time.NewTicker(k.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.Reload(ctx); err != nil {
+				log.Printf("failed to reload api keys: %v", err)
+			}
+		}
+	}
+}
+
+// Verify - вызывающий, которому выдан key: Subject - имя ключа. false - ключ неизвестен или отозван
+func (k *APIKeys) Verify(key string) (*Identity, bool) {
+	hash := HashAPIKey(key)
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	caller, ok := k.callers[hash]
+	return caller, ok
+}
@@ -0,0 +1,2 @@
+// Package auth - проверка учетных данных вызывающих сервис.
+package auth
@@ -0,0 +1,366 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksRefetchInterval - не чаще этого ключи перечитываются из-за токена с неизвестным kid
+const jwksRefetchInterval = time.Minute
+
+// clockSkew - допустимое расхождение часов с поставщиком удостоверений при проверке exp и nbf
+const clockSkew = 30 * time.Second
+
+// Identity - вызывающий по проверенному токену
+type Identity struct {
+	// Subject - значение SubjectClaim, обычно sub или client_id
+	Subject string
+	Scopes  []string
+}
+
+// HasScope - токен выдан с правом scope
+func (i *Identity) HasScope(scope string) bool {
+	for _, s := range i.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// JWTVerifier - проверка JWT поставщика удостоверений OAuth2 по его ключам из JWKS. Поддерживаются RS256/384/512
+// и ES256/384/512. Ключи перечитываются раз в RefreshInterval и, не чаще раза в минуту, когда приходит токен
+// с неизвестным kid (поставщик сменил ключ)
+type JWTVerifier struct {
+	// Issuer - обязательное значение iss
+	Issuer string
+	// Audience - значение, которое должно быть в aud, пусто - aud не проверяется
+	Audience string
+	// JWKSURL - адрес ключей поставщика (jwks_uri)
+	JWKSURL string
+	// SubjectClaim - claim с именем вызывающего, пусто - sub
+	SubjectClaim string
+	// RefreshInterval - как часто перечитывать ключи
+	RefreshInterval time.Duration
+
+	client *http.Client
+
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func NewJWTVerifier(issuer, audience, jwksURL string) *JWTVerifier {
+	return &JWTVerifier{
+		Issuer:          issuer,
+		Audience:        audience,
+		JWKSURL:         jwksURL,
+		SubjectClaim:    "sub",
+		RefreshInterval: time.Hour,
+		client:          &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// jwtHeader - заголовок JWT, только нужные поля
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwk - ключ из JWKS, только нужные поля
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Refresh - перечитывает ключи из JWKSURL, при ошибке остаются прежние
+func (v *JWTVerifier) Refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.JWKSURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwks: unexpected status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("jwks: skip key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	v.mu.Lock()
+	v.keys, v.fetchedAt = keys, time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+// Run - перечитывает ключи раз в RefreshInterval, пока не отменен ctx
+func (v *JWTVerifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(v.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := v.Refresh(ctx); err != nil {
+				log.Printf("failed to refresh jwks: %v", err)
+			}
+		}
+	}
+}
+
+// Verify - проверяет подпись, iss, aud, exp и nbf токена и возвращает вызывающего
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	hash, ok := jwtHash(header.Alg)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(key, header.Alg, hash, h.Sum(nil), sig) {
+		return nil, ErrInvalidToken
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	return v.identity(claims)
+}
+
+// identity - вызывающий по claims уже проверенного по подписи токена
+func (v *JWTVerifier) identity(claims map[string]interface{}) (*Identity, error) {
+	if iss, _ := claims["iss"].(string); iss != v.Issuer {
+		return nil, ErrInvalidToken
+	}
+	if v.Audience != "" && !hasAudience(claims["aud"], v.Audience) {
+		return nil, ErrInvalidToken
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	if now.Add(-clockSkew).Unix() >= int64(exp) {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Unix() < int64(nbf) {
+		return nil, ErrInvalidToken
+	}
+
+	claim := v.SubjectClaim
+	if claim == "" {
+		claim = "sub"
+	}
+	subject, _ := claims[claim].(string)
+	if subject == "" {
+		return nil, ErrInvalidToken
+	}
+
+	return &Identity{Subject: subject, Scopes: tokenScopes(claims)}, nil
+}
+
+// key - открытый ключ kid, неизвестный kid перечитывает ключи не чаще jwksRefetchInterval
+func (v *JWTVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.RLock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetchedAt) >= jwksRefetchInterval
+	v.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, ErrInvalidToken
+	}
+
+	if err := v.Refresh(ctx); err != nil {
+		log.Printf("failed to refresh jwks: %v", err)
+		return nil, ErrInvalidToken
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrInvalidToken
+}
+
+// tokenScopes - права из scope (строка через пробел) или scp (строка или массив)
+func tokenScopes(claims map[string]interface{}) []string {
+	for _, name := range []string{"scope", "scp"} {
+		switch v := claims[name].(type) {
+		case string:
+			return strings.Fields(v)
+		case []interface{}:
+			scopes := make([]string, 0, len(v))
+			for _, s := range v {
+				if s, ok := s.(string); ok {
+					scopes = append(scopes, s)
+				}
+			}
+			return scopes
+		}
+	}
+	return nil
+}
+
+// hasAudience - aud (строка или массив) содержит audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwtHash - хеш алгоритма подписи, false - алгоритм не поддерживается (в том числе none и HS*)
+func jwtHash(alg string) (crypto.Hash, bool) {
+	switch alg {
+	case "RS256", "ES256":
+		return crypto.SHA256, true
+	case "RS384", "ES384":
+		return crypto.SHA384, true
+	case "RS512", "ES512":
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+// verifySignature - подпись sig хеша digest ключом key, тип ключа должен соответствовать alg
+func verifySignature(key crypto.PublicKey, alg string, hash crypto.Hash, digest, sig []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+// publicKey - ключ RSA или EC из JWK
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("rsa exponent is too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,529 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// MapEntryOverhead - примерные накладные расходы map на одну запись (бакеты, tophash)
+const MapEntryOverhead = 16
+
+// shardCount - количество независимых частей кеша со своей блокировкой
+const shardCount = 64
+
+// ErrUnsaved - у пользователя есть несохраненные изменения, а сохранить их нечем (Flush не задан)
+var ErrUnsaved = errors.New("user has unsaved changes")
+
+// entrySize - примерный размер одной записи кеша: ключ и указатель в map, CachedUser, User и элемент списка LRU
+var entrySize = int64(unsafe.Sizeof(int(0))+unsafe.Sizeof(&CachedUser{})+unsafe.Sizeof(CachedUser{})+unsafe.Sizeof(store.User{})+unsafe.Sizeof(list.Element{})) + MapEntryOverhead
+
+// Cache - кеш пользователей, безопасный для конкурентного использования.
+// Записи разбиты по shardCount частям по id, у каждой своя RWMutex, map и список LRU
+type Cache struct {
+	shards [shardCount]*cacheShard
+	// entries - общее количество записей во всех частях
+	entries int64
+	stats   cacheStats
+	loads   flightGroup
+	// locks - блокировки записей по хешу id, отдельные от блокировок изменений пользователей в store
+	locks store.Stripes
+
+	// TTL - записи без несохраненных изменений, к которым не обращались дольше, удаляет RunJanitor, 0 - не удалять
+	TTL time.Duration
+	// NegativeTTL - сколько помнить, что пользователя нет в БД, 0 - не помнить, каждый запрос идет в БД
+	NegativeTTL time.Duration
+	// Changed - пользователи, строки которых записаны не раньше since (см. store.ChangedUsers), nil - не отслеживать.
+	// С ним RunJanitor удаляет пользователей, которых после загрузки изменил другой экземпляр
+	Changed func(ctx context.Context, since time.Time) ([]store.UserVersion, error)
+
+	// MemoryLimit - жесткий лимит памяти под кеш и фоновое сохранение в байтах, 0 - без ограничений
+	MemoryLimit int64
+	// Reserved - память, занятая вне кеша, но учитываемая в MemoryLimit (например очередь сохранения)
+	Reserved func() int64
+
+	// MaxEntries - максимальное количество записей, лишние вытесняются в порядке LRU, 0 - без ограничений
+	MaxEntries int
+	// Flush - сохраняет несохраненные изменения пользователя перед вытеснением по MaxEntries,
+	// nil - пользователи с изменениями не вытесняются
+	Flush func(user *store.User) error
+}
+
+// cacheShard - часть кеша
+type cacheShard struct {
+	mu    sync.RWMutex
+	users map[int]*CachedUser
+	// lru - записи от недавно добавленных к давно добавленным; записи, к которым обращались
+	// после добавления (referenced), при вытеснении получают второй шанс и переносятся в начало
+	lru *list.List
+}
+
+type CachedUser struct {
+	User *store.User
+	// lastAccess - время последнего обращения, unix nano
+	lastAccess int64
+	// referenced - 1, если к записи обращались с момента последнего переноса в начало LRU
+	referenced int32
+	// missingUntil - до этого момента (unix nano) пользователь считается отсутствующим в БД
+	missingUntil int64
+	// removed - запись удалена из кеша, ее надо получить заново; меняется под блокировкой записи
+	removed bool
+
+	id   int
+	elem *list.Element
+}
+
+func New(memoryLimit int64) *Cache {
+	c := &Cache{MemoryLimit: memoryLimit}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{users: make(map[int]*CachedUser), lru: list.New()}
+	}
+	return c
+}
+
+func (c *Cache) shard(id int) *cacheShard {
+	return c.shards[uint(id)%shardCount]
+}
+
+// GetUser - запись кеша, создается если ее нет. Попадание берет только блокировку на чтение
+func (c *Cache) GetUser(id int) *CachedUser {
+	shard := c.shard(id)
+
+	shard.mu.RLock()
+	item, ok := shard.users[id]
+	shard.mu.RUnlock()
+	if ok {
+		item.touch()
+		return item
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if item, ok := shard.users[id]; ok {
+		item.touch()
+		return item
+	}
+
+	c.evict(shard, entrySize)
+
+	item = &CachedUser{
+		User:       nil,
+		lastAccess: time.Now().UnixNano(),
+		id:         id,
+	}
+
+	item.elem = shard.lru.PushFront(item)
+	shard.users[id] = item
+	atomic.AddInt64(&c.entries, 1)
+
+	return item
+}
+
+func (item *CachedUser) touch() {
+	atomic.StoreInt64(&item.lastAccess, time.Now().UnixNano())
+	atomic.StoreInt32(&item.referenced, 1)
+}
+
+// LoadUser - Получает пользователя. Сначала смотрит кеш, если нет - загружает через load.
+// Одновременные промахи по одному пользователю делают один запрос к БД (см. flightGroup).
+// Отсутствие пользователя запоминается на NegativeTTL, без него запись сразу удаляется
+func (c *Cache) LoadUser(id int, load func(id int) (*store.User, error)) (*store.User, error) {
+	item := c.lockEntry(id)
+	if item.User != nil {
+		atomic.AddInt64(&c.stats.hits, 1)
+		c.locks.For(item.id).Unlock()
+		return item.User, nil
+	}
+	if time.Now().UnixNano() < item.missingUntil {
+		atomic.AddInt64(&c.stats.negativeHits, 1)
+		c.locks.For(item.id).Unlock()
+		return nil, nil
+	}
+	c.locks.For(item.id).Unlock()
+	atomic.AddInt64(&c.stats.misses, 1)
+
+	// запрос к БД идет без блокировки записи, чтобы ожидающие присоединились к нему, а не повторили
+	fetch := func() (*store.User, error) {
+		started := time.Now()
+		user, err := load(id)
+		c.stats.loadTime.observe(time.Since(started))
+		if err != nil {
+			atomic.AddInt64(&c.stats.loadErrors, 1)
+		}
+		return user, err
+	}
+	user, err, shared := c.loads.Do(id, fetch)
+	// загрузку прервала отмена запроса, к которому присоединились: загружаем сами, со своим контекстом
+	for shared && isCanceled(err) {
+		user, err, shared = c.loads.Do(id, fetch)
+	}
+	if err != nil {
+		c.discard(item)
+		return nil, err
+	}
+
+	return c.install(id, user), nil
+}
+
+// isCanceled - ошибка из-за отмены или дедлайна контекста загрузки
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// install - кладет загруженного пользователя в запись, если ее не заполнили раньше, и возвращает пользователя из кеша.
+// nil запоминается как отсутствие на NegativeTTL
+func (c *Cache) install(id int, user *store.User) *store.User {
+	item := c.lockEntry(id)
+
+	if item.User == nil && user != nil {
+		item.User = user
+		item.missingUntil = 0
+	}
+	if item.User == nil && c.NegativeTTL > 0 {
+		item.missingUntil = time.Now().Add(c.NegativeTTL).UnixNano()
+	}
+
+	user = item.User
+	placeholder := item.placeholder()
+	c.locks.For(item.id).Unlock()
+
+	if placeholder {
+		c.discard(item)
+	}
+	return user
+}
+
+// lockEntry - запись пользователя под блокировкой записи; если ее успели удалить из кеша, берется новая
+func (c *Cache) lockEntry(id int) *CachedUser {
+	for {
+		item := c.GetUser(id)
+		c.locks.For(item.id).Lock()
+		if !item.removed {
+			return item
+		}
+		c.locks.For(item.id).Unlock()
+	}
+}
+
+// placeholder - запись без пользователя и без запомненного отсутствия, вызывается под блокировкой записи
+func (item *CachedUser) placeholder() bool {
+	return item.User == nil && time.Now().UnixNano() >= item.missingUntil
+}
+
+// discard - удаляет пустую запись, если ее не заняли другие запросы
+func (c *Cache) discard(item *CachedUser) {
+	shard := c.shard(item.id)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if shard.users[item.id] != item || !c.locks.For(item.id).TryLock() {
+		return
+	}
+	defer c.locks.For(item.id).Unlock()
+
+	if !item.removed && item.placeholder() {
+		c.remove(shard, item)
+	}
+}
+
+// Warm - кладет в кеш уже загруженных пользователей, записи, которые уже загружены, не меняются
+func (c *Cache) Warm(users []*store.User) int {
+	added := 0
+	for _, user := range users {
+		item := c.lockEntry(user.ID)
+		if item.User == nil {
+			item.User = user
+			item.missingUntil = 0
+			added++
+		}
+		c.locks.For(item.id).Unlock()
+	}
+	return added
+}
+
+// Peek - пользователь из кеша без загрузки, nil если его нет
+func (c *Cache) Peek(id int) *store.User {
+	shard := c.shard(id)
+
+	shard.mu.RLock()
+	item, ok := shard.users[id]
+	shard.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	c.locks.For(item.id).Lock()
+	defer c.locks.For(item.id).Unlock()
+	return item.User
+}
+
+// Sample - до n загруженных пользователей из кеша в произвольном порядке: обход начинается со случайной части,
+// а порядок обхода map в Go и так не определен
+func (c *Cache) Sample(n int) []*store.User {
+	users := make([]*store.User, 0, n)
+	start := rand.Intn(shardCount)
+	for i := 0; i < shardCount && len(users) < n; i++ {
+		shard := c.shards[(start+i)%shardCount]
+		shard.mu.RLock()
+		for _, item := range shard.users {
+			if len(users) == n {
+				break
+			}
+			// занятая запись сейчас загружается
+			if !c.locks.For(item.id).TryLock() {
+				continue
+			}
+			if item.User != nil {
+				users = append(users, item.User)
+			}
+			c.locks.For(item.id).Unlock()
+		}
+		shard.mu.RUnlock()
+	}
+	return users
+}
+
+// Len - количество записей в кеше
+func (c *Cache) Len() int {
+	return int(atomic.LoadInt64(&c.entries))
+}
+
+// MemoryUsage - примерный объем памяти, занимаемый записями кеша
+func (c *Cache) MemoryUsage() int64 {
+	return atomic.LoadInt64(&c.entries) * entrySize
+}
+
+// Invalidate - удаляет пользователя из кеша, предварительно сохранив его изменения через Flush;
+// следующее обращение перечитает его из БД. false - пользователя в кеше не было
+func (c *Cache) Invalidate(id int) (bool, error) {
+	shard := c.shard(id)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	item, ok := shard.users[id]
+	if !ok {
+		return false, nil
+	}
+
+	if err := c.drop(shard, item); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Clear - удаляет из кеша всех пользователей, сохраняя их изменения через Flush.
+// Пользователи, изменения которых сохранить не удалось, остаются в кеше, возвращается первая ошибка
+func (c *Cache) Clear() (int, error) {
+	evicted := 0
+	var firstErr error
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for _, item := range shard.users {
+			if err := c.drop(shard, item); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			evicted++
+		}
+		shard.mu.Unlock()
+	}
+	return evicted, firstErr
+}
+
+// drop - сохраняет изменения пользователя и удаляет запись, ждет окончания загрузки. Вызывается под блокировкой части
+func (c *Cache) drop(shard *cacheShard, item *CachedUser) error {
+	c.locks.For(item.id).Lock()
+	defer c.locks.For(item.id).Unlock()
+
+	if item.User != nil && item.User.IsDirty() {
+		if c.Flush == nil {
+			return ErrUnsaved
+		}
+		if err := c.Flush(item.User); err != nil {
+			return err
+		}
+	}
+
+	c.remove(shard, item)
+	return nil
+}
+
+// RunJanitor - раз в interval удаляет записи старше TTL, пока не отменен ctx.
+// Пользователи с несохраненными изменениями не удаляются никогда
+func (c *Cache) RunJanitor(ctx context.Context, interval time.Duration) {
+	if c.TTL <= 0 && c.NegativeTTL <= 0 && c.Changed == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	changedSince := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expired := 0
+			for _, shard := range c.shards {
+				expired += c.expire(shard, time.Now())
+			}
+			if expired > 0 {
+				log.Printf("cache janitor evicted %d users", expired)
+			}
+
+			if c.Changed != nil {
+				var dropped int
+				changedSince, dropped = c.dropChanged(ctx, changedSince, interval)
+				if dropped > 0 {
+					log.Printf("cache janitor evicted %d users changed by other instances", dropped)
+				}
+			}
+		}
+	}
+}
+
+// changeOverlap - на сколько раньше последней увиденной записи начинается следующий запрос изменений:
+// updated_at ставится до коммита, поэтому долгая транзакция становится видна позже более новых записей
+const changeOverlap = 10 * time.Second
+
+// dropChanged - удаляет пользователей без несохраненных изменений, строка которых в БД новее состояния в памяти,
+// следующее обращение перечитает их. Возвращает время последней увиденной записи
+func (c *Cache) dropChanged(ctx context.Context, since time.Time, timeout time.Duration) (time.Time, int) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	rows, err := c.Changed(ctx, since.Add(-changeOverlap))
+	if err != nil {
+		log.Printf("failed to read changed users: %v", err)
+		return since, 0
+	}
+
+	dropped := 0
+	for _, row := range rows {
+		if row.UpdatedAt.After(since) {
+			since = row.UpdatedAt
+		}
+
+		shard := c.shard(row.ID)
+		shard.mu.Lock()
+		// занятая запись сейчас загружается и и так будет свежей
+		if item, ok := shard.users[row.ID]; ok && c.locks.For(row.ID).TryLock() {
+			if item.User != nil && item.User.Outdated(row.Version) {
+				c.remove(shard, item)
+				dropped++
+			}
+			c.locks.For(row.ID).Unlock()
+		}
+		shard.mu.Unlock()
+	}
+	return since, dropped
+}
+
+// expire - удаляет из части кеша записи без несохраненных изменений, к которым не обращались дольше TTL,
+// и записи отсутствующих пользователей с истекшим NegativeTTL
+func (c *Cache) expire(shard *cacheShard, now time.Time) int {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	expired := 0
+	for _, item := range shard.users {
+		if !c.locks.For(item.id).TryLock() {
+			continue
+		}
+
+		stale := c.TTL > 0 && atomic.LoadInt64(&item.lastAccess) < now.Add(-c.TTL).UnixNano()
+		if item.placeholder() || (stale && (item.User == nil || !item.User.IsDirty())) {
+			c.remove(shard, item)
+			expired++
+		}
+		c.locks.For(item.id).Unlock()
+	}
+	return expired
+}
+
+// evict - вытесняет из части кеша давно не использованные записи, пока не освободится need байт в рамках MemoryLimit
+// и место под одну запись в рамках MaxEntries. По MemoryLimit пользователи с изменениями пропускаются,
+// по MaxEntries - сначала сохраняются через Flush. Вызывается под блокировкой части
+func (c *Cache) evict(shard *cacheShard, need int64) {
+	if c.MemoryLimit <= 0 && c.MaxEntries <= 0 {
+		return
+	}
+
+	// каждая запись просматривается не больше двух раз: второй шанс и вытеснение
+	for budget := 2 * shard.lru.Len(); budget > 0; budget-- {
+		overMemory := c.MemoryLimit > 0 && c.MemoryUsage()+c.reserved()+need > c.MemoryLimit
+		overEntries := c.MaxEntries > 0 && c.Len() >= c.MaxEntries
+		if !overMemory && !overEntries {
+			return
+		}
+
+		elem := shard.lru.Back()
+		if elem == nil {
+			return
+		}
+		item := elem.Value.(*CachedUser)
+
+		if atomic.CompareAndSwapInt32(&item.referenced, 1, 0) {
+			shard.lru.MoveToFront(elem)
+			continue
+		}
+
+		// занятая запись сейчас загружается
+		if !c.locks.For(item.id).TryLock() {
+			shard.lru.MoveToFront(elem)
+			continue
+		}
+
+		clean := item.User == nil || !item.User.IsDirty()
+		if !clean && (!overEntries || !c.flush(item.User)) {
+			c.locks.For(item.id).Unlock()
+			shard.lru.MoveToFront(elem)
+			continue
+		}
+
+		c.remove(shard, item)
+		c.locks.For(item.id).Unlock()
+	}
+}
+
+// flush - сохраняет изменения вытесняемого пользователя, false - не удалось
+func (c *Cache) flush(user *store.User) bool {
+	if c.Flush == nil {
+		return false
+	}
+
+	if err := c.Flush(user); err != nil {
+		log.Printf("failed to save user %d before eviction: %v", user.ID, err)
+		return false
+	}
+	return true
+}
+
+// remove - удаляет запись, вызывается под блокировкой части и блокировкой записи
+func (c *Cache) remove(shard *cacheShard, item *CachedUser) {
+	item.removed = true
+	shard.lru.Remove(item.elem)
+	delete(shard.users, item.id)
+	atomic.AddInt64(&c.entries, -1)
+}
+
+func (c *Cache) reserved() int64 {
+	if c.Reserved == nil {
+		return 0
+	}
+	return c.Reserved()
+}
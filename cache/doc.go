@@ -0,0 +1,2 @@
+// Package cache - кеш пользователей в памяти процесса.
+package cache
@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"sync"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// flightGroup - объединяет одновременные загрузки одного пользователя в один запрос к БД,
+// по образцу golang.org/x/sync/singleflight
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[int]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	user *store.User
+	err  error
+}
+
+// Do - выполняет fn, если для id она еще не выполняется, иначе ждет и возвращает результат выполняющейся.
+// shared - результат получен от чужого вызова
+func (g *flightGroup) Do(id int, fn func() (*store.User, error)) (user *store.User, err error, shared bool) {
+	g.mu.Lock()
+	if call, ok := g.calls[id]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.user, call.err, true
+	}
+
+	if g.calls == nil {
+		g.calls = make(map[int]*flightCall)
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[id] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, id)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.user, call.err = fn()
+	return call.user, call.err, false
+}
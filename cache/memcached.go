@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// errMemcachedConflict - значение изменили между gets и cas, либо его нет
+var errMemcachedConflict = errors.New("memcached: cas conflict")
+
+// MemcachedShared - балансы в memcached, общие для всех реплик. Списание - gets и cas с повтором при конфликте.
+// memcached может вытеснить ключ, тогда общий баланс заново берется из БД при следующем списании
+type MemcachedShared struct {
+	Addr string
+	// KeyPrefix - префикс ключей балансов
+	KeyPrefix string
+
+	pool *connPool
+}
+
+func NewMemcachedShared(addr string, poolSize int) *MemcachedShared {
+	return &MemcachedShared{
+		Addr:      addr,
+		KeyPrefix: "balance:",
+		pool: newConnPool(poolSize, time.Second, func() (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, time.Second)
+		}, nil),
+	}
+}
+
+// Debit - атомарно списывает amount, если общий баланс после списания не меньше floor
+func (s *MemcachedShared) Debit(userID, amount, current, floor int) (int, error) {
+	key := s.key(userID)
+	for attempt := 0; attempt < sharedRetries; attempt++ {
+		balance, err := s.withConn(func(c *netConn) (int, error) {
+			balance, cas, ok, err := mcGets(c, key)
+			if err != nil {
+				return 0, err
+			}
+			if !ok {
+				// значения еще нет: кладем текущее, если другая реплика успела раньше - повтор
+				if reply, err := mcStore(c, "add", key, current, ""); err != nil {
+					return 0, err
+				} else if reply != "STORED" {
+					return 0, errMemcachedConflict
+				}
+				if balance, cas, ok, err = mcGets(c, key); err != nil {
+					return 0, err
+				} else if !ok {
+					return 0, errMemcachedConflict
+				}
+			}
+
+			if !store.Covers(int64(balance), amount, int64(floor)) {
+				return 0, store.ErrNotEnoughMoney
+			}
+
+			reply, err := mcStore(c, "cas", key, balance-amount, " "+cas)
+			if err != nil {
+				return 0, err
+			}
+			if reply != "STORED" {
+				return 0, errMemcachedConflict
+			}
+			return balance - amount, nil
+		})
+		if err == errMemcachedConflict {
+			continue
+		}
+		return balance, err
+	}
+	return 0, errors.New("memcached: too many concurrent updates")
+}
+
+// Refund - возвращает amount после неудавшегося списания, если общего значения нет - возвращать некуда
+func (s *MemcachedShared) Refund(userID, amount int) error {
+	_, err := s.withConn(func(c *netConn) (int, error) {
+		if _, err := fmt.Fprintf(c, "incr %s %d\r\n", s.key(userID), amount); err != nil {
+			return 0, err
+		}
+		_, err := mcLine(c)
+		return 0, err
+	})
+	return err
+}
+
+func (s *MemcachedShared) Get(userID int) (int, bool, error) {
+	var found bool
+	balance, err := s.withConn(func(c *netConn) (int, error) {
+		balance, _, ok, err := mcGets(c, s.key(userID))
+		found = ok
+		return balance, err
+	})
+	return balance, found, err
+}
+
+func (s *MemcachedShared) Set(userID, balance int) error {
+	_, err := s.withConn(func(c *netConn) (int, error) {
+		reply, err := mcStore(c, "set", s.key(userID), balance, "")
+		if err == nil && reply != "STORED" {
+			err = fmt.Errorf("memcached: %s", reply)
+		}
+		return 0, err
+	})
+	return err
+}
+
+func (s *MemcachedShared) key(userID int) string {
+	return s.KeyPrefix + strconv.Itoa(userID)
+}
+
+// withConn - выполняет fn на соединении из пула, соединение с сетевой ошибкой закрывается
+func (s *MemcachedShared) withConn(fn func(c *netConn) (int, error)) (int, error) {
+	c, err := s.pool.get()
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := fn(c)
+	s.pool.put(c, err != nil && err != errMemcachedConflict && err != store.ErrNotEnoughMoney)
+	return res, err
+}
+
+// mcGets - значение и cas ключа, ok=false - ключа нет
+func mcGets(c *netConn, key string) (balance int, cas string, ok bool, err error) {
+	if _, err := fmt.Fprintf(c, "gets %s\r\n", key); err != nil {
+		return 0, "", false, err
+	}
+
+	line, err := mcLine(c)
+	if err != nil || line == "END" {
+		return 0, "", false, err
+	}
+
+	// VALUE <key> <flags> <bytes> <cas>
+	fields := strings.Fields(line)
+	if len(fields) != 5 || fields[0] != "VALUE" {
+		return 0, "", false, fmt.Errorf("memcached: unexpected reply %q", line)
+	}
+	size, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return 0, "", false, err
+	}
+	if end, err := mcLine(c); err != nil {
+		return 0, "", false, err
+	} else if end != "END" {
+		return 0, "", false, fmt.Errorf("memcached: unexpected reply %q", end)
+	}
+
+	balance, err = strconv.Atoi(string(data[:size]))
+	return balance, fields[4], err == nil, err
+}
+
+// mcStore - команда записи (set, add, cas) со значением balance, extra - дополнительные аргументы (cas)
+func mcStore(c *netConn, cmd, key string, balance int, extra string) (string, error) {
+	value := strconv.Itoa(balance)
+	if _, err := fmt.Fprintf(c, "%s %s 0 0 %d%s\r\n%s\r\n", cmd, key, len(value), extra, value); err != nil {
+		return "", err
+	}
+	return mcLine(c)
+}
+
+// mcLine - строка ответа без \r\n, ошибки протокола возвращаются как error
+func mcLine(c *netConn) (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR") || strings.HasPrefix(line, "SERVER_ERROR") {
+		return "", fmt.Errorf("memcached: %s", line)
+	}
+	return line, nil
+}
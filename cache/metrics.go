@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// loadBucketsMs - верхние границы корзин гистограммы времени загрузки из БД, мс
+var loadBucketsMs = []int64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+// cacheStats - счетчики обращений к кешу
+type cacheStats struct {
+	hits         int64
+	negativeHits int64
+	misses       int64
+	loadErrors   int64
+	loadTime     histogram
+}
+
+// histogram - гистограмма длительностей с фиксированными корзинами loadBucketsMs и корзиной +Inf
+type histogram struct {
+	counts [11]int64
+	count  int64
+	sumNs  int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(loadBucketsMs) && d > time.Duration(loadBucketsMs[i])*time.Millisecond {
+		i++
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sumNs, int64(d))
+}
+
+// snapshot - накопительные значения корзин в стиле Prometheus: le_<мс> - загрузки не дольше границы
+func (h *histogram) snapshot() map[string]int64 {
+	snap := make(map[string]int64, len(h.counts)+2)
+	var total int64
+	for i := range h.counts {
+		total += atomic.LoadInt64(&h.counts[i])
+		if i < len(loadBucketsMs) {
+			snap["le_"+strconv.FormatInt(loadBucketsMs[i], 10)] = total
+		} else {
+			snap["le_inf"] = total
+		}
+	}
+	snap["count"] = atomic.LoadInt64(&h.count)
+	snap["sum_ms"] = atomic.LoadInt64(&h.sumNs) / int64(time.Millisecond)
+	return snap
+}
+
+// Stats - счетчики попаданий (negative_hits - по запомненному отсутствию), промахов, ошибок загрузки и гистограмма времени загрузки из БД
+func (c *Cache) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"hits":          atomic.LoadInt64(&c.stats.hits),
+		"negative_hits": atomic.LoadInt64(&c.stats.negativeHits),
+		"misses":        atomic.LoadInt64(&c.stats.misses),
+		"load_errors":   atomic.LoadInt64(&c.stats.loadErrors),
+		"load_ms":       c.stats.loadTime.snapshot(),
+	}
+}
@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"bufio"
+	"net"
+	"time"
+)
+
+// sharedRetries - сколько раз повторять списание в общем хранилище при конфликте оптимистичной блокировки
+const sharedRetries = 16
+
+// netConn - соединение с внешним хранилищем и буферизованное чтение ответов
+type netConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// connPool - пул соединений к внешнему хранилищу общих балансов
+type connPool struct {
+	timeout time.Duration
+	conns   chan *netConn
+	// dial - открывает соединение, init - подготавливает его (авторизация и т.п.)
+	dial func() (net.Conn, error)
+	init func(c *netConn) error
+}
+
+func newConnPool(size int, timeout time.Duration, dial func() (net.Conn, error), init func(c *netConn) error) *connPool {
+	return &connPool{timeout: timeout, conns: make(chan *netConn, size), dial: dial, init: init}
+}
+
+// get - свободное соединение из пула или новое
+func (p *connPool) get() (*netConn, error) {
+	select {
+	case c := <-p.conns:
+		c.SetDeadline(time.Now().Add(p.timeout))
+		return c, nil
+	default:
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &netConn{Conn: conn, r: bufio.NewReader(conn)}
+	c.SetDeadline(time.Now().Add(p.timeout))
+	if p.init != nil {
+		if err := p.init(c); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// put - возвращает соединение в пул, broken - закрывает его
+func (p *connPool) put(c *netConn, broken bool) {
+	if broken {
+		c.Close()
+		return
+	}
+
+	select {
+	case p.conns <- c:
+	default:
+		c.Close()
+	}
+}
@@ -0,0 +1,234 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// errRedisNil - ответ nil (нет ключа, либо EXEC отменен из-за WATCH)
+var errRedisNil = errors.New("redis: nil")
+
+// Shared - общий для экземпляров вид балансов поверх store.SharedBalance
+type Shared interface {
+	store.SharedBalance
+	// Get - общий баланс, ok=false - его еще нет
+	Get(userID int) (balance int, ok bool, err error)
+	// Set - устанавливает общий баланс, например после слияния пользователей
+	Set(userID, balance int) error
+}
+
+// RedisShared - балансы в Redis, общие для всех реплик. Списание - оптимистичная блокировка
+// WATCH/MULTI/EXEC по ключу пользователя с повтором при конфликте
+type RedisShared struct {
+	Addr     string
+	Password string
+	DB       int
+	// KeyPrefix - префикс ключей балансов
+	KeyPrefix string
+
+	// pool - соединения, WATCH действует в рамках соединения
+	pool *connPool
+}
+
+// redisConn - соединение с Redis
+type redisConn struct {
+	*netConn
+}
+
+func NewRedisShared(addr, password string, db, poolSize int) *RedisShared {
+	s := &RedisShared{
+		Addr:      addr,
+		Password:  password,
+		DB:        db,
+		KeyPrefix: "balance:",
+	}
+	s.pool = newConnPool(poolSize, time.Second, func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, time.Second)
+	}, s.init)
+	return s
+}
+
+// Debit - атомарно списывает amount, если общий баланс после списания не меньше floor
+func (s *RedisShared) Debit(userID, amount, current, floor int) (int, error) {
+	key := s.key(userID)
+	for attempt := 0; attempt < sharedRetries; attempt++ {
+		balance, err := s.withConn(func(c *redisConn) (int, error) {
+			if _, err := c.do("WATCH", key); err != nil {
+				return 0, err
+			}
+
+			balance := current
+			reply, err := c.do("GET", key)
+			switch {
+			case err == errRedisNil:
+			case err != nil:
+				return 0, err
+			default:
+				if balance, err = strconv.Atoi(reply.(string)); err != nil {
+					return 0, err
+				}
+			}
+
+			if !store.Covers(int64(balance), amount, int64(floor)) {
+				c.do("UNWATCH")
+				return 0, store.ErrNotEnoughMoney
+			}
+
+			if _, err := c.do("MULTI"); err != nil {
+				return 0, err
+			}
+			if _, err := c.do("SET", key, strconv.Itoa(balance-amount)); err != nil {
+				return 0, err
+			}
+			if _, err := c.do("EXEC"); err != nil {
+				return 0, err
+			}
+			return balance - amount, nil
+		})
+		if err == errRedisNil {
+			// ключ изменила другая реплика между WATCH и EXEC
+			continue
+		}
+		return balance, err
+	}
+	return 0, errors.New("redis: too many concurrent updates")
+}
+
+// Refund - возвращает amount после неудавшегося списания
+func (s *RedisShared) Refund(userID, amount int) error {
+	_, err := s.withConn(func(c *redisConn) (int, error) {
+		_, err := c.do("INCRBY", s.key(userID), strconv.Itoa(amount))
+		return 0, err
+	})
+	return err
+}
+
+func (s *RedisShared) Get(userID int) (int, bool, error) {
+	balance, err := s.withConn(func(c *redisConn) (int, error) {
+		reply, err := c.do("GET", s.key(userID))
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(reply.(string))
+	})
+	if err == errRedisNil {
+		return 0, false, nil
+	}
+	return balance, err == nil, err
+}
+
+func (s *RedisShared) Set(userID, balance int) error {
+	_, err := s.withConn(func(c *redisConn) (int, error) {
+		_, err := c.do("SET", s.key(userID), strconv.Itoa(balance))
+		return 0, err
+	})
+	return err
+}
+
+func (s *RedisShared) key(userID int) string {
+	return s.KeyPrefix + strconv.Itoa(userID)
+}
+
+// withConn - выполняет fn на соединении из пула
+func (s *RedisShared) withConn(fn func(c *redisConn) (int, error)) (int, error) {
+	c, err := s.pool.get()
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := fn(&redisConn{c})
+	// после сетевой ошибки или ошибки сервера посреди MULTI соединение в неизвестном состоянии
+	s.pool.put(c, err != nil && err != errRedisNil && err != store.ErrNotEnoughMoney)
+	return res, err
+}
+
+// init - авторизация и выбор базы на новом соединении
+func (s *RedisShared) init(nc *netConn) error {
+	c := &redisConn{nc}
+	if s.Password != "" {
+		if _, err := c.do("AUTH", s.Password); err != nil {
+			return err
+		}
+	}
+	if s.DB != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(s.DB)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redisError - ошибка, которую вернул сервер (-ERR ...), соединение после нее пригодно
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// do - отправляет команду в протоколе RESP и читает ответ
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read - ответ RESP: строка, число, nil (errRedisNil) или массив
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil && err != errRedisNil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply %q", line)
+}
@@ -0,0 +1,2 @@
+// Package cashback - правила кешбэка за списания по категории (тегу) и продавцу с месячным лимитом на пользователя.
+package cashback
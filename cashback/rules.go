@@ -0,0 +1,108 @@
+package cashback
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// Rules - правила кешбэка из таблицы cashback_rules, загруженные в память. Изменения через Set и Delete
+// действуют на этом экземпляре сразу, на остальных - после перезагрузки, не позже чем через Interval
+type Rules struct {
+	Sess *dbr.Session
+	// Interval - как часто перечитывать правила
+	Interval time.Duration
+
+	mu        sync.RWMutex
+	bySubject map[string]store.CashbackRule
+}
+
+// Reload - перечитывает правила, при ошибке остаются прежние
+func (r *Rules) Reload(ctx context.Context) error {
+	list, err := store.LoadCashbackRules(ctx, r.Sess)
+	if err != nil {
+		return err
+	}
+
+	bySubject := make(map[string]store.CashbackRule, len(list))
+	for _, rule := range list {
+		bySubject[rule.Subject] = rule
+	}
+
+	r.mu.Lock()
+	r.bySubject = bySubject
+	r.mu.Unlock()
+	return nil
+}
+
+// Run - перечитывает правила раз в Interval, пока не отменен ctx
+func (r *Rules) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Reload(ctx); err != nil {
+				log.Printf("failed to reload cashback rules: %v", err)
+			}
+		}
+	}
+}
+
+// List - все правила
+func (r *Rules) List() []store.CashbackRule {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]store.CashbackRule, 0, len(r.bySubject))
+	for _, rule := range r.bySubject {
+		list = append(list, rule)
+	}
+	return list
+}
+
+// Set - добавляет или заменяет правило
+func (r *Rules) Set(ctx context.Context, rule store.CashbackRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	if err := store.SetCashbackRule(ctx, r.Sess, rule); err != nil {
+		return err
+	}
+	return r.Reload(ctx)
+}
+
+// Delete - удаляет правило subject, store.ErrNotFound если его нет
+func (r *Rules) Delete(ctx context.Context, subject string) error {
+	if err := store.DeleteCashbackRule(ctx, r.Sess, subject); err != nil {
+		return err
+	}
+	return r.Reload(ctx)
+}
+
+// For - правило для списания с тегом tag у продавца merchant: правило продавца, иначе категории.
+// Пустые tag и merchant не совпадают ни с одним правилом
+func (r *Rules) For(tag, merchant string) (store.CashbackRule, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if merchant != "" {
+		if rule, ok := r.bySubject[store.MerchantSubject(merchant)]; ok {
+			return rule, true
+		}
+	}
+	if tag != "" {
+		if rule, ok := r.bySubject[store.CategorySubject(tag)]; ok {
+			return rule, true
+		}
+	}
+	return store.CashbackRule{}, false
+}
@@ -0,0 +1,188 @@
+package chain
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Skat712/test_balance/store"
+	"github.com/gocraft/dbr/v2"
+)
+
+// headName - строка головы цепочки в ledger_chain_head
+const headName = "ledger"
+
+// Chain - запечатывает новые записи леджера в цепочку хешей и проверяет ее. Запись получает chain_seq -
+// место в цепочке - и hash = sha256(hash предыдущей, поля записи). Записи печатаются в порядке seq,
+// не раньше чем через Settle после вставки, одной транзакцией с блокировкой головы цепочки, поэтому
+// экземпляров может быть несколько. Только Postgres
+type Chain struct {
+	Sess *dbr.Session
+	// Interval - как часто печатать новые записи
+	Interval time.Duration
+	// Settle - записи моложе этого не печатаются, см. projection.Projector
+	Settle time.Duration
+	// BatchSize - сколько записей печатать и проверять за шаг
+	BatchSize int
+}
+
+// Hash - хеш записи tx после записи с хешем prev, у первой записи prev пустой
+func Hash(prev string, tx store.Transaction) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%d|%s|%s|%s",
+		prev, tx.ID, tx.UserID, tx.Amount, tx.Operation, tx.Tag, tx.CreatedAt.UTC().Format(time.RFC3339Nano))))
+	return hex.EncodeToString(sum[:])
+}
+
+// link - запечатанная запись леджера
+type link struct {
+	store.Transaction
+	ChainSeq int64  `db:"chain_seq"`
+	Hash     string `db:"hash"`
+}
+
+// head - последняя запечатанная запись
+type head struct {
+	Seq  int64  `db:"seq"`
+	Hash string `db:"hash"`
+}
+
+// Run - печатает записи раз в Interval, пока не отменен ctx
+func (c *Chain) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	log.Printf("start ledger hash chain, interval %s", c.Interval)
+	for {
+		for {
+			sealed, err := c.Seal(ctx)
+			if err != nil {
+				log.Printf("ledger hash chain failed: %v", err)
+			}
+			if err != nil || sealed < c.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("stop ledger hash chain")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Seal - добавляет в цепочку следующую пачку записей, возвращает их количество
+func (c *Chain) Seal(ctx context.Context) (int, error) {
+	tx, err := c.Sess.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	if _, err := tx.InsertBySql(`INSERT INTO ledger_chain_head (name, seq, hash, updated_at) VALUES (?, 0, '', ?) ON CONFLICT (name) DO NOTHING`,
+		headName, time.Now().UTC()).ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	var h head
+	if err := tx.Select("seq", "hash").From("ledger_chain_head").Where("name = ?", headName).Suffix("FOR UPDATE").LoadOneContext(ctx, &h); err != nil {
+		return 0, err
+	}
+
+	var txs []store.Transaction
+	_, err = tx.Select(store.TransactionColumns...).From("transactions").
+		Where("chain_seq IS NULL AND inserted_at < (now() AT TIME ZONE 'utc') - ? * interval '1 second'", c.Settle.Seconds()).
+		OrderBy("seq").Limit(uint64(c.BatchSize)).LoadContext(ctx, &txs)
+	if err != nil || len(txs) == 0 {
+		return 0, err
+	}
+
+	var query strings.Builder
+	args := make([]interface{}, 0, 3*len(txs))
+	query.WriteString(`UPDATE transactions AS t SET chain_seq = v.chain_seq, hash = v.hash FROM (VALUES `)
+	for i, t := range txs {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		h.Seq++
+		h.Hash = Hash(h.Hash, t)
+		query.WriteString("(?::text, ?::bigint, ?::text)")
+		args = append(args, t.ID, h.Seq, h.Hash)
+	}
+	query.WriteString(`) AS v(id, chain_seq, hash) WHERE t.id = v.id`)
+	if _, err := tx.UpdateBySql(query.String(), args...).ExecContext(ctx); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Update("ledger_chain_head").Set("seq", h.Seq).Set("hash", h.Hash).Set("updated_at", time.Now().UTC()).
+		Where("name = ?", headName).ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	return len(txs), tx.Commit()
+}
+
+// Verification - результат проверки цепочки. Если Valid - false, BrokenAt - первое место, где цепочка
+// не сходится, а Reason - что с ним не так
+type Verification struct {
+	Valid    bool   `json:"valid"`
+	Verified int64  `json:"verified"`
+	HeadSeq  int64  `json:"head_seq"`
+	HeadHash string `json:"head_hash"`
+	BrokenAt int64  `json:"broken_at,omitempty"`
+	// TransactionID - запись в месте разрыва, пусто если записи нет
+	TransactionID string `json:"transaction_id,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+// Verify - проходит цепочку от начала до головы на момент запуска и пересчитывает хеши. Изменение записи
+// дает несовпадение хеша, удаление - пропуск в chain_seq, удаление хвоста - расхождение с головой
+func (c *Chain) Verify(ctx context.Context) (Verification, error) {
+	var h head
+	n, err := c.Sess.Select("seq", "hash").From("ledger_chain_head").Where("name = ?", headName).LoadContext(ctx, &h)
+	if err != nil {
+		return Verification{}, err
+	}
+	v := Verification{Valid: true, HeadSeq: h.Seq, HeadHash: h.Hash}
+	if n == 0 {
+		return v, nil
+	}
+
+	columns := append(append([]string{}, store.TransactionColumns...), "chain_seq", "hash")
+	var seq int64
+	prev := ""
+	for seq < h.Seq {
+		var links []link
+		_, err := c.Sess.Select(columns...).From("transactions").
+			Where("chain_seq > ? AND chain_seq <= ?", seq, h.Seq).OrderBy("chain_seq").
+			Limit(uint64(c.BatchSize)).LoadContext(ctx, &links)
+		if err != nil {
+			return Verification{}, err
+		}
+		if len(links) == 0 {
+			return v.broken(seq+1, "", "chain is shorter than its head"), nil
+		}
+		for _, l := range links {
+			if l.ChainSeq != seq+1 {
+				return v.broken(seq+1, "", "record is missing"), nil
+			}
+			if Hash(prev, l.Transaction) != l.Hash {
+				return v.broken(l.ChainSeq, l.ID, "hash mismatch: record or its predecessor was changed"), nil
+			}
+			seq, prev = l.ChainSeq, l.Hash
+			v.Verified++
+		}
+	}
+	if prev != h.Hash {
+		return v.broken(seq, "", "last record does not match the chain head"), nil
+	}
+	return v, nil
+}
+
+func (v Verification) broken(seq int64, id, reason string) Verification {
+	v.Valid, v.BrokenAt, v.TransactionID, v.Reason = false, seq, id, reason
+	return v
+}
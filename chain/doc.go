@@ -0,0 +1,3 @@
+// Package chain - цепочка хешей леджера: каждая запись получает хеш своего содержимого и хеша предыдущей,
+// поэтому изменение, удаление или вставка в уже запечатанную историю видны при проверке цепочки.
+package chain
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Client - клиент HTTP API сервиса балансов
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// APIKey - ключ API для изменяющих запросов, пусто - не передается
+	APIKey string
+}
+
+// Error - ошибка, которую вернул сервис
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("balance api: %d %s", e.StatusCode, e.Message)
+}
+
+// Version - информация о сборке сервиса
+type Version struct {
+	GitSHA    string `json:"git_sha"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// Capabilities - возможности и ограничения сервиса, см. GET /capabilities
+type Capabilities struct {
+	Version  int             `json:"version"`
+	Features map[string]bool `json:"features"`
+	Limits   struct {
+		MaxAmount              int64 `json:"max_amount"`
+		MaxBatchSize           int   `json:"max_batch_size"`
+		MaxTagLength           int   `json:"max_tag_length"`
+		MaxSupportTokenSeconds int64 `json:"max_support_token_ttl_seconds"`
+	} `json:"limits"`
+	PersistenceMode string `json:"persistence_mode"`
+}
+
+// Has - включена ли возможность, неизвестные сервису возможности выключены
+func (c *Capabilities) Has(feature string) bool {
+	return c.Features[feature]
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// DecreaseBalance - списывает amount с баланса пользователя
+func (c *Client) DecreaseBalance(ctx context.Context, userID, amount int) error {
+	body := map[string]int{
+		"user_id": userID,
+		"amount":  amount,
+	}
+	return c.do(ctx, http.MethodPost, "/user/balance", body, nil)
+}
+
+// IncreaseBalance - пополняет баланс пользователя на amount, с partial - не больше, чем до максимального баланса.
+// Возвращает сумму, на которую баланс пополнен
+func (c *Client) IncreaseBalance(ctx context.Context, userID, amount int, partial bool) (int, error) {
+	body := map[string]interface{}{
+		"user_id": userID,
+		"amount":  amount,
+		"partial": partial,
+	}
+	var out struct {
+		Credited int `json:"credited"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/user/credit", body, &out); err != nil {
+		return 0, err
+	}
+	return out.Credited, nil
+}
+
+// Version - информация о сборке, которая обслуживает запросы
+func (c *Client) Version(ctx context.Context) (*Version, error) {
+	var v Version
+	if err := c.do(ctx, http.MethodGet, "/version", nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Capabilities - возможности сервиса для определения доступных функций
+func (c *Client) Capabilities(ctx context.Context) (*Capabilities, error) {
+	var caps Capabilities
+	if err := c.do(ctx, http.MethodGet, "/capabilities", nil, &caps); err != nil {
+		return nil, err
+	}
+	return &caps, nil
+}
+
+// do - выполняет запрос, в out декодируется успешный ответ
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, &body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return &Error{StatusCode: resp.StatusCode, Message: apiErr.Error}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,2 @@
+// Package client - Go клиент для HTTP API сервиса балансов (контракт v1).
+package client
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/auth"
+	"github.com/Skat712/test_balance/store"
+)
+
+// apiKeyUsage - синтаксис подкоманды api-key
+const apiKeyUsage = "usage: balanced api-key create [-scopes service,admin] NAME | revoke NAME | list"
+
+// runAPIKey - подкоманда `balanced [flags] api-key create [-scopes service,admin] NAME | revoke NAME | list`.
+// Созданный ключ печатается один раз, в БД остается только его хеш
+func runAPIKey(db *dbr.Connection, args []string) {
+	if len(args) == 0 {
+		log.Fatal(apiKeyUsage)
+	}
+
+	fs := flag.NewFlagSet("api-key "+args[0], flag.ExitOnError)
+	scopes := fs.String("scopes", auth.ScopeService, "comma separated scopes of the new key: service (debits and other changes) and/or admin (/admin/* routes)")
+	fs.Parse(args[1:])
+	if (args[0] == "list") != (fs.NArg() == 0) || fs.NArg() > 1 {
+		log.Fatal(apiKeyUsage)
+	}
+	name := fs.Arg(0)
+
+	ctx := context.Background()
+	sess := db.NewSession(nil)
+	switch args[0] {
+	case "create":
+		list := strings.Split(*scopes, ",")
+		for _, scope := range list {
+			if !auth.ValidScope(scope) {
+				log.Fatalf("unknown scope %q", scope)
+			}
+		}
+		key, err := auth.NewAPIKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := store.CreateAPIKey(ctx, sess, name, auth.HashAPIKey(key), list); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(key)
+	case "revoke":
+		if err := store.RevokeAPIKey(ctx, sess, name); err != nil {
+			log.Fatalf("revoke api key %q: %v", name, err)
+		}
+		log.Printf("api key %q revoked, instances stop accepting it after the next reload", name)
+	case "list":
+		keys, err := store.LoadAPIKeys(ctx, sess, true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printJSON(keys)
+	default:
+		log.Fatalf("unknown api-key command %q", args[0])
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// runCheck - подкоманда `balanced [flags] check [-repair] [-trust balance|ledger] [-limit N]`: проверяет, что балансы всех пользователей равны суммам их записей леджера,
+// а проводки записей сбалансированы, и печатает план исправления в JSON. С -repair исправляет найденное
+// и проверяет заново. Код выхода 1 - расхождения остались
+func runCheck(storage store.Storage, args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "apply the repair plan")
+	trust := fs.String("trust", store.TrustBalance, "which side is correct for balance mismatches: balance (add adjustment ledger rows) or ledger (set balances to ledger sums)")
+	limit := fs.Int("limit", 10000, "report and repair at most this many problems of each kind per pass")
+	fs.Parse(args)
+
+	if err := store.ValidateTrust(*trust); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	report, err := storage.CheckConsistency(ctx, *limit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printJSON(report)
+
+	// расхождений больше limit: каждый проход исправляет следующую порцию
+	for *repair && !report.Consistent() {
+		res, err := storage.RepairConsistency(ctx, report, *trust)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("repaired: %d adjusted, %d rebalanced, %d reposted, %d skipped", res.Adjusted, res.Rebalanced, res.Reposted, res.Skipped)
+
+		truncated := report.Truncated
+		if report, err = storage.CheckConsistency(ctx, *limit); err != nil {
+			log.Fatal(err)
+		}
+		if !truncated || res.Adjusted+res.Rebalanced+res.Reposted == 0 {
+			break
+		}
+	}
+
+	if !report.Consistent() {
+		if *repair {
+			printJSON(report)
+		}
+		os.Exit(1)
+	}
+	log.Println("balances and ledger are consistent")
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,1039 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/api"
+	"github.com/Skat712/test_balance/audit"
+	"github.com/Skat712/test_balance/auth"
+	"github.com/Skat712/test_balance/cache"
+	"github.com/Skat712/test_balance/cashback"
+	"github.com/Skat712/test_balance/chain"
+	"github.com/Skat712/test_balance/denylist"
+	"github.com/Skat712/test_balance/erp"
+	"github.com/Skat712/test_balance/fees"
+	"github.com/Skat712/test_balance/fraud"
+	"github.com/Skat712/test_balance/journal"
+	"github.com/Skat712/test_balance/leader"
+	"github.com/Skat712/test_balance/limits"
+	"github.com/Skat712/test_balance/projection"
+	"github.com/Skat712/test_balance/receipt"
+	"github.com/Skat712/test_balance/reconcile"
+	"github.com/Skat712/test_balance/slo"
+	"github.com/Skat712/test_balance/snapshot"
+	"github.com/Skat712/test_balance/store"
+	"github.com/Skat712/test_balance/writeback"
+)
+
+// информация о сборке, задается через ldflags:
+// go build -ldflags "-X main.gitSHA=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/balanced
+var (
+	gitSHA    = "unknown"
+	buildTime = "unknown"
+)
+
+// startHttpServer - HTTP сервер, с tlsCfg - HTTPS
+func startHttpServer(port int, handler http.Handler, tlsCfg *tls.Config, wg *sync.WaitGroup) *http.Server {
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: handler, TLSConfig: tlsCfg}
+
+	go func() {
+		defer wg.Done()
+		var err error
+		if tlsCfg != nil {
+			log.Printf("Starting application on port %d (https)", port)
+			// сертификат уже в TLSConfig
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Starting application on port %d", port)
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatalf("ListenAndServe(): %v", err)
+		}
+	}()
+
+	return srv
+}
+
+// newERPExporter - выгрузка в ERP в директорию или S3, в зависимости от заданных флагов
+func newERPExporter(sess *dbr.Session, period time.Duration, templatePath, dir string, s3 *erp.S3Sink) (*erp.Exporter, error) {
+	var text string
+	if templatePath != "" {
+		data, err := os.ReadFile(templatePath)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+
+	tmpl, err := erp.ParseTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+
+	var sink erp.Sink
+	switch {
+	case s3.Endpoint != "":
+		if s3.Bucket == "" {
+			return nil, errors.New("erp_s3_bucket is required")
+		}
+		sink = s3
+	case dir != "":
+		sink = &erp.DirSink{Dir: dir}
+	default:
+		return nil, errors.New("erp export needs erp_export_dir or erp_s3_endpoint")
+	}
+
+	return &erp.Exporter{
+		Sess:     sess,
+		Template: tmpl,
+		Sink:     sink,
+		Period:   period,
+		Since:    time.Now().Add(-period),
+	}, nil
+}
+
+/////// ТОЧКА ВХОДА /////
+
+func main() {
+	// парсим входные параметры
+	var profile = flag.String("profile", "prod", "defaults for the environment: dev, staging or prod")
+	var resetData = flag.Bool("reset_data", false, "delete all users on start (dev only), combine with seed_users to start from test data")
+	var seedUsers = flag.Int("seed_users", 0, "create this many test users on start if there are no users yet, 0 - disabled")
+	var seedBalance = flag.Int64("seed_balance", 10000, "initial balance of seeded users")
+	var verbose = flag.Bool("verbose", false, "log source lines and every request")
+	var port = flag.Int("port", 8080, "listen port")
+	var tlsOpts tlsOptions
+	flag.StringVar(&tlsOpts.Mode, "tls", "", "HTTPS mode: off, files (tls_cert_file and tls_key_file) or acme (Let's Encrypt certificates obtained and renewed automatically), empty - files if tls_cert_file is set, otherwise off")
+	flag.StringVar(&tlsOpts.CertFile, "tls_cert_file", "", "certificate (PEM) for files mode")
+	flag.StringVar(&tlsOpts.KeyFile, "tls_key_file", "", "private key (PEM) of tls_cert_file")
+	flag.StringVar(&tlsOpts.ClientCAFile, "tls_client_ca_file", "", "require client certificates signed by these CAs (PEM bundle), empty - no client certificates")
+	flag.Func("tls_client_san", "allowed client certificate SAN (DNS name, URI such as a SPIFFE ID, IP or email), repeat for several, none - any certificate of tls_client_ca_file", func(san string) error {
+		tlsOpts.ClientSANs = append(tlsOpts.ClientSANs, san)
+		return nil
+	})
+	flag.Func("tls_acme_domain", "domain to obtain a certificate for in acme mode, repeat for several", func(domain string) error {
+		tlsOpts.ACMEDomains = append(tlsOpts.ACMEDomains, domain)
+		return nil
+	})
+	flag.StringVar(&tlsOpts.ACMECacheDir, "tls_acme_cache_dir", "", "directory keeping acme certificates and account key across restarts")
+	flag.StringVar(&tlsOpts.ACMEEmail, "tls_acme_email", "", "contact email of the acme account")
+	flag.StringVar(&tlsOpts.ACMEDirectory, "tls_acme_directory", "", "acme directory URL, empty - Let's Encrypt production")
+	var httpRedirectPort = flag.Int("http_redirect_port", 0, "with HTTPS also listen for plain HTTP on this port (e.g. 80) and redirect to HTTPS, serving acme http-01 challenges, 0 - disabled")
+	var dbDriver = flag.String("db_driver", "postgres", "storage backend: postgres (lib/pq), pgx (postgres via pgx connection pool), sqlite (single instance, local development) or memory (tests and demos, data is lost on restart)")
+	var pool store.PoolConfig
+	flag.IntVar(&pool.MaxOpenConns, "db_max_open_conns", 50, "postgres: maximum open connections, 0 - unlimited")
+	flag.IntVar(&pool.MaxIdleConns, "db_max_idle_conns", 50, "postgres: idle connections kept open to avoid reconnecting under load")
+	flag.DurationVar(&pool.ConnMaxLifetime, "db_conn_max_lifetime", 30*time.Minute, "postgres: reopen connections older than this, 0 - never")
+	var pgxPool store.PgxPoolConfig
+	var pgxMinConns = flag.Int("pgx_min_conns", 0, "pgx: minimum open connections kept by the pool")
+	var pgxMaxConns = flag.Int("pgx_max_conns", 0, "pgx: maximum pool size, 0 - pool default max(4, NumCPU)")
+	flag.DurationVar(&pgxPool.MaxConnLifetime, "pgx_max_conn_lifetime", 0, "pgx: reopen connections older than this, 0 - pool default (1h)")
+	flag.DurationVar(&pgxPool.MaxConnIdleTime, "pgx_max_conn_idle_time", 0, "pgx: close connections idle longer than this, 0 - pool default (30m)")
+	flag.DurationVar(&pgxPool.HealthCheckPeriod, "pgx_health_check_period", 0, "pgx: how often idle connections are checked, 0 - pool default (1m)")
+	var replicaDSNs []string
+	flag.Func("db_replica", "postgres read replica connection string, repeat for several replicas; user and ledger reads go there, writes go to db_connection_string", func(dsn string) error {
+		replicaDSNs = append(replicaDSNs, dsn)
+		return nil
+	})
+	var replicaMaxLag = flag.Duration("db_replica_max_lag", time.Second, "read from primary while a replica lags behind more than this")
+	var replicaCheckInterval = flag.Duration("db_replica_check_interval", time.Second, "how often read replicas are checked")
+	var statementTimeout = flag.Duration("db_statement_timeout", 30*time.Second, "postgres: server cancels statements running longer than this, 0 - disabled")
+	var queryTimeout = flag.Duration("db_query_timeout", 5*time.Second, "how long a request waits for one storage query, 0 - no limit")
+	var retryAttempts = flag.Int("db_retry_attempts", 3, "attempts of a storage call failing with a transient error (serialization failure, deadlock, lost connection), 1 - no retries")
+	var retryBase = flag.Duration("db_retry_base", 20*time.Millisecond, "first retry pause, doubled for every next one and randomized")
+	var retryMax = flag.Duration("db_retry_max", 500*time.Millisecond, "longest retry pause")
+	var breakerFailures = flag.Int("db_breaker_failures", 5, "fail storage calls fast with 503 after this many consecutive errors, 0 - disabled")
+	var breakerOpenFor = flag.Duration("db_breaker_open_for", 5*time.Second, "how long to fail fast before probing storage again")
+	var sqlitePath = flag.String("sqlite_path", "balance.db", "database file for sqlite storage backend")
+	var psqlInfo = flag.String("db_connection_string", "host=localhost port=5432 user=skat password=123456 dbname=test_app sslmode=disable", "")
+	saveCfg := writeback.DefaultConfig()
+	flag.IntVar(&saveCfg.Shards, "save_shards", saveCfg.Shards, "number of background save shards")
+	flag.DurationVar(&saveCfg.FlushInterval, "save_flush_interval", saveCfg.FlushInterval, "how often background save checks pending users")
+	flag.DurationVar(&saveCfg.Staleness, "save_staleness", saveCfg.Staleness, "save users not updated for longer than this")
+	flag.IntVar(&saveCfg.FlushThreshold, "save_flush_threshold", saveCfg.FlushThreshold, "save all pending users of a shard after N updates, 0 - disabled")
+	flag.IntVar(&saveCfg.BatchSize, "save_batch_size", saveCfg.BatchSize, "users saved by one multi-row statement")
+	flag.IntVar(&saveCfg.CopyThreshold, "save_copy_threshold", saveCfg.CopyThreshold, "save all due users with one COPY when at least this many are due, 0 - disabled")
+	flag.BoolVar(&saveCfg.Adaptive, "save_adaptive", saveCfg.Adaptive, "adapt background save interval to load, save_staleness becomes the upper bound")
+	flag.DurationVar(&saveCfg.MinFlushInterval, "save_min_flush_interval", saveCfg.MinFlushInterval, "lowest interval in adaptive mode")
+	flag.DurationVar(&saveCfg.SaveTimeout, "save_timeout", saveCfg.SaveTimeout, "how long background save waits for one statement, 0 - no limit")
+	flag.IntVar(&saveCfg.QueueSize, "save_queue_size", saveCfg.QueueSize, "capacity of the save queue of each shard")
+	flag.StringVar(&saveCfg.Backpressure, "save_backpressure", saveCfg.Backpressure, "policy when a save queue is full: block, error (reject debits with 503) or spill (to save_spill_dir)")
+	flag.StringVar(&saveCfg.SpillDir, "save_spill_dir", "", "directory for save queue overflow files of the spill policy")
+	flag.DurationVar(&saveCfg.RetryBase, "save_retry_base", saveCfg.RetryBase, "initial backoff after a failed background save")
+	flag.DurationVar(&saveCfg.RetryMax, "save_retry_max", saveCfg.RetryMax, "maximum backoff between background save retries")
+	flag.IntVar(&saveCfg.MaxAttempts, "save_max_attempts", saveCfg.MaxAttempts, "failed attempts before changes go to the dead-letter file")
+	var writerLockEnabled = flag.Bool("writer_lock", false, "postgres: only the instance holding an advisory lock runs background save, others keep changes queued until they get it")
+	var writerLockKey = flag.Int64("writer_lock_key", store.DefaultWriterLockKey, "advisory lock key shared by instances of one database")
+	var writerLockInterval = flag.Duration("writer_lock_interval", 5*time.Second, "how often the writer lock is requested and its connection checked")
+	var leaderElection = flag.Bool("leader_election", false, "kubernetes: only the replica holding a Lease runs background save, others write through to the database")
+	var leaseName = flag.String("leader_election_lease", "balanced", "name of the Lease object shared by replicas")
+	var leaseNamespace = flag.String("leader_election_namespace", "", "namespace of the Lease, empty - namespace of the pod")
+	var leaseIdentity = flag.String("leader_election_id", "", "name of this replica in the Lease, empty - hostname (pod name)")
+	var leaseDuration = flag.Duration("leader_election_lease_duration", 15*time.Second, "how long other replicas wait before taking over a Lease that is not renewed")
+	var leaseRenewDeadline = flag.Duration("leader_election_renew_deadline", 10*time.Second, "leader switches to write-through if it could not renew the Lease for this long")
+	var leaseRetryPeriod = flag.Duration("leader_election_retry_period", 2*time.Second, "how often replicas try to acquire or renew the Lease")
+	var deadLetterPath = flag.String("dead_letter_file", "", "file for changes that could not be saved (JSON lines), empty - retry forever")
+	var shutdownFlushTimeout = flag.Duration("shutdown_flush_timeout", 30*time.Second, "deadline for saving pending users on shutdown")
+	var persistenceMode = flag.String("persistence_mode", api.PersistAsync, "balance persistence: async (write-behind), sync (write-through) or strict (debit in a DB transaction with row lock, bypassing the cache)")
+	var locklessDebit = flag.Bool("debit_lockless", false, "async mode: reserve balance with compare-and-swap outside the user lock, cuts contention for very hot users")
+	var currency = flag.String("currency", "", "currency of balances, imported users in another currency are rejected, empty - not checked")
+	var allowFormParams = flag.Bool("allow_form_params", false, "accept debit parameters from query string and urlencoded form (legacy integrations)")
+	sloCfg := slo.DefaultConfig()
+	flag.DurationVar(&sloCfg.Window, "slo_window", sloCfg.Window, "SLO compliance window")
+	flag.Float64Var(&sloCfg.AvailabilityTarget, "slo_availability", sloCfg.AvailabilityTarget, "availability SLO target (share of non-5xx responses)")
+	flag.DurationVar(&sloCfg.LatencyThreshold, "slo_latency_threshold", sloCfg.LatencyThreshold, "requests faster than this count as good for latency SLO")
+	flag.Float64Var(&sloCfg.LatencyTarget, "slo_latency", sloCfg.LatencyTarget, "latency SLO target (share of requests under threshold)")
+	var journalDir = flag.String("journal_dir", "", "directory for the write-ahead journal of unsaved balance changes, empty - disabled")
+	var journalSync = flag.Bool("journal_sync", true, "fsync the journal on every balance change")
+	var auditLogPath = flag.String("audit_log", "", "audit log file (JSON lines), empty - stderr")
+	var receiptSecret = flag.String("receipt_secret", "", "HMAC secret for transaction receipts, empty - random per process")
+	var apiKeysEnabled = flag.Bool("api_keys", false, "require an API key from the api_keys table in X-API-Key for debits and credits and for all other requests except GET, HEAD and OPTIONS, see the api-key subcommand")
+	var apiKeysReload = flag.Duration("api_keys_reload_interval", 30*time.Second, "how often API keys are reloaded, created and revoked keys take effect after this")
+	var spendLimitsEnabled = flag.Bool("spend_limits", false, "enforce daily and weekly spend limits from the spend_limits table, see /admin/spend-limits")
+	var spendLimitsReload = flag.Duration("spend_limits_reload_interval", 30*time.Second, "how often spend limits are reloaded, limits changed on other instances take effect after this")
+	var feeSchedule = flag.String("fees", "", `fees charged with debits as a separate ledger line, "operation[:tag]=flat+percent%,...", e.g. "debit=10+1.5%,debit:sms=0.5%"`)
+	var maxBalance = flag.Int64("max_balance", 0, "credits may not raise a balance above this unless the user has its own max balance, 0 - no limit")
+	var bonusTTL = flag.Duration("bonus_ttl", 0, "enable the bonus balance: bonus credits (POST /user/bonus) are spent before the main balance and expire after this unless the request sets days, 0 - disabled")
+	var bonusSweepInterval = flag.Duration("bonus_sweep_interval", time.Hour, "how often expired bonuses are debited")
+	var referrerAmount = flag.Int("referral_referrer_amount", 0, "credit the referrer this much for each user it refers (POST /user/{id}/referral)")
+	var refereeAmount = flag.Int("referral_referee_amount", 0, "credit a referred user this much; referrals are enabled when either amount is positive")
+	var schedulesEnabled = flag.Bool("schedules", false, "enable recurring debits: created with POST /user/{id}/schedules and executed by a background worker")
+	var scheduleInterval = flag.Duration("schedule_interval", time.Minute, "how often due recurring debits are executed")
+	var scheduleRetry = flag.Duration("schedule_retry_interval", time.Hour, "how soon a failed recurring debit is retried, never later than its next regular run")
+	var scheduleMaxFailures = flag.Int("schedule_max_failures", 3, "pause a recurring debit after this many failed debits in a row, 0 - never")
+	var scheduledOpsEnabled = flag.Bool("scheduled_operations", false, "enable future-dated debits, credits and transfers: created with POST /user/{id}/scheduled-operations and executed by a background worker")
+	var scheduledOpsInterval = flag.Duration("scheduled_operations_interval", 10*time.Second, "how often due scheduled operations are executed")
+	var disputesEnabled = flag.Bool("disputes", false, "enable disputes on credits: POST /transactions/{id}/dispute holds the credited amount until the dispute is resolved")
+	var reversalsEnabled = flag.Bool("reversals", false, "enable operator reversals: POST /transactions/{id}/reverse (admin scope) writes a compensating ledger entry, once per transaction")
+	var escrowsEnabled = flag.Bool("escrows", false, "enable escrow deals: POST /escrows debits the payer, POST /escrows/{id}/release|return settles the deal")
+	var escrowTimeout = flag.Duration("escrow_timeout", 7*24*time.Hour, "how soon a deal without a decision is settled by its on_timeout unless the request sets expires_at")
+	var escrowInterval = flag.Duration("escrow_interval", 10*time.Second, "how often expired escrow deals are settled")
+	var interestRate = flag.Int("interest_rate", 0, "accrue interest on balances at this annual rate in basis points (500 = 5%): daily accruals are paid out once a month, 0 - disabled")
+	var interestThreshold = flag.Int64("interest_threshold", 0, "accrue interest only on balances above this")
+	var interestInterval = flag.Duration("interest_interval", time.Hour, "how often the interest job runs, interest is accrued once a day however often it runs")
+	var cashbackEnabled = flag.Bool("cashback", false, "credit cashback after debits by the rules in the cashback_rules table, see /admin/cashback-rules")
+	var cashbackReload = flag.Duration("cashback_reload_interval", 30*time.Second, "how often cashback rules are reloaded, rules changed on other instances take effect after this")
+	var promoCodesEnabled = flag.Bool("promo_codes", false, "enable promo codes: managed under /admin/promo-codes, redeemed with POST /user/{id}/redeem")
+	var pocketsEnabled = flag.Bool("pockets", false, "enable named pockets: sub-balances in the pockets table with transfers between them and debits from a chosen pocket")
+	var pendingDebitsEnabled = flag.Bool("pending_debits", false, "allow the queue insufficient funds policy: the unpaid remainder of a debit waits in the pending_debits table and is debited when funds arrive")
+	var approvalThreshold = flag.Int("approval_threshold", 0, "debits above this amount wait for approval by another authenticated caller in /admin/approvals (needs api_keys, jwt_issuer or tls_client_ca_file), 0 - disabled")
+	var denylistEnabled = flag.Bool("denylist", false, "reject requests to users and from callers in the denylist table, see /admin/denylist")
+	var denylistReload = flag.Duration("denylist_reload_interval", 10*time.Second, "how often the denylist is reloaded, entries added on other instances take effect after this")
+	var velocityMax = flag.Int("fraud_velocity_max", 0, "debits of one user allowed within fraud_velocity_window, 0 - rule disabled")
+	var velocityWindow = flag.Duration("fraud_velocity_window", time.Minute, "sliding window of the fraud_velocity_max rule")
+	var velocityAction = flag.String("fraud_velocity_action", "reject", "what to do with debits over fraud_velocity_max: reject or flag")
+	var spikeFactor = flag.Float64("fraud_spike_factor", 0, "flag debits larger than this multiple of the user's average recent debit, 0 - rule disabled")
+	var spikeHistory = flag.Int("fraud_spike_history", 20, "recent debits per user averaged by the fraud_spike_factor rule")
+	var spikeMinHistory = flag.Int("fraud_spike_min_history", 5, "debits a user needs before the fraud_spike_factor rule applies")
+	var spikeAction = flag.String("fraud_spike_action", "flag", "what to do with debits over fraud_spike_factor: reject or flag")
+	var jwtIssuer = flag.String("jwt_issuer", "", "accept JWTs of this OAuth2 issuer (iss) in Authorization: Bearer, empty - disabled")
+	var jwtAudience = flag.String("jwt_audience", "", "required JWT audience (aud), empty - not checked")
+	var jwtJWKSURL = flag.String("jwt_jwks_url", "", "JWKS URL with signing keys of jwt_issuer")
+	var jwtSubjectClaim = flag.String("jwt_subject_claim", "sub", "JWT claim identifying the caller in the audit log")
+	var jwtJWKSRefresh = flag.Duration("jwt_jwks_refresh_interval", time.Hour, "how often JWKS keys are reloaded, unknown key ids reload them at most once a minute")
+	var maxInFlight = flag.Int("max_in_flight", 0, "requests processed at once, excess requests get 503 right away, 0 - unlimited")
+	var userRateLimit = flag.Float64("rate_limit_user", 0, "requests per second to one user (debits and GET /user/{id}), 0 - unlimited")
+	var userRateBurst = flag.Int("rate_limit_user_burst", 20, "requests to one user allowed at once above rate_limit_user")
+	var ipRateLimit = flag.Float64("rate_limit_ip", 0, "requests per second from one client address, 0 - unlimited")
+	var ipRateBurst = flag.Int("rate_limit_ip_burst", 100, "requests from one address allowed at once above rate_limit_ip")
+	var trustForwardedFor = flag.Bool("trust_x_forwarded_for", false, "take the client address for rate_limit_ip from X-Forwarded-For (only behind a proxy that sets it)")
+	var supportTokenSecret = flag.String("support_token_secret", "", "HMAC secret for support tokens, empty - random per process")
+	var erpPeriod = flag.Duration("erp_export_period", 0, "ledger export period for ERP (e.g. 24h), 0 - disabled")
+	var erpTemplate = flag.String("erp_export_template", "", "text/template file with ERP import format, empty - built-in CSV")
+	var erpDir = flag.String("erp_export_dir", "", "deliver ERP export files to this directory")
+	var erpS3Endpoint = flag.String("erp_s3_endpoint", "", "deliver ERP export files to S3 endpoint (credentials from AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY)")
+	var erpS3Region = flag.String("erp_s3_region", "us-east-1", "S3 region for ERP export")
+	var erpS3Bucket = flag.String("erp_s3_bucket", "", "S3 bucket for ERP export")
+	var erpS3Prefix = flag.String("erp_s3_prefix", "", "S3 key prefix for ERP export")
+	var projectionInterval = flag.Duration("projection_interval", 0, "how often ledger analytics projections are updated, 0 - disabled")
+	var chainInterval = flag.Duration("ledger_chain_interval", 0, "how often new ledger records are sealed into the hash chain, 0 - disabled")
+	var snapshotInterval = flag.Duration("balance_snapshot_interval", 0, "how often finished days are checked for end-of-day balance snapshots, 0 - disabled")
+	var snapshotSettle = flag.Duration("balance_snapshot_settle", 15*time.Minute, "how long after the end of a UTC day its balance snapshot is taken")
+	var cacheMemoryLimit = flag.Int64("cache_memory_limit", 0, "hard memory budget for cache in bytes, 0 - unlimited")
+	var responseCacheTTL = flag.Duration("response_cache_ttl", 0, "cache GET /user/{id} responses for this long, invalidated on change, 0 - disabled")
+	var cacheBackend = flag.String("cache_backend", "memory", "balance view: memory (per replica), redis or memcached (shared by replicas)")
+	var redisAddr = flag.String("redis_addr", "localhost:6379", "redis address for redis cache backend")
+	var redisPassword = flag.String("redis_password", "", "redis password")
+	var redisDB = flag.Int("redis_db", 0, "redis database")
+	var memcachedAddr = flag.String("memcached_addr", "localhost:11211", "memcached address for memcached cache backend")
+	var cacheMaxEntries = flag.Int("cache_max_entries", 0, "maximum cached users, least recently used are evicted after saving their changes, 0 - unlimited")
+	var cacheTTL = flag.Duration("cache_ttl", 0, "evict users without unsaved changes not accessed for this long, 0 - never")
+	var cacheNegativeTTL = flag.Duration("cache_negative_ttl", 5*time.Second, "remember that a user does not exist for this long, 0 - always ask the database")
+	var warmUpRecent = flag.Int("warmup_recent_users", 0, "preload this many most recently active users into the cache before reporting ready")
+	var warmUpIDs = flag.String("warmup_user_ids", "", "comma separated user ids to preload into the cache before reporting ready")
+	var cacheTrackChanges = flag.Bool("cache_track_changes", false, "every cache_janitor_interval evict cached users whose row was written by another instance since loading (by users.updated_at)")
+	var cacheJanitorInterval = flag.Duration("cache_janitor_interval", time.Minute, "how often expired cache entries are evicted")
+	var reconcileInterval = flag.Duration("reconcile_interval", 0, "how often cached balances are compared with the database, 0 - disabled")
+	var reconcileSample = flag.Int("reconcile_sample", 100, "how many cached users are compared with the database each reconcile_interval")
+	var reconcileCorrect = flag.Bool("reconcile_correct", false, "correct cached balances that diverge from the database instead of only reporting them")
+	flag.Parse()
+
+	if err := applyProfile(*profile); err != nil {
+		log.Fatal(err)
+	}
+
+	if *resetData && *profile == "prod" {
+		log.Fatal("reset_data is not allowed with prod profile")
+	}
+
+	if *verbose {
+		log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
+	}
+
+	if *persistenceMode != api.PersistAsync && *persistenceMode != api.PersistSync && *persistenceMode != api.PersistStrict {
+		log.Fatalf("unknown persistence mode %q", *persistenceMode)
+	}
+
+	tlsCfg, certManager, err := tlsOpts.config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsCfg == nil && *httpRedirectPort > 0 {
+		log.Fatalf("http_redirect_port requires HTTPS, see -tls")
+	}
+
+	if env := os.Getenv("PG_CONNECTION_STRING"); len(env) > 0 {
+		*psqlInfo = env
+	}
+
+	if flag.Arg(0) == "migrate" {
+		if !isPostgres(*dbDriver) {
+			log.Fatalf("migrations are for postgres only, sqlite schema is created on start")
+		}
+		runMigrate(*psqlInfo, flag.Args()[1:])
+		return
+	}
+
+	// инициализация базы
+	if isPostgres(*dbDriver) {
+		*psqlInfo = store.WithStatementTimeout(*psqlInfo, *statementTimeout)
+		for i := range replicaDSNs {
+			replicaDSNs[i] = store.WithStatementTimeout(replicaDSNs[i], *statementTimeout)
+		}
+	}
+	pgxPool.MinConns, pgxPool.MaxConns = int32(*pgxMinConns), int32(*pgxMaxConns)
+	dbConn, storage, err := openStorage(*dbDriver, *psqlInfo, *sqlitePath, pool, pgxPool)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if flag.Arg(0) == "check" {
+		if dbConn == nil {
+			log.Fatalf("check needs a database, in-memory storage starts empty")
+		}
+		runCheck(storage, flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "api-key" {
+		if dbConn == nil {
+			log.Fatalf("api keys need a database, in-memory storage starts empty")
+		}
+		runAPIKey(dbConn, flag.Args()[1:])
+		return
+	}
+	if !isPostgres(*dbDriver) && (*projectionInterval > 0 || *erpPeriod > 0 || *snapshotInterval > 0 || *chainInterval > 0) {
+		log.Fatalf("projections, ERP export, balance snapshots and ledger hash chain require postgres storage")
+	}
+
+	var replicas *store.ReadReplicas
+	var replicaConns []*dbr.Connection
+	if len(replicaDSNs) > 0 {
+		if !isPostgres(*dbDriver) {
+			log.Fatalf("read replicas require postgres storage")
+		}
+		replicaConns, err = openReplicas(*dbDriver, replicaDSNs, pool, pgxPool)
+		if err != nil {
+			log.Fatal(err)
+		}
+		replicas = store.NewReadReplicas(storage, replicaConns, *replicaMaxLag, *replicaCheckInterval)
+		storage = replicas
+		log.Printf("read replicas: %d", len(replicaConns))
+	}
+
+	if *resetData {
+		if err := resetStorage(dbConn, storage); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("data reset")
+	}
+
+	if *seedUsers > 0 {
+		if *seedBalance < 0 {
+			log.Fatalf("seed_balance must not be negative")
+		}
+		seeded, err := seedStorage(dbConn, storage, *seedUsers, *seedBalance)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if seeded > 0 {
+			log.Printf("seeded %d users with balance %d", seeded, *seedBalance)
+		}
+	}
+
+	// повторы внутри предохранителя: он видит одну ошибку на вызов, после всех попыток
+	var retry *store.Retry
+	if *retryAttempts > 1 && dbConn != nil {
+		retry = store.NewRetry(storage, *retryAttempts, *retryBase, *retryMax)
+		storage = retry
+	}
+	var breaker *store.CircuitBreaker
+	if *breakerFailures > 0 && dbConn != nil {
+		breaker = store.NewCircuitBreaker(storage, *breakerFailures, *breakerOpenFor)
+		storage = breaker
+	}
+
+	var writerLock *store.WriterLock
+	if *writerLockEnabled {
+		if !isPostgres(*dbDriver) {
+			log.Fatalf("writer lock requires postgres storage")
+		}
+		writerLock = store.NewWriterLock(dbConn, *writerLockKey, *writerLockInterval)
+		saveCfg.Writer = writerLock.Held
+	}
+
+	var lease *leader.Lease
+	if *leaderElection {
+		if *writerLockEnabled {
+			log.Fatalf("leader_election and writer_lock are mutually exclusive")
+		}
+		if *persistenceMode != api.PersistAsync {
+			log.Fatalf("leader election is for async persistence mode only")
+		}
+		if *leaseNamespace == "" {
+			*leaseNamespace = leader.InClusterNamespace()
+		}
+		if *leaseIdentity == "" {
+			*leaseIdentity, err = os.Hostname()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		lease, err = leader.NewInClusterLease(*leaseNamespace, *leaseName, *leaseIdentity)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lease.LeaseDuration, lease.RenewDeadline, lease.RetryPeriod = *leaseDuration, *leaseRenewDeadline, *leaseRetryPeriod
+		if lease.RenewDeadline >= lease.LeaseDuration {
+			log.Fatalf("leader_election_renew_deadline must be shorter than leader_election_lease_duration")
+		}
+	}
+
+	// журнал изменений: проигрываем то, что не успело сохраниться, до приема запросов
+	var wal *journal.Journal
+	if *journalDir != "" {
+		wal, err = journal.Open(*journalDir, journal.DefaultSegmentSize, *journalSync)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		replayed, err := writeback.ReplayJournal(context.Background(), storage, wal)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("journal replayed, users updated: %d", replayed)
+		saveCfg.Journal = wal
+	}
+
+	auditOut := os.Stderr
+	if *auditLogPath != "" {
+		auditOut, err = os.OpenFile(*auditLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	supportTokens, err := auth.NewSupportTokens(*supportTokenSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var apiKeys *auth.APIKeys
+	if *apiKeysEnabled {
+		if dbConn == nil {
+			log.Fatalf("api keys need a database, in-memory storage has no api_keys table")
+		}
+		sess := dbConn.NewSession(nil)
+		apiKeys = &auth.APIKeys{
+			Load: func(ctx context.Context) ([]store.APIKey, error) {
+				return store.LoadAPIKeys(ctx, sess, false)
+			},
+			Interval: *apiKeysReload,
+		}
+		if err := apiKeys.Reload(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var spendLimits *limits.SpendLimits
+	if *spendLimitsEnabled {
+		if dbConn == nil {
+			log.Fatalf("spend limits need a database, in-memory storage has no spend_limits table")
+		}
+		spendLimits = &limits.SpendLimits{
+			Sess:     dbConn.NewSession(nil),
+			Interval: *spendLimitsReload,
+		}
+		if err := spendLimits.Reload(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var approvals *api.Approvals
+	if *approvalThreshold > 0 {
+		if dbConn == nil {
+			log.Fatalf("approvals need a database, in-memory storage has no approvals table")
+		}
+		// без проверки вызывающих maker-checker различает их только по адресу
+		if !*apiKeysEnabled && *jwtIssuer == "" && tlsOpts.ClientCAFile == "" {
+			log.Fatalf("approvals need authenticated callers: enable -api_keys, -jwt_issuer or -tls_client_ca_file")
+		}
+		approvals = &api.Approvals{Sess: dbConn.NewSession(nil), Threshold: *approvalThreshold}
+	}
+
+	var pendingDebits *api.PendingDebits
+	if *pendingDebitsEnabled {
+		if dbConn == nil {
+			log.Fatalf("pending debits need a database, in-memory storage has no pending_debits table")
+		}
+		pendingDebits = &api.PendingDebits{Sess: dbConn.NewSession(nil)}
+	}
+
+	var referrals *api.Referrals
+	if *referrerAmount > 0 || *refereeAmount > 0 {
+		if dbConn == nil {
+			log.Fatalf("referrals need a database, in-memory storage has no referrals table")
+		}
+		referrals = &api.Referrals{Sess: dbConn.NewSession(nil), ReferrerAmount: *referrerAmount, RefereeAmount: *refereeAmount}
+	}
+
+	var schedules *api.Schedules
+	if *schedulesEnabled {
+		if dbConn == nil {
+			log.Fatalf("schedules need a database, in-memory storage has no schedules table")
+		}
+		if *scheduleRetry <= 0 {
+			log.Fatalf("schedule_retry_interval must be positive")
+		}
+		schedules = &api.Schedules{Sess: dbConn.NewSession(nil), Retry: *scheduleRetry, MaxFailures: *scheduleMaxFailures}
+	}
+
+	var scheduledOps *api.ScheduledOperations
+	if *scheduledOpsEnabled {
+		if dbConn == nil {
+			log.Fatalf("scheduled operations need a database, in-memory storage has no scheduled_operations table")
+		}
+		scheduledOps = &api.ScheduledOperations{Sess: dbConn.NewSession(nil)}
+	}
+
+	var disputes *api.Disputes
+	if *disputesEnabled {
+		if dbConn == nil {
+			log.Fatalf("disputes need a database, in-memory storage has no disputes table")
+		}
+		disputes = &api.Disputes{Sess: dbConn.NewSession(nil)}
+	}
+
+	var reversals *api.Reversals
+	if *reversalsEnabled {
+		if dbConn == nil {
+			log.Fatalf("reversals need a database, in-memory storage has no reversals table")
+		}
+		reversals = &api.Reversals{Sess: dbConn.NewSession(nil)}
+	}
+
+	var escrows *api.Escrows
+	if *escrowsEnabled {
+		if dbConn == nil {
+			log.Fatalf("escrows need a database, in-memory storage has no escrows table")
+		}
+		if *escrowTimeout <= 0 {
+			log.Fatalf("escrow_timeout must be positive")
+		}
+		escrows = &api.Escrows{Sess: dbConn.NewSession(nil), Timeout: *escrowTimeout}
+	}
+
+	var interest *api.Interest
+	if *interestRate != 0 {
+		if dbConn == nil {
+			log.Fatalf("interest needs a database, in-memory storage has no interest_accruals table")
+		}
+		if *interestRate < 0 || *interestThreshold < 0 {
+			log.Fatalf("interest_rate and interest_threshold must not be negative")
+		}
+		interest = &api.Interest{Sess: dbConn.NewSession(nil), BasisPoints: *interestRate, Threshold: *interestThreshold}
+	}
+
+	var cashbackRules *cashback.Rules
+	if *cashbackEnabled {
+		if dbConn == nil {
+			log.Fatalf("cashback needs a database, in-memory storage has no cashback_rules table")
+		}
+		cashbackRules = &cashback.Rules{
+			Sess:     dbConn.NewSession(nil),
+			Interval: *cashbackReload,
+		}
+		if err := cashbackRules.Reload(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var promoCodes *api.PromoCodes
+	if *promoCodesEnabled {
+		if dbConn == nil {
+			log.Fatalf("promo codes need a database, in-memory storage has no promo_codes table")
+		}
+		promoCodes = &api.PromoCodes{Sess: dbConn.NewSession(nil)}
+	}
+
+	var pockets *api.Pockets
+	if *pocketsEnabled {
+		if dbConn == nil {
+			log.Fatalf("pockets need a database, in-memory storage has no pockets table")
+		}
+		pockets = &api.Pockets{Sess: dbConn.NewSession(nil)}
+	}
+
+	var bonuses *api.Bonuses
+	if *bonusTTL > 0 {
+		if dbConn == nil {
+			log.Fatalf("bonuses need a database, in-memory storage has no bonus_grants table")
+		}
+		bonuses = &api.Bonuses{Sess: dbConn.NewSession(nil), TTL: *bonusTTL}
+	}
+
+	var deny *denylist.Denylist
+	if *denylistEnabled {
+		if dbConn == nil {
+			log.Fatalf("denylist needs a database, in-memory storage has no denylist table")
+		}
+		deny = &denylist.Denylist{
+			Sess:     dbConn.NewSession(nil),
+			Interval: *denylistReload,
+		}
+		if err := deny.Reload(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var fraudRules *fraud.Engine
+	var velocity *fraud.Velocity
+	if *velocityMax > 0 || *spikeFactor > 0 {
+		fraudRules = fraud.NewEngine()
+		if *velocityMax > 0 {
+			action, err := fraud.ParseAction(*velocityAction)
+			if err != nil {
+				log.Fatal(err)
+			}
+			velocity = fraud.NewVelocity(*velocityMax, *velocityWindow, action)
+			fraudRules.Register(velocity)
+		}
+		if *spikeFactor > 0 {
+			action, err := fraud.ParseAction(*spikeAction)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fraudRules.Register(fraud.NewAmountSpike(*spikeFactor, *spikeHistory, *spikeMinHistory, action))
+		}
+	}
+
+	var debitFees fees.Schedule
+	if *feeSchedule != "" {
+		schedule, err := fees.Parse(*feeSchedule)
+		if err != nil {
+			log.Fatal(err)
+		}
+		debitFees = schedule
+	}
+
+	var tokens *auth.JWTVerifier
+	if *jwtIssuer != "" {
+		if *jwtJWKSURL == "" {
+			log.Fatalf("jwt_jwks_url is required with jwt_issuer")
+		}
+		tokens = auth.NewJWTVerifier(*jwtIssuer, *jwtAudience, *jwtJWKSURL)
+		tokens.SubjectClaim = *jwtSubjectClaim
+		tokens.RefreshInterval = *jwtJWKSRefresh
+		if err := tokens.Refresh(context.Background()); err != nil {
+			log.Fatalf("failed to load jwks: %v", err)
+		}
+	}
+
+	receipts, err := receipt.NewSigner(*receiptSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var deadLetters *writeback.DeadLetters
+	if *deadLetterPath != "" {
+		deadLetters = writeback.OpenDeadLetters(*deadLetterPath)
+		saveCfg.DeadLetters = deadLetters
+	}
+
+	// инициализация кеша
+	userCache := cache.New(*cacheMemoryLimit)
+	userCache.TTL = *cacheTTL
+	userCache.NegativeTTL = *cacheNegativeTTL
+	userCache.MaxEntries = *cacheMaxEntries
+	if *cacheTrackChanges {
+		userCache.Changed = changedUsers(dbConn, storage)
+	}
+	userCache.Flush = func(user *store.User) error {
+		if writerLock != nil && !writerLock.Held() {
+			return errors.New("writer lock is not held")
+		}
+		p := user.TakePending()
+		ctx := context.Background()
+		if saveCfg.SaveTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, saveCfg.SaveTimeout)
+			defer cancel()
+		}
+		if err := store.SaveVersioned(ctx, storage, user, p); err != nil {
+			user.RestorePending(p)
+			return err
+		}
+		return nil
+	}
+
+	// запускаем сохранение в фоне
+	saveCfg.Lookup = userCache.Peek
+	delayedSave, err := writeback.NewDelayedSave(storage, saveCfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	userCache.Reserved = delayedSave.MemoryUsage
+
+	if *persistenceMode == api.PersistStrict && *cacheBackend != "memory" {
+		log.Fatalf("strict persistence mode checks balances in the database and cannot use shared cache backend %q", *cacheBackend)
+	}
+	if *reconcileInterval > 0 && *cacheBackend != "memory" {
+		log.Fatalf("reconciliation compares per replica cached balances and cannot use shared cache backend %q", *cacheBackend)
+	}
+
+	var shared cache.Shared
+	switch *cacheBackend {
+	case "memory":
+	case "redis":
+		shared = cache.NewRedisShared(*redisAddr, *redisPassword, *redisDB, 64)
+	case "memcached":
+		shared = cache.NewMemcachedShared(*memcachedAddr, 64)
+	default:
+		log.Fatalf("unknown cache backend %q", *cacheBackend)
+	}
+
+	var responses *api.ResponseCache
+	if *responseCacheTTL > 0 {
+		responses = api.NewResponseCache(*responseCacheTTL, 100000)
+	}
+
+	var inFlight *api.InFlightLimiter
+	if *maxInFlight > 0 {
+		inFlight = api.NewInFlightLimiter(*maxInFlight)
+	}
+
+	var userLimit, ipLimit *api.RateLimiter
+	if *userRateLimit > 0 {
+		userLimit = api.NewRateLimiter(*userRateLimit, *userRateBurst)
+	}
+	if *ipRateLimit > 0 {
+		ipLimit = api.NewRateLimiter(*ipRateLimit, *ipRateBurst)
+	}
+
+	var ledgerChain *chain.Chain
+	if *chainInterval > 0 {
+		ledgerChain = &chain.Chain{
+			Sess:      dbConn.NewSession(nil),
+			Interval:  *chainInterval,
+			Settle:    10 * time.Second,
+			BatchSize: 10000,
+		}
+	}
+
+	app := &api.API{
+		Store: storage,
+		Cache: userCache,
+		Saver: delayedSave,
+		Build: api.BuildInfo{GitSHA: gitSHA, BuildTime: buildTime},
+		SLO:   slo.NewTracker(sloCfg),
+		Audit: audit.New(auditOut),
+
+		Journal:             wal,
+		DeadLetters:         deadLetters,
+		APIKeys:             apiKeys,
+		Tokens:              tokens,
+		SupportTokens:       supportTokens,
+		Receipts:            receipts,
+		Responses:           responses,
+		InFlight:            inFlight,
+		UserLimit:           userLimit,
+		IPLimit:             ipLimit,
+		Shared:              shared,
+		Chain:               ledgerChain,
+		SpendLimits:         spendLimits,
+		Fraud:               fraudRules,
+		Fees:                debitFees,
+		Denylist:            deny,
+		Approvals:           approvals,
+		PendingDebits:       pendingDebits,
+		Bonuses:             bonuses,
+		Pockets:             pockets,
+		PromoCodes:          promoCodes,
+		Disputes:            disputes,
+		Reversals:           reversals,
+		Escrows:             escrows,
+		Interest:            interest,
+		Cashback:            cashbackRules,
+		Schedules:           schedules,
+		ScheduledOperations: scheduledOps,
+		Referrals:           referrals,
+
+		PersistenceMode:   *persistenceMode,
+		AllowFormParams:   *allowFormParams,
+		TrustForwardedFor: *trustForwardedFor,
+		LocklessDebit:     *locklessDebit,
+		Verbose:           *verbose,
+		QueryTimeout:      *queryTimeout,
+		Currency:          *currency,
+		MaxBalance:        *maxBalance,
+	}
+	if lease != nil {
+		app.Leader = lease.Held
+	}
+	if fraudRules != nil {
+		fraudRules.OnFlag = func(d fraud.Debit, rule string, reason string) {
+			app.Audit.Record(audit.Event{
+				Actor:  "fraud",
+				Action: "debit.flag",
+				Target: fmt.Sprintf("user:%d", d.UserID),
+				Result: rule,
+				Fields: map[string]interface{}{
+					"amount": d.Amount,
+					"reason": reason,
+				},
+			})
+		}
+	}
+	app.PublishMetrics()
+	if retry != nil {
+		expvar.Publish("db_retries", expvar.Func(func() interface{} {
+			return retry.Stats()
+		}))
+	}
+	if breaker != nil {
+		expvar.Publish("db_breaker", expvar.Func(func() interface{} {
+			return breaker.Stats()
+		}))
+	}
+	if lease != nil {
+		expvar.Publish("leader", expvar.Func(func() interface{} {
+			return lease.Held()
+		}))
+	}
+	if writerLock != nil {
+		expvar.Publish("writer_lock", expvar.Func(func() interface{} {
+			return writerLock.Held()
+		}))
+	}
+	if dbConn != nil {
+		expvar.Publish("db_pool", expvar.Func(func() interface{} {
+			return dbConn.Stats()
+		}))
+	}
+
+	// expvar регистрирует /debug/vars в http.DefaultServeMux
+	app.Register(http.DefaultServeMux)
+
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	go userCache.RunJanitor(bgCtx, *cacheJanitorInterval)
+
+	if apiKeys != nil {
+		go apiKeys.Run(bgCtx)
+	}
+	if tokens != nil {
+		go tokens.Run(bgCtx)
+	}
+	if spendLimits != nil {
+		go spendLimits.Run(bgCtx)
+	}
+	if cashbackRules != nil {
+		go cashbackRules.Run(bgCtx)
+	}
+	if velocity != nil {
+		go velocity.Run(bgCtx, time.Minute)
+	}
+	if deny != nil {
+		go deny.Run(bgCtx)
+	}
+	go userLimit.Run(bgCtx, time.Minute)
+	go ipLimit.Run(bgCtx, time.Minute)
+
+	if *reconcileInterval > 0 {
+		reconciler := &reconcile.Reconciler{
+			Cache:    userCache,
+			Store:    storage,
+			Interval: *reconcileInterval,
+			Sample:   *reconcileSample,
+			Confirm:  2 * time.Second,
+			Correct:  *reconcileCorrect,
+		}
+		expvar.Publish("reconcile", expvar.Func(func() interface{} {
+			return reconciler.Stats()
+		}))
+		go reconciler.Run(bgCtx)
+	}
+
+	if replicas != nil {
+		go replicas.Run(bgCtx)
+	}
+
+	if bonuses != nil {
+		go app.RunBonusSweeper(bgCtx, *bonusSweepInterval)
+	}
+
+	if schedules != nil {
+		go app.RunScheduler(bgCtx, *scheduleInterval)
+	}
+
+	if scheduledOps != nil {
+		go app.RunOperationScheduler(bgCtx, *scheduledOpsInterval)
+	}
+
+	if interest != nil {
+		go app.RunInterest(bgCtx, *interestInterval)
+	}
+
+	if escrows != nil {
+		go app.RunEscrowSweeper(bgCtx, *escrowInterval)
+	}
+
+	// блокировка писателя и аренда лидера отпускаются после последнего сохранения, а не вместе с bgCtx
+	lockCtx, releaseLock := context.WithCancel(context.Background())
+	lockDone := make(chan struct{})
+	switch {
+	case writerLock != nil:
+		go func() {
+			writerLock.Run(lockCtx)
+			close(lockDone)
+		}()
+	case lease != nil:
+		go func() {
+			lease.Run(lockCtx)
+			close(lockDone)
+		}()
+	default:
+		close(lockDone)
+	}
+
+	if *projectionInterval > 0 {
+		projector := &projection.Projector{
+			Sess:      dbConn.NewSession(nil),
+			Interval:  *projectionInterval,
+			Settle:    10 * time.Second,
+			BatchSize: 10000,
+		}
+		go projector.Run(bgCtx)
+	}
+
+	if ledgerChain != nil {
+		go ledgerChain.Run(bgCtx)
+	}
+
+	if *erpPeriod > 0 {
+		exporter, err := newERPExporter(dbConn.NewSession(nil), *erpPeriod, *erpTemplate, *erpDir,
+			&erp.S3Sink{
+				Endpoint:  *erpS3Endpoint,
+				Region:    *erpS3Region,
+				Bucket:    *erpS3Bucket,
+				Prefix:    *erpS3Prefix,
+				AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			})
+		if err != nil {
+			log.Fatal(err)
+		}
+		go exporter.Run(bgCtx)
+	}
+
+	if *snapshotInterval > 0 {
+		snapshotter := &snapshot.Snapshotter{
+			Sess:     dbConn.NewSession(nil),
+			Interval: *snapshotInterval,
+			Settle:   *snapshotSettle,
+			Since:    time.Now().Add(-24 * time.Hour),
+		}
+		go snapshotter.Run(bgCtx)
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	srv := startHttpServer(*port, app.Middleware(http.DefaultServeMux), tlsCfg, wg)
+	var redirectSrv *http.Server
+	if *httpRedirectPort > 0 {
+		wg.Add(1)
+		redirectSrv = startRedirectServer(*httpRedirectPort, *port, certManager, wg)
+	}
+
+	// прогрев кеша: /readyz отвечает 503, пока он не закончится
+	go func() {
+		ids, err := parseIDs(*warmUpIDs)
+		if err != nil {
+			log.Fatalf("invalid warmup_user_ids: %v", err)
+		}
+
+		if len(ids) > 0 || *warmUpRecent > 0 {
+			added, err := warmUp(bgCtx, storage, userCache, ids, *warmUpRecent)
+			if err != nil {
+				log.Printf("cache warm-up failed: %v", err)
+			}
+			log.Printf("cache warmed up, users loaded: %d", added)
+		}
+		app.SetReady(true)
+	}()
+
+	// подписываемся на сигналы
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	// ждем сигнала закрытия
+	<-sigchan
+
+	// выключаем все
+	fmt.Println()
+	log.Println("shutting down...")
+	srv.Shutdown(context.Background())
+	if redirectSrv != nil {
+		redirectSrv.Shutdown(context.Background())
+	}
+	wg.Wait()
+	log.Println("server stopped")
+	stopBackground()
+	delayedSave.Close(*shutdownFlushTimeout)
+	releaseLock()
+	<-lockDone
+	if wal != nil {
+		wal.Close()
+	}
+	if dbConn != nil {
+		dbConn.Close()
+	}
+	for _, conn := range replicaConns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// runMigrate - подкоманда `balanced [flags] migrate status|up|down [-to N] [-force]`
+func runMigrate(psqlInfo string, args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: balanced migrate status|up|down [-to N] [-force]")
+	}
+
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	to := fs.Int("to", -1, "target schema version for down, default - previous version")
+	force := fs.Bool("force", false, "roll back even if data would be lost")
+	fs.Parse(args[1:])
+
+	dbConn, err := store.Open(psqlInfo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dbConn.Close()
+
+	version, err := store.SchemaVersion(dbConn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch args[0] {
+	case "status":
+		fmt.Printf("schema version: %d\nsupported version: %d\n", version, store.LatestVersion())
+	case "up":
+		err = store.MigrateUp(dbConn)
+	case "down":
+		if *to < 0 {
+			*to = version - 1
+		}
+		err = store.MigrateDown(dbConn, *to, *force)
+	default:
+		log.Fatalf("unknown migrate command %q", args[0])
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
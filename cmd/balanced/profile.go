@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// profiles - значения флагов по умолчанию для окружений. Явно заданные флаги имеют приоритет
+var profiles = map[string]map[string]string{
+	"dev": {
+		"save_flush_interval":    "5s",
+		"save_staleness":         "10s",
+		"shutdown_flush_timeout": "5s",
+		"journal_sync":           "false",
+		"seed_users":             "1",
+		"verbose":                "true",
+	},
+	"staging": {
+		"save_flush_interval":    "30s",
+		"save_staleness":         "1m",
+		"shutdown_flush_timeout": "15s",
+	},
+	"prod": {
+		"save_flush_interval":    "1m",
+		"save_staleness":         "2m",
+		"shutdown_flush_timeout": "30s",
+		"journal_sync":           "true",
+	},
+}
+
+// applyProfile - подставляет значения профиля во флаги, которые не заданы в командной строке
+func applyProfile(name string) error {
+	profile, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for flagName, value := range profile {
+		if set[flagName] {
+			continue
+		}
+		if err := flag.Set(flagName, value); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+const (
+	driverPostgres = "postgres"
+	driverPgx      = "pgx"
+	driverSQLite   = "sqlite"
+	driverMemory   = "memory"
+)
+
+// openStorage - подключение к хранилищу по -db_driver и применение схемы.
+// Соединение возвращается для того, что работает с БД напрямую: сброс данных, проекции, выгрузка в ERP;
+// у хранилища в памяти его нет
+func openStorage(driver, psqlInfo, sqlitePath string, pool store.PoolConfig, pgxPool store.PgxPoolConfig) (*dbr.Connection, store.Storage, error) {
+	switch driver {
+	case driverPostgres, driverPgx:
+		db, err := openPostgres(driver, psqlInfo, pool, pgxPool)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("postgres connected via %s!", driver)
+
+		if err := store.InitSchema(db); err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return db, store.NewPostgres(db), nil
+	case driverSQLite:
+		db, err := store.OpenSQLite(sqlitePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("sqlite database %s opened", sqlitePath)
+		return db, store.NewSQLite(db), nil
+	case driverMemory:
+		log.Println("using in-memory storage, data is lost on restart")
+		return nil, store.NewMemory(), nil
+	default:
+		return nil, nil, fmt.Errorf("unknown db driver %q", driver)
+	}
+}
+
+// openPostgres - подключение к Postgres через lib/pq или пул pgx
+func openPostgres(driver, dsn string, pool store.PoolConfig, pgxPool store.PgxPoolConfig) (*dbr.Connection, error) {
+	if driver == driverPgx {
+		return store.OpenPgx(context.Background(), dsn, pgxPool)
+	}
+
+	db, err := store.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	// у pgx соединениями управляет его пул, см. -pgx_*
+	pool.Apply(db)
+	return db, nil
+}
+
+// openReplicas - подключение к репликам для чтения с теми же драйвером и настройками пула, что у primary
+func openReplicas(driver string, dsns []string, pool store.PoolConfig, pgxPool store.PgxPoolConfig) ([]*dbr.Connection, error) {
+	var conns []*dbr.Connection
+	for i, dsn := range dsns {
+		db, err := openPostgres(driver, dsn, pool, pgxPool)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, fmt.Errorf("read replica %d: %w", i, err)
+		}
+		conns = append(conns, db)
+	}
+	return conns, nil
+}
+
+// resetStorage - сброс данных, см. store.ResetData
+func resetStorage(db *dbr.Connection, storage store.Storage) error {
+	if memory, ok := storage.(*store.Memory); ok {
+		memory.ResetData()
+		return nil
+	}
+	return store.ResetData(db)
+}
+
+// seedStorage - тестовые пользователи в пустом хранилище, см. store.Seed
+func seedStorage(db *dbr.Connection, storage store.Storage, count int, balance int64) (int, error) {
+	if memory, ok := storage.(*store.Memory); ok {
+		return memory.Seed(count, balance), nil
+	}
+	return store.Seed(db, count, balance)
+}
+
+// changedUsersLimit - сколько последних изменений читает за раз отслеживание изменений кеша
+const changedUsersLimit = 10000
+
+// changedUsers - источник изменений для cache.Changed, см. store.ChangedUsers
+func changedUsers(db *dbr.Connection, storage store.Storage) func(ctx context.Context, since time.Time) ([]store.UserVersion, error) {
+	if memory, ok := storage.(*store.Memory); ok {
+		return func(ctx context.Context, since time.Time) ([]store.UserVersion, error) {
+			return memory.ChangedUsers(ctx, since, changedUsersLimit)
+		}
+	}
+	sess := db.NewSession(nil)
+	return func(ctx context.Context, since time.Time) ([]store.UserVersion, error) {
+		return store.ChangedUsers(ctx, sess, since, changedUsersLimit)
+	}
+}
+
+// isPostgres - хранилище на Postgres, с миграциями, проекциями и выгрузкой в ERP
+func isPostgres(driver string) bool {
+	return driver == driverPostgres || driver == driverPgx
+}
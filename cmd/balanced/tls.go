@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// режимы -tls
+const (
+	// tlsOff - HTTP без TLS
+	tlsOff = "off"
+	// tlsFiles - сертификат и ключ из файлов
+	tlsFiles = "files"
+	// tlsACME - сертификаты выпускаются и продлеваются через ACME (Let's Encrypt)
+	tlsACME = "acme"
+)
+
+// tlsOptions - настройки HTTPS из флагов
+type tlsOptions struct {
+	// Mode - tlsOff, tlsFiles или tlsACME, пусто - tlsFiles, если задан CertFile, иначе tlsOff
+	Mode     string
+	CertFile string
+	KeyFile  string
+	// ClientCAFile - клиенты обязаны предъявить сертификат, подписанный одним из этих CA (mTLS)
+	ClientCAFile string
+	// ClientSANs - если не пуст, в сертификате клиента должно быть одно из этих имен: DNS, URI (например SPIFFE ID),
+	// IP или email
+	ClientSANs []string
+	// ACMEDomains - домены, для которых выпускаются сертификаты, другие имена в SNI отклоняются
+	ACMEDomains []string
+	// ACMECacheDir - где хранить выпущенные сертификаты и ключ аккаунта, чтобы не выпускать их заново при перезапуске
+	ACMECacheDir string
+	ACMEEmail    string
+	// ACMEDirectory - адрес каталога ACME, пусто - Let's Encrypt
+	ACMEDirectory string
+}
+
+// config - настройки TLS сервера, nil - HTTPS выключен. В режиме tlsACME возвращает и менеджер сертификатов,
+// его обработчик нужен HTTP серверу для проверок http-01
+func (o tlsOptions) config() (*tls.Config, *autocert.Manager, error) {
+	mode := o.Mode
+	if mode == "" {
+		mode = tlsOff
+		if o.CertFile != "" {
+			mode = tlsFiles
+		}
+	}
+
+	var cfg *tls.Config
+	var manager *autocert.Manager
+	switch mode {
+	case tlsOff:
+		if o.ClientCAFile != "" || len(o.ClientSANs) > 0 {
+			return nil, nil, errors.New("client certificates require tls mode files or acme")
+		}
+		return nil, nil, nil
+	case tlsFiles:
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg = &tls.Config{Certificates: []tls.Certificate{cert}}
+	case tlsACME:
+		if len(o.ACMEDomains) == 0 {
+			return nil, nil, errors.New("tls_acme_domain is required in acme mode")
+		}
+		if o.ACMECacheDir == "" {
+			return nil, nil, errors.New("tls_acme_cache_dir is required in acme mode")
+		}
+		manager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(o.ACMECacheDir),
+			HostPolicy: autocert.HostWhitelist(o.ACMEDomains...),
+			Email:      o.ACMEEmail,
+		}
+		if o.ACMEDirectory != "" {
+			manager.Client = &acme.Client{DirectoryURL: o.ACMEDirectory}
+		}
+		// с tls-alpn-01 сертификат выпускается и без HTTP порта
+		cfg = manager.TLSConfig()
+	default:
+		return nil, nil, fmt.Errorf("unknown tls mode %q", mode)
+	}
+	cfg.MinVersion = tls.VersionTLS12
+
+	if err := o.requireClientCerts(cfg); err != nil {
+		return nil, nil, err
+	}
+	return cfg, manager, nil
+}
+
+// requireClientCerts - mTLS по ClientCAFile и ClientSANs
+func (o tlsOptions) requireClientCerts(cfg *tls.Config) error {
+	if o.ClientCAFile == "" {
+		if len(o.ClientSANs) > 0 {
+			return errors.New("tls_client_san requires tls_client_ca_file")
+		}
+		return nil
+	}
+
+	pem, err := os.ReadFile(o.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates in %s", o.ClientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+
+	if len(o.ClientSANs) > 0 {
+		allowed := make(map[string]bool, len(o.ClientSANs))
+		for _, san := range o.ClientSANs {
+			allowed[san] = true
+		}
+		// цепочка уже проверена по ClientCAs, здесь только имя клиента
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("client certificate is required")
+			}
+			for _, san := range certificateSANs(cs.PeerCertificates[0]) {
+				if allowed[san] {
+					return nil
+				}
+			}
+			return fmt.Errorf("client certificate %q has no allowed SAN", cs.PeerCertificates[0].Subject.CommonName)
+		}
+	}
+	return nil
+}
+
+// certificateSANs - все альтернативные имена сертификата строками
+func certificateSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+// startRedirectServer - HTTP сервер на port, который перенаправляет запросы на HTTPS порт httpsPort.
+// С manager он же отвечает на проверки ACME http-01
+func startRedirectServer(port, httpsPort int, manager *autocert.Manager, wg *sync.WaitGroup) *http.Server {
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+	if manager != nil {
+		handler = manager.HTTPHandler(handler)
+	}
+
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: handler}
+	go func() {
+		defer wg.Done()
+		log.Printf("Redirecting HTTP port %d to HTTPS", port)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("ListenAndServe(): %v", err)
+		}
+	}()
+	return srv
+}
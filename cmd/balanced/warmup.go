@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/Skat712/test_balance/cache"
+	"github.com/Skat712/test_balance/store"
+)
+
+// warmUpBatch - сколько пользователей загружать одним запросом при прогреве
+const warmUpBatch = 1000
+
+// warmUp - загружает в кеш пользователей из ids и recent самых недавно активных, возвращает количество добавленных
+func warmUp(ctx context.Context, storage store.Storage, c *cache.Cache, ids []int, recent int) (int, error) {
+	if recent > 0 {
+		active, err := storage.RecentUserIDs(ctx, recent)
+		if err != nil {
+			return 0, err
+		}
+		ids = append(ids, active...)
+	}
+
+	added := 0
+	for start := 0; start < len(ids); start += warmUpBatch {
+		end := start + warmUpBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		users, err := storage.LoadUsers(ctx, ids[start:end])
+		if err != nil {
+			return added, err
+		}
+		added += c.Warm(withoutDeleted(users))
+	}
+	return added, nil
+}
+
+// withoutDeleted - пользователи, кроме удаленных: их незачем держать в кеше
+func withoutDeleted(users []*store.User) []*store.User {
+	kept := users[:0]
+	for _, u := range users {
+		if u.Status != store.StatusDeleted {
+			kept = append(kept, u)
+		}
+	}
+	return kept
+}
+
+// parseIDs - список id через запятую
+func parseIDs(list string) ([]int, error) {
+	var ids []int
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,119 @@
+package denylist
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// ErrDenied - пользователь или вызывающий в denylist
+var ErrDenied = errors.New("denied")
+
+// Denylist - записи таблицы denylist в памяти. Изменения через Add и Remove действуют на этом экземпляре сразу,
+// на остальных - после перезагрузки, не позже чем через Interval
+type Denylist struct {
+	Sess *dbr.Session
+	// Interval - как часто перечитывать denylist
+	Interval time.Duration
+
+	mu      sync.RWMutex
+	users   map[int]bool
+	callers map[string]bool
+	entries []store.DenyEntry
+}
+
+// Reload - перечитывает denylist, при ошибке остается прежний
+func (d *Denylist) Reload(ctx context.Context) error {
+	entries, err := store.LoadDenylist(ctx, d.Sess)
+	if err != nil {
+		return err
+	}
+
+	users := make(map[int]bool)
+	callers := make(map[string]bool)
+	for _, e := range entries {
+		switch e.Kind {
+		case store.DenyUser:
+			if id, err := strconv.Atoi(e.Value); err == nil {
+				users[id] = true
+			}
+		case store.DenyCaller:
+			callers[e.Value] = true
+		}
+	}
+
+	d.mu.Lock()
+	d.users, d.callers, d.entries = users, callers, entries
+	d.mu.Unlock()
+	return nil
+}
+
+// Run - перечитывает denylist раз в Interval, пока не отменен ctx
+func (d *Denylist) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.Reload(ctx); err != nil {
+				log.Printf("failed to reload denylist: %v", err)
+			}
+		}
+	}
+}
+
+// List - все записи
+func (d *Denylist) List() []store.DenyEntry {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append([]store.DenyEntry{}, d.entries...)
+}
+
+// Add - добавляет запись
+func (d *Denylist) Add(ctx context.Context, e store.DenyEntry) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	if err := store.AddDenied(ctx, d.Sess, e); err != nil {
+		return err
+	}
+	return d.Reload(ctx)
+}
+
+// Remove - удаляет запись, store.ErrNotFound если ее нет
+func (d *Denylist) Remove(ctx context.Context, kind, value string) error {
+	if err := store.RemoveDenied(ctx, d.Sess, kind, value); err != nil {
+		return err
+	}
+	return d.Reload(ctx)
+}
+
+// User - пользователь id в denylist, nil - никто
+func (d *Denylist) User(id int) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.users[id]
+}
+
+// Caller - вызывающий в denylist, nil - никто
+func (d *Denylist) Caller(caller string) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.callers[caller]
+}
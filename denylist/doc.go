@@ -0,0 +1,3 @@
+// Package denylist - экстренная блокировка пользователей и вызывающих: запросы к ним и от них отклоняются
+// до обращения к кешу и БД.
+package denylist
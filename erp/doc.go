@@ -0,0 +1,3 @@
+// Package erp - выгрузка леджера за период в формат импорта ERP по настраиваемому шаблону
+// и доставка файла по расписанию (локальная директория или S3).
+package erp
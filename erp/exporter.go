@@ -0,0 +1,118 @@
+package erp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"text/template"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// Exporter - выгружает леджер за каждый завершившийся период и отмечает выгруженные периоды в БД
+type Exporter struct {
+	Sess     *dbr.Session
+	Template *template.Template
+	Sink     Sink
+	// Period - длина периода выгрузки, периоды выравниваются по UTC (например 24h - за сутки)
+	Period time.Duration
+	// Since - с какого момента выгружать, если выгрузок еще не было
+	Since time.Time
+}
+
+// Run - выгружает пропущенные периоды сразу и затем после окончания каждого периода, пока не отменен ctx
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	log.Printf("start erp export, period %s", e.Period)
+	for {
+		if err := e.ExportDue(ctx); err != nil {
+			log.Printf("erp export failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("stop erp export")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ExportDue - выгружает все завершившиеся и еще не выгруженные периоды
+func (e *Exporter) ExportDue(ctx context.Context) error {
+	var last dbr.NullTime
+	if err := e.Sess.Select("MAX(period_end)").From("erp_exports").LoadOneContext(ctx, &last); err != nil {
+		return err
+	}
+
+	from := e.Since.UTC().Truncate(e.Period)
+	if last.Valid {
+		from = last.Time.UTC()
+	}
+
+	for {
+		to := from.Add(e.Period)
+		if to.After(time.Now().UTC()) {
+			return nil
+		}
+
+		if err := e.Export(ctx, from, to); err != nil {
+			return err
+		}
+		from = to
+	}
+}
+
+// Export - выгружает транзакции [from, to) и отмечает период выгруженным
+func (e *Exporter) Export(ctx context.Context, from, to time.Time) error {
+	var txs []store.Transaction
+	_, err := e.Sess.Select(store.TransactionColumns...).From("transactions").
+		Where("created_at >= ? AND created_at < ?", from, to).
+		OrderBy("created_at").
+		LoadContext(ctx, &txs)
+	if err != nil {
+		return err
+	}
+
+	doc := Document{
+		From:        from,
+		To:          to,
+		GeneratedAt: time.Now().UTC(),
+		Lines:       txs,
+		ByTag:       make(map[string]int),
+	}
+	for _, tx := range txs {
+		doc.Total += tx.Amount
+		doc.ByTag[tx.Tag] += tx.Amount
+	}
+
+	var buf bytes.Buffer
+	if err := e.Template.Execute(&buf, doc); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("ledger_%s_%s.csv", from.Format("20060102T150405Z"), to.Format("20060102T150405Z"))
+	if err := e.Sink.Deliver(ctx, name, buf.Bytes()); err != nil {
+		return err
+	}
+
+	_, err = e.Sess.InsertInto("erp_exports").
+		Pair("period_start", from).
+		Pair("period_end", to).
+		Pair("file", name).
+		Pair("lines", len(txs)).
+		Pair("exported_at", time.Now().UTC()).
+		ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("erp export %s: %d lines", name, len(txs))
+	return nil
+}
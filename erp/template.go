@@ -0,0 +1,62 @@
+package erp
+
+import (
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// DefaultTemplate - шаблон по умолчанию: CSV с разделителем ';', одна строка на транзакцию
+const DefaultTemplate = `date;transaction_id;user_id;operation;tag;amount
+{{range .Lines}}{{date .CreatedAt}};{{.ID}};{{.UserID}};{{.Operation}};{{csv .Tag}};{{money .Amount}}
+{{end}}`
+
+// Document - данные, которые получает шаблон
+type Document struct {
+	From        time.Time
+	To          time.Time
+	GeneratedAt time.Time
+	Lines       []store.Transaction
+	// Total - сумма Amount всех строк
+	Total int
+	// ByTag - сумма Amount по тегам операций
+	ByTag map[string]int
+}
+
+// funcs - функции, доступные в шаблоне
+var funcs = template.FuncMap{
+	"date": func(t time.Time) string {
+		return t.UTC().Format("2006-01-02")
+	},
+	"datetime": func(t time.Time) string {
+		return t.UTC().Format(time.RFC3339)
+	},
+	"abs": func(v int) int {
+		if v < 0 {
+			return -v
+		}
+		return v
+	},
+	// money - сумма в минимальных единицах как есть, без разделителей
+	"money": func(v int) int {
+		return v
+	},
+	// csv - экранирование значения для CSV
+	"csv": func(v string) string {
+		if strings.ContainsAny(v, ";,\"\n") {
+			return `"` + strings.ReplaceAll(v, `"`, `""`) + `"`
+		}
+		return v
+	},
+	"upper": strings.ToUpper,
+}
+
+// ParseTemplate - разбирает шаблон выгрузки, пустой text - DefaultTemplate
+func ParseTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultTemplate
+	}
+	return template.New("erp").Funcs(funcs).Parse(text)
+}
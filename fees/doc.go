@@ -0,0 +1,2 @@
+// Package fees - комиссии за операции: фиксированная часть и процент от суммы по типу операции и тегу.
+package fees
@@ -0,0 +1,96 @@
+package fees
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Fee - комиссия: Flat плюс BasisPoints сотых долей процента от суммы операции
+type Fee struct {
+	Flat        int `json:"flat"`
+	BasisPoints int `json:"basis_points"`
+}
+
+// For - комиссия с суммы amount, процентная часть округляется до ближайшего целого
+func (f Fee) For(amount int) int {
+	return f.Flat + int(math.Round(float64(amount)*float64(f.BasisPoints)/10000))
+}
+
+// String - запись в формате Parse
+func (f Fee) String() string {
+	var parts []string
+	if f.Flat != 0 {
+		parts = append(parts, strconv.Itoa(f.Flat))
+	}
+	if f.BasisPoints != 0 {
+		parts = append(parts, strconv.FormatFloat(float64(f.BasisPoints)/100, 'f', -1, 64)+"%")
+	}
+	if len(parts) == 0 {
+		return "0"
+	}
+	return strings.Join(parts, "+")
+}
+
+// Schedule - комиссии по типу операции ("debit") или по типу и тегу операции ("debit:sms"),
+// комиссия с тегом заменяет комиссию типа целиком. nil - без комиссий
+type Schedule map[string]Fee
+
+// Parse - комиссии из строки вида "debit=10+1.5%,debit:sms=0.5%": фиксированная часть, процент или их сумма
+func Parse(s string) (Schedule, error) {
+	schedule := Schedule{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("fee %q: expected operation[:tag]=fee", item)
+		}
+		fee, err := parseFee(value)
+		if err != nil {
+			return nil, fmt.Errorf("fee %q: %w", item, err)
+		}
+		schedule[key] = fee
+	}
+	return schedule, nil
+}
+
+// parseFee - "10", "1.5%" или "10+1.5%"
+func parseFee(s string) (Fee, error) {
+	var fee Fee
+	for _, part := range strings.Split(s, "+") {
+		part = strings.TrimSpace(part)
+		if strings.HasSuffix(part, "%") {
+			p, err := strconv.ParseFloat(strings.TrimSuffix(part, "%"), 64)
+			if err != nil || p < 0 || p > 100 {
+				return Fee{}, fmt.Errorf("invalid percent %q", part)
+			}
+			fee.BasisPoints += int(math.Round(p * 100))
+			continue
+		}
+		flat, err := strconv.Atoi(part)
+		if err != nil || flat < 0 {
+			return Fee{}, fmt.Errorf("invalid flat fee %q", part)
+		}
+		fee.Flat += flat
+	}
+	return fee, nil
+}
+
+// For - комиссия операции operation с тегом tag
+func (s Schedule) For(operation, tag string) Fee {
+	if tag != "" {
+		if fee, ok := s[operation+":"+tag]; ok {
+			return fee
+		}
+	}
+	return s[operation]
+}
+
+// Amount - комиссия операции operation с тегом tag на сумму amount, 0 - без комиссии
+func (s Schedule) Amount(operation, tag string, amount int) int {
+	return s.For(operation, tag).For(amount)
+}
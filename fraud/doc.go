@@ -0,0 +1,3 @@
+// Package fraud - правила против мошенничества, которые проверяют списание до его применения
+// и отклоняют или помечают его.
+package fraud
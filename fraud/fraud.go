@@ -0,0 +1,188 @@
+package fraud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// действия правила
+const (
+	// Allow - списание проходит
+	Allow Action = iota
+	// Flag - списание проходит, но помечается для разбора (см. Engine.OnFlag)
+	Flag
+	// Reject - списание отклоняется
+	Reject
+)
+
+// Action - что делать со списанием по решению правила
+type Action int
+
+func (a Action) String() string {
+	switch a {
+	case Flag:
+		return "flag"
+	case Reject:
+		return "reject"
+	}
+	return "allow"
+}
+
+// ParseAction - действие по имени из флага: "flag" или "reject"
+func ParseAction(name string) (Action, error) {
+	switch name {
+	case "flag":
+		return Flag, nil
+	case "reject":
+		return Reject, nil
+	}
+	return Allow, fmt.Errorf("unknown fraud action %q, expected flag or reject", name)
+}
+
+// ErrRejected - списание отклонено правилом
+var ErrRejected = errors.New("debit rejected by fraud rule")
+
+// RejectedError - списание отклонено правилом Rule по причине Reason
+type RejectedError struct {
+	Rule   string
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("%v %s: %s", ErrRejected, e.Rule, e.Reason)
+}
+
+func (e *RejectedError) Is(target error) bool {
+	return target == ErrRejected
+}
+
+// Debit - списание, которое проверяют правила
+type Debit struct {
+	UserID int
+	Amount int
+	Tag    string
+	At     time.Time
+}
+
+// Decision - решение правила, Reason - объяснение для журнала аудита
+type Decision struct {
+	Action Action
+	Reason string
+}
+
+// Rule - правило проверки списания. Evaluate вызывается до списания, в том числе под блокировкой пользователя,
+// поэтому должно быть быстрым; ошибка Evaluate отклоняет списание
+type Rule interface {
+	Name() string
+	Evaluate(ctx context.Context, d Debit) (Decision, error)
+}
+
+// Recorder - правило, которому нужна история: Record вызывается после каждого успешного списания
+type Recorder interface {
+	Record(d Debit)
+}
+
+// Engine - набор правил. Отклоняет списание первое правило, которое решило Reject, пометки собираются со всех
+type Engine struct {
+	// OnFlag - вызывается для каждого правила, пометившего списание, nil - пометки только в статистике
+	OnFlag func(d Debit, rule string, reason string)
+
+	mu       sync.RWMutex
+	rules    []Rule
+	flagged  map[string]int64
+	rejected map[string]int64
+}
+
+func NewEngine() *Engine {
+	return &Engine{flagged: make(map[string]int64), rejected: make(map[string]int64)}
+}
+
+// Register - добавляет правило, в том числе свое, правила проверяются в порядке добавления
+func (e *Engine) Register(rule Rule) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = append(e.rules, rule)
+}
+
+// Len - количество правил, nil - 0
+func (e *Engine) Len() int {
+	if e == nil {
+		return 0
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return len(e.rules)
+}
+
+// Check - *RejectedError, если какое-то правило отклонило списание. nil - без правил
+func (e *Engine) Check(ctx context.Context, d Debit) error {
+	if e == nil {
+		return nil
+	}
+	e.mu.RLock()
+	rules := e.rules
+	e.mu.RUnlock()
+
+	for _, rule := range rules {
+		decision, err := rule.Evaluate(ctx, d)
+		if err != nil {
+			return fmt.Errorf("fraud rule %s: %w", rule.Name(), err)
+		}
+		switch decision.Action {
+		case Reject:
+			e.count(e.rejected, rule.Name())
+			return &RejectedError{Rule: rule.Name(), Reason: decision.Reason}
+		case Flag:
+			e.count(e.flagged, rule.Name())
+			if e.OnFlag != nil {
+				e.OnFlag(d, rule.Name(), decision.Reason)
+			}
+		}
+	}
+	return nil
+}
+
+// Record - передает успешное списание правилам с историей
+func (e *Engine) Record(d Debit) {
+	if e == nil {
+		return
+	}
+	e.mu.RLock()
+	rules := e.rules
+	e.mu.RUnlock()
+
+	for _, rule := range rules {
+		if r, ok := rule.(Recorder); ok {
+			r.Record(d)
+		}
+	}
+}
+
+func (e *Engine) count(counters map[string]int64, rule string) {
+	e.mu.Lock()
+	counters[rule]++
+	e.mu.Unlock()
+}
+
+// Stats - количество пометок и отклонений по правилам
+func (e *Engine) Stats() map[string]interface{} {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	flagged := make(map[string]int64, len(e.flagged))
+	for rule, n := range e.flagged {
+		flagged[rule] = n
+	}
+	rejected := make(map[string]int64, len(e.rejected))
+	for rule, n := range e.rejected {
+		rejected[rule] = n
+	}
+	return map[string]interface{}{
+		"rules":    len(e.rules),
+		"flagged":  flagged,
+		"rejected": rejected,
+	}
+}
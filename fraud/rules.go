@@ -0,0 +1,149 @@
+package fraud
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Velocity - не больше Max списаний пользователя за скользящее окно Window. История в памяти экземпляра,
+// поэтому с несколькими экземплярами пользователь может сделать до Max списаний на каждом
+type Velocity struct {
+	Max    int
+	Window time.Duration
+	Action Action
+
+	mu sync.Mutex
+	// debits - время недавних списаний по пользователям, старые отбрасываются при записи и в Run
+	debits map[int][]time.Time
+}
+
+func NewVelocity(max int, window time.Duration, action Action) *Velocity {
+	return &Velocity{Max: max, Window: window, Action: action, debits: make(map[int][]time.Time)}
+}
+
+func (v *Velocity) Name() string {
+	return "velocity"
+}
+
+func (v *Velocity) Evaluate(ctx context.Context, d Debit) (Decision, error) {
+	v.mu.Lock()
+	recent := countSince(v.debits[d.UserID], d.At.Add(-v.Window))
+	v.mu.Unlock()
+
+	if recent >= v.Max {
+		return Decision{Action: v.Action, Reason: fmt.Sprintf("%d debits in %s", recent, v.Window)}, nil
+	}
+	return Decision{}, nil
+}
+
+func (v *Velocity) Record(d Debit) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	times := v.debits[d.UserID]
+	since := d.At.Add(-v.Window)
+	for len(times) > 0 && times[0].Before(since) {
+		times = times[1:]
+	}
+	v.debits[d.UserID] = append(times, d.At)
+}
+
+// Run - раз в interval удаляет пользователей без списаний за Window, пока не отменен ctx
+func (v *Velocity) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			since := now.Add(-v.Window)
+			v.mu.Lock()
+			for id, times := range v.debits {
+				if len(times) == 0 || times[len(times)-1].Before(since) {
+					delete(v.debits, id)
+				}
+			}
+			v.mu.Unlock()
+		}
+	}
+}
+
+// countSince - сколько времен в отсортированном times не раньше since
+func countSince(times []time.Time, since time.Time) int {
+	n := 0
+	for i := len(times) - 1; i >= 0 && !times[i].Before(since); i-- {
+		n++
+	}
+	return n
+}
+
+// AmountSpike - списание больше Factor средних последних History списаний пользователя. Пока у пользователя
+// меньше MinHistory списаний, правило не срабатывает. История в памяти экземпляра и ограничена History
+// списаниями на пользователя
+type AmountSpike struct {
+	Factor     float64
+	History    int
+	MinHistory int
+	Action     Action
+
+	mu      sync.Mutex
+	amounts map[int][]int
+}
+
+func NewAmountSpike(factor float64, history, minHistory int, action Action) *AmountSpike {
+	if history < 1 {
+		history = 1
+	}
+	if minHistory > history {
+		minHistory = history
+	}
+	return &AmountSpike{
+		Factor:     factor,
+		History:    history,
+		MinHistory: minHistory,
+		Action:     action,
+		amounts:    make(map[int][]int),
+	}
+}
+
+func (s *AmountSpike) Name() string {
+	return "amount_spike"
+}
+
+func (s *AmountSpike) Evaluate(ctx context.Context, d Debit) (Decision, error) {
+	s.mu.Lock()
+	amounts := s.amounts[d.UserID]
+	if len(amounts) == 0 || len(amounts) < s.MinHistory {
+		s.mu.Unlock()
+		return Decision{}, nil
+	}
+	var sum int64
+	for _, amount := range amounts {
+		sum += int64(amount)
+	}
+	average := float64(sum) / float64(len(amounts))
+	s.mu.Unlock()
+
+	if float64(d.Amount) > s.Factor*average {
+		return Decision{
+			Action: s.Action,
+			Reason: fmt.Sprintf("amount %d is over %.1fx the average %.0f", d.Amount, s.Factor, average),
+		}, nil
+	}
+	return Decision{}, nil
+}
+
+func (s *AmountSpike) Record(d Debit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	amounts := append(s.amounts[d.UserID], d.Amount)
+	if len(amounts) > s.History {
+		amounts = amounts[len(amounts)-s.History:]
+	}
+	s.amounts[d.UserID] = amounts
+}
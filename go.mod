@@ -1,8 +1,20 @@
-module testovoe
+module github.com/Skat712/test_balance
 
-go 1.18
+go 1.19
 
 require (
 	github.com/gocraft/dbr/v2 v2.7.3
+	github.com/jackc/pgx/v5 v5.5.5
 	github.com/lib/pq v1.10.4
+	github.com/mattn/go-sqlite3 v1.14.16
+	golang.org/x/crypto v0.17.0
+)
+
+require (
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
+	github.com/jackc/puddle/v2 v2.2.1 // indirect
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 )
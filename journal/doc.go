@@ -0,0 +1,6 @@
+// Package journal - локальный журнал изменений балансов (write-ahead log).
+//
+// Каждое списание записывается в журнал до ответа клиенту. Записи пронумерованы монотонным seq,
+// вместе с изменением баланса в БД сохраняется seq последней примененной записи пользователя,
+// поэтому при повторном проигрывании журнала после падения каждая запись применяется ровно один раз.
+package journal
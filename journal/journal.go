@@ -0,0 +1,326 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// headerSize - заголовок записи: длина и crc32 JSON тела
+const headerSize = 4 + 4
+
+// maxRecordSize - записи больше считаются повреждением файла
+const maxRecordSize = 1 << 20
+
+// DefaultSegmentSize - размер сегмента, после которого журнал переключается на новый файл
+const DefaultSegmentSize = 64 << 20
+
+// Entry - запись журнала
+type Entry struct {
+	Seq         int64             `json:"seq"`
+	Transaction store.Transaction `json:"tx"`
+}
+
+// segment - файл журнала и диапазон seq в нем
+type segment struct {
+	path     string
+	firstSeq int64
+	lastSeq  int64
+}
+
+// Journal - журнал изменений балансов из сегментов в одной директории
+type Journal struct {
+	dir         string
+	segmentSize int64
+	sync        bool
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	seq      int64
+	segments []*segment
+	// unapplied - диапазоны seq еще не примененных в БД записей по пользователям
+	unapplied map[int]*seqRange
+}
+
+// seqRange - первая (нижняя граница) и последняя непримененные записи пользователя
+type seqRange struct {
+	first int64
+	last  int64
+}
+
+// Open - открывает журнал в dir. Если sync, каждая запись сбрасывается на диск до возврата из Append
+func Open(dir string, segmentSize int64, sync bool) (*Journal, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		dir:         dir,
+		segmentSize: segmentSize,
+		sync:        sync,
+		unapplied:   make(map[int]*seqRange),
+		// seq продолжается от текущего времени, чтобы после очистки журнала
+		// новые записи всегда были больше уже сохраненных в БД
+		seq: time.Now().UnixNano(),
+	}
+
+	paths, err := j.segmentPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		seg := &segment{path: path}
+		err := readSegment(path, func(e Entry) error {
+			if seg.firstSeq == 0 {
+				seg.firstSeq = e.Seq
+			}
+			seg.lastSeq = e.Seq
+			if e.Seq > j.seq {
+				j.seq = e.Seq
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		j.segments = append(j.segments, seg)
+	}
+
+	return j, nil
+}
+
+// segmentPaths - файлы сегментов в порядке записи
+func (j *Journal) segmentPaths() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(j.dir, "wal-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Replay - вызывает fn для каждой записи журнала в порядке seq
+func (j *Journal) Replay(fn func(e Entry) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, seg := range j.segments {
+		if err := readSegment(seg.path, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset - удаляет все сегменты, например после того как журнал проигран в БД
+func (j *Journal) Reset() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+
+	for _, seg := range j.segments {
+		if err := os.Remove(seg.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	j.segments = nil
+	j.unapplied = make(map[int]*seqRange)
+	return nil
+}
+
+// Append - записывает транзакцию и возвращает ее seq
+func (j *Journal) Append(tx store.Transaction) (int64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil || j.size >= j.segmentSize {
+		if err := j.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	seq := j.seq + 1
+
+	payload, err := json.Marshal(Entry{Seq: seq, Transaction: tx})
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, headerSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+	copy(buf[headerSize:], payload)
+
+	if _, err := j.file.Write(buf); err != nil {
+		return 0, err
+	}
+	if j.sync {
+		if err := j.file.Sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	j.seq = seq
+	j.size += int64(len(buf))
+
+	seg := j.segments[len(j.segments)-1]
+	if seg.firstSeq == 0 {
+		seg.firstSeq = seq
+	}
+	seg.lastSeq = seq
+
+	userID := tx.UserID
+	if r, ok := j.unapplied[userID]; ok {
+		r.last = seq
+	} else {
+		j.unapplied[userID] = &seqRange{first: seq, last: seq}
+	}
+
+	return seq, nil
+}
+
+// Applied - отмечает, что все записи пользователя до seq включительно применены в БД
+func (j *Journal) Applied(userID int, seq int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	r, ok := j.unapplied[userID]
+	if !ok || r.first > seq {
+		return
+	}
+
+	if seq >= r.last {
+		delete(j.unapplied, userID)
+		return
+	}
+
+	r.first = seq + 1
+}
+
+// Close - закрывает текущий сегмент
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// rotate - закрывает текущий сегмент, открывает новый и удаляет сегменты, все записи которых уже в БД
+func (j *Journal) rotate() error {
+	if j.file != nil {
+		if err := j.file.Close(); err != nil {
+			return err
+		}
+		j.file = nil
+	}
+
+	path := filepath.Join(j.dir, fmt.Sprintf("wal-%020d.log", j.seq+1))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	j.file = f
+	j.size = 0
+	j.segments = append(j.segments, &segment{path: path})
+	j.compact()
+
+	return nil
+}
+
+// compact - удаляет закрытые сегменты, в которых не осталось непримененных записей
+func (j *Journal) compact() {
+	oldest := int64(-1)
+	for _, r := range j.unapplied {
+		if oldest < 0 || r.first < oldest {
+			oldest = r.first
+		}
+	}
+
+	segments := j.segments[:0]
+	for i, seg := range j.segments {
+		isCurrent := i == len(j.segments)-1
+		if !isCurrent && seg.lastSeq != 0 && (oldest < 0 || seg.lastSeq < oldest) {
+			if err := os.Remove(seg.path); err == nil || errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+		}
+		segments = append(segments, seg)
+	}
+	j.segments = segments
+}
+
+// readSegment - читает записи сегмента. Недописанная или поврежденная запись в конце файла
+// (процесс упал во время записи) означает конец сегмента
+func readSegment(path string, fn func(e Entry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var header [headerSize]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+
+		size := binary.LittleEndian.Uint32(header[0:])
+		if size == 0 || size > maxRecordSize {
+			return nil
+		}
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+			return nil
+		}
+
+		var e Entry
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return nil
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
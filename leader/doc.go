@@ -0,0 +1,3 @@
+// Package leader - выбор лидера среди реплик в Kubernetes через объект Lease (coordination.k8s.io/v1):
+// фоновое сохранение ведет только держатель аренды, остальные реплики пишут в БД синхронно.
+package leader
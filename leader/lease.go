@@ -0,0 +1,340 @@
+package leader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// файлы сервисного аккаунта, которые Kubernetes монтирует в под
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	tokenFile         = serviceAccountDir + "/token"
+	caFile            = serviceAccountDir + "/ca.crt"
+	namespaceFile     = serviceAccountDir + "/namespace"
+)
+
+// microTime - формат MicroTime в объектах Kubernetes
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// errConflict - Lease успел изменить другой кандидат
+var errConflict = errors.New("lease was changed by another candidate")
+
+// Lease - аренда лидерства через API Kubernetes. Кандидат раз в RetryPeriod пытается взять или продлить аренду;
+// чужая аренда считается истекшей, если она не продлевалась LeaseDuration по часам этого кандидата.
+// Лидер перестает считать себя лидером, если не смог продлить аренду за RenewDeadline, то есть раньше,
+// чем ее смогут забрать другие
+type Lease struct {
+	// Namespace, Name - объект Lease, общий для всех реплик
+	Namespace string
+	Name      string
+	// Identity - имя этого кандидата, обычно имя пода
+	Identity string
+	// LeaseDuration - сколько аренда действует без продления
+	LeaseDuration time.Duration
+	// RenewDeadline - сколько лидер пытается продлить аренду, прежде чем отказаться от лидерства
+	RenewDeadline time.Duration
+	// RetryPeriod - как часто кандидат запрашивает аренду
+	RetryPeriod time.Duration
+
+	host   string
+	client *http.Client
+
+	// renewed - время последнего продления аренды этим кандидатом (UnixNano), 0 - не лидер
+	renewed int64
+
+	// observed - последняя увиденная версия чужой аренды и когда она изменилась по местным часам
+	observedVersion string
+	observedAt      time.Time
+}
+
+// lease - объект Lease API Kubernetes, только нужные поля
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int32  `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string  `json:"acquireTime,omitempty"`
+	RenewTime            string  `json:"renewTime,omitempty"`
+	LeaseTransitions     *int32  `json:"leaseTransitions,omitempty"`
+}
+
+// InClusterNamespace - namespace пода из сервисного аккаунта, пусто вне кластера
+func InClusterNamespace() string {
+	data, err := os.ReadFile(namespaceFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// NewInClusterLease - аренда через API сервер кластера, в котором запущен под: адрес из KUBERNETES_SERVICE_HOST
+// и KUBERNETES_SERVICE_PORT, сертификат и токен сервисного аккаунта. Сервисному аккаунту нужны права
+// get, create и update на leases в namespace
+func NewInClusterLease(namespace, name, identity string) (*Lease, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in kubernetes: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+
+	return &Lease{
+		Namespace:     namespace,
+		Name:          name,
+		Identity:      identity,
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+
+		host: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		},
+	}, nil
+}
+
+// Held - этот кандидат сейчас лидер
+func (l *Lease) Held() bool {
+	renewed := atomic.LoadInt64(&l.renewed)
+	return renewed != 0 && time.Since(time.Unix(0, renewed)) < l.RenewDeadline
+}
+
+// Run - берет и продлевает аренду, пока не отменен ctx, затем освобождает ее, чтобы лидером сразу стал другой
+func (l *Lease) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.RetryPeriod)
+	defer ticker.Stop()
+
+	leader := false
+	for {
+		if err := l.tryAcquireOrRenew(ctx); err != nil && !errors.Is(err, errConflict) && ctx.Err() == nil {
+			log.Printf("lease %s/%s: %v", l.Namespace, l.Name, err)
+		}
+
+		if held := l.Held(); held != leader {
+			leader = held
+			if leader {
+				log.Printf("lease %s/%s acquired by %s, background save is enabled", l.Namespace, l.Name, l.Identity)
+			} else {
+				log.Printf("lease %s/%s is not held by %s, switching to write-through", l.Namespace, l.Name, l.Identity)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if leader {
+				l.release()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tryAcquireOrRenew - одна попытка: создать Lease, продлить свою аренду или забрать истекшую
+func (l *Lease) tryAcquireOrRenew(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, l.RetryPeriod)
+	defer cancel()
+
+	now := time.Now()
+	current, err := l.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	if current == nil {
+		desired := l.desired(nil, now)
+		if err := l.write(ctx, http.MethodPost, l.collectionPath(), desired); err != nil {
+			return err
+		}
+		atomic.StoreInt64(&l.renewed, now.UnixNano())
+		return nil
+	}
+
+	holder := ""
+	if current.Spec.HolderIdentity != nil {
+		holder = *current.Spec.HolderIdentity
+	}
+	if holder != l.Identity {
+		atomic.StoreInt64(&l.renewed, 0)
+		if current.Metadata.ResourceVersion != l.observedVersion {
+			l.observedVersion, l.observedAt = current.Metadata.ResourceVersion, now
+		}
+		duration := l.LeaseDuration
+		if current.Spec.LeaseDurationSeconds != nil {
+			duration = time.Duration(*current.Spec.LeaseDurationSeconds) * time.Second
+		}
+		if holder != "" && now.Sub(l.observedAt) < duration {
+			return nil
+		}
+	}
+
+	if err := l.write(ctx, http.MethodPut, l.objectPath(), l.desired(current, now)); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&l.renewed, now.UnixNano())
+	return nil
+}
+
+// desired - Lease, в котором этот кандидат держит аренду с момента now
+func (l *Lease) desired(current *lease, now time.Time) *lease {
+	identity := l.Identity
+	// срок в Lease - в целых секундах, округляем вверх
+	seconds := int32((l.LeaseDuration + time.Second - 1) / time.Second)
+	transitions := int32(0)
+	acquired := now.UTC().Format(microTime)
+
+	desired := &lease{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata:   leaseMetadata{Name: l.Name, Namespace: l.Namespace},
+	}
+	if current != nil {
+		desired.Metadata.ResourceVersion = current.Metadata.ResourceVersion
+		if current.Spec.LeaseTransitions != nil {
+			transitions = *current.Spec.LeaseTransitions
+		}
+		if current.Spec.HolderIdentity != nil && *current.Spec.HolderIdentity == l.Identity {
+			acquired = current.Spec.AcquireTime
+		} else {
+			transitions++
+		}
+	}
+
+	desired.Spec = leaseSpec{
+		HolderIdentity:       &identity,
+		LeaseDurationSeconds: &seconds,
+		AcquireTime:          acquired,
+		RenewTime:            now.UTC().Format(microTime),
+		LeaseTransitions:     &transitions,
+	}
+	return desired
+}
+
+// release - освобождает аренду: пустой holderIdentity и минимальный срок, другие кандидаты берут ее сразу
+func (l *Lease) release() {
+	atomic.StoreInt64(&l.renewed, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.RetryPeriod)
+	defer cancel()
+
+	current, err := l.get(ctx)
+	if err == nil && current != nil && current.Spec.HolderIdentity != nil && *current.Spec.HolderIdentity == l.Identity {
+		empty, seconds := "", int32(1)
+		current.Spec.HolderIdentity = &empty
+		current.Spec.LeaseDurationSeconds = &seconds
+		current.Spec.RenewTime = time.Now().UTC().Format(microTime)
+		err = l.write(ctx, http.MethodPut, l.objectPath(), current)
+	}
+	if err != nil {
+		log.Printf("failed to release lease %s/%s: %v", l.Namespace, l.Name, err)
+		return
+	}
+	log.Printf("lease %s/%s released", l.Namespace, l.Name)
+}
+
+func (l *Lease) collectionPath() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + l.Namespace + "/leases"
+}
+
+func (l *Lease) objectPath() string {
+	return l.collectionPath() + "/" + l.Name
+}
+
+// get - текущий Lease, nil если его еще нет
+func (l *Lease) get(ctx context.Context) (*lease, error) {
+	resp, err := l.do(ctx, http.MethodGet, l.objectPath(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var current lease
+		if err := json.NewDecoder(resp.Body).Decode(&current); err != nil {
+			return nil, err
+		}
+		return &current, nil
+	case http.StatusNotFound:
+		return nil, nil
+	}
+	return nil, statusError(http.MethodGet, resp)
+}
+
+// write - создает (POST) или обновляет (PUT) Lease. Обновление проверяет resourceVersion,
+// поэтому из двух одновременных попыток проходит одна, вторая получает errConflict
+func (l *Lease) write(ctx context.Context, method, path string, obj *lease) error {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	resp, err := l.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return nil
+	case http.StatusConflict:
+		return errConflict
+	}
+	return statusError(method, resp)
+}
+
+func (l *Lease) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	// токен сервисного аккаунта периодически обновляется, поэтому читается на каждый запрос
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, l.host+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return l.client.Do(req)
+}
+
+func statusError(method string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s lease: %s: %s", strings.ToLower(method), resp.Status, body)
+}
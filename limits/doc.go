@@ -0,0 +1,2 @@
+// Package limits - лимиты трат пользователей и сегментов за скользящие сутки и неделю, потраченное считается по леджеру.
+package limits
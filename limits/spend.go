@@ -0,0 +1,142 @@
+package limits
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// SpendLimits - лимиты трат из таблицы spend_limits, загруженные в память. Изменения через Set и Delete
+// действуют на этом экземпляре сразу, на остальных - после перезагрузки, не позже чем через Interval
+type SpendLimits struct {
+	Sess *dbr.Session
+	// Interval - как часто перечитывать лимиты
+	Interval time.Duration
+
+	mu        sync.RWMutex
+	bySubject map[string]store.SpendLimit
+	// segments - есть лимиты сегментов, иначе сегмент пользователя не нужно читать из метаданных
+	segments bool
+}
+
+// Reload - перечитывает лимиты, при ошибке остаются прежние
+func (l *SpendLimits) Reload(ctx context.Context) error {
+	list, err := store.LoadSpendLimits(ctx, l.Sess)
+	if err != nil {
+		return err
+	}
+
+	bySubject := make(map[string]store.SpendLimit, len(list))
+	segments := false
+	for _, limit := range list {
+		bySubject[limit.Subject] = limit
+		segments = segments || strings.HasPrefix(limit.Subject, "segment:")
+	}
+
+	l.mu.Lock()
+	l.bySubject, l.segments = bySubject, segments
+	l.mu.Unlock()
+	return nil
+}
+
+// Run - перечитывает лимиты раз в Interval, пока не отменен ctx
+func (l *SpendLimits) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Reload(ctx); err != nil {
+				log.Printf("failed to reload spend limits: %v", err)
+			}
+		}
+	}
+}
+
+// List - все лимиты
+func (l *SpendLimits) List() []store.SpendLimit {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	list := make([]store.SpendLimit, 0, len(l.bySubject))
+	for _, limit := range l.bySubject {
+		list = append(list, limit)
+	}
+	return list
+}
+
+// Set - добавляет или заменяет лимит
+func (l *SpendLimits) Set(ctx context.Context, limit store.SpendLimit) error {
+	if err := limit.Validate(); err != nil {
+		return err
+	}
+	if err := store.SetSpendLimit(ctx, l.Sess, limit); err != nil {
+		return err
+	}
+	return l.Reload(ctx)
+}
+
+// Delete - удаляет лимит subject, store.ErrNotFound если его нет
+func (l *SpendLimits) Delete(ctx context.Context, subject string) error {
+	if err := store.DeleteSpendLimit(ctx, l.Sess, subject); err != nil {
+		return err
+	}
+	return l.Reload(ctx)
+}
+
+// For - лимит пользователя u: свой, иначе его сегмента. Вызывается под блокировкой пользователя
+func (l *SpendLimits) For(u *store.User) (store.SpendLimit, bool) {
+	l.mu.RLock()
+	limit, ok := l.bySubject[store.UserSubject(u.ID)]
+	segments := l.segments
+	l.mu.RUnlock()
+	if ok || !segments {
+		return limit, ok
+	}
+
+	segment := u.Segment()
+	if segment == "" {
+		return store.SpendLimit{}, false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	limit, ok = l.bySubject[store.SegmentSubject(segment)]
+	return limit, ok
+}
+
+// Check - *store.SpendLimitError, если списание amount превысит лимит пользователя u в каком-то окне.
+// Потраченное - списания по леджеру в storage плюс несохраненные списания u, поэтому u должен быть
+// под блокировкой (DebitOptions.Check) или только что прочитан. Списания, которые фоновое сохранение уже забрало,
+// но еще не записало, не видны ни там, ни там, поэтому под нагрузкой лимит может быть немного превышен. nil - без лимитов
+func (l *SpendLimits) Check(ctx context.Context, storage store.Storage, u *store.User, amount int) error {
+	if l == nil {
+		return nil
+	}
+	limit, ok := l.For(u)
+	if !ok {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	for _, w := range limit.Windows() {
+		since := now.Add(-w.Length)
+		spent, err := storage.SpentSince(ctx, u.ID, since)
+		if err != nil {
+			return err
+		}
+		spent += u.UnsavedSpent(since)
+		if spent+int64(amount) > w.Limit {
+			return &store.SpendLimitError{Window: w.Name, Limit: w.Limit, Spent: spent}
+		}
+	}
+	return nil
+}
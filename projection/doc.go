@@ -0,0 +1,3 @@
+// Package projection - денормализованные модели чтения для аналитики, которые строятся из леджера
+// в отдельных таблицах и не нагружают таблицы горячего пути списаний.
+package projection
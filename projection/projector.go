@@ -0,0 +1,115 @@
+package projection
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// checkpointName - позиция проектора в леджере в projection_checkpoints
+const checkpointName = "ledger"
+
+// Projector - применяет новые записи леджера к проекциям:
+// user_daily_totals - списания, зачисления и количество операций пользователя за сутки (UTC),
+// user_running_balances - накопленный итог операций пользователя.
+// Записи читаются по seq (порядку вставки), позиция хранится в той же транзакции, что и проекции
+type Projector struct {
+	Sess *dbr.Session
+	// Interval - как часто проверять новые записи
+	Interval time.Duration
+	// Settle - записи моложе этого не читаются: транзакции, начатые раньше, могут зафиксироваться с меньшим seq позже
+	Settle time.Duration
+	// BatchSize - сколько записей применять за шаг
+	BatchSize int
+}
+
+// Run - применяет записи раз в Interval, пока не отменен ctx
+func (p *Projector) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	log.Printf("start ledger projections, interval %s", p.Interval)
+	for {
+		for {
+			applied, err := p.Step(ctx)
+			if err != nil {
+				log.Printf("ledger projection failed: %v", err)
+			}
+			if err != nil || applied < p.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("stop ledger projections")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Step - применяет к проекциям следующую пачку записей, возвращает их количество
+func (p *Projector) Step(ctx context.Context) (int, error) {
+	tx, err := p.Sess.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	if _, err := tx.InsertBySql(`INSERT INTO projection_checkpoints (name, seq, updated_at) VALUES (?, 0, ?) ON CONFLICT (name) DO NOTHING`,
+		checkpointName, time.Now().UTC()).ExecContext(ctx); err != nil {
+		return 0, err
+	}
+
+	var from int64
+	if err := tx.Select("seq").From("projection_checkpoints").Where("name = ?", checkpointName).Suffix("FOR UPDATE").LoadOneContext(ctx, &from); err != nil {
+		return 0, err
+	}
+
+	var batch struct {
+		To    dbr.NullInt64 `db:"to_seq"`
+		Count int           `db:"count"`
+	}
+	err = tx.SelectBySql(`SELECT MAX(seq) AS to_seq, COUNT(*) AS count FROM (
+		SELECT seq FROM transactions WHERE seq > ? AND inserted_at < (now() AT TIME ZONE 'utc') - ? * interval '1 second'
+		ORDER BY seq LIMIT ?) AS b`, from, p.Settle.Seconds(), p.BatchSize).LoadOneContext(ctx, &batch)
+	if err != nil {
+		return 0, err
+	}
+	if !batch.To.Valid {
+		return 0, nil
+	}
+	to := batch.To.Int64
+	now := time.Now().UTC()
+
+	if _, err := tx.InsertBySql(`INSERT INTO user_daily_totals (user_id, day, debits, credits, operations)
+		SELECT user_id, created_at::date,
+			SUM(CASE WHEN amount < 0 THEN -amount ELSE 0 END), SUM(CASE WHEN amount > 0 THEN amount ELSE 0 END), COUNT(*)
+		FROM transactions WHERE seq > ? AND seq <= ? GROUP BY 1, 2
+		ON CONFLICT (user_id, day) DO UPDATE SET
+			debits = user_daily_totals.debits + EXCLUDED.debits,
+			credits = user_daily_totals.credits + EXCLUDED.credits,
+			operations = user_daily_totals.operations + EXCLUDED.operations`, from, to).ExecContext(ctx); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.InsertBySql(`INSERT INTO user_running_balances (user_id, net, operations, last_seq, updated_at)
+		SELECT user_id, SUM(amount), COUNT(*), MAX(seq), ? FROM transactions WHERE seq > ? AND seq <= ? GROUP BY 1
+		ON CONFLICT (user_id) DO UPDATE SET
+			net = user_running_balances.net + EXCLUDED.net,
+			operations = user_running_balances.operations + EXCLUDED.operations,
+			last_seq = EXCLUDED.last_seq,
+			updated_at = EXCLUDED.updated_at`, now, from, to).ExecContext(ctx); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Update("projection_checkpoints").Set("seq", to).Set("updated_at", now).
+		Where("name = ?", checkpointName).ExecContext(ctx); err != nil {
+		return 0, err
+	}
+
+	return batch.Count, tx.Commit()
+}
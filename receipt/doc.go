@@ -0,0 +1,2 @@
+// Package receipt - подписанные квитанции об операциях по балансу для клиентов (JSON и PDF).
+package receipt
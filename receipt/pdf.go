@@ -0,0 +1,68 @@
+package receipt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PDF - квитанция одной страницей A4 со стандартным шрифтом Helvetica
+func PDF(r Receipt) []byte {
+	lines := []string{
+		"Receipt",
+		"",
+		"Transaction: " + r.TransactionID,
+		fmt.Sprintf("User: %d", r.UserID),
+		"Operation: " + r.Operation,
+		"Direction: " + r.Direction,
+		fmt.Sprintf("Amount: %d", r.Amount),
+		"Date (UTC): " + r.CreatedAt.Format(time.RFC3339),
+	}
+	if r.Tag != "" {
+		lines = append(lines, "Tag: "+r.Tag)
+	}
+	lines = append(lines, "", "Signature (HMAC-SHA256):", r.Signature)
+
+	var content bytes.Buffer
+	content.WriteString("BT\n/F1 12 Tf\n14 TL\n72 770 Td\n")
+	for _, line := range lines {
+		fmt.Fprintf(&content, "(%s) '\n", pdfEscape(line))
+	}
+	content.WriteString("ET\n")
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 4 0 R >> >> /Contents 5 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// pdfEscape - экранирование строки PDF, символы вне ASCII заменяются на '?'
+func pdfEscape(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 32 || r > 126 {
+			return '?'
+		}
+		return r
+	}, s)
+	return strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`).Replace(s)
+}
@@ -0,0 +1,75 @@
+package receipt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// Receipt - квитанция об операции
+type Receipt struct {
+	TransactionID string `json:"transaction_id"`
+	UserID        int    `json:"user_id"`
+	Operation     string `json:"operation"`
+	Tag           string `json:"tag,omitempty"`
+	// Amount - сумма операции в минимальных единицах, всегда положительная
+	Amount int `json:"amount"`
+	// Direction - "debit" для списаний, "credit" для зачислений
+	Direction string    `json:"direction"`
+	CreatedAt time.Time `json:"created_at"`
+	// Signature - HMAC-SHA256 полей квитанции, hex
+	Signature string `json:"signature"`
+}
+
+// Signer - выпуск и проверка подписи квитанций
+type Signer struct {
+	secret []byte
+}
+
+// NewSigner - secret пустой - генерируется случайный, подписи квитанций не проверяются после перезапуска
+func NewSigner(secret string) (*Signer, error) {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &Signer{secret: key}, nil
+}
+
+// Issue - подписанная квитанция по записи леджера
+func (s *Signer) Issue(tx store.Transaction) Receipt {
+	r := Receipt{
+		TransactionID: tx.ID,
+		UserID:        tx.UserID,
+		Operation:     tx.Operation,
+		Tag:           tx.Tag,
+		Amount:        tx.Amount,
+		Direction:     "credit",
+		CreatedAt:     tx.CreatedAt.UTC(),
+	}
+	if r.Amount < 0 {
+		r.Amount = -r.Amount
+		r.Direction = "debit"
+	}
+	r.Signature = s.sign(r)
+	return r
+}
+
+// Verify - подпись квитанции сделана этим Signer
+func (s *Signer) Verify(r Receipt) bool {
+	return hmac.Equal([]byte(r.Signature), []byte(s.sign(r)))
+}
+
+// sign - подпись канонической строки из полей квитанции
+func (s *Signer) sign(r Receipt) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s|%d|%s|%s|%d|%s|%s", r.TransactionID, r.UserID, r.Operation, r.Tag, r.Amount, r.Direction, r.CreatedAt.Format(time.RFC3339Nano))
+	return hex.EncodeToString(mac.Sum(nil))
+}
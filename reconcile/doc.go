@@ -0,0 +1,3 @@
+// Package reconcile - сверка балансов в кеше с БД: находит тихие расхождения состояния в памяти
+// с сохраненным до того, как они попадут в ответы и сохранения.
+package reconcile
@@ -0,0 +1,161 @@
+package reconcile
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/Skat712/test_balance/cache"
+	"github.com/Skat712/test_balance/store"
+)
+
+// Reconciler - раз в Interval берет Sample пользователей из кеша и сравнивает баланс в памяти без несохраненных
+// изменений с балансом в БД. Сохранение и Lockless списание дают короткие расхождения, поэтому расхождение
+// перепроверяется через Confirm и считается, только если не изменилось. Пользователи, строку которых с загрузки
+// изменил кто-то еще (версия в БД другая), пропускаются
+type Reconciler struct {
+	Cache *cache.Cache
+	Store store.Storage
+	// Interval - как часто сверять
+	Interval time.Duration
+	// Sample - сколько пользователей сверять за раз
+	Sample int
+	// Confirm - через сколько перепроверять найденное расхождение
+	Confirm time.Duration
+	// Correct - исправлять баланс в памяти по БД, иначе только сообщать
+	Correct bool
+
+	checked   int64
+	skipped   int64
+	diverged  int64
+	corrected int64
+	errors    int64
+}
+
+// Stats - счетчики сверки с запуска
+type Stats struct {
+	Checked   int64 `json:"checked"`
+	Skipped   int64 `json:"skipped"`
+	Diverged  int64 `json:"diverged"`
+	Corrected int64 `json:"corrected"`
+	Errors    int64 `json:"errors"`
+}
+
+func (r *Reconciler) Stats() Stats {
+	return Stats{
+		Checked:   atomic.LoadInt64(&r.checked),
+		Skipped:   atomic.LoadInt64(&r.skipped),
+		Diverged:  atomic.LoadInt64(&r.diverged),
+		Corrected: atomic.LoadInt64(&r.corrected),
+		Errors:    atomic.LoadInt64(&r.errors),
+	}
+}
+
+// Run - сверяет раз в Interval, пока не отменен ctx
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	log.Printf("start cache reconciliation, %d users every %s", r.Sample, r.Interval)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("stop cache reconciliation")
+			return
+		case <-ticker.C:
+			if err := r.Reconcile(ctx); err != nil && ctx.Err() == nil {
+				atomic.AddInt64(&r.errors, 1)
+				log.Printf("cache reconciliation failed: %v", err)
+			}
+		}
+	}
+}
+
+// suspect - пользователь с расхождением при первой проверке
+type suspect struct {
+	user  *store.User
+	drift int64
+}
+
+// Reconcile - одна сверка выборки из кеша
+func (r *Reconciler) Reconcile(ctx context.Context) error {
+	users := r.Cache.Sample(r.Sample)
+	if len(users) == 0 {
+		return nil
+	}
+
+	suspects, err := r.check(ctx, users, nil)
+	if err != nil || len(suspects) == 0 {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(r.Confirm):
+	}
+
+	candidates := make([]*store.User, 0, len(suspects))
+	for _, s := range suspects {
+		candidates = append(candidates, s.user)
+	}
+	_, err = r.check(ctx, candidates, suspects)
+	return err
+}
+
+// check - сравнивает users с их строками в БД. Без first возвращает пользователей с расхождением,
+// с first - результат первой проверки - сообщает о тех, у кого расхождение то же, и при Correct исправляет их
+func (r *Reconciler) check(ctx context.Context, users []*store.User, first map[int]suspect) (map[int]suspect, error) {
+	ids := make([]int, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.Interval)
+	defer cancel()
+
+	rows, err := r.Store.LoadUsers(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]*store.User, len(rows))
+	for _, row := range rows {
+		byID[row.ID] = row
+	}
+
+	suspects := make(map[int]suspect)
+	for _, u := range users {
+		row, ok := byID[u.ID]
+		if !ok {
+			atomic.AddInt64(&r.skipped, 1)
+			continue
+		}
+		drift, ok := u.Drift(row.Balance, row.Version)
+		if !ok {
+			atomic.AddInt64(&r.skipped, 1)
+			continue
+		}
+		if first == nil {
+			atomic.AddInt64(&r.checked, 1)
+			if drift != 0 {
+				suspects[u.ID] = suspect{user: u, drift: drift}
+			}
+			continue
+		}
+		if drift == 0 || drift != first[u.ID].drift {
+			continue
+		}
+
+		atomic.AddInt64(&r.diverged, 1)
+		if !r.Correct {
+			log.Printf("user %d: cached balance diverges from database by %d (version %d)", u.ID, drift, row.Version)
+			continue
+		}
+		if u.Correct(row.Balance, row.Version, drift) {
+			atomic.AddInt64(&r.corrected, 1)
+			log.Printf("user %d: cached balance diverged from database by %d (version %d), corrected", u.ID, drift, row.Version)
+		}
+	}
+	return suspects, nil
+}
@@ -0,0 +1,2 @@
+// Package slo - учет доступности и задержек запросов в скользящем окне и расчет расхода бюджета ошибок.
+package slo
@@ -0,0 +1,200 @@
+package slo
+
+import (
+	"sync"
+	"time"
+)
+
+// Config - цели SLO
+type Config struct {
+	// Window - окно, за которое считается соответствие SLO
+	Window time.Duration
+	// AvailabilityTarget - доля успешных (не 5xx) запросов, например 0.999
+	AvailabilityTarget float64
+	// LatencyThreshold - запрос быстрее этого времени считается хорошим
+	LatencyThreshold time.Duration
+	// LatencyTarget - доля запросов быстрее LatencyThreshold, например 0.99
+	LatencyTarget float64
+}
+
+// DefaultConfig - цели по умолчанию
+func DefaultConfig() Config {
+	return Config{
+		Window:             30 * 24 * time.Hour,
+		AvailabilityTarget: 0.999,
+		LatencyThreshold:   200 * time.Millisecond,
+		LatencyTarget:      0.99,
+	}
+}
+
+// bucket - счетчики запросов за одну минуту
+type bucket struct {
+	minute int64
+	total  int64
+	errors int64
+	slow   int64
+}
+
+// Counts - счетчики запросов за период
+type Counts struct {
+	Total  int64 `json:"total"`
+	Errors int64 `json:"errors"`
+	Slow   int64 `json:"slow"`
+}
+
+// Tracker - поминутные счетчики запросов в кольцевом буфере размером с окно SLO
+type Tracker struct {
+	cfg Config
+
+	mu      sync.Mutex
+	buckets []bucket
+	totals  Counts
+}
+
+func NewTracker(cfg Config) *Tracker {
+	minutes := int(cfg.Window / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+
+	return &Tracker{
+		cfg:     cfg,
+		buckets: make([]bucket, minutes),
+	}
+}
+
+// Record - учитывает завершенный запрос
+func (t *Tracker) Record(status int, duration time.Duration) {
+	minute := time.Now().Unix() / 60
+	isError := status >= 500
+	isSlow := duration > t.cfg.LatencyThreshold
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := &t.buckets[minute%int64(len(t.buckets))]
+	if b.minute != minute {
+		*b = bucket{minute: minute}
+	}
+
+	b.total++
+	t.totals.Total++
+	if isError {
+		b.errors++
+		t.totals.Errors++
+	}
+	if isSlow {
+		b.slow++
+		t.totals.Slow++
+	}
+}
+
+// Totals - счетчики с момента запуска
+func (t *Tracker) Totals() Counts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.totals
+}
+
+// Counts - счетчики за последний период (не больше окна SLO)
+func (t *Tracker) Counts(period time.Duration) Counts {
+	minutes := int64(period / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	if minutes > int64(len(t.buckets)) {
+		minutes = int64(len(t.buckets))
+	}
+
+	now := time.Now().Unix() / 60
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var c Counts
+	for m := now - minutes + 1; m <= now; m++ {
+		b := t.buckets[m%int64(len(t.buckets))]
+		if b.minute != m {
+			continue
+		}
+		c.Total += b.total
+		c.Errors += b.errors
+		c.Slow += b.slow
+	}
+	return c
+}
+
+// Objective - соответствие одной цели SLO
+type Objective struct {
+	Target float64 `json:"target"`
+	// Actual - фактическая доля хороших запросов за окно
+	Actual float64 `json:"actual"`
+	// ErrorBudgetRemaining - остаток бюджета ошибок за окно (1 - не тронут, <0 - превышен)
+	ErrorBudgetRemaining float64 `json:"error_budget_remaining"`
+	// BurnRate - скорость расхода бюджета за период: 1 - бюджет кончится ровно к концу окна
+	BurnRate map[string]float64 `json:"burn_rate"`
+}
+
+// Report - отчет по SLO
+type Report struct {
+	Window             string    `json:"window"`
+	Requests           Counts    `json:"requests"`
+	Availability       Objective `json:"availability"`
+	Latency            Objective `json:"latency"`
+	LatencyThresholdMs int64     `json:"latency_threshold_ms"`
+}
+
+// burnRatePeriods - периоды, за которые считается скорость расхода бюджета
+var burnRatePeriods = []struct {
+	name   string
+	period time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+	{"24h", 24 * time.Hour},
+}
+
+// Report - соответствие целям SLO за окно и скорость расхода бюджета
+func (t *Tracker) Report() Report {
+	window := t.Counts(t.cfg.Window)
+
+	report := Report{
+		Window:             t.cfg.Window.String(),
+		Requests:           window,
+		Availability:       objective(t.cfg.AvailabilityTarget, window.Total, window.Errors),
+		Latency:            objective(t.cfg.LatencyTarget, window.Total, window.Slow),
+		LatencyThresholdMs: t.cfg.LatencyThreshold.Milliseconds(),
+	}
+
+	report.Availability.BurnRate = make(map[string]float64, len(burnRatePeriods))
+	report.Latency.BurnRate = make(map[string]float64, len(burnRatePeriods))
+	for _, p := range burnRatePeriods {
+		c := t.Counts(p.period)
+		report.Availability.BurnRate[p.name] = burnRate(t.cfg.AvailabilityTarget, c.Total, c.Errors)
+		report.Latency.BurnRate[p.name] = burnRate(t.cfg.LatencyTarget, c.Total, c.Slow)
+	}
+
+	return report
+}
+
+func objective(target float64, total, bad int64) Objective {
+	o := Objective{Target: target, Actual: 1, ErrorBudgetRemaining: 1}
+	if total == 0 {
+		return o
+	}
+
+	o.Actual = 1 - float64(bad)/float64(total)
+	if budget := 1 - target; budget > 0 {
+		o.ErrorBudgetRemaining = 1 - (float64(bad)/float64(total))/budget
+	}
+	return o
+}
+
+func burnRate(target float64, total, bad int64) float64 {
+	budget := 1 - target
+	if total == 0 || budget <= 0 {
+		return 0
+	}
+	return (float64(bad) / float64(total)) / budget
+}
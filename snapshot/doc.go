@@ -0,0 +1,3 @@
+// Package snapshot - балансы пользователей на конец каждых суток (UTC) в таблице balance_snapshots:
+// стабильный дневной ряд для финансов и опора для исторических запросов баланса.
+package snapshot
@@ -0,0 +1,114 @@
+package snapshot
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// day - длина суток снимка, сутки выравниваются по UTC
+const day = 24 * time.Hour
+
+// Snapshotter - раз в Interval снимает балансы за все завершившиеся и еще не снятые сутки.
+// Баланс на конец суток - баланс в БД без записей леджера с начала следующих суток: он сходится с леджером,
+// даже если снимок снят позже. Снятые сутки отмечаются в balance_snapshot_days, поэтому сутки снимает
+// один экземпляр, даже если задача запущена на нескольких
+type Snapshotter struct {
+	Sess *dbr.Session
+	// Interval - как часто проверять, не завершились ли очередные сутки
+	Interval time.Duration
+	// Settle - сколько ждать после конца суток: фоновое сохранение пишет списания в БД с задержкой,
+	// и списание конца суток, сохраненное после снимка, в него бы не попало
+	Settle time.Duration
+	// Since - с каких суток снимать, если снимков еще не было
+	Since time.Time
+}
+
+// Run - снимает пропущенные сутки сразу и затем раз в Interval, пока не отменен ctx
+func (s *Snapshotter) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	log.Printf("start balance snapshots, settle %s", s.Settle)
+	for {
+		if err := s.SnapshotDue(ctx); err != nil {
+			log.Printf("balance snapshot failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("stop balance snapshots")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SnapshotDue - снимает все завершившиеся (с учетом Settle) и еще не снятые сутки
+func (s *Snapshotter) SnapshotDue(ctx context.Context) error {
+	var last dbr.NullTime
+	if err := s.Sess.Select("MAX(day)").From("balance_snapshot_days").LoadOneContext(ctx, &last); err != nil {
+		return err
+	}
+
+	next := s.Since.UTC().Truncate(day)
+	if last.Valid {
+		next = last.Time.UTC().Truncate(day).Add(day)
+	}
+
+	for !next.Add(day + s.Settle).After(time.Now().UTC()) {
+		if err := s.Snapshot(ctx, next); err != nil {
+			return err
+		}
+		next = next.Add(day)
+	}
+	return nil
+}
+
+// Snapshot - балансы всех пользователей, созданных до конца суток date, одним запросом и потому на один момент.
+// Уже снятые сутки пропускаются
+func (s *Snapshotter) Snapshot(ctx context.Context, date time.Time) error {
+	date = date.UTC().Truncate(day)
+	end := date.Add(day)
+
+	tx, err := s.Sess.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	// строка суток берется первой: второй экземпляр ждет на ней и после коммита первого ничего не делает
+	var taken []string
+	_, err = tx.SelectBySql(`INSERT INTO balance_snapshot_days (day, users, created_at) VALUES (?, 0, ?)
+		ON CONFLICT (day) DO NOTHING RETURNING 'taken'`, date, time.Now().UTC()).LoadContext(ctx, &taken)
+	if err != nil {
+		return err
+	}
+	if len(taken) == 0 {
+		return nil
+	}
+
+	res, err := tx.InsertBySql(`INSERT INTO balance_snapshots (day, user_id, balance)
+		SELECT ?, u.id, u.balance - COALESCE(later.amount, 0)
+		FROM users u
+		LEFT JOIN (SELECT user_id, SUM(amount) AS amount FROM transactions WHERE created_at >= ? GROUP BY user_id) later
+			ON later.user_id = u.id
+		WHERE u.created_at < ?
+		ON CONFLICT (day, user_id) DO NOTHING`, date, end, end).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	users, _ := res.RowsAffected()
+
+	if _, err := tx.Update("balance_snapshot_days").Set("users", users).Where("day = ?", date).ExecContext(ctx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("balance snapshot %s: %d users", date.Format("2006-01-02"), users)
+	return nil
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// ErrAPIKeyExists - ключ с таким именем уже есть (в том числе отозванный)
+var ErrAPIKeyExists = errors.New("api key with this name already exists")
+
+// APIKey - ключ API вызывающего сервиса. Сам ключ не хранится, только его хеш, см. auth.HashAPIKey
+type APIKey struct {
+	// Name - имя вызывающего, оно попадает в журнал аудита
+	Name string `db:"name" json:"name"`
+	Hash string `db:"key_hash" json:"-"`
+	// Scopes - права ключа через пробел, см. auth.ScopeService и auth.ScopeAdmin
+	Scopes    string     `db:"scopes" json:"scopes"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+	RevokedAt *time.Time `db:"revoked_at" json:"revoked_at,omitempty"`
+}
+
+// ScopeList - Scopes списком
+func (k APIKey) ScopeList() []string {
+	return strings.Fields(k.Scopes)
+}
+
+// APIKeyColumns - колонки таблицы api_keys
+var APIKeyColumns = []string{"name", "key_hash", "scopes", "created_at", "revoked_at"}
+
+// LoadAPIKeys - все ключи, с отозванными, если withRevoked
+func LoadAPIKeys(ctx context.Context, sess *dbr.Session, withRevoked bool) ([]APIKey, error) {
+	stmt := sess.Select(APIKeyColumns...).From("api_keys").OrderBy("name")
+	if !withRevoked {
+		stmt = stmt.Where("revoked_at IS NULL")
+	}
+	var keys []APIKey
+	_, err := stmt.LoadContext(ctx, &keys)
+	return keys, err
+}
+
+// CreateAPIKey - добавляет ключ с хешем hash и правами scopes, ErrAPIKeyExists если имя занято
+func CreateAPIKey(ctx context.Context, sess *dbr.Session, name, hash string, scopes []string) error {
+	_, err := sess.InsertInto("api_keys").Columns("name", "key_hash", "scopes", "created_at").
+		Values(name, hash, strings.Join(scopes, " "), time.Now().UTC()).ExecContext(ctx)
+	if isUniqueViolation(err) {
+		return ErrAPIKeyExists
+	}
+	return err
+}
+
+// RevokeAPIKey - отзывает ключ, ErrNotFound если действующего ключа с таким именем нет
+func RevokeAPIKey(ctx context.Context, sess *dbr.Session, name string) error {
+	res, err := sess.Update("api_keys").Set("revoked_at", time.Now().UTC()).
+		Where("name = ? AND revoked_at IS NULL", name).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// состояния списания, ожидающего подтверждения
+const (
+	// ApprovalPending - ждет решения
+	ApprovalPending = "pending"
+	// ApprovalApproved - подтверждено и списано (TransactionID)
+	ApprovalApproved = "approved"
+	// ApprovalRejected - отклонено
+	ApprovalRejected = "rejected"
+	// ApprovalFailed - подтверждено, но списание не прошло (Reason)
+	ApprovalFailed = "failed"
+)
+
+// ErrApprovalDecided - по списанию уже принято решение
+var ErrApprovalDecided = errors.New("approval is already decided")
+
+// Approval - крупное списание, которое ждет подтверждения вторым человеком (maker-checker)
+type Approval struct {
+	ID     string `db:"id" json:"id"`
+	UserID int    `db:"user_id" json:"user_id"`
+	Amount int    `db:"amount" json:"amount"`
+	Tag    string `db:"tag" json:"tag,omitempty"`
+	// Category, Tags - категория и теги списания, см. Transaction
+	Category string `db:"category" json:"category,omitempty"`
+	Tags     Tags   `db:"tags" json:"tags,omitempty"`
+	Strict   bool   `db:"strict" json:"strict,omitempty"`
+	// Pocket - карман, из которого идет списание, пусто - основной
+	Pocket string `db:"pocket" json:"pocket,omitempty"`
+	Status string `db:"status" json:"status"`
+	// RequestedBy, DecidedBy - вызывающие, как в журнале аудита
+	RequestedBy   string     `db:"requested_by" json:"requested_by"`
+	DecidedBy     string     `db:"decided_by" json:"decided_by,omitempty"`
+	Reason        string     `db:"reason" json:"reason,omitempty"`
+	TransactionID string     `db:"transaction_id" json:"transaction_id,omitempty"`
+	CreatedAt     time.Time  `db:"created_at" json:"created_at"`
+	DecidedAt     *time.Time `db:"decided_at" json:"decided_at,omitempty"`
+}
+
+var approvalColumns = []string{"id", "user_id", "amount", "tag", "category", "tags", "strict", "pocket", "status", "requested_by",
+	"decided_by", "reason", "transaction_id", "created_at", "decided_at"}
+
+// ValidApprovalStatus - известное состояние подтверждения
+func ValidApprovalStatus(status string) bool {
+	switch status {
+	case ApprovalPending, ApprovalApproved, ApprovalRejected, ApprovalFailed:
+		return true
+	}
+	return false
+}
+
+// CreateApproval - сохраняет новое ожидающее подтверждения списание
+func CreateApproval(ctx context.Context, sess *dbr.Session, a Approval) error {
+	_, err := sess.InsertInto("approvals").
+		Columns("id", "user_id", "amount", "tag", "category", "tags", "strict", "pocket", "status", "requested_by", "created_at").
+		Values(a.ID, a.UserID, a.Amount, a.Tag, a.Category, a.Tags, a.Strict, a.Pocket, a.Status, a.RequestedBy, a.CreatedAt).
+		ExecContext(ctx)
+	return err
+}
+
+// LoadApproval - списание на подтверждении по id, ErrNotFound если его нет
+func LoadApproval(ctx context.Context, sess *dbr.Session, id string) (Approval, error) {
+	var a Approval
+	err := sess.Select(approvalColumns...).From("approvals").Where("id = ?", id).LoadOneContext(ctx, &a)
+	if errors.Is(err, dbr.ErrNotFound) {
+		return a, ErrNotFound
+	}
+	return a, err
+}
+
+// ListApprovals - до limit списаний в состоянии status (пусто - в любом), старые первыми
+func ListApprovals(ctx context.Context, sess *dbr.Session, status string, limit int) ([]Approval, error) {
+	stmt := sess.Select(approvalColumns...).From("approvals").OrderBy("created_at").Limit(uint64(limit))
+	if status != "" {
+		stmt.Where("status = ?", status)
+	}
+	var approvals []Approval
+	_, err := stmt.LoadContext(ctx, &approvals)
+	return approvals, err
+}
+
+// DecideApproval - переводит ожидающее списание в status от имени decidedBy. ErrApprovalDecided, если решение
+// уже принято, в том числе параллельным запросом
+func DecideApproval(ctx context.Context, sess *dbr.Session, id, status, decidedBy, reason string) error {
+	res, err := sess.Update("approvals").Set("status", status).Set("decided_by", decidedBy).Set("reason", reason).
+		Set("decided_at", time.Now().UTC()).Where("id = ? AND status = ?", id, ApprovalPending).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return ErrApprovalDecided
+	}
+	return nil
+}
+
+// CompleteApproval - результат списания подтвержденного id: транзакция или, если оно не прошло, ApprovalFailed с reason
+func CompleteApproval(ctx context.Context, sess *dbr.Session, id, transactionID, reason string) error {
+	stmt := sess.Update("approvals").Where("id = ? AND status = ?", id, ApprovalApproved)
+	if transactionID != "" {
+		stmt.Set("transaction_id", transactionID)
+	} else {
+		stmt.Set("status", ApprovalFailed).Set("reason", reason)
+	}
+	_, err := stmt.ExecContext(ctx)
+	return err
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// BonusGrant - начисление бонусов, которое сгорает в ExpiresAt. Бонусы тратятся в порядке сгорания,
+// поэтому сколько осталось от начисления, не хранится: см. ExpireBonus
+type BonusGrant struct {
+	ID        string    `db:"id" json:"id"`
+	UserID    int       `db:"user_id" json:"user_id"`
+	Amount    int       `db:"amount" json:"amount"`
+	ExpiresAt time.Time `db:"expires_at" json:"expires_at"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+var bonusGrantColumns = []string{"id", "user_id", "amount", "expires_at", "created_at"}
+
+// CreateBonusGrant - сохраняет начисление бонусов
+func CreateBonusGrant(ctx context.Context, sess *dbr.Session, g BonusGrant) error {
+	_, err := sess.InsertInto("bonus_grants").Columns(bonusGrantColumns...).
+		Values(g.ID, g.UserID, g.Amount, g.ExpiresAt, g.CreatedAt).ExecContext(ctx)
+	return err
+}
+
+// CreditBonus - начисляет amount бонусов, которые сгорают в expiresAt. Начисление с ID записи пополнения
+// сохраняется под блокировкой пользователя до изменения баланса, с суммой, которую действительно удалось начислить
+// (opts.Partial), и удаляется, если пополнение не прошло
+func CreditBonus(ctx context.Context, sess *dbr.Session, u *User, amount int, expiresAt time.Time, opts CreditOptions) (Transaction, error) {
+	var grantID string
+	opts.Bonus = true
+	opts.Before = func(tx Transaction) error {
+		g := BonusGrant{ID: tx.ID, UserID: tx.UserID, Amount: tx.Amount, ExpiresAt: expiresAt.UTC(), CreatedAt: tx.CreatedAt}
+		if err := CreateBonusGrant(ctx, sess, g); err != nil {
+			return err
+		}
+		grantID = g.ID
+		return nil
+	}
+
+	tx, err := u.ApplyCredit(amount, opts)
+	if err != nil && grantID != "" {
+		if _, delErr := sess.DeleteFrom("bonus_grants").Where("id = ?", grantID).ExecContext(ctx); delErr != nil {
+			return Transaction{}, fmt.Errorf("%w (bonus grant %s left: %v)", err, grantID, delErr)
+		}
+	}
+	return tx, err
+}
+
+// LoadBonusGrants - еще не сгоревшие к now начисления пользователя, раньше сгорающие первыми
+func LoadBonusGrants(ctx context.Context, sess *dbr.Session, userID int, now time.Time) ([]BonusGrant, error) {
+	var grants []BonusGrant
+	_, err := sess.Select(bonusGrantColumns...).From("bonus_grants").
+		Where("user_id = ? AND expires_at > ?", userID, now.UTC()).OrderBy("expires_at").LoadContext(ctx, &grants)
+	return grants, err
+}
+
+// ExpiredBonusUsers - до limit пользователей с id больше afterID, у которых есть сгоревшие к now начисления, по id
+func ExpiredBonusUsers(ctx context.Context, sess *dbr.Session, now time.Time, afterID, limit int) ([]int, error) {
+	var ids []int
+	_, err := sess.SelectBySql(`SELECT DISTINCT user_id FROM bonus_grants WHERE expires_at <= ? AND user_id > ?
+		ORDER BY user_id LIMIT ?`, now.UTC(), afterID, limit).LoadContext(ctx, &ids)
+	return ids, err
+}
+
+// ExpireBonus - удаляет сгоревшие к now начисления пользователя и списывает сгоревшие бонусы записью
+// OperationBonusExpiry. Бонусы тратятся в порядке сгорания, поэтому на сгоревшие приходится все, что в Bonus больше
+// суммы еще действующих начислений. Начисления читаются под блокировкой пользователя, чтобы не разминуться
+// с параллельным начислением, а списывает только тот, кто удалил сгоревшие начисления, поэтому задачу можно
+// запускать на нескольких экземплярах. Возвращает запись, у которой Amount 0, если сгорать нечему
+func ExpireBonus(ctx context.Context, sess *dbr.Session, u *User, now time.Time, opts CreditOptions) (Transaction, error) {
+	tx, err := u.expireBonus(ctx, sess, now, opts)
+	if err == nil && tx.Amount != 0 && opts.Mark != nil {
+		opts.Mark(u)
+	}
+	return tx, err
+}
+
+func (u *User) expireBonus(ctx context.Context, sess *dbr.Session, now time.Time, opts CreditOptions) (Transaction, error) {
+	l := u.lock()
+	l.Lock()
+	defer l.Unlock()
+
+	res, err := sess.DeleteFrom("bonus_grants").Where("user_id = ? AND expires_at <= ?", u.ID, now.UTC()).ExecContext(ctx)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if rows, err := res.RowsAffected(); err != nil || rows == 0 {
+		return Transaction{}, err
+	}
+
+	grants, err := LoadBonusGrants(ctx, sess, u.ID, now)
+	if err != nil {
+		return Transaction{}, err
+	}
+	var active int64
+	for _, g := range grants {
+		active += int64(g.Amount)
+	}
+
+	expired := u.Bonus - active
+	if expired <= 0 || u.merged {
+		return Transaction{}, nil
+	}
+	tx := newTransaction(u.ID, -int(expired), OperationBonusExpiry, "")
+	if err := u.applyLocked(opts, tx); err != nil {
+		return Transaction{}, err
+	}
+	return tx, nil
+}
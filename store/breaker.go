@@ -0,0 +1,366 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrUnavailable - хранилище считается недоступным, запрос к нему не выполнялся
+var ErrUnavailable = errors.New("storage is unavailable")
+
+// состояния CircuitBreaker
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// CircuitBreaker - Storage, который после Failures ошибок подряд перестает обращаться к хранилищу
+// и сразу возвращает ErrUnavailable. Через OpenFor пропускается один пробный запрос: если он успешен,
+// обращения возобновляются, если нет - ожидание начинается заново
+type CircuitBreaker struct {
+	// Failures - после стольких ошибок подряд хранилище считается недоступным
+	Failures int
+	// OpenFor - сколько ждать до пробного запроса
+	OpenFor time.Duration
+
+	storage Storage
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// opens, rejected - для статистики
+	opens    int64
+	rejected int64
+}
+
+// BreakerStats - состояние CircuitBreaker для /debug/vars
+type BreakerStats struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	Opens    int64  `json:"opens"`
+	Rejected int64  `json:"rejected"`
+}
+
+func NewCircuitBreaker(storage Storage, failures int, openFor time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Failures: failures,
+		OpenFor:  openFor,
+		storage:  storage,
+		state:    breakerClosed,
+	}
+}
+
+func (b *CircuitBreaker) Stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerStats{State: b.state, Failures: b.failures, Opens: b.opens, Rejected: b.rejected}
+}
+
+// allow - можно ли обращаться к хранилищу. В состоянии half-open пропускается только один пробный запрос
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) >= b.OpenFor {
+			b.state = breakerHalfOpen
+			return nil
+		}
+	case breakerHalfOpen:
+	default:
+		return nil
+	}
+	b.rejected++
+	return ErrUnavailable
+}
+
+// done - учитывает результат запроса
+func (b *CircuitBreaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if errors.Is(err, context.Canceled) {
+		// клиент отменил запрос, проба не состоялась: следующий запрос пробует снова
+		if b.state == breakerHalfOpen {
+			b.state = breakerOpen
+		}
+		return
+	}
+	if !isStorageFailure(err) {
+		if b.state != breakerClosed {
+			log.Printf("storage is available again")
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.Failures) {
+		if b.state == breakerClosed {
+			log.Printf("storage is unavailable after %d failures, failing fast for %s: %v", b.failures, b.OpenFor, err)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.opens++
+	}
+}
+
+// isStorageFailure - ошибка говорит о проблеме с хранилищем, а не с запросом: бизнес-ошибки не считаются
+func isStorageFailure(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, ErrNotFound),
+		errors.Is(err, ErrFrozen),
+		errors.Is(err, ErrBlocked),
+		errors.Is(err, ErrDeleted),
+		errors.Is(err, ErrNotEnoughMoney),
+		errors.Is(err, ErrMaxBalance),
+		errors.Is(err, ErrInvalidMaxBalance),
+		errors.Is(err, ErrSameUser),
+		errors.Is(err, ErrOverdrawn),
+		errors.Is(err, ErrVersionConflict),
+		errors.Is(err, ErrExternalRefTaken),
+		errors.Is(err, ErrTooManyTransactions),
+		errors.Is(err, ErrInvalidTrust),
+		errors.As(err, new(*ImportError)):
+		return false
+	}
+	return true
+}
+
+func (b *CircuitBreaker) LoadUser(ctx context.Context, id int) (*User, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	user, err := b.storage.LoadUser(ctx, id)
+	b.done(err)
+	return user, err
+}
+
+func (b *CircuitBreaker) LoadUsers(ctx context.Context, ids []int) ([]*User, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	users, err := b.storage.LoadUsers(ctx, ids)
+	b.done(err)
+	return users, err
+}
+
+func (b *CircuitBreaker) RecentUserIDs(ctx context.Context, limit int) ([]int, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	ids, err := b.storage.RecentUserIDs(ctx, limit)
+	b.done(err)
+	return ids, err
+}
+
+func (b *CircuitBreaker) SavePending(ctx context.Context, userID int, p Pending) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.storage.SavePending(ctx, userID, p)
+	b.done(err)
+	return err
+}
+
+func (b *CircuitBreaker) SavePendingBatch(ctx context.Context, batch []UserPending) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.storage.SavePendingBatch(ctx, batch)
+	b.done(err)
+	return err
+}
+
+// SavePendingBulk - через BulkSaver хранилища, если он есть
+func (b *CircuitBreaker) SavePendingBulk(ctx context.Context, batch []UserPending) error {
+	bulk, ok := b.storage.(BulkSaver)
+	if !ok {
+		return b.SavePendingBatch(ctx, batch)
+	}
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := bulk.SavePendingBulk(ctx, batch)
+	b.done(err)
+	return err
+}
+
+func (b *CircuitBreaker) JournalSeq(ctx context.Context, userID int) (int64, error) {
+	if err := b.allow(); err != nil {
+		return 0, err
+	}
+	seq, err := b.storage.JournalSeq(ctx, userID)
+	b.done(err)
+	return seq, err
+}
+
+func (b *CircuitBreaker) LoadTransaction(ctx context.Context, id string) (Transaction, error) {
+	if err := b.allow(); err != nil {
+		return Transaction{}, err
+	}
+	tx, err := b.storage.LoadTransaction(ctx, id)
+	b.done(err)
+	return tx, err
+}
+
+func (b *CircuitBreaker) MergeUsers(ctx context.Context, from, into *User) (int, error) {
+	if err := b.allow(); err != nil {
+		return 0, err
+	}
+	moved, err := b.storage.MergeUsers(ctx, from, into)
+	b.done(err)
+	return moved, err
+}
+
+func (b *CircuitBreaker) DebitStrict(ctx context.Context, userID, amount, fee int, tag, category string, tags Tags) (Transaction, error) {
+	if err := b.allow(); err != nil {
+		return Transaction{}, err
+	}
+	tx, err := b.storage.DebitStrict(ctx, userID, amount, fee, tag, category, tags)
+	b.done(err)
+	return tx, err
+}
+
+func (b *CircuitBreaker) SetUserStatus(ctx context.Context, userID int, status string) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.storage.SetUserStatus(ctx, userID, status)
+	b.done(err)
+	return err
+}
+
+func (b *CircuitBreaker) CreateUser(ctx context.Context, balance int64, metadata Metadata) (*User, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	user, err := b.storage.CreateUser(ctx, balance, metadata)
+	b.done(err)
+	return user, err
+}
+
+func (b *CircuitBreaker) SetUserMetadata(ctx context.Context, userID int, metadata Metadata) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.storage.SetUserMetadata(ctx, userID, metadata)
+	b.done(err)
+	return err
+}
+
+func (b *CircuitBreaker) ListUsers(ctx context.Context, opts ListOptions) (UserPage, error) {
+	if err := b.allow(); err != nil {
+		return UserPage{}, err
+	}
+	page, err := b.storage.ListUsers(ctx, opts)
+	b.done(err)
+	return page, err
+}
+
+func (b *CircuitBreaker) ImportUsers(ctx context.Context, users []ImportUser) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.storage.ImportUsers(ctx, users)
+	b.done(err)
+	return err
+}
+
+func (b *CircuitBreaker) ListTransactions(ctx context.Context, f TransactionFilter) ([]Transaction, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	txs, err := b.storage.ListTransactions(ctx, f)
+	b.done(err)
+	return txs, err
+}
+
+func (b *CircuitBreaker) Statement(ctx context.Context, userID int, from, to time.Time, category string, tags []string, limit int) (Statement, error) {
+	if err := b.allow(); err != nil {
+		return Statement{}, err
+	}
+	s, err := b.storage.Statement(ctx, userID, from, to, category, tags, limit)
+	b.done(err)
+	return s, err
+}
+
+func (b *CircuitBreaker) BalanceAt(ctx context.Context, userID int, at time.Time) (HistoricalBalance, error) {
+	if err := b.allow(); err != nil {
+		return HistoricalBalance{}, err
+	}
+	h, err := b.storage.BalanceAt(ctx, userID, at)
+	b.done(err)
+	return h, err
+}
+
+func (b *CircuitBreaker) TrialBalance(ctx context.Context) (TrialBalance, error) {
+	if err := b.allow(); err != nil {
+		return TrialBalance{}, err
+	}
+	t, err := b.storage.TrialBalance(ctx)
+	b.done(err)
+	return t, err
+}
+
+func (b *CircuitBreaker) CheckConsistency(ctx context.Context, limit int) (ConsistencyReport, error) {
+	if err := b.allow(); err != nil {
+		return ConsistencyReport{}, err
+	}
+	r, err := b.storage.CheckConsistency(ctx, limit)
+	b.done(err)
+	return r, err
+}
+
+func (b *CircuitBreaker) RepairConsistency(ctx context.Context, report ConsistencyReport, trust string) (RepairResult, error) {
+	if err := b.allow(); err != nil {
+		return RepairResult{}, err
+	}
+	res, err := b.storage.RepairConsistency(ctx, report, trust)
+	b.done(err)
+	return res, err
+}
+
+func (b *CircuitBreaker) SpentSince(ctx context.Context, userID int, since time.Time) (int64, error) {
+	if err := b.allow(); err != nil {
+		return 0, err
+	}
+	spent, err := b.storage.SpentSince(ctx, userID, since)
+	b.done(err)
+	return spent, err
+}
+
+func (b *CircuitBreaker) SetUserFrozen(ctx context.Context, userID int, frozen bool) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.storage.SetUserFrozen(ctx, userID, frozen)
+	b.done(err)
+	return err
+}
+
+func (b *CircuitBreaker) SetUserCreditLimit(ctx context.Context, userID int, limit int64) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.storage.SetUserCreditLimit(ctx, userID, limit)
+	b.done(err)
+	return err
+}
+
+func (b *CircuitBreaker) SetUserMaxBalance(ctx context.Context, userID int, maxBalance int64) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.storage.SetUserMaxBalance(ctx, userID, maxBalance)
+	b.done(err)
+	return err
+}
@@ -0,0 +1,187 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// ErrCashbackPaid - кешбэк за это списание уже начислен
+var ErrCashbackPaid = errors.New("cashback is already paid for this debit")
+
+// errCashbackCapped - параллельное начисление исчерпало месячный лимит правила, см. CreditCashback
+var errCashbackCapped = errors.New("cashback monthly cap reached")
+
+// cashbackAttempts - сколько раз CreditCashback пересчитывает сумму, если месячный лимит успели занять
+const cashbackAttempts = 3
+
+// CashbackRule - кешбэк BasisPoints сотых долей процента от списаний категории ("category:{tag}", тег списания)
+// или продавца ("merchant:{name}"), не больше MonthlyCap одному пользователю за календарный месяц UTC
+// (0 - без лимита). Правило продавца заменяет правило категории целиком
+type CashbackRule struct {
+	Subject     string    `db:"subject" json:"subject"`
+	BasisPoints int       `db:"basis_points" json:"basis_points"`
+	MonthlyCap  int64     `db:"monthly_cap" json:"monthly_cap"`
+	UpdatedAt   time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// CategorySubject, MerchantSubject - Subject правила категории и продавца
+func CategorySubject(tag string) string {
+	return "category:" + tag
+}
+
+func MerchantSubject(merchant string) string {
+	return "merchant:" + merchant
+}
+
+// Validate - Subject в одном из форматов с допустимым тегом, процент от 0.01% до 100%, лимит не отрицательный
+func (r CashbackRule) Validate() error {
+	kind, name, _ := strings.Cut(r.Subject, ":")
+	if kind != "category" && kind != "merchant" {
+		return errors.New(`subject must be "category:{tag}" or "merchant:{name}"`)
+	}
+	if name == "" || ValidateTag(name) != nil {
+		return errors.New("invalid category or merchant in subject")
+	}
+	if r.BasisPoints < 1 || r.BasisPoints > 10000 {
+		return errors.New("basis_points must be from 1 to 10000")
+	}
+	if r.MonthlyCap < 0 {
+		return errors.New("monthly_cap must not be negative")
+	}
+	return nil
+}
+
+// Amount - кешбэк со списания amount, округляется вниз
+func (r CashbackRule) Amount(amount int) int {
+	return int(int64(amount) * int64(r.BasisPoints) / 10000)
+}
+
+// LoadCashbackRules - все правила кешбэка
+func LoadCashbackRules(ctx context.Context, sess *dbr.Session) ([]CashbackRule, error) {
+	var rules []CashbackRule
+	_, err := sess.Select("subject", "basis_points", "monthly_cap", "updated_at").From("cashback_rules").
+		OrderBy("subject").LoadContext(ctx, &rules)
+	return rules, err
+}
+
+// SetCashbackRule - добавляет или заменяет правило r.Subject
+func SetCashbackRule(ctx context.Context, sess *dbr.Session, r CashbackRule) error {
+	_, err := sess.InsertBySql(`INSERT INTO cashback_rules (subject, basis_points, monthly_cap, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (subject) DO UPDATE SET basis_points = excluded.basis_points, monthly_cap = excluded.monthly_cap, updated_at = excluded.updated_at`,
+		r.Subject, r.BasisPoints, r.MonthlyCap, time.Now().UTC()).ExecContext(ctx)
+	return err
+}
+
+// DeleteCashbackRule - удаляет правило subject, начисленный кешбэк остается. ErrNotFound если его нет
+func DeleteCashbackRule(ctx context.Context, sess *dbr.Session, subject string) error {
+	res, err := sess.DeleteFrom("cashback_rules").Where("subject = ?", subject).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Cashback - кешбэк Amount (запись TransactionID) за списание DebitTransactionID по правилу Rule
+type Cashback struct {
+	DebitTransactionID string    `db:"debit_transaction_id" json:"debit_transaction_id"`
+	UserID             int       `db:"user_id" json:"user_id"`
+	Rule               string    `db:"rule" json:"rule"`
+	Amount             int       `db:"amount" json:"amount"`
+	TransactionID      string    `db:"transaction_id" json:"transaction_id"`
+	CreatedAt          time.Time `db:"created_at" json:"created_at"`
+}
+
+var cashbackColumns = []string{"debit_transaction_id", "user_id", "rule", "amount", "transaction_id", "created_at"}
+
+// cashbackSince - кешбэк пользователя userID по правилу rule, начисленный начиная с since
+func cashbackSince(ctx context.Context, runner dbr.SessionRunner, userID int, rule string, since time.Time) (int64, error) {
+	var paid int64
+	err := runner.Select("COALESCE(SUM(amount), 0)").From("cashback").
+		Where("user_id = ? AND rule = ? AND created_at >= ?", userID, rule, since).LoadOneContext(ctx, &paid)
+	return paid, err
+}
+
+// CreditCashback - начисляет пользователю u кешбэк по правилу rule за его списание debit отдельной записью
+// OperationCashback с тегом списания. Пополнение и запись в таблицу cashback пишутся одной транзакцией
+// SQL хранилища: за одно списание кешбэк начисляется один раз (иначе ErrCashbackPaid), а сумма урезается до
+// остатка месячного лимита правила, который перепроверяется в транзакции под блокировкой строки пользователя.
+// Кешбэк без суммы (мелкое списание, лимит исчерпан) возвращается с пустым TransactionID без пополнения.
+// opts.Save и opts.Journal заменяются
+func CreditCashback(ctx context.Context, sess *dbr.Session, u *User, rule CashbackRule, debit Transaction, opts CreditOptions) (Cashback, error) {
+	c := Cashback{DebitTransactionID: debit.ID, UserID: u.ID, Rule: rule.Subject}
+	want := rule.Amount(-debit.Amount)
+	if want <= 0 {
+		return c, nil
+	}
+
+	opts.Operation, opts.Tag, opts.Partial, opts.Journal = OperationCashback, debit.Tag, false, nil
+	for attempt := 0; attempt < cashbackAttempts; attempt++ {
+		month := MonthStart(time.Now())
+		amount := want
+		if rule.MonthlyCap > 0 {
+			paid, err := cashbackSince(ctx, sess, u.ID, rule.Subject, month)
+			if err != nil {
+				return c, err
+			}
+			if left := rule.MonthlyCap - paid; left < int64(amount) {
+				amount = int(left)
+			}
+			if amount <= 0 {
+				return c, nil
+			}
+		}
+
+		opts.Save = saveWith(ctx, sess, u.ID, func(tx *dbr.Tx, p Pending) error {
+			t := p.Transactions[0]
+			if rule.MonthlyCap > 0 {
+				// параллельные начисления других экземпляров ждут блокировки и видят уже сохраненный кешбэк
+				if err := lockUserRow(ctx, tx, u.ID); err != nil {
+					return err
+				}
+				paid, err := cashbackSince(ctx, tx, u.ID, rule.Subject, month)
+				if err != nil {
+					return err
+				}
+				if paid+int64(t.Amount) > rule.MonthlyCap {
+					return errCashbackCapped
+				}
+			}
+			res, err := tx.InsertBySql(`INSERT INTO cashback (debit_transaction_id, user_id, rule, amount, transaction_id, created_at)
+				VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (debit_transaction_id) DO NOTHING`,
+				debit.ID, u.ID, rule.Subject, t.Amount, t.ID, t.CreatedAt).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+				return ErrCashbackPaid
+			}
+			return nil
+		})
+
+		t, err := u.ApplyCredit(amount, opts)
+		if errors.Is(err, errCashbackCapped) {
+			continue
+		}
+		if err != nil {
+			return c, err
+		}
+		c.Amount, c.TransactionID, c.CreatedAt = t.Amount, t.ID, t.CreatedAt
+		return c, nil
+	}
+	return c, errCashbackCapped
+}
+
+// LoadCashback - кешбэк пользователя userID, начисленный начиная с since, новый первым
+func LoadCashback(ctx context.Context, sess *dbr.Session, userID int, since time.Time) ([]Cashback, error) {
+	var cashback []Cashback
+	_, err := sess.Select(cashbackColumns...).From("cashback").Where("user_id = ? AND created_at >= ?", userID, since.UTC()).
+		OrderDesc("created_at").LoadContext(ctx, &cashback)
+	return cashback, err
+}
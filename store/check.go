@@ -0,0 +1,167 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/gocraft/dbr/v2/dialect"
+)
+
+// чему верить при исправлении расхождения баланса с леджером
+const (
+	// TrustBalance - баланс верный: в леджер добавляется запись OperationAdjustment на разницу
+	TrustBalance = "balance"
+	// TrustLedger - леджер верный: баланс становится суммой его записей
+	TrustLedger = "ledger"
+)
+
+// ErrInvalidTrust - неизвестный источник истины для исправления
+var ErrInvalidTrust = errors.New("trust must be balance or ledger")
+
+// BalanceMismatch - баланс пользователя не равен сумме его записей леджера
+type BalanceMismatch struct {
+	UserID  int   `db:"user_id" json:"user_id"`
+	Balance int64 `db:"balance" json:"balance"`
+	Ledger  int64 `db:"ledger" json:"ledger"`
+}
+
+// Difference - на сколько баланс больше суммы леджера
+func (m BalanceMismatch) Difference() int64 {
+	return m.Balance - m.Ledger
+}
+
+// ConsistencyReport - результат проверки и план исправления: расхождения балансов с леджером
+// и записи леджера без сбалансированных проводок двойной записи
+type ConsistencyReport struct {
+	Mismatches []BalanceMismatch `json:"mismatches"`
+	// Unbalanced - id записей леджера, проводки которых отсутствуют или не дают в сумме ноль
+	Unbalanced []string `json:"unbalanced"`
+	// Truncated - нашлось больше limit расхождений одного вида, после исправления проверку нужно повторить
+	Truncated bool `json:"truncated"`
+}
+
+// Consistent - расхождений нет
+func (r ConsistencyReport) Consistent() bool {
+	return len(r.Mismatches) == 0 && len(r.Unbalanced) == 0
+}
+
+// RepairResult - что исправлено. Skipped - расхождения, которые изменились с проверки (идут операции
+// или их уже исправили), они не трогаются
+type RepairResult struct {
+	Adjusted   int `json:"adjusted"`
+	Rebalanced int `json:"rebalanced"`
+	Reposted   int `json:"reposted"`
+	Skipped    int `json:"skipped"`
+}
+
+// ValidateTrust - trust - TrustBalance или TrustLedger
+func ValidateTrust(trust string) error {
+	if trust != TrustBalance && trust != TrustLedger {
+		return ErrInvalidTrust
+	}
+	return nil
+}
+
+// checkConsistency - до limit расхождений каждого вида в SQL хранилище: суммы леджера по всем пользователям
+// считаются одним запросом, это полный проход по transactions
+func checkConsistency(ctx context.Context, sess *dbr.Session, limit int) (ConsistencyReport, error) {
+	if limit < 1 {
+		return ConsistencyReport{}, errInvalidLimit
+	}
+
+	r := ConsistencyReport{Mismatches: []BalanceMismatch{}, Unbalanced: []string{}}
+	_, err := sess.SelectBySql(`SELECT u.id AS user_id, u.balance, COALESCE(l.amount, 0) AS ledger FROM users u
+		LEFT JOIN (SELECT user_id, SUM(amount) AS amount FROM transactions GROUP BY user_id) l ON l.user_id = u.id
+		WHERE u.balance <> COALESCE(l.amount, 0) ORDER BY u.id LIMIT ?`, limit+1).LoadContext(ctx, &r.Mismatches)
+	if err != nil {
+		return ConsistencyReport{}, err
+	}
+
+	// у каждой записи ровно две проводки, см. Transaction.Entries
+	_, err = sess.SelectBySql(`SELECT t.id FROM transactions t LEFT JOIN ledger_entries e ON e.transaction_id = t.id
+		GROUP BY t.id HAVING COUNT(e.transaction_id) <> 2 OR COALESCE(SUM(e.amount), 0) <> 0 ORDER BY t.id LIMIT ?`, limit+1).
+		LoadContext(ctx, &r.Unbalanced)
+	if err != nil {
+		return ConsistencyReport{}, err
+	}
+
+	if len(r.Mismatches) > limit {
+		r.Mismatches, r.Truncated = r.Mismatches[:limit], true
+	}
+	if len(r.Unbalanced) > limit {
+		r.Unbalanced, r.Truncated = r.Unbalanced[:limit], true
+	}
+	return r, nil
+}
+
+// repairConsistency - исправляет расхождения из report одной транзакцией. Строки пользователей блокируются,
+// и расхождение пересчитывается: исправляется, только если оно то же, что в отчете. Проводки записей
+// из Unbalanced пересоздаются по самим записям
+func repairConsistency(ctx context.Context, sess *dbr.Session, report ConsistencyReport, trust string) (RepairResult, error) {
+	if err := ValidateTrust(trust); err != nil {
+		return RepairResult{}, err
+	}
+
+	tx, err := sess.BeginTx(ctx, nil)
+	if err != nil {
+		return RepairResult{}, err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	var res RepairResult
+	var adjustments []Transaction
+	for _, m := range report.Mismatches {
+		stmt := tx.Select("balance").From("users").Where("id = ?", m.UserID)
+		// в SQLite писатель и так один, блокировка строк не нужна
+		if tx.Dialect != dialect.SQLite3 {
+			stmt.Suffix("FOR UPDATE")
+		}
+		var balances []int64
+		if _, err := stmt.LoadContext(ctx, &balances); err != nil {
+			return RepairResult{}, err
+		}
+		var ledger int64
+		err := tx.Select("COALESCE(SUM(amount), 0)").From("transactions").Where("user_id = ?", m.UserID).LoadOneContext(ctx, &ledger)
+		if err != nil {
+			return RepairResult{}, err
+		}
+		if len(balances) == 0 || balances[0]-ledger != m.Difference() {
+			res.Skipped++
+			continue
+		}
+
+		if trust == TrustBalance {
+			adjustments = append(adjustments, newTransaction(m.UserID, int(m.Difference()), OperationAdjustment, ""))
+			res.Adjusted++
+			continue
+		}
+		// версия растет, чтобы экземпляры с этим пользователем в кеше догнали БД при следующем сохранении
+		_, err = tx.Update("users").Set("balance", ledger).Set("version", dbr.Expr("version + 1")).
+			Set("updated_at", dbr.Now).Where("id = ?", m.UserID).ExecContext(ctx)
+		if err != nil {
+			return RepairResult{}, err
+		}
+		res.Rebalanced++
+	}
+	if err := insertTransactions(ctx, tx, adjustments); err != nil {
+		return RepairResult{}, err
+	}
+
+	if len(report.Unbalanced) > 0 {
+		var txs []Transaction
+		if _, err := tx.Select(TransactionColumns...).From("transactions").Where("id IN ?", report.Unbalanced).LoadContext(ctx, &txs); err != nil {
+			return RepairResult{}, err
+		}
+		if _, err := tx.DeleteFrom("ledger_entries").Where("transaction_id IN ?", report.Unbalanced).ExecContext(ctx); err != nil {
+			return RepairResult{}, err
+		}
+		if err := insertLedgerEntries(ctx, tx, ledgerEntries(txs)); err != nil {
+			return RepairResult{}, err
+		}
+		res.Reposted = len(txs)
+		res.Skipped += len(report.Unbalanced) - len(txs)
+	}
+
+	return res, tx.Commit()
+}
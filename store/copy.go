@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/lib/pq"
+)
+
+// SavePendingCopy - то же, что SavePendingBatch, для очень больших пачек: дельты потоком COPY пишутся
+// во временную таблицу и применяются одним UPDATE ... FROM, записи леджера и их проводки тоже пишутся через COPY.
+// Не строит запрос со всеми значениями, поэтому размер пачки не ограничен количеством параметров
+func SavePendingCopy(ctx context.Context, sess *dbr.Session, batch []UserPending) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	// COPY через pgx идет мимо database/sql, поэтому транзакция открывается на закрепленном соединении
+	conn, err := sess.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sqlTx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	tx := &dbr.Tx{EventReceiver: sess.EventReceiver, Dialect: sess.Dialect, Tx: sqlTx, Timeout: sess.GetTimeout()}
+	defer tx.RollbackUnlessCommitted()
+
+	if _, err := tx.ExecContext(ctx, `CREATE TEMP TABLE pending_deltas (id integer, delta bigint, bonus bigint, seq bigint, version bigint) ON COMMIT DROP`); err != nil {
+		return err
+	}
+
+	err = copyRows(ctx, conn, tx.Tx, "pending_deltas", []string{"id", "delta", "bonus", "seq", "version"}, len(batch), func(i int) []interface{} {
+		return []interface{}{batch[i].UserID, batch[i].Pending.Delta, batch[i].Pending.BonusDelta(), batch[i].Pending.Seq, batch[i].Pending.Version}
+	})
+	if err != nil {
+		return err
+	}
+
+	var updated []int
+	_, err = tx.SelectBySql(`UPDATE users AS u SET balance = u.balance + v.delta, bonus = u.bonus + v.bonus, journal_seq = GREATEST(u.journal_seq, v.seq), version = u.version + 1, updated_at = ? `+
+		`FROM pending_deltas AS v WHERE u.id = v.id AND (v.seq = 0 OR u.journal_seq < v.seq) `+
+		`AND (v.version = 0 OR u.version = v.version) RETURNING u.id`, dbr.Now).LoadContext(ctx, &updated)
+	if err != nil {
+		return err
+	}
+
+	applied, err := checkBatchVersions(batch, updated)
+	if err != nil {
+		return err
+	}
+
+	var txs []Transaction
+	for _, item := range batch {
+		if applied[item.UserID] {
+			txs = append(txs, item.Pending.Transactions...)
+		}
+	}
+
+	if len(txs) > 0 {
+		err = copyRows(ctx, conn, tx.Tx, "transactions", TransactionColumns, len(txs), func(i int) []interface{} {
+			t := txs[i]
+			return []interface{}{t.ID, t.UserID, t.Amount, t.Operation, t.Tag, t.Category, t.Tags.String(), t.CreatedAt}
+		})
+		if err != nil {
+			return err
+		}
+
+		entries := ledgerEntries(txs)
+		err = copyRows(ctx, conn, tx.Tx, "ledger_entries", LedgerEntryColumns, len(entries), func(i int) []interface{} {
+			e := entries[i]
+			return []interface{}{e.TransactionID, e.Account, e.UserID, e.Amount, e.CreatedAt}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// copyRows - выполняет COPY в table строками row(0..n-1): через pgx или lib/pq, смотря каким драйвером открыто conn.
+// tx - транзакция на conn
+func copyRows(ctx context.Context, conn *sql.Conn, tx *sql.Tx, table string, columns []string, n int, row func(i int) []interface{}) error {
+	if ok, err := pgxCopy(ctx, conn, table, columns, n, row); ok || err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i := 0; i < n; i++ {
+		if _, err := stmt.ExecContext(ctx, row(i)...); err != nil {
+			return err
+		}
+	}
+
+	// пустой Exec завершает COPY
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
@@ -0,0 +1,201 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync/atomic"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// ErrMaxBalance - пополнение увело бы баланс выше максимального (без него - за пределы int64)
+var ErrMaxBalance = errors.New("max balance exceeded")
+
+// ErrInvalidMaxBalance - отрицательный максимальный баланс
+var ErrInvalidMaxBalance = errors.New("max balance must not be negative")
+
+// CreditOptions - шаги, которые выполняются вместе с пополнением под блокировкой пользователя, как DebitOptions
+type CreditOptions struct {
+	Tag string
+	// Category, Tags - категория и теги записи пополнения
+	Category string
+	Tags     Tags
+	// MaxBalance - максимальный баланс, если у пользователя не задан свой (User.MaxBalance), 0 - без ограничения
+	MaxBalance int64
+	// Partial - пополнить только до максимального баланса, а не отклонять пополнение целиком
+	Partial bool
+	// Refund - возврат уже списанных с пользователя денег: без максимального баланса и проверки состояния счета,
+	// иначе деньги застряли бы между счетами
+	Refund bool
+	// Bonus - начислить в бонусную часть баланса (OperationBonusCredit)
+	Bonus bool
+	// BonusReturn - часть пополнения, которая возвращается в бонусную часть баланса обратной парой
+	// OperationBonusOut/OperationBonusIn (отмена списания, оплаченного бонусами)
+	BonusReturn int
+	// Operation - операция записи, пусто - OperationCredit (OperationBonusCredit с Bonus)
+	Operation string
+	// Check - дополнительные проверки перед пополнением (место в очереди сохранения)
+	Check func(u *User) error
+	// Before - вызывается с готовой записью перед ее применением, ошибка отменяет пополнение (начисление бонусов)
+	Before func(tx Transaction) error
+	// Journal - журнал, в который транзакция пишется до изменения баланса, nil - без журнала
+	Journal Journal
+	// Save - синхронное сохранение изменения; если вернул ошибку, пополнение отменяется. nil - изменение копится в Pending
+	Save func(p Pending) error
+	// Mark - вызывается после успешного пополнения, уже без блокировки
+	Mark func(u *User)
+}
+
+// ApplyCredit - пополняет баланс на amount со всеми шагами opts под блокировкой пользователя. С opts.Partial
+// пополняет не больше, чем осталось до максимального баланса: сумма пополнения - Amount транзакции
+func (u *User) ApplyCredit(amount int, opts CreditOptions) (Transaction, error) {
+	tx, err := u.applyCredit(amount, opts)
+	if err == nil && opts.Mark != nil {
+		opts.Mark(u)
+	}
+	return tx, err
+}
+
+func (u *User) applyCredit(amount int, opts CreditOptions) (Transaction, error) {
+	l := u.lock()
+	l.Lock()
+	defer l.Unlock()
+
+	if err := u.checkState(); err != nil && !opts.Refund {
+		return Transaction{}, err
+	}
+
+	maxBalance := opts.MaxBalance
+	if u.MaxBalance > 0 {
+		maxBalance = u.MaxBalance
+	}
+	if opts.Refund {
+		maxBalance = 0
+	}
+	if room := creditRoom(atomic.LoadInt64(&u.Balance), maxBalance); int64(amount) > room {
+		if !opts.Partial || room <= 0 {
+			return Transaction{}, ErrMaxBalance
+		}
+		amount = int(room)
+	}
+
+	if opts.Check != nil {
+		if err := opts.Check(u); err != nil {
+			return Transaction{}, err
+		}
+	}
+
+	operation := OperationCredit
+	if opts.Bonus {
+		operation = OperationBonusCredit
+	}
+	if opts.Operation != "" {
+		operation = opts.Operation
+	}
+	tx := newTransaction(u.ID, amount, operation, opts.Tag)
+	tx.Category, tx.Tags = opts.Category, opts.Tags
+	if opts.Before != nil {
+		if err := opts.Before(tx); err != nil {
+			return Transaction{}, err
+		}
+	}
+	txs := append([]Transaction{tx}, bonusReturnTransactions(tx, opts.BonusReturn)...)
+	if err := u.applyLocked(opts, txs...); err != nil {
+		return Transaction{}, err
+	}
+	return tx, nil
+}
+
+// bonusReturnTransactions - пара, обратная bonusTransactions: переносит до amount из пополнения tx обратно
+// в бонусную часть баланса с тем же тегом и временем
+func bonusReturnTransactions(tx Transaction, amount int) []Transaction {
+	if amount > tx.Amount {
+		amount = tx.Amount
+	}
+	if amount <= 0 {
+		return nil
+	}
+	in := newTransaction(tx.UserID, -amount, OperationBonusIn, tx.Tag)
+	out := newTransaction(tx.UserID, amount, OperationBonusOut, tx.Tag)
+	in.CreatedAt, out.CreatedAt = tx.CreatedAt, tx.CreatedAt
+	return []Transaction{in, out}
+}
+
+// creditRoom - сколько можно пополнить баланс balance до maxBalance (0 - до предела int64) без переполнения
+func creditRoom(balance, maxBalance int64) int64 {
+	if maxBalance <= 0 {
+		maxBalance = math.MaxInt64
+	}
+	if balance < 0 && maxBalance > math.MaxInt64+balance {
+		return math.MaxInt64
+	}
+	return maxBalance - balance
+}
+
+// applyLocked - применяет записи txs к балансу с сохранением или журналом из opts, вызывается под блокировкой
+func (u *User) applyLocked(opts CreditOptions, txs ...Transaction) error {
+	var amount int
+	for _, tx := range txs {
+		amount += tx.Amount
+	}
+	if opts.Save != nil {
+		p := Pending{Delta: amount, Transactions: txs}
+		if err := opts.Save(p); err != nil {
+			return err
+		}
+		u.savedLocked(p)
+	} else {
+		if opts.Journal != nil {
+			for _, tx := range txs {
+				seq, err := opts.Journal.Append(tx)
+				if err != nil {
+					return err
+				}
+				u.pending.Seq = seq
+			}
+		}
+
+		u.pending.Delta += amount
+		u.pending.Transactions = append(u.pending.Transactions, txs...)
+	}
+	atomic.AddInt64(&u.Balance, int64(amount))
+	u.Bonus += bonusDelta(txs)
+	u.UpdatedAt = txs[0].CreatedAt
+
+	return nil
+}
+
+// setUserMaxBalance - меняет максимальный баланс пользователя в SQL хранилище
+func setUserMaxBalance(ctx context.Context, sess *dbr.Session, userID int, maxBalance int64) error {
+	res, err := sess.Update("users").Set("max_balance", maxBalance).Set("version", dbr.Expr("version + 1")).
+		Set("updated_at", dbr.Now).Where("id = ?", userID).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetMaxBalance - меняет максимальный баланс через storage.SetUserMaxBalance, как SetStatus. Баланс выше нового
+// максимума не уменьшается, но пополнения до него не проходят
+func SetMaxBalance(ctx context.Context, storage Storage, cached *User, userID int, maxBalance int64) error {
+	if maxBalance < 0 {
+		return ErrInvalidMaxBalance
+	}
+	if cached == nil {
+		return storage.SetUserMaxBalance(ctx, userID, maxBalance)
+	}
+
+	l := cached.lock()
+	l.Lock()
+	defer l.Unlock()
+
+	if err := storage.SetUserMaxBalance(ctx, userID, maxBalance); err != nil {
+		return err
+	}
+	cached.MaxBalance = maxBalance
+	return nil
+}
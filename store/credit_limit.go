@@ -0,0 +1,58 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// ErrInvalidCreditLimit - отрицательный кредитный лимит
+var ErrInvalidCreditLimit = errors.New("credit limit must not be negative")
+
+// ErrOverdrawn - баланс пользователя в минусе, а операция требует неотрицательного (слияние)
+var ErrOverdrawn = errors.New("user is overdrawn")
+
+// Overdrawn - на сколько баланс ушел в минус, 0 для неотрицательного
+func Overdrawn(balance int) int {
+	if balance < 0 {
+		return -balance
+	}
+	return 0
+}
+
+// setUserCreditLimit - меняет кредитный лимит пользователя в SQL хранилище
+func setUserCreditLimit(ctx context.Context, sess *dbr.Session, userID int, limit int64) error {
+	res, err := sess.Update("users").Set("credit_limit", limit).Set("version", dbr.Expr("version + 1")).
+		Set("updated_at", dbr.Now).Where("id = ?", userID).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetCreditLimit - меняет кредитный лимит через storage.SetUserCreditLimit, как SetStatus: если пользователь есть
+// в кеше, лимит в памяти меняется под его блокировкой. Уже ушедший в минус баланс уменьшение лимита не трогает,
+// но следующие списания получат ErrNotEnoughMoney
+func SetCreditLimit(ctx context.Context, storage Storage, cached *User, userID int, limit int64) error {
+	if limit < 0 {
+		return ErrInvalidCreditLimit
+	}
+	if cached == nil {
+		return storage.SetUserCreditLimit(ctx, userID, limit)
+	}
+
+	l := cached.lock()
+	l.Lock()
+	defer l.Unlock()
+
+	if err := storage.SetUserCreditLimit(ctx, userID, limit); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&cached.CreditLimit, limit)
+	return nil
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// виды записей denylist
+const (
+	// DenyUser - пользователь по id, запросы к нему отклоняются
+	DenyUser = "user"
+	// DenyCaller - вызывающий по имени из журнала аудита ("key:<имя ключа>", "jwt:<subject>", "cert:<CN>")
+	DenyCaller = "caller"
+)
+
+// DenyEntry - запись denylist
+type DenyEntry struct {
+	Kind      string    `db:"kind" json:"kind"`
+	Value     string    `db:"value" json:"value"`
+	Reason    string    `db:"reason" json:"reason"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Validate - известный вид и значение в его формате
+func (e DenyEntry) Validate() error {
+	switch e.Kind {
+	case DenyUser:
+		if id, err := strconv.Atoi(e.Value); err != nil || id < 1 {
+			return errors.New("invalid user id")
+		}
+	case DenyCaller:
+		if e.Value == "" {
+			return errors.New("caller is required")
+		}
+	default:
+		return errors.New(`kind must be "user" or "caller"`)
+	}
+	return nil
+}
+
+// LoadDenylist - все записи denylist
+func LoadDenylist(ctx context.Context, sess *dbr.Session) ([]DenyEntry, error) {
+	var entries []DenyEntry
+	_, err := sess.Select("kind", "value", "reason", "created_at").From("denylist").
+		OrderBy("kind").OrderBy("value").LoadContext(ctx, &entries)
+	return entries, err
+}
+
+// AddDenied - добавляет запись, у существующей обновляется причина
+func AddDenied(ctx context.Context, sess *dbr.Session, e DenyEntry) error {
+	_, err := sess.InsertBySql(`INSERT INTO denylist (kind, value, reason, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (kind, value) DO UPDATE SET reason = excluded.reason`,
+		e.Kind, e.Value, e.Reason, time.Now().UTC()).ExecContext(ctx)
+	return err
+}
+
+// RemoveDenied - удаляет запись, ErrNotFound если ее нет
+func RemoveDenied(ctx context.Context, sess *dbr.Session, kind, value string) error {
+	res, err := sess.DeleteFrom("denylist").Where("kind = ? AND value = ?", kind, value).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// состояния спора
+const (
+	// DisputeOpen - спор открыт, сумма пополнения удержана
+	DisputeOpen = "open"
+	// DisputeUpheld - пополнение подтверждено, удержанное возвращено пользователю
+	DisputeUpheld = "upheld"
+	// DisputeReversed - пополнение отменено, удержанное не возвращается
+	DisputeReversed = "reversed"
+)
+
+// решения по спору
+const (
+	// DisputeUphold - оставить пополнение в силе
+	DisputeUphold = "uphold"
+	// DisputeReverse - отменить пополнение
+	DisputeReverse = "reverse"
+)
+
+// ErrDisputeExists - по этой операции уже открыт спор
+var ErrDisputeExists = errors.New("transaction is already disputed")
+
+// ErrDisputeResolved - спор уже решен
+var ErrDisputeResolved = errors.New("dispute is already resolved")
+
+// ErrNotDisputable - оспорить можно только пополнение (OperationCredit)
+var ErrNotDisputable = errors.New("only credits can be disputed")
+
+// Dispute - спор по пополнению TransactionID на Amount: пока он открыт, с пользователя удержано Held (не больше,
+// чем было на балансе, записью HoldTransactionID). Решение DisputeUphold возвращает удержанное записью
+// ReleaseTransactionID, DisputeReverse оставляет удержание окончательным
+type Dispute struct {
+	ID            string `db:"id" json:"id"`
+	TransactionID string `db:"transaction_id" json:"transaction_id"`
+	UserID        int    `db:"user_id" json:"user_id"`
+	Amount        int    `db:"amount" json:"amount"`
+	Held          int    `db:"held" json:"held"`
+	Status        string `db:"status" json:"status"`
+	Reason        string `db:"reason" json:"reason,omitempty"`
+	// Note - комментарий к решению
+	Note                 string     `db:"note" json:"note,omitempty"`
+	HoldTransactionID    string     `db:"hold_transaction_id" json:"hold_transaction_id,omitempty"`
+	ReleaseTransactionID string     `db:"release_transaction_id" json:"release_transaction_id,omitempty"`
+	OpenedBy             string     `db:"opened_by" json:"opened_by"`
+	ResolvedBy           string     `db:"resolved_by" json:"resolved_by,omitempty"`
+	CreatedAt            time.Time  `db:"created_at" json:"created_at"`
+	ResolvedAt           *time.Time `db:"resolved_at" json:"resolved_at,omitempty"`
+}
+
+var disputeColumns = []string{"id", "transaction_id", "user_id", "amount", "held", "status", "reason", "note",
+	"hold_transaction_id", "release_transaction_id", "opened_by", "resolved_by", "created_at", "resolved_at"}
+
+// OpenDispute - открывает спор d по пополнению credit пользователя u и удерживает его сумму из основного баланса
+// записью OperationDisputeHold с тегом, категорией и тегами пополнения: если часть уже потрачена - сколько есть,
+// если ничего нет - спор открывается без удержания. Удержание и спор пишутся одной транзакцией SQL хранилища,
+// по одной операции - один спор (иначе ErrDisputeExists). opts.Save, opts.Journal, opts.Partial, opts.Fee
+// и opts.MainOnly заменяются
+func OpenDispute(ctx context.Context, sess *dbr.Session, u *User, credit Transaction, d Dispute, opts DebitOptions) (Dispute, error) {
+	if credit.Operation != OperationCredit || credit.Amount <= 0 {
+		return d, ErrNotDisputable
+	}
+	d.TransactionID, d.UserID, d.Amount, d.Status = credit.ID, credit.UserID, credit.Amount, DisputeOpen
+
+	opts.Operation, opts.Tag, opts.Partial, opts.Fee, opts.Journal = OperationDisputeHold, credit.Tag, true, nil, nil
+	opts.Category, opts.Tags, opts.MainOnly = credit.Category, credit.Tags, true
+	opts.Save = saveWith(ctx, sess, u.ID, func(tx *dbr.Tx, p Pending) error {
+		t := pendingTransaction(p, OperationDisputeHold)
+		held := d
+		held.Held, held.HoldTransactionID, held.CreatedAt = -t.Amount, t.ID, t.CreatedAt
+		return insertDispute(ctx, tx, held)
+	})
+	t, err := u.ApplyDebit(credit.Amount, opts)
+	if errors.Is(err, ErrNotEnoughMoney) {
+		d.CreatedAt = time.Now().UTC()
+		return d, insertDispute(ctx, sess, d)
+	}
+	if err != nil {
+		return d, err
+	}
+	d.Held, d.HoldTransactionID, d.CreatedAt = -t.Amount, t.ID, t.CreatedAt
+	return d, nil
+}
+
+// insertDispute - сохраняет открытый спор d, ErrDisputeExists если по операции спор уже есть
+func insertDispute(ctx context.Context, runner dbr.SessionRunner, d Dispute) error {
+	res, err := runner.InsertBySql(`INSERT INTO disputes (id, transaction_id, user_id, amount, held, status, reason, note,
+		hold_transaction_id, release_transaction_id, opened_by, resolved_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, '', ?, '', ?, '', ?) ON CONFLICT (transaction_id) DO NOTHING`,
+		d.ID, d.TransactionID, d.UserID, d.Amount, d.Held, d.Status, d.Reason, d.HoldTransactionID, d.OpenedBy, d.CreatedAt).
+		ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return ErrDisputeExists
+	}
+	return nil
+}
+
+// ResolveDispute - решает открытый спор d пользователя u: DisputeUphold возвращает удержанное записью
+// OperationDisputeRelease, DisputeReverse только закрывает спор. Пополнение и решение пишутся одной транзакцией
+// SQL хранилища, спор решается один раз (иначе ErrDisputeResolved). opts.Save и opts.Journal заменяются
+func ResolveDispute(ctx context.Context, sess *dbr.Session, u *User, d Dispute, resolution, note, by string, opts CreditOptions) (Dispute, error) {
+	status := DisputeUpheld
+	if resolution == DisputeReverse {
+		status = DisputeReversed
+	}
+	now := time.Now().UTC()
+	resolve := func(runner dbr.SessionRunner, releaseID string) error {
+		res, err := runner.Update("disputes").Set("status", status).Set("note", note).Set("resolved_by", by).
+			Set("release_transaction_id", releaseID).Set("resolved_at", now).
+			Where("id = ? AND status = ?", d.ID, DisputeOpen).ExecContext(ctx)
+		if err != nil {
+			return err
+		}
+		if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+			return ErrDisputeResolved
+		}
+		return nil
+	}
+
+	if status == DisputeReversed || d.Held == 0 {
+		if err := resolve(sess, ""); err != nil {
+			return d, err
+		}
+	} else {
+		opts.Operation, opts.Tag, opts.Partial, opts.Journal = OperationDisputeRelease, "", false, nil
+		opts.Save = saveWith(ctx, sess, u.ID, func(tx *dbr.Tx, p Pending) error {
+			return resolve(tx, p.Transactions[0].ID)
+		})
+		t, err := u.ApplyCredit(d.Held, opts)
+		if err != nil {
+			return d, err
+		}
+		d.ReleaseTransactionID = t.ID
+	}
+	d.Status, d.Note, d.ResolvedBy, d.ResolvedAt = status, note, by, &now
+	return d, nil
+}
+
+// LoadDispute - спор по операции transactionID, ErrNotFound если его нет
+func LoadDispute(ctx context.Context, sess *dbr.Session, transactionID string) (Dispute, error) {
+	var d Dispute
+	err := sess.Select(disputeColumns...).From("disputes").Where("transaction_id = ?", transactionID).LoadOneContext(ctx, &d)
+	if errors.Is(err, dbr.ErrNotFound) {
+		return d, ErrNotFound
+	}
+	return d, err
+}
+
+// LoadDisputes - до limit споров пользователя userID в состоянии status (пусто - в любом), новые первыми
+func LoadDisputes(ctx context.Context, sess *dbr.Session, userID int, status string, limit int) ([]Dispute, error) {
+	stmt := sess.Select(disputeColumns...).From("disputes").Where("user_id = ?", userID).
+		OrderDesc("created_at").Limit(uint64(limit))
+	if status != "" {
+		stmt.Where("status = ?", status)
+	}
+	var disputes []Dispute
+	_, err := stmt.LoadContext(ctx, &disputes)
+	return disputes, err
+}
@@ -0,0 +1,3 @@
+// Package store - модель пользователя и хранилище: интерфейс Storage, через который работают API и фоновое
+// сохранение, и его реализация на Postgres (подключение, схема, чтение и запись балансов).
+package store
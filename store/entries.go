@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// счета двойной записи: у каждого пользователя свой счет AccountUser (проводка с user_id),
+// системные счета общие
+const (
+	AccountUser = "user"
+	// AccountRevenue - выручка: списания с пользователей
+	AccountRevenue = "revenue"
+	// AccountSuspense - транзитный счет переносов между пользователями (слияния): в сумме по переносу ноль.
+	// На него же встают исправления расхождений
+	AccountSuspense = "suspense"
+	// AccountFunding - внешний источник начальных балансов и пополнений, на него же возвращаются удержания
+	// по оспоренным пополнениям
+	AccountFunding = "funding"
+	// AccountFees - комиссии, списанные с пользователей
+	AccountFees = "fees"
+	// AccountMarketing - источник бонусов и кешбэка: начисления, сгоревшие бонусы и кешбэк
+	AccountMarketing = "marketing"
+	// AccountInterest - источник процентов на баланс
+	AccountInterest = "interest"
+	// AccountEscrow - суммы сделок с эскроу, которые списаны у плательщиков и еще не выплачены и не возвращены
+	AccountEscrow = "escrow"
+)
+
+// LedgerEntry - проводка двойной записи. Каждая запись леджера раскладывается на проводки по счету пользователя
+// и системному счету с суммами противоположного знака, поэтому сумма проводок каждой операции и всего леджера - ноль
+type LedgerEntry struct {
+	TransactionID string `db:"transaction_id" json:"transaction_id"`
+	Account       string `db:"account" json:"account"`
+	// UserID - владелец счета AccountUser, nil у системных счетов
+	UserID *int `db:"user_id" json:"user_id,omitempty"`
+	// Amount - изменение счета, со знаком: увеличение баланса пользователя положительное
+	Amount    int64     `db:"amount" json:"amount"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// LedgerEntryColumns - колонки таблицы ledger_entries
+var LedgerEntryColumns = []string{"transaction_id", "account", "user_id", "amount", "created_at"}
+
+// AccountBalance - сумма проводок по счету, у AccountUser - по всем пользователям
+type AccountBalance struct {
+	Account string `db:"account" json:"account"`
+	Balance int64  `db:"balance" json:"balance"`
+}
+
+// TrialBalance - оборотная ведомость: суммы по счетам, Total должен быть нулем
+type TrialBalance struct {
+	Accounts []AccountBalance `json:"accounts"`
+	Total    int64            `json:"total"`
+	Balanced bool             `json:"balanced"`
+}
+
+// counterAccount - системный счет, на который встает вторая проводка операции. Отмена встает на счет
+// отмененной операции, поэтому сторнирует ее проводку
+func counterAccount(operation string) string {
+	if original := strings.TrimPrefix(operation, OperationReversal+"_"); original != operation {
+		return counterAccount(original)
+	}
+	switch operation {
+	case OperationDebit:
+		return AccountRevenue
+	case OperationOpening, OperationCredit, OperationDisputeHold, OperationDisputeRelease:
+		return AccountFunding
+	case OperationFee:
+		return AccountFees
+	case OperationBonusCredit, OperationBonusExpiry, OperationCashback:
+		return AccountMarketing
+	case OperationInterest:
+		return AccountInterest
+	case OperationEscrowHold, OperationEscrowRelease, OperationEscrowReturn:
+		return AccountEscrow
+	}
+	return AccountSuspense
+}
+
+// Entries - проводки записи леджера: по счету пользователя на Amount и по системному счету на -Amount
+func (tx Transaction) Entries() []LedgerEntry {
+	userID := tx.UserID
+	return []LedgerEntry{
+		{TransactionID: tx.ID, Account: AccountUser, UserID: &userID, Amount: int64(tx.Amount), CreatedAt: tx.CreatedAt},
+		{TransactionID: tx.ID, Account: counterAccount(tx.Operation), Amount: -int64(tx.Amount), CreatedAt: tx.CreatedAt},
+	}
+}
+
+// ledgerEntries - проводки всех записей txs
+func ledgerEntries(txs []Transaction) []LedgerEntry {
+	entries := make([]LedgerEntry, 0, 2*len(txs))
+	for _, tx := range txs {
+		entries = append(entries, tx.Entries()...)
+	}
+	return entries
+}
+
+// newTrialBalance - ведомость по суммам счетов
+func newTrialBalance(accounts []AccountBalance) TrialBalance {
+	b := TrialBalance{Accounts: accounts}
+	if b.Accounts == nil {
+		b.Accounts = []AccountBalance{}
+	}
+	for _, a := range b.Accounts {
+		b.Total += a.Balance
+	}
+	b.Balanced = b.Total == 0
+	return b
+}
+
+// loadTrialBalance - суммы проводок по счетам из SQL хранилища
+func loadTrialBalance(ctx context.Context, sess *dbr.Session) (TrialBalance, error) {
+	var accounts []AccountBalance
+	_, err := sess.Select("account", "SUM(amount) AS balance").From("ledger_entries").
+		GroupBy("account").OrderBy("account").LoadContext(ctx, &accounts)
+	if err != nil {
+		return TrialBalance{}, err
+	}
+	return newTrialBalance(accounts), nil
+}
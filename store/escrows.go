@@ -0,0 +1,167 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// состояния сделки с эскроу
+const (
+	// EscrowHeld - сумма списана у плательщика и ждет решения
+	EscrowHeld = "held"
+	// EscrowReleased - сумма зачислена получателю
+	EscrowReleased = "released"
+	// EscrowReturned - сумма возвращена плательщику
+	EscrowReturned = "returned"
+)
+
+// действия над сделкой с эскроу
+const (
+	// EscrowRelease - выплатить сумму получателю
+	EscrowRelease = "release"
+	// EscrowReturn - вернуть сумму плательщику
+	EscrowReturn = "return"
+)
+
+// ErrEscrowSettled - сделка уже завершена: сумма выплачена получателю или возвращена плательщику
+var ErrEscrowSettled = errors.New("escrow is already settled")
+
+// Escrow - сделка: Amount списан у PayerID на счет эскроу и ждет, пока его отдадут PayeeID (EscrowReleased)
+// или вернут PayerID (EscrowReturned). В ExpiresAt сделка без решения завершается по OnTimeout
+type Escrow struct {
+	ID      string `db:"id" json:"id"`
+	PayerID int    `db:"payer_id" json:"payer_id"`
+	PayeeID int    `db:"payee_id" json:"payee_id"`
+	Amount  int    `db:"amount" json:"amount"`
+	Tag     string `db:"tag" json:"tag,omitempty"`
+	Status  string `db:"status" json:"status"`
+	// OnTimeout - EscrowRelease или EscrowReturn
+	OnTimeout string    `db:"on_timeout" json:"on_timeout"`
+	ExpiresAt time.Time `db:"expires_at" json:"expires_at"`
+	// Reason - почему сделка завершена так, пусто - по запросу
+	Reason string `db:"reason" json:"reason,omitempty"`
+	// TransactionID - списание у плательщика, SettleTransactionID - пополнение получателя или возврат плательщику
+	TransactionID       string     `db:"transaction_id" json:"transaction_id"`
+	SettleTransactionID string     `db:"settle_transaction_id" json:"settle_transaction_id,omitempty"`
+	CreatedBy           string     `db:"created_by" json:"created_by"`
+	CreatedAt           time.Time  `db:"created_at" json:"created_at"`
+	SettledAt           *time.Time `db:"settled_at" json:"settled_at,omitempty"`
+}
+
+var escrowColumns = []string{"id", "payer_id", "payee_id", "amount", "tag", "status", "on_timeout", "expires_at", "reason",
+	"transaction_id", "settle_transaction_id", "created_by", "created_at", "settled_at"}
+
+// Validate - разные плательщик и получатель, сумма положительная, известное действие по истечении, тег допустимый
+func (e Escrow) Validate() error {
+	if e.PayerID < 1 || e.PayeeID < 1 {
+		return errors.New("invalid payer_id or payee_id")
+	}
+	if e.PayerID == e.PayeeID {
+		return errors.New("payer and payee must differ")
+	}
+	if e.Amount < 1 {
+		return errors.New("invalid amount")
+	}
+	if e.OnTimeout != EscrowRelease && e.OnTimeout != EscrowReturn {
+		return errors.New("on_timeout must be release or return")
+	}
+	return ValidateTag(e.Tag)
+}
+
+// HoldEscrow - открывает сделку e: списывает e.Amount с плательщика u записью OperationEscrowHold без комиссии
+// и только из основного баланса.
+// Списание и сделка пишутся одной транзакцией SQL хранилища: сделки без списания и списания без сделки не бывает.
+// opts.Save и opts.Journal заменяются
+func HoldEscrow(ctx context.Context, sess *dbr.Session, u *User, e Escrow, opts DebitOptions) (Escrow, error) {
+	opts.Operation, opts.Tag, opts.Partial, opts.Fee, opts.Journal = OperationEscrowHold, e.Tag, false, nil, nil
+	opts.MainOnly = true
+	opts.Save = saveWith(ctx, sess, u.ID, func(tx *dbr.Tx, p Pending) error {
+		t := pendingTransaction(p, OperationEscrowHold)
+		e.TransactionID, e.CreatedAt = t.ID, t.CreatedAt
+		_, err := tx.InsertInto("escrows").
+			Columns("id", "payer_id", "payee_id", "amount", "tag", "status", "on_timeout", "expires_at", "reason",
+				"transaction_id", "settle_transaction_id", "created_by", "created_at").
+			Values(e.ID, e.PayerID, e.PayeeID, e.Amount, e.Tag, EscrowHeld, e.OnTimeout, e.ExpiresAt, "",
+				e.TransactionID, "", e.CreatedBy, e.CreatedAt).
+			ExecContext(ctx)
+		return err
+	})
+	if _, err := u.ApplyDebit(e.Amount, opts); err != nil {
+		return Escrow{}, err
+	}
+	e.Status = EscrowHeld
+	return e, nil
+}
+
+// SettleEscrow - завершает сделку e действием action: EscrowRelease зачисляет сумму получателю u записью
+// OperationEscrowRelease (сделка EscrowReleased), EscrowReturn - возвращает плательщику u записью
+// OperationEscrowReturn (EscrowReturned) сверх максимального баланса и при любом состоянии счета (CreditOptions.Refund).
+// Пополнение и новое состояние сделки пишутся одной транзакцией SQL хранилища, поэтому сделка завершается один раз,
+// в том числе на нескольких экземплярах: завершенная раньше - ErrEscrowSettled. opts.Save и opts.Journal заменяются
+func SettleEscrow(ctx context.Context, sess *dbr.Session, u *User, e Escrow, action, reason string, opts CreditOptions) (Escrow, error) {
+	status, operation := EscrowReleased, OperationEscrowRelease
+	if action == EscrowReturn {
+		status, operation = EscrowReturned, OperationEscrowReturn
+		opts.Refund = true
+	}
+	now := time.Now().UTC()
+	opts.Operation, opts.Tag, opts.Partial, opts.Journal = operation, e.Tag, false, nil
+	opts.Save = saveWith(ctx, sess, u.ID, func(tx *dbr.Tx, p Pending) error {
+		res, err := tx.Update("escrows").Set("status", status).Set("reason", reason).
+			Set("settle_transaction_id", p.Transactions[0].ID).Set("settled_at", now).
+			Where("id = ? AND status = ?", e.ID, EscrowHeld).ExecContext(ctx)
+		if err != nil {
+			return err
+		}
+		if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+			return ErrEscrowSettled
+		}
+		return nil
+	})
+
+	t, err := u.ApplyCredit(e.Amount, opts)
+	if err != nil {
+		return e, err
+	}
+	e.Status, e.Reason, e.SettleTransactionID, e.SettledAt = status, reason, t.ID, &now
+	return e, nil
+}
+
+// LoadEscrow - сделка id, ErrNotFound если ее нет
+func LoadEscrow(ctx context.Context, sess *dbr.Session, id string) (Escrow, error) {
+	var e Escrow
+	err := sess.Select(escrowColumns...).From("escrows").Where("id = ?", id).LoadOneContext(ctx, &e)
+	if errors.Is(err, dbr.ErrNotFound) {
+		return e, ErrNotFound
+	}
+	return e, err
+}
+
+// LoadEscrows - до limit сделок, в которых userID плательщик или получатель, в состоянии status
+// (пусто - в любом), новые первыми
+func LoadEscrows(ctx context.Context, sess *dbr.Session, userID int, status string, limit int) ([]Escrow, error) {
+	stmt := sess.Select(escrowColumns...).From("escrows").
+		Where("(payer_id = ? OR payee_id = ?)", userID, userID).OrderDesc("created_at").Limit(uint64(limit))
+	if status != "" {
+		stmt.Where("status = ?", status)
+	}
+	var escrows []Escrow
+	_, err := stmt.LoadContext(ctx, &escrows)
+	return escrows, err
+}
+
+// ExpiredEscrows - до limit сделок без решения, истекших к now, давние первыми. after - последняя сделка
+// предыдущей страницы, nil - первая страница
+func ExpiredEscrows(ctx context.Context, sess *dbr.Session, now time.Time, after *Escrow, limit int) ([]Escrow, error) {
+	stmt := sess.Select(escrowColumns...).From("escrows").
+		Where("status = ? AND expires_at <= ?", EscrowHeld, now.UTC())
+	if after != nil {
+		stmt.Where("(expires_at, id) > (?, ?)", after.ExpiresAt.UTC(), after.ID)
+	}
+	var escrows []Escrow
+	_, err := stmt.OrderBy("expires_at").OrderBy("id").Limit(uint64(limit)).LoadContext(ctx, &escrows)
+	return escrows, err
+}
@@ -0,0 +1,38 @@
+package store
+
+import (
+	"context"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// setUserFrozen - замораживает или размораживает счет пользователя в SQL хранилище
+func setUserFrozen(ctx context.Context, sess *dbr.Session, userID int, frozen bool) error {
+	res, err := sess.Update("users").Set("frozen", frozen).Set("version", dbr.Expr("version + 1")).
+		Set("updated_at", dbr.Now).Where("id = ?", userID).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetFrozen - замораживает или размораживает счет через storage.SetUserFrozen, как SetStatus: если пользователь
+// есть в кеше, флаг в памяти меняется под его блокировкой, и списания после ответа уже получают ErrFrozen
+func SetFrozen(ctx context.Context, storage Storage, cached *User, userID int, frozen bool) error {
+	if cached == nil {
+		return storage.SetUserFrozen(ctx, userID, frozen)
+	}
+
+	l := cached.lock()
+	l.Lock()
+	defer l.Unlock()
+
+	if err := storage.SetUserFrozen(ctx, userID, frozen); err != nil {
+		return err
+	}
+	cached.Frozen = frozen
+	return nil
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/gocraft/dbr/v2/dialect"
+	"github.com/mattn/go-sqlite3"
+)
+
+// ExternalRefKey - ключ метаданных с идентификатором пользователя во внешней системе, уникален среди пользователей
+const ExternalRefKey = "external_ref"
+
+// ErrExternalRefTaken - external_ref из метаданных уже есть у другого пользователя
+var ErrExternalRefTaken = errors.New("external_ref is already taken by another user")
+
+// importBatchSize - сколько пользователей импорта проверяется и вставляется одним запросом
+const importBatchSize = 1000
+
+// ImportUser - строка импорта пользователей
+type ImportUser struct {
+	// Line - номер строки во входном файле, для отчета об ошибках
+	Line int
+	// ID - id пользователя, 0 - назначит БД
+	ID      int
+	Balance int64
+	// Metadata - метаданные, external_ref импорта передается в них
+	Metadata Metadata
+}
+
+// ImportRowError - ошибка одной строки импорта
+type ImportRowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// ImportError - импорт не применен целиком из-за ошибок в строках
+type ImportError struct {
+	Rows []ImportRowError
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("import failed: %d invalid rows", len(e.Rows))
+}
+
+// externalRef - external_ref из метаданных, пусто если его нет или он не строка
+func externalRef(m Metadata) string {
+	if len(m) == 0 {
+		return ""
+	}
+	var object struct {
+		Ref string `json:"external_ref"`
+	}
+	json.Unmarshal(m, &object)
+	return object.Ref
+}
+
+// withExternalRef - метаданные m с external_ref ref, пустой ref убирает его
+func withExternalRef(m Metadata, ref string) (Metadata, error) {
+	object := map[string]json.RawMessage{}
+	if len(m) > 0 {
+		if err := json.Unmarshal(m, &object); err != nil {
+			return nil, err
+		}
+	}
+	delete(object, ExternalRefKey)
+	if ref != "" {
+		object[ExternalRefKey], _ = json.Marshal(ref)
+	}
+	data, err := json.Marshal(object)
+	return Metadata(data), err
+}
+
+// externalRefExpr - выражение уникального индекса users_external_ref в диалекте d
+func externalRefExpr(d dbr.Dialect) string {
+	if d == dialect.SQLite3 {
+		return `json_extract(metadata, '$.external_ref')`
+	}
+	return `metadata->>'external_ref'`
+}
+
+// importUsers - добавляет пользователей одной транзакцией пачками по importBatchSize, с записями леджера
+// о начальных балансах. Если id или external_ref
+// строки уже заняты, ничего не добавляется и возвращается *ImportError со всеми такими строками
+func importUsers(ctx context.Context, sess *dbr.Session, users []ImportUser) error {
+	tx, err := sess.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	var batches [][]ImportUser
+	for start := 0; start < len(users); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(users) {
+			end = len(users)
+		}
+		batches = append(batches, users[start:end])
+	}
+
+	var conflicts []ImportRowError
+	for _, batch := range batches {
+		rows, err := importConflicts(ctx, tx, batch)
+		if err != nil {
+			return err
+		}
+		conflicts = append(conflicts, rows...)
+	}
+	if len(conflicts) > 0 {
+		return &ImportError{Rows: conflicts}
+	}
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	explicit := false
+	balances := make(map[int]int64, len(users))
+	for _, batch := range batches {
+		withID := tx.InsertInto("users").Columns("id", "balance", "created_at", "updated_at", "metadata")
+		withoutID := tx.InsertInto("users").Columns("balance", "created_at", "updated_at", "metadata")
+		var nWith, nWithout int
+		for _, u := range batch {
+			if u.ID > 0 {
+				withID.Values(u.ID, u.Balance, now, now, u.Metadata)
+				balances[u.ID] = u.Balance
+				nWith++
+			} else {
+				withoutID.Values(u.Balance, now, now, u.Metadata)
+				nWithout++
+			}
+		}
+		if nWith > 0 {
+			if _, err := withID.ExecContext(ctx); err != nil {
+				return err
+			}
+			explicit = true
+		}
+		if nWithout > 0 {
+			// id строк без id известны только после вставки, а для записей леджера хватает пары id и баланса
+			var created []struct {
+				ID      int   `db:"id"`
+				Balance int64 `db:"balance"`
+			}
+			if err := withoutID.Returning("id", "balance").LoadContext(ctx, &created); err != nil {
+				return err
+			}
+			for _, c := range created {
+				balances[c.ID] = c.Balance
+			}
+		}
+	}
+	if err := insertTransactions(ctx, tx, openingTransactions(balances, now)); err != nil {
+		return err
+	}
+
+	// в SQLite AUTOINCREMENT сам учитывает явные id, последовательность SERIAL в Postgres - нет
+	if explicit && tx.Dialect != dialect.SQLite3 {
+		if _, err := tx.ExecContext(ctx, `SELECT setval(pg_get_serial_sequence('users', 'id'), (SELECT max(id) FROM users))`); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// importConflicts - строки batch, id или external_ref которых уже есть в БД
+func importConflicts(ctx context.Context, tx *dbr.Tx, batch []ImportUser) ([]ImportRowError, error) {
+	var ids []int
+	var refs []string
+	for _, u := range batch {
+		if u.ID > 0 {
+			ids = append(ids, u.ID)
+		}
+		if ref := externalRef(u.Metadata); ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+
+	takenIDs := make(map[int]bool)
+	if len(ids) > 0 {
+		var existing []int
+		if _, err := tx.Select("id").From("users").Where("id IN ?", ids).LoadContext(ctx, &existing); err != nil {
+			return nil, err
+		}
+		for _, id := range existing {
+			takenIDs[id] = true
+		}
+	}
+	takenRefs := make(map[string]bool)
+	if len(refs) > 0 {
+		expr := externalRefExpr(tx.Dialect)
+		var existing []string
+		if _, err := tx.Select(expr).From("users").Where(expr+" IN ?", refs).LoadContext(ctx, &existing); err != nil {
+			return nil, err
+		}
+		for _, ref := range existing {
+			takenRefs[ref] = true
+		}
+	}
+
+	var conflicts []ImportRowError
+	for _, u := range batch {
+		if takenIDs[u.ID] {
+			conflicts = append(conflicts, ImportRowError{Line: u.Line, Error: fmt.Sprintf("user %d already exists", u.ID)})
+		} else if ref := externalRef(u.Metadata); takenRefs[ref] {
+			conflicts = append(conflicts, ImportRowError{Line: u.Line, Error: ErrExternalRefTaken.Error()})
+		}
+	}
+	return conflicts, nil
+}
+
+// isUniqueViolation - нарушение уникального индекса или первичного ключа (Postgres unique_violation,
+// SQLite UNIQUE constraint)
+func isUniqueViolation(err error) bool {
+	if sqlState(err) == "23505" {
+		return true
+	}
+	var liteErr sqlite3.Error
+	return errors.As(err, &liteErr) &&
+		(liteErr.ExtendedCode == sqlite3.ErrConstraintUnique || liteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
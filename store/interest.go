@@ -0,0 +1,150 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// InterestScale - начисления процентов за день хранятся в миллионных долях единицы баланса,
+// чтобы проценты с небольших балансов не терялись на округлении
+const InterestScale = 1000000
+
+// ErrInterestPaid - проценты пользователя за этот месяц уже выплачены
+var ErrInterestPaid = errors.New("interest is already paid for this month")
+
+// InterestAccrual - проценты Amount (в миллионных долях, см. InterestScale), начисленные пользователю за день Day
+// на баланс Balance
+type InterestAccrual struct {
+	UserID    int       `db:"user_id" json:"user_id"`
+	Day       time.Time `db:"day" json:"day"`
+	Balance   int64     `db:"balance" json:"balance"`
+	Amount    int64     `db:"amount" json:"amount"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// InterestPayout - выплата процентов Amount (запись TransactionID) за месяц Month. Amount 0 без записи -
+// выплачивать было нечего или пополнение не прошло, начисленное переходит на следующий месяц
+type InterestPayout struct {
+	UserID        int       `db:"user_id" json:"user_id"`
+	Month         time.Time `db:"month" json:"month"`
+	Amount        int       `db:"amount" json:"amount"`
+	TransactionID string    `db:"transaction_id" json:"transaction_id,omitempty"`
+	CreatedAt     time.Time `db:"created_at" json:"created_at"`
+}
+
+// InterestDay - начало дня UTC, в котором лежит t
+func InterestDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// AccrueInterest - начисляет за день day проценты по годовой ставке basisPoints (сотые доли процента, год - 365 дней)
+// всем не удаленным пользователям, у которых основной баланс в БД (без бонусов) больше threshold: на весь баланс.
+// Одним запросом, за день пользователю начисляется не больше одного раза, поэтому повторный запуск, в том числе
+// на другом экземпляре, ничего не добавит. Возвращает количество новых начислений
+func AccrueInterest(ctx context.Context, sess *dbr.Session, day time.Time, basisPoints int, threshold int64) (int, error) {
+	res, err := sess.InsertBySql(`INSERT INTO interest_accruals (user_id, day, balance, amount, created_at)
+		SELECT id, ?, balance - bonus, (balance - bonus) * ? / ?, ? FROM users WHERE balance - bonus > ? AND status <> ?
+		ON CONFLICT (user_id, day) DO NOTHING`,
+		InterestDay(day), basisPoints*(InterestScale/10000), 365, time.Now().UTC(), threshold, StatusDeleted).ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := res.RowsAffected()
+	return int(rows), err
+}
+
+// InterestPayoutUsers - до limit пользователей с id больше afterID, у которых есть начисления за месяц month,
+// но еще нет выплаты за него, по id
+func InterestPayoutUsers(ctx context.Context, sess *dbr.Session, month time.Time, afterID, limit int) ([]int, error) {
+	month = MonthStart(month)
+	var ids []int
+	_, err := sess.SelectBySql(`SELECT DISTINCT a.user_id FROM interest_accruals a
+		WHERE a.day >= ? AND a.day < ? AND a.user_id > ?
+		AND NOT EXISTS (SELECT 1 FROM interest_payouts p WHERE p.user_id = a.user_id AND p.month = ?)
+		ORDER BY a.user_id LIMIT ?`, month, month.AddDate(0, 1, 0), afterID, month, limit).LoadContext(ctx, &ids)
+	return ids, err
+}
+
+// unpaidInterest - начисленные пользователю userID до before и еще не выплаченные проценты в миллионных долях
+func unpaidInterest(ctx context.Context, runner dbr.SessionRunner, userID int, before time.Time) (int64, error) {
+	var accrued, paid int64
+	err := runner.Select("COALESCE(SUM(amount), 0)").From("interest_accruals").
+		Where("user_id = ? AND day < ?", userID, before).LoadOneContext(ctx, &accrued)
+	if err != nil {
+		return 0, err
+	}
+	err = runner.Select("COALESCE(SUM(amount), 0)").From("interest_payouts").
+		Where("user_id = ?", userID).LoadOneContext(ctx, &paid)
+	return accrued - paid*InterestScale, err
+}
+
+// PayInterest - выплачивает пользователю u проценты, начисленные до конца месяца month и еще не выплаченные
+// (с остатками прошлых месяцев), целыми единицами записью OperationInterest. Пополнение и выплата за месяц пишутся
+// одной транзакцией SQL хранилища: за месяц проценты выплачиваются один раз (иначе ErrInterestPaid). Дробная часть
+// и то, что не вошло до максимального баланса, переходят на следующий месяц. Выплата без суммы сохраняется без
+// пополнения, с пустым TransactionID. opts.Save, opts.Journal и opts.Partial заменяются
+func PayInterest(ctx context.Context, sess *dbr.Session, u *User, month time.Time, opts CreditOptions) (InterestPayout, error) {
+	month = MonthStart(month)
+	payout := InterestPayout{UserID: u.ID, Month: month}
+	unpaid, err := unpaidInterest(ctx, sess, u.ID, month.AddDate(0, 1, 0))
+	if err != nil {
+		return payout, err
+	}
+	if amount := int(unpaid / InterestScale); amount > 0 {
+		opts.Operation, opts.Partial, opts.Journal = OperationInterest, true, nil
+		opts.Save = saveWith(ctx, sess, u.ID, func(tx *dbr.Tx, p Pending) error {
+			t := p.Transactions[0]
+			return insertInterestPayout(ctx, tx, InterestPayout{UserID: u.ID, Month: month, Amount: t.Amount,
+				TransactionID: t.ID, CreatedAt: t.CreatedAt})
+		})
+		t, err := u.ApplyCredit(amount, opts)
+		if err != nil {
+			return payout, err
+		}
+		payout.Amount, payout.TransactionID, payout.CreatedAt = t.Amount, t.ID, t.CreatedAt
+		return payout, nil
+	}
+
+	payout.CreatedAt = time.Now().UTC()
+	return payout, insertInterestPayout(ctx, sess, payout)
+}
+
+// SkipInterestPayout - сохраняет выплату за месяц month без суммы: проценты, которые не удалось выплатить,
+// переходят на следующий месяц. ErrInterestPaid, если выплата за месяц уже есть
+func SkipInterestPayout(ctx context.Context, sess *dbr.Session, userID int, month time.Time) error {
+	return insertInterestPayout(ctx, sess, InterestPayout{UserID: userID, Month: MonthStart(month), CreatedAt: time.Now().UTC()})
+}
+
+// insertInterestPayout - сохраняет выплату p, ErrInterestPaid если за этот месяц она уже есть
+func insertInterestPayout(ctx context.Context, runner dbr.SessionRunner, p InterestPayout) error {
+	res, err := runner.InsertBySql(`INSERT INTO interest_payouts (user_id, month, amount, transaction_id, created_at)
+		VALUES (?, ?, ?, ?, ?) ON CONFLICT (user_id, month) DO NOTHING`,
+		p.UserID, p.Month, p.Amount, p.TransactionID, p.CreatedAt).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return ErrInterestPaid
+	}
+	return nil
+}
+
+// LoadInterestAccruals - начисления процентов пользователю userID начиная с дня since, новые первыми
+func LoadInterestAccruals(ctx context.Context, sess *dbr.Session, userID int, since time.Time) ([]InterestAccrual, error) {
+	var accruals []InterestAccrual
+	_, err := sess.Select("user_id", "day", "balance", "amount", "created_at").From("interest_accruals").
+		Where("user_id = ? AND day >= ?", userID, since.UTC()).OrderDesc("day").LoadContext(ctx, &accruals)
+	return accruals, err
+}
+
+// LoadInterestPayouts - до limit последних выплат процентов пользователю userID, новые первыми
+func LoadInterestPayouts(ctx context.Context, sess *dbr.Session, userID, limit int) ([]InterestPayout, error) {
+	var payouts []InterestPayout
+	_, err := sess.Select("user_id", "month", "amount", "transaction_id", "created_at").From("interest_payouts").
+		Where("user_id = ?", userID).OrderDesc("month").Limit(uint64(limit)).LoadContext(ctx, &payouts)
+	return payouts, err
+}
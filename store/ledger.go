@@ -0,0 +1,74 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// errInvalidLimit - размер страницы не положительный
+var errInvalidLimit = errors.New("invalid limit")
+
+// TransactionCursor - последняя запись леджера предыдущей страницы
+type TransactionCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// TransactionFilter - страница записей леджера за [From, To) по возрастанию (created_at, id)
+type TransactionFilter struct {
+	// UserID - только записи пользователя, 0 - всех
+	UserID int
+	// From, To - границы периода, нулевые - без границы
+	From time.Time
+	To   time.Time
+	// Category, Tags - только записи с этой категорией (пусто - с любой) и со всеми этими тегами
+	Category string
+	Tags     []string
+	// After - курсор предыдущей страницы, nil - первая страница
+	After *TransactionCursor
+	Limit int
+}
+
+// Cursor - курсор страницы, которая начнется после tx
+func (tx Transaction) Cursor() *TransactionCursor {
+	return &TransactionCursor{CreatedAt: tx.CreatedAt, ID: tx.ID}
+}
+
+// listTransactions - страница леджера из SQL хранилища. Период без пользователя читается по индексу
+// transactions_created_at, с пользователем - по transactions_user_id_created_at, категория и теги без пользователя -
+// по transactions_category и transactions_tags
+func listTransactions(ctx context.Context, sess *dbr.Session, f TransactionFilter) ([]Transaction, error) {
+	if f.Limit < 1 {
+		return nil, errInvalidLimit
+	}
+
+	stmt := sess.Select(TransactionColumns...).From("transactions")
+	if f.UserID > 0 {
+		stmt.Where("user_id = ?", f.UserID)
+	}
+	if !f.From.IsZero() {
+		stmt.Where("created_at >= ?", f.From.UTC())
+	}
+	if !f.To.IsZero() {
+		stmt.Where("created_at < ?", f.To.UTC())
+	}
+	if f.After != nil {
+		stmt.Where("(created_at, id) > (?, ?)", f.After.CreatedAt.UTC(), f.After.ID)
+	}
+	filterLabels(stmt, sess.Dialect, f.Category, f.Tags)
+
+	var txs []Transaction
+	_, err := stmt.OrderBy("created_at").OrderBy("id").Limit(uint64(f.Limit)).LoadContext(ctx, &txs)
+	return txs, err
+}
+
+// transactionAfter - tx идет после c в порядке (created_at, id)
+func transactionAfter(tx Transaction, c *TransactionCursor) bool {
+	if !tx.CreatedAt.Equal(c.CreatedAt) {
+		return tx.CreatedAt.After(c.CreatedAt)
+	}
+	return tx.ID > c.ID
+}
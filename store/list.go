@@ -0,0 +1,248 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/gocraft/dbr/v2/dialect"
+)
+
+// сортировки списка пользователей
+const (
+	SortByID      = "id"
+	SortByBalance = "balance"
+)
+
+// ErrInvalidMetadataKey - ключ фильтра по метаданным в недопустимом формате
+var ErrInvalidMetadataKey = errors.New("invalid metadata key: up to 64 chars of a-z, A-Z, 0-9, '_', '-'")
+
+var metadataKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// UserCursor - последний пользователь предыдущей страницы, следующая начинается строго после него
+type UserCursor struct {
+	ID      int
+	Balance int64
+}
+
+// ListOptions - параметры страницы списка пользователей. Удаленные пользователи попадают в список,
+// только если Status = StatusDeleted
+type ListOptions struct {
+	// Sort - SortByID или SortByBalance, при равных балансах порядок по id
+	Sort string
+	Desc bool
+	// After - курсор предыдущей страницы, nil - первая страница
+	After *UserCursor
+	Limit int
+	// Total - посчитать всех пользователей по фильтру, без учета курсора и Limit
+	Total bool
+	// Metadata - строковые значения верхнего уровня метаданных, которые должны совпасть
+	Metadata map[string]string
+	// MinBalance, MaxBalance - границы баланса включительно, nil - без границы
+	MinBalance *int64
+	MaxBalance *int64
+	// Status - только пользователи в этом состоянии, пусто - все, кроме удаленных
+	Status string
+	// IncludeDeleted - с пустым Status не пропускать удаленных (выгрузки)
+	IncludeDeleted bool
+	// UpdatedSince - только измененные не раньше, нулевое - без ограничения
+	UpdatedSince time.Time
+}
+
+// UserPage - страница списка пользователей
+type UserPage struct {
+	Users []*User
+	// Next - курсор следующей страницы, nil - страница последняя
+	Next *UserCursor
+	// Total - число пользователей по фильтру, если оно запрошено ListOptions.Total
+	Total int
+}
+
+// Validate - известная сортировка, положительный Limit, известное состояние и допустимые ключи метаданных
+func (o ListOptions) Validate() error {
+	if o.Sort != SortByID && o.Sort != SortByBalance {
+		return errors.New("sort must be id or balance")
+	}
+	if o.Limit < 1 {
+		return errInvalidLimit
+	}
+	if o.Status != "" && !ValidStatus(o.Status) {
+		return fmt.Errorf("unknown user status %q", o.Status)
+	}
+	if o.MinBalance != nil && o.MaxBalance != nil && *o.MinBalance > *o.MaxBalance {
+		return errors.New("min_balance is greater than max_balance")
+	}
+	for key := range o.Metadata {
+		if !metadataKeyPattern.MatchString(key) {
+			return ErrInvalidMetadataKey
+		}
+	}
+	return nil
+}
+
+// cursorAfter - курсор страницы, которая начнется после u
+func cursorAfter(u *User) *UserCursor {
+	return &UserCursor{ID: u.ID, Balance: u.Balance}
+}
+
+// listUsers - страница пользователей из SQL хранилища, по курсору (keyset): без OFFSET и с одним запросом на страницу
+func listUsers(ctx context.Context, sess *dbr.Session, opts ListOptions) (UserPage, error) {
+	if err := opts.Validate(); err != nil {
+		return UserPage{}, err
+	}
+
+	var page UserPage
+	if opts.Total {
+		stmt := sess.Select("count(*)").From("users")
+		if err := filterUsers(stmt, sess.Dialect, opts); err != nil {
+			return UserPage{}, err
+		}
+		if err := stmt.LoadOneContext(ctx, &page.Total); err != nil {
+			return UserPage{}, err
+		}
+	}
+
+	stmt := sess.Select(UserColumns...).From("users")
+	if err := filterUsers(stmt, sess.Dialect, opts); err != nil {
+		return UserPage{}, err
+	}
+	cmp := ">"
+	if opts.Desc {
+		cmp = "<"
+	}
+	if opts.After != nil {
+		if opts.Sort == SortByBalance {
+			stmt.Where("(balance, id) "+cmp+" (?, ?)", opts.After.Balance, opts.After.ID)
+		} else {
+			stmt.Where("id "+cmp+" ?", opts.After.ID)
+		}
+	}
+	if opts.Sort == SortByBalance {
+		stmt.OrderDir("balance", !opts.Desc)
+	}
+	// лишняя строка показывает, есть ли следующая страница
+	stmt.OrderDir("id", !opts.Desc).Limit(uint64(opts.Limit + 1))
+
+	if _, err := stmt.LoadContext(ctx, &page.Users); err != nil {
+		return UserPage{}, err
+	}
+	for _, u := range page.Users {
+		u.loaded()
+	}
+	if len(page.Users) > opts.Limit {
+		page.Users = page.Users[:opts.Limit]
+		page.Next = cursorAfter(page.Users[opts.Limit-1])
+	}
+	return page, nil
+}
+
+// filterUsers - условия ListOptions, кроме курсора. Каждое условие - по одной колонке с индексом:
+// balance - users_balance_id, status - частичный users_status, updated_at - users_updated_at
+func filterUsers(stmt *dbr.SelectStmt, d dbr.Dialect, opts ListOptions) error {
+	if opts.Status != "" {
+		stmt.Where("status = ?", opts.Status)
+	} else if !opts.IncludeDeleted {
+		stmt.Where("status <> ?", StatusDeleted)
+	}
+	if opts.MinBalance != nil {
+		stmt.Where("balance >= ?", *opts.MinBalance)
+	}
+	if opts.MaxBalance != nil {
+		stmt.Where("balance <= ?", *opts.MaxBalance)
+	}
+	if !opts.UpdatedSince.IsZero() {
+		stmt.Where("updated_at >= ?", opts.UpdatedSince.UTC())
+	}
+
+	if len(opts.Metadata) == 0 {
+		return nil
+	}
+	if d == dialect.SQLite3 {
+		for key, value := range opts.Metadata {
+			stmt.Where("json_extract(metadata, ?) = ?", `$."`+key+`"`, value)
+		}
+		return nil
+	}
+	// одно условие @> на все ключи использует GIN индекс users_metadata
+	filter, err := json.Marshal(opts.Metadata)
+	if err != nil {
+		return err
+	}
+	stmt.Where("metadata @> ?::jsonb", string(filter))
+	return nil
+}
+
+// listMemoryUsers - то же, что listUsers, по пользователям в памяти
+func listMemoryUsers(users []*User, opts ListOptions) (UserPage, error) {
+	if err := opts.Validate(); err != nil {
+		return UserPage{}, err
+	}
+
+	var page UserPage
+	matched := users[:0]
+	for _, u := range users {
+		if opts.matches(u) {
+			matched = append(matched, u)
+		}
+	}
+	page.Total = len(matched)
+
+	less := func(a, b *User) bool {
+		if opts.Sort == SortByBalance && a.Balance != b.Balance {
+			return a.Balance < b.Balance
+		}
+		return a.ID < b.ID
+	}
+	if opts.Desc {
+		asc := less
+		less = func(a, b *User) bool { return asc(b, a) }
+	}
+	sort.Slice(matched, func(i, j int) bool { return less(matched[i], matched[j]) })
+
+	start := 0
+	if opts.After != nil {
+		after := &User{ID: opts.After.ID, Balance: opts.After.Balance}
+		start = sort.Search(len(matched), func(i int) bool { return less(after, matched[i]) })
+	}
+	page.Users = matched[start:]
+	if len(page.Users) > opts.Limit {
+		page.Users = page.Users[:opts.Limit]
+		page.Next = cursorAfter(page.Users[opts.Limit-1])
+	}
+	return page, nil
+}
+
+// matches - u проходит условия opts, кроме курсора, как filterUsers
+func (o ListOptions) matches(u *User) bool {
+	switch {
+	case o.Status != "" && u.Status != o.Status,
+		o.Status == "" && !o.IncludeDeleted && u.Status == StatusDeleted,
+		o.MinBalance != nil && u.Balance < *o.MinBalance,
+		o.MaxBalance != nil && u.Balance > *o.MaxBalance,
+		!o.UpdatedSince.IsZero() && u.UpdatedAt.Before(o.UpdatedSince):
+		return false
+	}
+	return metadataMatches(u.Metadata, o.Metadata)
+}
+
+// metadataMatches - у m есть все строковые значения filter
+func metadataMatches(m Metadata, filter map[string]string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(m, &object); err != nil {
+		return false
+	}
+	for key, value := range filter {
+		if s, ok := object[key].(string); !ok || s != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,617 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory - Storage в памяти процесса для тестов и демонстраций: данные теряются при перезапуске
+type Memory struct {
+	mu           sync.Mutex
+	nextID       int
+	users        map[int]*memoryUser
+	transactions map[string]Transaction
+}
+
+// memoryUser - строка таблицы users
+type memoryUser struct {
+	balance     int64
+	creditLimit int64
+	maxBalance  int64
+	bonus       int64
+	pocketed    int64
+	frozen      bool
+	journalSeq  int64
+	version     int64
+	createdAt   time.Time
+	updatedAt   time.Time
+	status      string
+	metadata    Metadata
+	// lastActivity - время последней записи леджера, для RecentUserIDs
+	lastActivity time.Time
+}
+
+func (row *memoryUser) user(id int) *User {
+	return (&User{ID: id, Balance: row.balance, CreditLimit: row.creditLimit, MaxBalance: row.maxBalance,
+		Bonus: row.bonus, Pocketed: row.pocketed, Frozen: row.frozen, Version: row.version,
+		CreatedAt: row.createdAt, UpdatedAt: row.updatedAt, Status: row.status, Metadata: row.metadata}).loaded()
+}
+
+func newMemoryUser(balance int64) *memoryUser {
+	now := time.Now().UTC()
+	return &memoryUser{balance: balance, version: 1, createdAt: now, updatedAt: now, status: StatusActive}
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:        make(map[int]*memoryUser),
+		transactions: make(map[string]Transaction),
+	}
+}
+
+// AddUser - создает пользователя с балансом balance и возвращает его id
+func (m *Memory) AddUser(balance int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	m.users[m.nextID] = newMemoryUser(int64(balance))
+	m.addOpening(m.nextID, int64(balance))
+	return m.nextID
+}
+
+// addOpening - запись леджера о начальном балансе нового пользователя, вызывается под m.mu
+func (m *Memory) addOpening(id int, balance int64) {
+	m.addTransactions(openingTransactions(map[int]int64{id: balance}, m.users[id].createdAt))
+}
+
+// ResetData - удаляет все данные, как ResetData для БД
+func (m *Memory) ResetData() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID = 0
+	m.users = make(map[int]*memoryUser)
+	m.transactions = make(map[string]Transaction)
+}
+
+// Seed - создает count пользователей с балансом balance, если пользователей нет, как Seed для БД
+func (m *Memory) Seed(count int, balance int64) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.users) > 0 {
+		return 0
+	}
+	for i := 0; i < count; i++ {
+		m.nextID++
+		m.users[m.nextID] = newMemoryUser(balance)
+		m.addOpening(m.nextID, balance)
+	}
+	return count
+}
+
+func (m *Memory) LoadUser(ctx context.Context, id int) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, ok := m.users[id]
+	if !ok {
+		return nil, nil
+	}
+	return row.user(id), nil
+}
+
+func (m *Memory) LoadUsers(ctx context.Context, ids []int) ([]*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var users []*User
+	for _, id := range ids {
+		if row, ok := m.users[id]; ok {
+			users = append(users, row.user(id))
+		}
+	}
+	return users, nil
+}
+
+func (m *Memory) RecentUserIDs(ctx context.Context, limit int) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for id, row := range m.users {
+		if !row.lastActivity.IsZero() && row.status != StatusDeleted {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return m.users[ids[i]].lastActivity.After(m.users[ids[j]].lastActivity)
+	})
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+func (m *Memory) SavePending(ctx context.Context, userID int, p Pending) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkVersion(userID, p); err != nil {
+		return err
+	}
+	m.applyPending(userID, p)
+	return nil
+}
+
+func (m *Memory) SavePendingBatch(ctx context.Context, batch []UserPending) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// как и в транзакции БД, при конфликте не применяется ничего
+	for _, item := range batch {
+		if err := m.checkVersion(item.UserID, item.Pending); err != nil {
+			return err
+		}
+	}
+	for _, item := range batch {
+		m.applyPending(item.UserID, item.Pending)
+	}
+	return nil
+}
+
+// checkVersion - VersionConflict, если p основаны на другой версии существующего пользователя
+func (m *Memory) checkVersion(userID int, p Pending) error {
+	row, ok := m.users[userID]
+	if !ok || p.Version == 0 || p.Version == row.version || (p.Seq > 0 && row.journalSeq >= p.Seq) {
+		return nil
+	}
+	return &VersionConflict{UserID: userID, Balance: row.balance, Bonus: row.bonus, Pocketed: row.pocketed, CreditLimit: row.creditLimit, MaxBalance: row.maxBalance,
+		Frozen: row.frozen, Status: row.status, Version: row.version}
+}
+
+// applyPending - как savePending: изменения с уже примененным seq журнала и несуществующих пользователей пропускаются
+func (m *Memory) applyPending(userID int, p Pending) {
+	row, ok := m.users[userID]
+	if !ok || (p.Seq > 0 && row.journalSeq >= p.Seq) {
+		return
+	}
+
+	row.balance += int64(p.Delta)
+	row.bonus += p.BonusDelta()
+	row.pocketed += p.PocketDelta()
+	row.version++
+	row.updatedAt = time.Now().UTC()
+	if p.Seq > row.journalSeq {
+		row.journalSeq = p.Seq
+	}
+	m.addTransactions(p.Transactions)
+}
+
+func (m *Memory) addTransactions(txs []Transaction) {
+	for _, tx := range txs {
+		m.transactions[tx.ID] = tx
+		if row, ok := m.users[tx.UserID]; ok && tx.CreatedAt.After(row.lastActivity) {
+			row.lastActivity = tx.CreatedAt
+		}
+	}
+}
+
+// ChangedUsers - как ChangedUsers для БД
+func (m *Memory) ChangedUsers(ctx context.Context, since time.Time, limit int) ([]UserVersion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rows []UserVersion
+	for id, row := range m.users {
+		if !row.updatedAt.Before(since) {
+			rows = append(rows, UserVersion{ID: id, Version: row.version, UpdatedAt: row.updatedAt})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].UpdatedAt.After(rows[j].UpdatedAt)
+	})
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return rows, nil
+}
+
+func (m *Memory) JournalSeq(ctx context.Context, userID int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, ok := m.users[userID]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return row.journalSeq, nil
+}
+
+func (m *Memory) LoadTransaction(ctx context.Context, id string) (Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, ok := m.transactions[id]
+	if !ok {
+		return Transaction{}, ErrNotFound
+	}
+	return tx, nil
+}
+
+func (m *Memory) MergeUsers(ctx context.Context, from, into *User) (int, error) {
+	return mergeUsers(from, into, func(fromMetadata, intoMetadata Metadata) (int, error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		fromRow, ok := m.users[from.ID]
+		if !ok {
+			return 0, ErrNotFound
+		}
+		intoRow, ok := m.users[into.ID]
+		if !ok {
+			return 0, ErrNotFound
+		}
+
+		m.applyPending(from.ID, from.pending)
+		m.applyPending(into.ID, into.pending)
+
+		moved := int(fromRow.balance)
+		intoRow.balance += fromRow.balance
+		fromRow.balance, fromRow.bonus, fromRow.pocketed, fromRow.frozen = 0, 0, 0, true
+		if fromMetadata != nil {
+			fromRow.metadata, intoRow.metadata = fromMetadata, intoMetadata
+		}
+		fromRow.version++
+		intoRow.version++
+		fromRow.updatedAt = time.Now().UTC()
+		intoRow.updatedAt = fromRow.updatedAt
+		if moved != 0 {
+			m.addTransactions([]Transaction{
+				newTransaction(from.ID, -moved, OperationMergeOut, ""),
+				newTransaction(into.ID, moved, OperationMergeIn, ""),
+			})
+		}
+		return moved, nil
+	})
+}
+
+func (m *Memory) DebitStrict(ctx context.Context, userID, amount, fee int, tag, category string, tags Tags) (Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, ok := m.users[userID]
+	if !ok {
+		return Transaction{}, ErrNotFound
+	}
+	if err := checkStrictDebit(row.balance, row.creditLimit-row.pocketed, row.frozen, row.status, amount+fee); err != nil {
+		return Transaction{}, err
+	}
+
+	tx := newTransaction(userID, -amount, OperationDebit, tag)
+	tx.Category, tx.Tags = category, tags
+	txs := append(bonusTransactions(tx, row.bonus), debitTransactions(tx, fee)...)
+	row.balance -= int64(amount + fee)
+	row.bonus += bonusDelta(txs)
+	row.version++
+	row.updatedAt = tx.CreatedAt
+	m.addTransactions(txs)
+	return tx, nil
+}
+
+func (m *Memory) SetUserStatus(ctx context.Context, userID int, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	row.status = status
+	row.version++
+	row.updatedAt = time.Now().UTC()
+	return nil
+}
+
+func (m *Memory) CreateUser(ctx context.Context, balance int64, metadata Metadata) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.externalRefTaken(externalRef(metadata), 0) {
+		return nil, ErrExternalRefTaken
+	}
+	m.nextID++
+	row := newMemoryUser(balance)
+	row.metadata = metadata
+	m.users[m.nextID] = row
+	m.addOpening(m.nextID, balance)
+	return row.user(m.nextID), nil
+}
+
+func (m *Memory) SetUserMetadata(ctx context.Context, userID int, metadata Metadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	if m.externalRefTaken(externalRef(metadata), userID) {
+		return ErrExternalRefTaken
+	}
+	row.metadata = metadata
+	row.version++
+	row.updatedAt = time.Now().UTC()
+	return nil
+}
+
+func (m *Memory) ListUsers(ctx context.Context, opts ListOptions) (UserPage, error) {
+	m.mu.Lock()
+	users := make([]*User, 0, len(m.users))
+	for id, row := range m.users {
+		users = append(users, row.user(id))
+	}
+	m.mu.Unlock()
+
+	return listMemoryUsers(users, opts)
+}
+
+func (m *Memory) ImportUsers(ctx context.Context, users []ImportUser) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var conflicts []ImportRowError
+	for _, u := range users {
+		if _, ok := m.users[u.ID]; ok {
+			conflicts = append(conflicts, ImportRowError{Line: u.Line, Error: fmt.Sprintf("user %d already exists", u.ID)})
+		} else if m.externalRefTaken(externalRef(u.Metadata), 0) {
+			conflicts = append(conflicts, ImportRowError{Line: u.Line, Error: ErrExternalRefTaken.Error()})
+		}
+	}
+	if len(conflicts) > 0 {
+		return &ImportError{Rows: conflicts}
+	}
+
+	for _, u := range users {
+		id := u.ID
+		if id == 0 {
+			id = m.nextID + 1
+		}
+		// nextID - наибольший id, как последовательность после setval в importUsers
+		if id > m.nextID {
+			m.nextID = id
+		}
+		row := newMemoryUser(u.Balance)
+		row.metadata = u.Metadata
+		m.users[id] = row
+		m.addOpening(id, u.Balance)
+	}
+	return nil
+}
+
+// externalRefTaken - ref есть в метаданных пользователя, кроме exceptID, вызывается под m.mu
+func (m *Memory) externalRefTaken(ref string, exceptID int) bool {
+	if ref == "" {
+		return false
+	}
+	for id, row := range m.users {
+		if id != exceptID && externalRef(row.metadata) == ref {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) ListTransactions(ctx context.Context, f TransactionFilter) ([]Transaction, error) {
+	if f.Limit < 1 {
+		return nil, errInvalidLimit
+	}
+
+	m.mu.Lock()
+	var txs []Transaction
+	for _, tx := range m.transactions {
+		if (f.UserID == 0 || tx.UserID == f.UserID) &&
+			(f.From.IsZero() || !tx.CreatedAt.Before(f.From)) &&
+			(f.To.IsZero() || tx.CreatedAt.Before(f.To)) &&
+			(f.After == nil || transactionAfter(tx, f.After)) && tx.Matches(f.Category, f.Tags) {
+			txs = append(txs, tx)
+		}
+	}
+	m.mu.Unlock()
+
+	sort.Slice(txs, func(i, j int) bool { return transactionAfter(txs[j], txs[i].Cursor()) })
+	if len(txs) > f.Limit {
+		txs = txs[:f.Limit]
+	}
+	return txs, nil
+}
+
+func (m *Memory) Statement(ctx context.Context, userID int, from, to time.Time, category string, tags []string, limit int) (Statement, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, ok := m.users[userID]
+	if !ok {
+		return Statement{}, ErrNotFound
+	}
+
+	s := Statement{UserID: userID, From: from.UTC(), To: to.UTC(), Transactions: []Transaction{}}
+	var after, during int64
+	for _, tx := range m.transactions {
+		switch {
+		case tx.UserID != userID, tx.CreatedAt.Before(from):
+		case !tx.CreatedAt.Before(to):
+			after += int64(tx.Amount)
+		default:
+			during += int64(tx.Amount)
+			if tx.Matches(category, tags) {
+				s.Transactions = append(s.Transactions, tx)
+			}
+		}
+	}
+	if len(s.Transactions) > limit {
+		return Statement{}, ErrTooManyTransactions
+	}
+	sort.Slice(s.Transactions, func(i, j int) bool {
+		return transactionAfter(s.Transactions[j], s.Transactions[i].Cursor())
+	})
+
+	s.close(row.balance, after, during)
+	return s, nil
+}
+
+// BalanceAt - снимков в памяти нет, баланс всегда пересчитывается от текущего
+func (m *Memory) BalanceAt(ctx context.Context, userID int, at time.Time) (HistoricalBalance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, ok := m.users[userID]
+	if !ok {
+		return HistoricalBalance{}, ErrNotFound
+	}
+	b := HistoricalBalance{UserID: userID, At: at.UTC(), Balance: row.balance}
+	for _, tx := range m.transactions {
+		if tx.UserID == userID && !tx.CreatedAt.Before(at) {
+			b.Balance -= int64(tx.Amount)
+		}
+	}
+	return b, nil
+}
+
+// TrialBalance - проводки в памяти не хранятся, ведомость считается по записям леджера
+func (m *Memory) TrialBalance(ctx context.Context) (TrialBalance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sums := make(map[string]int64)
+	for _, tx := range m.transactions {
+		for _, e := range tx.Entries() {
+			sums[e.Account] += e.Amount
+		}
+	}
+	accounts := make([]AccountBalance, 0, len(sums))
+	for account, balance := range sums {
+		accounts = append(accounts, AccountBalance{Account: account, Balance: balance})
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Account < accounts[j].Account })
+	return newTrialBalance(accounts), nil
+}
+
+// CheckConsistency - проводки в памяти не хранятся, поэтому несбалансированных записей не бывает
+func (m *Memory) CheckConsistency(ctx context.Context, limit int) (ConsistencyReport, error) {
+	if limit < 1 {
+		return ConsistencyReport{}, errInvalidLimit
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := ConsistencyReport{Mismatches: []BalanceMismatch{}, Unbalanced: []string{}}
+	ledger := m.ledgerSums()
+	for id, row := range m.users {
+		if row.balance != ledger[id] {
+			r.Mismatches = append(r.Mismatches, BalanceMismatch{UserID: id, Balance: row.balance, Ledger: ledger[id]})
+		}
+	}
+	sort.Slice(r.Mismatches, func(i, j int) bool { return r.Mismatches[i].UserID < r.Mismatches[j].UserID })
+	if len(r.Mismatches) > limit {
+		r.Mismatches, r.Truncated = r.Mismatches[:limit], true
+	}
+	return r, nil
+}
+
+func (m *Memory) RepairConsistency(ctx context.Context, report ConsistencyReport, trust string) (RepairResult, error) {
+	if err := ValidateTrust(trust); err != nil {
+		return RepairResult{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var res RepairResult
+	ledger := m.ledgerSums()
+	for _, mismatch := range report.Mismatches {
+		row, ok := m.users[mismatch.UserID]
+		if !ok || row.balance-ledger[mismatch.UserID] != mismatch.Difference() {
+			res.Skipped++
+			continue
+		}
+		if trust == TrustBalance {
+			m.addTransactions([]Transaction{newTransaction(mismatch.UserID, int(mismatch.Difference()), OperationAdjustment, "")})
+			res.Adjusted++
+			continue
+		}
+		row.balance = ledger[mismatch.UserID]
+		row.version++
+		row.updatedAt = time.Now().UTC()
+		res.Rebalanced++
+	}
+	res.Skipped += len(report.Unbalanced)
+	return res, nil
+}
+
+func (m *Memory) SpentSince(ctx context.Context, userID int, since time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var spent int64
+	for _, tx := range m.transactions {
+		if tx.UserID == userID && tx.Operation == OperationDebit && !tx.CreatedAt.Before(since) {
+			spent -= int64(tx.Amount)
+		}
+	}
+	return spent, nil
+}
+
+func (m *Memory) SetUserFrozen(ctx context.Context, userID int, frozen bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	row.frozen = frozen
+	row.version++
+	row.updatedAt = time.Now().UTC()
+	return nil
+}
+
+func (m *Memory) SetUserCreditLimit(ctx context.Context, userID int, limit int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	row.creditLimit = limit
+	row.version++
+	row.updatedAt = time.Now().UTC()
+	return nil
+}
+
+func (m *Memory) SetUserMaxBalance(ctx context.Context, userID int, maxBalance int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	row.maxBalance = maxBalance
+	row.version++
+	row.updatedAt = time.Now().UTC()
+	return nil
+}
+
+// ledgerSums - суммы записей леджера по пользователям, вызывается под m.mu
+func (m *Memory) ledgerSums() map[int]int64 {
+	sums := make(map[int]int64, len(m.users))
+	for _, tx := range m.transactions {
+		sums[tx.UserID] += int64(tx.Amount)
+	}
+	return sums
+}
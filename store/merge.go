@@ -0,0 +1,161 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/gocraft/dbr/v2/dialect"
+)
+
+// ErrSameUser - попытка слить пользователя с самим собой
+var ErrSameUser = errors.New("cannot merge user into itself")
+
+// MergeUsers - переносит весь баланс from на into парой записей merge_out/merge_in, external_ref from - на into,
+// и замораживает from. Записи леджера from остаются у него: пользователь записи входит в ее хеш в цепочке леджера,
+// перенос сломал бы цепочку. Если external_ref есть у обоих - ErrExternalRefTaken.
+// Блокирует обоих пользователей в памяти, поэтому несохраненные изменения применяются в той же транзакции,
+// а параллельные списания ждут окончания слияния. Возвращает перенесенную сумму
+func MergeUsers(ctx context.Context, sess *dbr.Session, from, into *User) (int, error) {
+	return mergeUsers(from, into, func(fromMetadata, intoMetadata Metadata) (int, error) {
+		return mergeInDB(ctx, sess, from, into, fromMetadata, intoMetadata)
+	})
+}
+
+// mergeUsers - общая для хранилищ часть слияния: блокировки, проверки и состояние в памяти.
+// persist под блокировкой атомарно применяет Pending обоих пользователей, переносит баланс в хранилище
+// и, если метаданные не nil, записывает новые метаданные обоих с перенесенным external_ref
+func mergeUsers(from, into *User, persist func(fromMetadata, intoMetadata Metadata) (int, error)) (int, error) {
+	if from.ID == into.ID {
+		return 0, ErrSameUser
+	}
+
+	defer userLocks.LockPair(from.ID, into.ID)()
+
+	if err := into.checkState(); err != nil {
+		return 0, err
+	}
+	// долг не переносится: into мог бы уйти ниже своего кредитного лимита
+	if atomic.LoadInt64(&from.Balance) < 0 {
+		return 0, ErrOverdrawn
+	}
+	if atomic.LoadInt64(&from.Balance) > creditRoom(atomic.LoadInt64(&into.Balance), into.MaxBalance) {
+		return 0, ErrMaxBalance
+	}
+
+	// по external_ref внешняя система должна находить живой счет
+	var fromMetadata, intoMetadata Metadata
+	if ref := externalRef(from.Metadata); ref != "" {
+		if externalRef(into.Metadata) != "" {
+			return 0, ErrExternalRefTaken
+		}
+		var err error
+		if fromMetadata, err = withExternalRef(from.Metadata, ""); err != nil {
+			return 0, err
+		}
+		if intoMetadata, err = withExternalRef(into.Metadata, ref); err != nil {
+			return 0, err
+		}
+	}
+
+	moved, err := persist(fromMetadata, intoMetadata)
+	if err != nil {
+		return 0, err
+	}
+	if fromMetadata != nil {
+		from.Metadata, into.Metadata = fromMetadata, intoMetadata
+	}
+
+	// несохраненные изменения обоих и перенесенный баланс записаны; версии в памяти отстали,
+	// следующее сохранение into догонит БД через Rebase
+	into.saved += int64(into.pending.Delta) + int64(moved)
+	into.savedBonus += into.pending.BonusDelta()
+	// бонусы и карманы from переносятся как основной баланс: у into нет их начислений, по которым они бы сгорели,
+	// и своих карманов
+	from.saved, from.savedBonus, from.Bonus = 0, 0, 0
+	from.savedPocketed = 0
+	atomic.StoreInt64(&from.Pocketed, 0)
+	from.pending = Pending{Seq: from.pending.Seq}
+	into.pending = Pending{Seq: into.pending.Seq}
+	// списания в режиме Lockless могут резервировать баланс без блокировки, поэтому into только увеличивается,
+	// а резервы from обнуляются вместе с балансом
+	atomic.StoreInt64(&from.Balance, 0)
+	from.Frozen, from.merged = true, true
+	atomic.AddInt64(&into.Balance, int64(moved))
+	now := time.Now().UTC()
+	from.UpdatedAt, into.UpdatedAt = now, now
+
+	return moved, nil
+}
+
+// mergeInDB - слияние в одной транзакции SQL хранилища
+func mergeInDB(ctx context.Context, sess *dbr.Session, from, into *User, fromMetadata, intoMetadata Metadata) (int, error) {
+	tx, err := sess.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	// в SQLite писатель и так один, блокировка строк не нужна
+	if tx.Dialect != dialect.SQLite3 {
+		var ids []int
+		if _, err := tx.Select("id").From("users").Where("id IN ?", []int{from.ID, into.ID}).OrderBy("id").Suffix("FOR UPDATE").LoadContext(ctx, &ids); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, u := range []*User{from, into} {
+		if err := savePending(ctx, tx, u.ID, u.pending); err != nil {
+			return 0, err
+		}
+	}
+
+	var moved int
+	if err := tx.Select("balance").From("users").Where("id = ?", from.ID).LoadOneContext(ctx, &moved); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Update("users").Set("balance", dbr.Expr("balance + ?", moved)).Set("version", dbr.Expr("version + 1")).
+		Set("updated_at", dbr.Now).Where("id = ?", into.ID).ExecContext(ctx); err != nil {
+		return 0, err
+	}
+
+	if moved != 0 {
+		txs := []Transaction{
+			newTransaction(from.ID, -moved, OperationMergeOut, ""),
+			newTransaction(into.ID, moved, OperationMergeIn, ""),
+		}
+		if err := insertTransactions(ctx, tx, txs); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.DeleteFrom("pockets").Where("user_id = ?", from.ID).ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	freeze := tx.Update("users").Set("balance", 0).Set("bonus", 0).Set("pocketed", 0).Set("frozen", true).Set("version", dbr.Expr("version + 1")).
+		Set("updated_at", dbr.Now).Where("id = ?", from.ID)
+	if fromMetadata != nil {
+		freeze.Set("metadata", fromMetadata)
+	}
+	if _, err := freeze.ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	// external_ref уникален, поэтому into получает его только после того, как он убран у from
+	if intoMetadata != nil {
+		if _, err := tx.Update("users").Set("metadata", intoMetadata).Where("id = ?", into.ID).ExecContext(ctx); err != nil {
+			if isUniqueViolation(err) {
+				return 0, ErrExternalRefTaken
+			}
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return moved, nil
+}
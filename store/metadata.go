@@ -0,0 +1,147 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// MaxMetadataSize - максимальный размер метаданных пользователя в байтах JSON
+const MaxMetadataSize = 16 << 10
+
+// ErrInvalidMetadata - метаданные не JSON объект или больше MaxMetadataSize
+var ErrInvalidMetadata = fmt.Errorf("metadata must be a JSON object up to %d bytes", MaxMetadataSize)
+
+// Metadata - произвольный JSON объект пользователя (тариф, сегмент, внешние id), в Postgres - колонка jsonb.
+// Пустое значение - пустой объект
+type Metadata json.RawMessage
+
+// emptyMetadata - значение колонки metadata по умолчанию
+const emptyMetadata = "{}"
+
+// ValidateMetadata - m - JSON объект не больше MaxMetadataSize
+func ValidateMetadata(m Metadata) error {
+	if len(m) == 0 {
+		return nil
+	}
+	if len(m) > MaxMetadataSize {
+		return ErrInvalidMetadata
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(m, &object); err != nil || object == nil {
+		return ErrInvalidMetadata
+	}
+	return nil
+}
+
+// Scan - из jsonb (драйверы отдают []byte или string) и TEXT SQLite, байты копируются: буфер драйвера переиспользуется
+func (m *Metadata) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = nil
+	case []byte:
+		*m = append(Metadata(nil), v...)
+	case string:
+		*m = Metadata(v)
+	default:
+		return fmt.Errorf("cannot scan %T into metadata", src)
+	}
+	return nil
+}
+
+func (m Metadata) Value() (driver.Value, error) {
+	if len(m) == 0 {
+		return emptyMetadata, nil
+	}
+	return string(m), nil
+}
+
+func (m Metadata) MarshalJSON() ([]byte, error) {
+	if len(m) == 0 {
+		return []byte(emptyMetadata), nil
+	}
+	return m, nil
+}
+
+func (m *Metadata) UnmarshalJSON(data []byte) error {
+	if m == nil {
+		return errors.New("metadata: UnmarshalJSON on nil pointer")
+	}
+	if bytes.Equal(data, []byte("null")) {
+		*m = nil
+		return nil
+	}
+	*m = append((*m)[:0], data...)
+	return nil
+}
+
+// createUser - добавляет пользователя в SQL хранилище вместе с записью леджера о начальном балансе и возвращает его
+func createUser(ctx context.Context, sess *dbr.Session, balance int64, metadata Metadata) (*User, error) {
+	tx, err := sess.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	user := &User{Balance: balance, Version: 1, CreatedAt: now, UpdatedAt: now, Status: StatusActive, Metadata: metadata}
+	// RETURNING есть и в Postgres, и в SQLite 3.35+, а LastInsertId у драйверов Postgres нет
+	err = tx.InsertInto("users").Columns("balance", "created_at", "updated_at", "metadata").
+		Values(balance, now, now, metadata).Returning("id").LoadContext(ctx, &user.ID)
+	if isUniqueViolation(err) {
+		return nil, ErrExternalRefTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := insertTransactions(ctx, tx, openingTransactions(map[int]int64{user.ID: balance}, now)); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return user.loaded(), nil
+}
+
+// setUserMetadata - заменяет метаданные пользователя в SQL хранилище
+func setUserMetadata(ctx context.Context, sess *dbr.Session, userID int, metadata Metadata) error {
+	res, err := sess.Update("users").Set("metadata", metadata).Set("version", dbr.Expr("version + 1")).
+		Set("updated_at", dbr.Now).Where("id = ?", userID).ExecContext(ctx)
+	if isUniqueViolation(err) {
+		return ErrExternalRefTaken
+	}
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetMetadata - заменяет метаданные пользователя через storage.SetUserMetadata. Если пользователь есть в кеше
+// (cached != nil), метаданные в памяти меняются под его блокировкой
+func SetMetadata(ctx context.Context, storage Storage, cached *User, userID int, metadata Metadata) error {
+	if err := ValidateMetadata(metadata); err != nil {
+		return err
+	}
+	if cached == nil {
+		return storage.SetUserMetadata(ctx, userID, metadata)
+	}
+
+	l := cached.lock()
+	l.Lock()
+	defer l.Unlock()
+
+	if err := storage.SetUserMetadata(ctx, userID, metadata); err != nil {
+		return err
+	}
+	cached.Metadata = metadata
+	return nil
+}
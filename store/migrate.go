@@ -0,0 +1,825 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// Migration - версия схемы БД. Up применяет изменения, Down откатывает их.
+// Check - запрос количества строк с данными, которые потеряются при откате, пустой - откат без потерь
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+	Check   string
+}
+
+// ErrDataLoss - откат удалит данные, нужен force
+var ErrDataLoss = errors.New("migration rollback would lose data")
+
+// Migrations - все версии схемы по порядку. Up написаны идемпотентно (IF NOT EXISTS),
+// поэтому на базе, созданной до появления schema_migrations, применяются без ошибок.
+// Код читает только известные ему колонки, поэтому версия N работает на схеме N+1 и откат бинарника
+// не требует отката схемы
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "users",
+		Up:      []string{`CREATE TABLE IF NOT EXISTS public.users (id SERIAL NOT NULL, balance bigint NOT NULL)`},
+		Down:    []string{`DROP TABLE IF EXISTS users`},
+		Check:   `SELECT count(*) FROM users WHERE balance <> 0`,
+	},
+	{
+		Version: 2,
+		Name:    "users_frozen",
+		Up:      []string{`ALTER TABLE users ADD COLUMN IF NOT EXISTS frozen boolean NOT NULL DEFAULT false`},
+		Down:    []string{`ALTER TABLE users DROP COLUMN IF EXISTS frozen`},
+		Check:   `SELECT count(*) FROM users WHERE frozen`,
+	},
+	{
+		Version: 3,
+		Name:    "users_journal_seq",
+		Up:      []string{`ALTER TABLE users ADD COLUMN IF NOT EXISTS journal_seq bigint NOT NULL DEFAULT 0`},
+		Down:    []string{`ALTER TABLE users DROP COLUMN IF EXISTS journal_seq`},
+		Check:   `SELECT count(*) FROM users WHERE journal_seq > 0`,
+	},
+	{
+		Version: 4,
+		Name:    "transactions",
+		// время хранится в UTC без пояса: dbr подставляет значения времени строкой в UTC
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS transactions (
+				id text PRIMARY KEY,
+				user_id integer NOT NULL,
+				amount bigint NOT NULL,
+				operation text NOT NULL,
+				tag text NOT NULL DEFAULT '',
+				created_at timestamp NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS transactions_user_id_created_at ON transactions (user_id, created_at)`,
+			`CREATE INDEX IF NOT EXISTS transactions_created_at ON transactions (created_at)`,
+		},
+		Down:  []string{`DROP TABLE IF EXISTS transactions`},
+		Check: `SELECT count(*) FROM transactions`,
+	},
+	{
+		Version: 5,
+		Name:    "erp_exports",
+		Up: []string{`CREATE TABLE IF NOT EXISTS erp_exports (
+			period_start timestamp PRIMARY KEY,
+			period_end timestamp NOT NULL,
+			file text NOT NULL,
+			lines integer NOT NULL,
+			exported_at timestamp NOT NULL
+		)`},
+		Down:  []string{`DROP TABLE IF EXISTS erp_exports`},
+		Check: `SELECT count(*) FROM erp_exports`,
+	},
+	{
+		Version: 6,
+		Name:    "transactions_seq",
+		// seq - порядок вставки записей леджера для проекций: created_at не монотонен, записи сохраняются в фоне
+		Up: []string{
+			`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS seq bigserial`,
+			`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS inserted_at timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'utc')`,
+			`CREATE INDEX IF NOT EXISTS transactions_seq ON transactions (seq)`,
+		},
+		Down: []string{
+			`ALTER TABLE transactions DROP COLUMN IF EXISTS inserted_at`,
+			`ALTER TABLE transactions DROP COLUMN IF EXISTS seq`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "projections",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS projection_checkpoints (
+				name text PRIMARY KEY,
+				seq bigint NOT NULL DEFAULT 0,
+				updated_at timestamp NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS user_daily_totals (
+				user_id integer NOT NULL,
+				day date NOT NULL,
+				debits bigint NOT NULL,
+				credits bigint NOT NULL,
+				operations integer NOT NULL,
+				PRIMARY KEY (user_id, day)
+			)`,
+			`CREATE TABLE IF NOT EXISTS user_running_balances (
+				user_id integer PRIMARY KEY,
+				net bigint NOT NULL,
+				operations bigint NOT NULL,
+				last_seq bigint NOT NULL,
+				updated_at timestamp NOT NULL
+			)`,
+		},
+		// проекции строятся заново из леджера, поэтому откат без потерь
+		Down: []string{
+			`DROP TABLE IF EXISTS user_running_balances`,
+			`DROP TABLE IF EXISTS user_daily_totals`,
+			`DROP TABLE IF EXISTS projection_checkpoints`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "users_version",
+		// версия растет с каждой записью строки, по ней писатель замечает чужие изменения, см. VersionConflict
+		Up:   []string{`ALTER TABLE users ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1`},
+		Down: []string{`ALTER TABLE users DROP COLUMN IF EXISTS version`},
+	},
+	{
+		Version: 9,
+		Name:    "users_timestamps",
+		// updated_at пишет сервис при каждой записи строки, у существующих пользователей обе колонки - время миграции
+		Up: []string{
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'utc')`,
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'utc')`,
+			`CREATE INDEX IF NOT EXISTS users_updated_at ON users (updated_at)`,
+		},
+		Down: []string{
+			`DROP INDEX IF EXISTS users_updated_at`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS updated_at`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS created_at`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "users_status",
+		Up: []string{
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'active'`,
+			`CREATE INDEX IF NOT EXISTS users_status ON users (status) WHERE status <> 'active'`,
+		},
+		Down: []string{
+			`DROP INDEX IF EXISTS users_status`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS status`,
+		},
+		Check: `SELECT count(*) FROM users WHERE status <> 'active'`,
+	},
+	{
+		Version: 11,
+		Name:    "users_metadata",
+		Up: []string{
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS metadata jsonb NOT NULL DEFAULT '{}'`,
+			// jsonb_path_ops - для фильтров metadata @> '{"plan": "pro"}'
+			`CREATE INDEX IF NOT EXISTS users_metadata ON users USING gin (metadata jsonb_path_ops)`,
+		},
+		Down: []string{
+			`DROP INDEX IF EXISTS users_metadata`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS metadata`,
+		},
+		Check: `SELECT count(*) FROM users WHERE metadata <> '{}'`,
+	},
+	{
+		Version: 12,
+		Name:    "users_list_indexes",
+		Up: []string{
+			// в первой версии схемы у users нет первичного ключа: без индекса по id чтение пользователя и
+			// страницы списка с курсором по id читают всю таблицу
+			`CREATE UNIQUE INDEX IF NOT EXISTS users_id ON users (id)`,
+			// сортировка списка по балансу с курсором (balance, id)
+			`CREATE INDEX IF NOT EXISTS users_balance_id ON users (balance, id)`,
+		},
+		Down: []string{
+			`DROP INDEX IF EXISTS users_balance_id`,
+			`DROP INDEX IF EXISTS users_id`,
+		},
+	},
+	{
+		Version: 13,
+		Name:    "users_external_ref",
+		Up: []string{
+			`CREATE UNIQUE INDEX IF NOT EXISTS users_external_ref ON users ((metadata->>'external_ref')) WHERE metadata->>'external_ref' IS NOT NULL`,
+		},
+		Down: []string{
+			`DROP INDEX IF EXISTS users_external_ref`,
+		},
+	},
+	{
+		Version: 14,
+		Name:    "balance_snapshots",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS balance_snapshot_days (
+				day date PRIMARY KEY,
+				users integer NOT NULL,
+				created_at timestamp NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS balance_snapshots (
+				day date NOT NULL,
+				user_id integer NOT NULL,
+				balance bigint NOT NULL,
+				PRIMARY KEY (day, user_id)
+			)`,
+			// последний снимок пользователя до заданных суток
+			`CREATE INDEX IF NOT EXISTS balance_snapshots_user_id_day ON balance_snapshots (user_id, day)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS balance_snapshots`,
+			`DROP TABLE IF EXISTS balance_snapshot_days`,
+		},
+		Check: `SELECT count(*) FROM balance_snapshots`,
+	},
+	{
+		Version: 15,
+		Name:    "ledger_entries",
+		// проводки уже записанных операций восстанавливаются по transactions, см. counterAccount.
+		// Операции, записанные бинарником без проводок во время выкладки, остаются без них
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS ledger_entries (
+				transaction_id text NOT NULL,
+				account text NOT NULL,
+				user_id integer,
+				amount bigint NOT NULL,
+				created_at timestamp NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS ledger_entries_transaction_id ON ledger_entries (transaction_id)`,
+			`CREATE INDEX IF NOT EXISTS ledger_entries_user_id ON ledger_entries (user_id) WHERE user_id IS NOT NULL`,
+			`INSERT INTO ledger_entries (transaction_id, account, user_id, amount, created_at)
+				SELECT id, 'user', user_id, amount, created_at FROM transactions
+				WHERE NOT EXISTS (SELECT 1 FROM ledger_entries)
+				UNION ALL
+				SELECT id, CASE operation WHEN 'debit' THEN 'revenue' WHEN 'opening' THEN 'funding' ELSE 'suspense' END, NULL, -amount, created_at FROM transactions
+				WHERE NOT EXISTS (SELECT 1 FROM ledger_entries)`,
+		},
+		Down:  []string{`DROP TABLE IF EXISTS ledger_entries`},
+		Check: `SELECT count(*) FROM ledger_entries`,
+	},
+	{
+		Version: 16,
+		Name:    "transactions_chain",
+		// chain_seq и hash заполняет chain.Chain, голова цепочки - в ledger_chain_head
+		Up: []string{
+			`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS chain_seq bigint`,
+			`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS hash text`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS transactions_chain_seq ON transactions (chain_seq)`,
+			`CREATE INDEX IF NOT EXISTS transactions_unchained ON transactions (seq) WHERE chain_seq IS NULL`,
+			`CREATE TABLE IF NOT EXISTS ledger_chain_head (
+				name text PRIMARY KEY,
+				seq bigint NOT NULL,
+				hash text NOT NULL,
+				updated_at timestamp NOT NULL
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS ledger_chain_head`,
+			`DROP INDEX IF EXISTS transactions_unchained`,
+			`DROP INDEX IF EXISTS transactions_chain_seq`,
+			`ALTER TABLE transactions DROP COLUMN IF EXISTS hash`,
+			`ALTER TABLE transactions DROP COLUMN IF EXISTS chain_seq`,
+		},
+		Check: `SELECT count(*) FROM transactions WHERE chain_seq IS NOT NULL`,
+	},
+	{
+		Version: 17,
+		Name:    "api_keys",
+		// в key_hash - sha256 ключа, сам ключ показывается один раз при создании
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS api_keys (
+				name text PRIMARY KEY,
+				key_hash text NOT NULL UNIQUE,
+				created_at timestamp NOT NULL,
+				revoked_at timestamp
+			)`,
+		},
+		Down:  []string{`DROP TABLE IF EXISTS api_keys`},
+		Check: `SELECT count(*) FROM api_keys`,
+	},
+	{
+		Version: 18,
+		Name:    "api_keys_scopes",
+		// права через пробел, существующие ключи остаются ключами сервисов
+		Up:    []string{`ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS scopes text NOT NULL DEFAULT 'service'`},
+		Down:  []string{`ALTER TABLE api_keys DROP COLUMN IF EXISTS scopes`},
+		Check: `SELECT count(*) FROM api_keys WHERE scopes <> 'service'`,
+	},
+	{
+		Version: 19,
+		Name:    "spend_limits",
+		// потраченное считается по transactions, здесь только величины лимитов
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS spend_limits (
+				subject text PRIMARY KEY,
+				daily bigint NOT NULL DEFAULT 0,
+				weekly bigint NOT NULL DEFAULT 0,
+				updated_at timestamp NOT NULL
+			)`,
+		},
+		Down:  []string{`DROP TABLE IF EXISTS spend_limits`},
+		Check: `SELECT count(*) FROM spend_limits`,
+	},
+	{
+		Version: 20,
+		Name:    "denylist",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS denylist (
+				kind text NOT NULL,
+				value text NOT NULL,
+				reason text NOT NULL DEFAULT '',
+				created_at timestamp NOT NULL,
+				PRIMARY KEY (kind, value)
+			)`,
+		},
+		Down:  []string{`DROP TABLE IF EXISTS denylist`},
+		Check: `SELECT count(*) FROM denylist`,
+	},
+	{
+		Version: 21,
+		Name:    "approvals",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS approvals (
+				id text PRIMARY KEY,
+				user_id integer NOT NULL,
+				amount bigint NOT NULL,
+				tag text NOT NULL DEFAULT '',
+				strict boolean NOT NULL DEFAULT false,
+				status text NOT NULL,
+				requested_by text NOT NULL,
+				decided_by text NOT NULL DEFAULT '',
+				reason text NOT NULL DEFAULT '',
+				transaction_id text NOT NULL DEFAULT '',
+				created_at timestamp NOT NULL,
+				decided_at timestamp
+			)`,
+			`CREATE INDEX IF NOT EXISTS approvals_status_created_at ON approvals (status, created_at)`,
+		},
+		Down:  []string{`DROP TABLE IF EXISTS approvals`},
+		Check: `SELECT count(*) FROM approvals`,
+	},
+	{
+		Version: 22,
+		Name:    "users_credit_limit",
+		Up:      []string{`ALTER TABLE users ADD COLUMN IF NOT EXISTS credit_limit bigint NOT NULL DEFAULT 0`},
+		Down:    []string{`ALTER TABLE users DROP COLUMN IF EXISTS credit_limit`},
+		Check:   `SELECT count(*) FROM users WHERE credit_limit > 0 OR balance < 0`,
+	},
+	{
+		Version: 23,
+		Name:    "users_max_balance",
+		Up:      []string{`ALTER TABLE users ADD COLUMN IF NOT EXISTS max_balance bigint NOT NULL DEFAULT 0`},
+		Down:    []string{`ALTER TABLE users DROP COLUMN IF EXISTS max_balance`},
+		Check:   `SELECT count(*) FROM users WHERE max_balance > 0`,
+	},
+	{
+		Version: 24,
+		Name:    "pending_debits",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS pending_debits (
+				id text PRIMARY KEY,
+				user_id integer NOT NULL,
+				amount bigint NOT NULL,
+				tag text NOT NULL DEFAULT '',
+				created_at timestamp NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS pending_debits_user_id_created_at ON pending_debits (user_id, created_at)`,
+		},
+		Down:  []string{`DROP TABLE IF EXISTS pending_debits`},
+		Check: `SELECT count(*) FROM pending_debits`,
+	},
+	{
+		Version: 25,
+		Name:    "bonus",
+		Up: []string{
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS bonus bigint NOT NULL DEFAULT 0`,
+			`CREATE TABLE IF NOT EXISTS bonus_grants (
+				id text PRIMARY KEY,
+				user_id integer NOT NULL,
+				amount bigint NOT NULL,
+				expires_at timestamp NOT NULL,
+				created_at timestamp NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS bonus_grants_user_id_expires_at ON bonus_grants (user_id, expires_at)`,
+			`CREATE INDEX IF NOT EXISTS bonus_grants_expires_at ON bonus_grants (expires_at)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS bonus_grants`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS bonus`,
+		},
+		Check: `SELECT count(*) FROM users WHERE bonus > 0`,
+	},
+	{
+		Version: 26,
+		Name:    "pockets",
+		Up: []string{
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS pocketed bigint NOT NULL DEFAULT 0`,
+			`CREATE TABLE IF NOT EXISTS pockets (
+				user_id integer NOT NULL,
+				name text NOT NULL,
+				balance bigint NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_id, name)
+			)`,
+			`ALTER TABLE approvals ADD COLUMN IF NOT EXISTS pocket text NOT NULL DEFAULT ''`,
+		},
+		Down: []string{
+			`ALTER TABLE approvals DROP COLUMN IF EXISTS pocket`,
+			`DROP TABLE IF EXISTS pockets`,
+			`ALTER TABLE users DROP COLUMN IF EXISTS pocketed`,
+		},
+		Check: `SELECT count(*) FROM pockets WHERE balance > 0`,
+	},
+	{
+		Version: 27,
+		Name:    "promo_codes",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS promo_codes (
+				code text PRIMARY KEY,
+				amount bigint NOT NULL,
+				tag text NOT NULL DEFAULT '',
+				max_uses integer NOT NULL DEFAULT 0,
+				uses integer NOT NULL DEFAULT 0,
+				valid_from timestamp NOT NULL,
+				valid_until timestamp,
+				created_at timestamp NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS promo_redemptions (
+				code text NOT NULL,
+				user_id integer NOT NULL,
+				transaction_id text NOT NULL,
+				created_at timestamp NOT NULL,
+				PRIMARY KEY (code, user_id)
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS promo_redemptions`,
+			`DROP TABLE IF EXISTS promo_codes`,
+		},
+		Check: `SELECT count(*) FROM promo_redemptions`,
+	},
+	{
+		Version: 28,
+		Name:    "referrals",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS referrals (
+				referee_id integer PRIMARY KEY,
+				referrer_id integer NOT NULL,
+				referrer_transaction_id text NOT NULL DEFAULT '',
+				referee_transaction_id text NOT NULL DEFAULT '',
+				created_at timestamp NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS referrals_referrer_id ON referrals (referrer_id, created_at)`,
+		},
+		Down:  []string{`DROP TABLE IF EXISTS referrals`},
+		Check: `SELECT count(*) FROM referrals`,
+	},
+	{
+		Version: 29,
+		Name:    "cashback",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS cashback_rules (
+				subject text PRIMARY KEY,
+				basis_points integer NOT NULL,
+				monthly_cap bigint NOT NULL DEFAULT 0,
+				updated_at timestamp NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS cashback (
+				debit_transaction_id text PRIMARY KEY,
+				user_id integer NOT NULL,
+				rule text NOT NULL,
+				amount bigint NOT NULL,
+				transaction_id text NOT NULL,
+				created_at timestamp NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS cashback_user_id_rule_created_at ON cashback (user_id, rule, created_at)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS cashback`,
+			`DROP TABLE IF EXISTS cashback_rules`,
+		},
+		Check: `SELECT count(*) FROM cashback`,
+	},
+	{
+		Version: 30,
+		Name:    "schedules",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS schedules (
+				id text PRIMARY KEY,
+				user_id integer NOT NULL,
+				amount bigint NOT NULL,
+				tag text NOT NULL DEFAULT '',
+				period text NOT NULL,
+				status text NOT NULL,
+				start_at timestamp NOT NULL,
+				next_run_at timestamp NOT NULL,
+				runs integer NOT NULL DEFAULT 0,
+				failures integer NOT NULL DEFAULT 0,
+				last_error text NOT NULL DEFAULT '',
+				last_transaction_id text NOT NULL DEFAULT '',
+				last_run_at timestamp,
+				created_at timestamp NOT NULL,
+				updated_at timestamp NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS schedules_status_next_run_at ON schedules (status, next_run_at)`,
+			`CREATE INDEX IF NOT EXISTS schedules_user_id ON schedules (user_id, created_at)`,
+		},
+		Down:  []string{`DROP TABLE IF EXISTS schedules`},
+		Check: `SELECT count(*) FROM schedules WHERE status <> 'cancelled'`,
+	},
+	{
+		Version: 31,
+		Name:    "scheduled_operations",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS scheduled_operations (
+				id text PRIMARY KEY,
+				kind text NOT NULL,
+				user_id integer NOT NULL,
+				to_user_id integer NOT NULL DEFAULT 0,
+				amount bigint NOT NULL,
+				tag text NOT NULL DEFAULT '',
+				execute_at timestamp NOT NULL,
+				status text NOT NULL,
+				reason text NOT NULL DEFAULT '',
+				transaction_id text NOT NULL DEFAULT '',
+				to_transaction_id text NOT NULL DEFAULT '',
+				refund_transaction_id text NOT NULL DEFAULT '',
+				created_by text NOT NULL DEFAULT '',
+				created_at timestamp NOT NULL,
+				executed_at timestamp
+			)`,
+			`CREATE INDEX IF NOT EXISTS scheduled_operations_status_execute_at ON scheduled_operations (status, execute_at)`,
+			`CREATE INDEX IF NOT EXISTS scheduled_operations_user_id ON scheduled_operations (user_id, execute_at)`,
+			`CREATE INDEX IF NOT EXISTS scheduled_operations_to_user_id ON scheduled_operations (to_user_id, execute_at)`,
+		},
+		Down:  []string{`DROP TABLE IF EXISTS scheduled_operations`},
+		Check: `SELECT count(*) FROM scheduled_operations WHERE status IN ('pending', 'debited')`,
+	},
+	{
+		Version: 32,
+		Name:    "interest",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS interest_accruals (
+				user_id integer NOT NULL,
+				day timestamp NOT NULL,
+				balance bigint NOT NULL,
+				amount bigint NOT NULL,
+				created_at timestamp NOT NULL,
+				PRIMARY KEY (user_id, day)
+			)`,
+			`CREATE INDEX IF NOT EXISTS interest_accruals_day ON interest_accruals (day)`,
+			`CREATE TABLE IF NOT EXISTS interest_payouts (
+				user_id integer NOT NULL,
+				month timestamp NOT NULL,
+				amount bigint NOT NULL,
+				transaction_id text NOT NULL DEFAULT '',
+				created_at timestamp NOT NULL,
+				PRIMARY KEY (user_id, month)
+			)`,
+		},
+		Down:  []string{`DROP TABLE IF EXISTS interest_payouts`, `DROP TABLE IF EXISTS interest_accruals`},
+		Check: `SELECT count(*) FROM interest_accruals`,
+	},
+	{
+		Version: 33,
+		Name:    "escrows",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS escrows (
+				id text PRIMARY KEY,
+				payer_id integer NOT NULL,
+				payee_id integer NOT NULL,
+				amount bigint NOT NULL,
+				tag text NOT NULL DEFAULT '',
+				status text NOT NULL,
+				on_timeout text NOT NULL,
+				expires_at timestamp NOT NULL,
+				reason text NOT NULL DEFAULT '',
+				transaction_id text NOT NULL,
+				settle_transaction_id text NOT NULL DEFAULT '',
+				created_by text NOT NULL DEFAULT '',
+				created_at timestamp NOT NULL,
+				settled_at timestamp
+			)`,
+			`CREATE INDEX IF NOT EXISTS escrows_status_expires_at ON escrows (status, expires_at)`,
+			`CREATE INDEX IF NOT EXISTS escrows_payer_id ON escrows (payer_id, created_at)`,
+			`CREATE INDEX IF NOT EXISTS escrows_payee_id ON escrows (payee_id, created_at)`,
+		},
+		Down:  []string{`DROP TABLE IF EXISTS escrows`},
+		Check: `SELECT count(*) FROM escrows WHERE status = 'held'`,
+	},
+	{
+		Version: 34,
+		Name:    "disputes",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS disputes (
+				id text PRIMARY KEY,
+				transaction_id text NOT NULL UNIQUE,
+				user_id integer NOT NULL,
+				amount bigint NOT NULL,
+				held bigint NOT NULL,
+				status text NOT NULL,
+				reason text NOT NULL DEFAULT '',
+				note text NOT NULL DEFAULT '',
+				hold_transaction_id text NOT NULL DEFAULT '',
+				release_transaction_id text NOT NULL DEFAULT '',
+				opened_by text NOT NULL DEFAULT '',
+				resolved_by text NOT NULL DEFAULT '',
+				created_at timestamp NOT NULL,
+				resolved_at timestamp
+			)`,
+			`CREATE INDEX IF NOT EXISTS disputes_user_id ON disputes (user_id, created_at)`,
+		},
+		Down:  []string{`DROP TABLE IF EXISTS disputes`},
+		Check: `SELECT count(*) FROM disputes WHERE status = 'open'`,
+	},
+	{
+		Version: 35,
+		Name:    "reversals",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS reversals (
+				transaction_id text PRIMARY KEY,
+				reversal_transaction_id text NOT NULL,
+				user_id integer NOT NULL,
+				amount bigint NOT NULL,
+				reason text NOT NULL DEFAULT '',
+				reversed_by text NOT NULL DEFAULT '',
+				created_at timestamp NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS reversals_user_id ON reversals (user_id, created_at)`,
+		},
+		Down:  []string{`DROP TABLE IF EXISTS reversals`},
+		Check: `SELECT count(*) FROM reversals`,
+	},
+	{
+		Version: 36,
+		Name:    "transaction_labels",
+		Up: []string{
+			`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS category text NOT NULL DEFAULT ''`,
+			`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS tags jsonb NOT NULL DEFAULT '[]'`,
+			`CREATE INDEX IF NOT EXISTS transactions_category ON transactions (category, created_at) WHERE category <> ''`,
+			// jsonb_path_ops - для фильтров tags @> '["trip"]'
+			`CREATE INDEX IF NOT EXISTS transactions_tags ON transactions USING gin (tags jsonb_path_ops)`,
+			// категория и теги списаний, которые ждут подтверждения или остатка средств
+			`ALTER TABLE approvals ADD COLUMN IF NOT EXISTS category text NOT NULL DEFAULT ''`,
+			`ALTER TABLE approvals ADD COLUMN IF NOT EXISTS tags jsonb NOT NULL DEFAULT '[]'`,
+			`ALTER TABLE pending_debits ADD COLUMN IF NOT EXISTS category text NOT NULL DEFAULT ''`,
+			`ALTER TABLE pending_debits ADD COLUMN IF NOT EXISTS tags jsonb NOT NULL DEFAULT '[]'`,
+		},
+		Down: []string{
+			`ALTER TABLE pending_debits DROP COLUMN IF EXISTS tags`,
+			`ALTER TABLE pending_debits DROP COLUMN IF EXISTS category`,
+			`ALTER TABLE approvals DROP COLUMN IF EXISTS tags`,
+			`ALTER TABLE approvals DROP COLUMN IF EXISTS category`,
+			`DROP INDEX IF EXISTS transactions_tags`,
+			`DROP INDEX IF EXISTS transactions_category`,
+			`ALTER TABLE transactions DROP COLUMN IF EXISTS tags`,
+			`ALTER TABLE transactions DROP COLUMN IF EXISTS category`,
+		},
+		Check: `SELECT count(*) FROM transactions WHERE category <> '' OR tags <> '[]'`,
+	},
+}
+
+// LatestVersion - версия схемы, которую знает этот бинарник
+func LatestVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// SchemaVersion - текущая версия схемы БД, 0 - миграции не применялись
+func SchemaVersion(db *dbr.Connection) (int, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version integer PRIMARY KEY, name text NOT NULL, applied_at timestamp NOT NULL)`); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := db.NewSession(nil).Select("COALESCE(MAX(version), 0)").From("schema_migrations").LoadOne(&version)
+	return version, err
+}
+
+// migrationLockKey - ключ advisory lock, под которым применяются миграции
+const migrationLockKey = 7120286
+
+// withMigrationLock - выполняет fn под advisory lock Postgres: при одновременном старте нескольких экземпляров
+// миграции применяет один, остальные ждут и затем видят уже примененную схему
+func withMigrationLock(db *dbr.Connection, fn func() error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+
+	return fn()
+}
+
+// MigrateUp - применяет недостающие миграции под advisory lock. Если схема новее бинарника (откат деплоя),
+// ничего не меняет: новые колонки и таблицы не мешают работе
+func MigrateUp(db *dbr.Connection) error {
+	return withMigrationLock(db, func() error {
+		return migrateUp(db)
+	})
+}
+
+func migrateUp(db *dbr.Connection) error {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if version > LatestVersion() {
+		log.Printf("schema version %d is newer than supported %d, running in compatibility mode", version, LatestVersion())
+		return nil
+	}
+
+	for _, m := range Migrations {
+		if m.Version <= version {
+			continue
+		}
+
+		if err := applyMigration(db, m, m.Up, func(tx *dbr.Tx) error {
+			_, err := tx.InsertInto("schema_migrations").Pair("version", m.Version).Pair("name", m.Name).Pair("applied_at", time.Now().UTC()).Exec()
+			return err
+		}); err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		log.Printf("schema migrated to %d %s", m.Version, m.Name)
+	}
+
+	// проверка: после применения (своего или другого экземпляра) схема должна быть актуальной
+	if version, err = SchemaVersion(db); err != nil {
+		return err
+	}
+	if version < LatestVersion() {
+		return fmt.Errorf("schema version %d after migration, expected %d", version, LatestVersion())
+	}
+
+	return nil
+}
+
+// MigrateDown - откатывает миграции до версии to включительно (остается to).
+// Перед откатом каждой миграции выполняется Check, и если данные будут потеряны - ErrDataLoss, если не задан force.
+// Схему новее бинарника откатить нельзя: этот бинарник не знает ее Down
+func MigrateDown(db *dbr.Connection, to int, force bool) error {
+	return withMigrationLock(db, func() error {
+		return migrateDown(db, to, force)
+	})
+}
+
+func migrateDown(db *dbr.Connection, to int, force bool) error {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if version > LatestVersion() {
+		return fmt.Errorf("schema version %d is newer than supported %d, roll back with the binary that applied it", version, LatestVersion())
+	}
+
+	if to < 0 {
+		return errors.New("invalid target version")
+	}
+
+	for i := len(Migrations) - 1; i >= 0; i-- {
+		m := Migrations[i]
+		if m.Version > version || m.Version <= to {
+			continue
+		}
+
+		if m.Check != "" && !force {
+			var rows int
+			if err := db.QueryRow(m.Check).Scan(&rows); err != nil {
+				return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+			}
+			if rows > 0 {
+				return fmt.Errorf("migration %d %s: %w (%d rows)", m.Version, m.Name, ErrDataLoss, rows)
+			}
+		}
+
+		if err := applyMigration(db, m, m.Down, func(tx *dbr.Tx) error {
+			_, err := tx.DeleteFrom("schema_migrations").Where("version = ?", m.Version).Exec()
+			return err
+		}); err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		log.Printf("schema rolled back from %d %s", m.Version, m.Name)
+	}
+
+	return nil
+}
+
+// applyMigration - выполняет запросы миграции и отметку о ней в одной транзакции
+func applyMigration(db *dbr.Connection, m Migration, queries []string, mark func(tx *dbr.Tx) error) error {
+	tx, err := db.NewSession(nil).Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	for _, q := range queries {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+
+	if err := mark(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
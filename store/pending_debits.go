@@ -0,0 +1,81 @@
+package store
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// политики списания при нехватке средств
+const (
+	// FundsReject - списание отклоняется целиком (ErrNotEnoughMoney)
+	FundsReject = "reject"
+	// FundsPartial - списывается сколько есть, до нуля или кредитного лимита
+	FundsPartial = "partial"
+	// FundsQueue - списывается сколько есть, остаток ждет в pending_debits и списывается при поступлении средств
+	FundsQueue = "queue"
+)
+
+// FundsPolicyKey - ключ метаданных пользователя с его политикой при нехватке средств, пусто - FundsReject
+const FundsPolicyKey = "insufficient_funds"
+
+// ValidFundsPolicy - известная политика при нехватке средств
+func ValidFundsPolicy(policy string) bool {
+	switch policy {
+	case FundsReject, FundsPartial, FundsQueue:
+		return true
+	}
+	return false
+}
+
+// PendingDebit - остаток списания, которое ждет поступления средств (FundsQueue)
+type PendingDebit struct {
+	ID     string `db:"id" json:"id"`
+	UserID int    `db:"user_id" json:"user_id"`
+	// Amount - сколько еще осталось списать
+	Amount int    `db:"amount" json:"amount"`
+	Tag    string `db:"tag" json:"tag,omitempty"`
+	// Category, Tags - категория и теги списания, см. Transaction
+	Category  string    `db:"category" json:"category,omitempty"`
+	Tags      Tags      `db:"tags" json:"tags,omitempty"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+var pendingDebitColumns = []string{"id", "user_id", "amount", "tag", "category", "tags", "created_at"}
+
+// CreatePendingDebit - сохраняет остаток списания в очередь
+func CreatePendingDebit(ctx context.Context, sess *dbr.Session, d PendingDebit) error {
+	_, err := sess.InsertInto("pending_debits").Columns(pendingDebitColumns...).
+		Values(d.ID, d.UserID, d.Amount, d.Tag, d.Category, d.Tags, d.CreatedAt).ExecContext(ctx)
+	return err
+}
+
+// LoadPendingDebits - ожидающие списания пользователя, старые первыми
+func LoadPendingDebits(ctx context.Context, sess *dbr.Session, userID int) ([]PendingDebit, error) {
+	var debits []PendingDebit
+	_, err := sess.Select(pendingDebitColumns...).From("pending_debits").Where("user_id = ?", userID).
+		OrderBy("created_at").LoadContext(ctx, &debits)
+	return debits, err
+}
+
+// ClaimPendingDebit - забирает ожидающее списание из очереди, чтобы его выполнил только один экземпляр.
+// false - его уже забрал кто-то другой. Невыполненный остаток возвращается в очередь через CreatePendingDebit
+func ClaimPendingDebit(ctx context.Context, sess *dbr.Session, id string) (bool, error) {
+	res, err := sess.DeleteFrom("pending_debits").Where("id = ?", id).ExecContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows > 0, err
+}
+
+// available - сколько из amount можно списать сейчас, не опуская баланс ниже floor, вызывается под блокировкой
+func (u *User) available(amount int, floor int64) int {
+	room := atomic.LoadInt64(&u.Balance) - floor
+	if room < int64(amount) {
+		return int(room)
+	}
+	return amount
+}
@@ -0,0 +1,9 @@
+package store
+
+import "time"
+
+// MonthStart - начало календарного месяца UTC, в котором лежит t: месяц лимитов кешбэка и выплаты процентов
+func MonthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/gocraft/dbr/v2/dialect"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// PgxPoolConfig - настройки пула соединений pgx, нулевые значения - из строки подключения (pool_max_conns и т.д.)
+// или умолчания pgxpool
+type PgxPoolConfig struct {
+	MinConns int32
+	MaxConns int32
+	// MaxConnLifetime - соединение старше закрывается и открывается заново
+	MaxConnLifetime time.Duration
+	// MaxConnIdleTime - простаивающее дольше соединение закрывает проверка здоровья
+	MaxConnIdleTime time.Duration
+	// HealthCheckPeriod - как часто пул проверяет простаивающие соединения и добирает MinConns
+	HealthCheckPeriod time.Duration
+}
+
+// OpenPgx - подключение к Postgres через пул pgx. dbr работает поверх пула через database/sql,
+// Close соединения закрывает и пул
+func OpenPgx(ctx context.Context, dsn string, cfg PgxPoolConfig) (*dbr.Connection, error) {
+	poolCfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MinConns > 0 {
+		poolCfg.MinConns = cfg.MinConns
+	}
+	if cfg.MaxConns > 0 {
+		poolCfg.MaxConns = cfg.MaxConns
+	}
+	if cfg.MaxConnLifetime > 0 {
+		poolCfg.MaxConnLifetime = cfg.MaxConnLifetime
+	}
+	if cfg.MaxConnIdleTime > 0 {
+		poolCfg.MaxConnIdleTime = cfg.MaxConnIdleTime
+	}
+	if cfg.HealthCheckPeriod > 0 {
+		poolCfg.HealthCheckPeriod = cfg.HealthCheckPeriod
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// простаивающими соединениями управляет пул pgx, см. stdlib.OpenDBFromPool
+	db := sql.OpenDB(poolConnector{Connector: stdlib.GetPoolConnector(pool), pool: pool})
+	db.SetMaxIdleConns(0)
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &dbr.Connection{DB: db, Dialect: dialect.PostgreSQL, EventReceiver: &dbr.NullEventReceiver{}}, nil
+}
+
+// poolConnector - закрывает пул вместе с sql.DB
+type poolConnector struct {
+	driver.Connector
+	pool *pgxpool.Pool
+}
+
+func (c poolConnector) Close() error {
+	c.pool.Close()
+	return nil
+}
+
+// pgxCopy - COPY через pgx, если соединение открыто драйвером pgx; ok=false - драйвер другой
+func pgxCopy(ctx context.Context, conn *sql.Conn, table string, columns []string, n int, row func(i int) []interface{}) (ok bool, err error) {
+	err = conn.Raw(func(dc interface{}) error {
+		c, isPgx := dc.(*stdlib.Conn)
+		if !isPgx {
+			return nil
+		}
+		ok = true
+
+		_, err := c.Conn().CopyFrom(ctx, pgx.Identifier{table}, columns, pgx.CopyFromSlice(n, func(i int) ([]interface{}, error) {
+			return row(i), nil
+		}))
+		return err
+	})
+	return ok, err
+}
@@ -0,0 +1,170 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync/atomic"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// PocketMain - основной карман: часть баланса вне именованных карманов, с него идут списания без кармана
+const PocketMain = "main"
+
+// ErrInvalidPocket - имя кармана в недопустимом формате
+var ErrInvalidPocket = errors.New("invalid pocket: up to 64 chars of a-z, 0-9, '_', '-', '.'")
+
+// ErrSamePocket - перевод из кармана в него же
+var ErrSamePocket = errors.New("cannot transfer to the same pocket")
+
+// ErrPocketNeedsSave - операции с именованными карманами сохраняются только синхронно, см. Pending.PocketDelta
+var ErrPocketNeedsSave = errors.New("pocket operations must be saved synchronously")
+
+// Pocket - именованный карман пользователя в таблице pockets
+type Pocket struct {
+	Name    string `db:"name" json:"name"`
+	Balance int64  `db:"balance" json:"balance"`
+}
+
+// ValidatePocket - имя кармана в формате тега, не пустое
+func ValidatePocket(name string) error {
+	if name == "" || ValidateTag(name) != nil {
+		return ErrInvalidPocket
+	}
+	return nil
+}
+
+// PocketDelta - изменение суммы именованных карманов (User.Pocketed) по записям Transactions.
+// Записи карманов попадают в Pending только через синхронное сохранение, поэтому пакетные пути
+// сохранения их не учитывают
+func (p Pending) PocketDelta() int64 {
+	var delta int64
+	for name, d := range pocketDeltas(p.Transactions) {
+		if name != PocketMain {
+			delta += d
+		}
+	}
+	return delta
+}
+
+// pocketDeltas - изменения карманов по записям OperationPocketOut и OperationPocketIn, Tag которых - имя кармана
+func pocketDeltas(txs []Transaction) map[string]int64 {
+	var deltas map[string]int64
+	for _, tx := range txs {
+		if tx.Operation != OperationPocketOut && tx.Operation != OperationPocketIn {
+			continue
+		}
+		if deltas == nil {
+			deltas = make(map[string]int64)
+		}
+		deltas[tx.Tag] += int64(tx.Amount)
+	}
+	return deltas
+}
+
+// pocketTransactions - перевод amount из кармана from в карман to парой записей, в сумме ноль
+func pocketTransactions(userID int, from, to string, amount int) []Transaction {
+	out := newTransaction(userID, -amount, OperationPocketOut, from)
+	in := newTransaction(userID, amount, OperationPocketIn, to)
+	in.CreatedAt = out.CreatedAt
+	return []Transaction{out, in}
+}
+
+// savePockets - применяет к таблице pockets изменения карманов по записям txs внутри транзакции savePending.
+// Карман не уходит в минус: если в нем не хватает средств, ErrNotEnoughMoney и транзакция откатывается
+func savePockets(ctx context.Context, tx *dbr.Tx, userID int, txs []Transaction) error {
+	deltas := pocketDeltas(txs)
+	names := make([]string, 0, len(deltas))
+	for name := range deltas {
+		if name != PocketMain && deltas[name] != 0 {
+			names = append(names, name)
+		}
+	}
+	// одинаковый порядок блокировки строк у параллельных переводов
+	sort.Strings(names)
+
+	for _, name := range names {
+		delta := deltas[name]
+		if delta > 0 {
+			_, err := tx.InsertBySql(`INSERT INTO pockets (user_id, name, balance) VALUES (?, ?, ?)
+				ON CONFLICT (user_id, name) DO UPDATE SET balance = pockets.balance + excluded.balance`,
+				userID, name, delta).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		res, err := tx.Update("pockets").Set("balance", dbr.Expr("balance + ?", delta)).
+			Where("user_id = ? AND name = ? AND balance >= ?", userID, name, -delta).ExecContext(ctx)
+		if err != nil {
+			return err
+		}
+		if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+			return ErrNotEnoughMoney
+		}
+	}
+	return nil
+}
+
+// LoadPockets - именованные карманы пользователя по имени, пустые тоже
+func LoadPockets(ctx context.Context, sess *dbr.Session, userID int) ([]Pocket, error) {
+	var pockets []Pocket
+	_, err := sess.Select("name", "balance").From("pockets").Where("user_id = ?", userID).
+		OrderBy("name").LoadContext(ctx, &pockets)
+	return pockets, err
+}
+
+// TransferPocket - переводит amount между карманами пользователя со всеми шагами opts под его блокировкой.
+// Баланс не меняется, поэтому максимальный баланс не проверяется. Из основного кармана переводится не больше,
+// чем в нем есть без кредитного лимита, именованный карман проверяется при сохранении, поэтому opts.Save обязателен.
+// Возвращает пару записей перевода
+func (u *User) TransferPocket(from, to string, amount int, opts CreditOptions) ([]Transaction, error) {
+	txs, err := u.transferPocket(from, to, amount, opts)
+	if err == nil && opts.Mark != nil {
+		opts.Mark(u)
+	}
+	return txs, err
+}
+
+func (u *User) transferPocket(from, to string, amount int, opts CreditOptions) ([]Transaction, error) {
+	if err := ValidatePocket(from); err != nil {
+		return nil, err
+	}
+	if err := ValidatePocket(to); err != nil {
+		return nil, err
+	}
+	if from == to {
+		return nil, ErrSamePocket
+	}
+	if opts.Save == nil {
+		return nil, ErrPocketNeedsSave
+	}
+
+	l := u.lock()
+	l.Lock()
+	defer l.Unlock()
+
+	if err := u.checkState(); err != nil {
+		return nil, err
+	}
+	if from == PocketMain && atomic.LoadInt64(&u.Balance)-atomic.LoadInt64(&u.Pocketed) < int64(amount) {
+		return nil, ErrNotEnoughMoney
+	}
+	if opts.Check != nil {
+		if err := opts.Check(u); err != nil {
+			return nil, err
+		}
+	}
+
+	txs := pocketTransactions(u.ID, from, to, amount)
+	p := Pending{Transactions: txs}
+	if err := opts.Save(p); err != nil {
+		return nil, err
+	}
+	u.savedLocked(p)
+	atomic.AddInt64(&u.Pocketed, p.PocketDelta())
+	u.UpdatedAt = txs[0].CreatedAt
+	return txs, nil
+}
@@ -0,0 +1,377 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/gocraft/dbr/v2/dialect"
+	_ "github.com/lib/pq"
+)
+
+// Open - подключение к базе
+func Open(psqlInfo string) (*dbr.Connection, error) {
+	db, err := dbr.Open("postgres", psqlInfo, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// PoolConfig - настройки пула соединений database/sql
+type PoolConfig struct {
+	// MaxOpenConns - максимум открытых соединений, 0 - без ограничения
+	MaxOpenConns int
+	// MaxIdleConns - сколько соединений держать открытыми без дела, чтобы не переоткрывать их под нагрузкой
+	MaxIdleConns int
+	// ConnMaxLifetime - соединение старше закрывается и открывается заново, 0 - без ограничения
+	ConnMaxLifetime time.Duration
+}
+
+// Apply - применяет настройки к соединению
+func (c PoolConfig) Apply(db *dbr.Connection) {
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	db.SetMaxIdleConns(c.MaxIdleConns)
+	db.SetConnMaxLifetime(c.ConnMaxLifetime)
+}
+
+// WithStatementTimeout - добавляет к строке подключения statement_timeout: сервер сам прерывает запросы дольше d,
+// даже если клиент не отменил контекст. Работает для lib/pq и pgx, оба передают параметр серверу при подключении
+func WithStatementTimeout(dsn string, d time.Duration) string {
+	if d <= 0 {
+		return dsn
+	}
+	ms := strconv.FormatInt(d.Milliseconds(), 10)
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		if u, err := url.Parse(dsn); err == nil {
+			q := u.Query()
+			q.Set("statement_timeout", ms)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+		return dsn
+	}
+	return strings.TrimSpace(dsn + " statement_timeout=" + ms)
+}
+
+// InitSchema - применение миграций
+func InitSchema(db *dbr.Connection) error {
+	return MigrateUp(db)
+}
+
+// ResetData - удаляет всех пользователей, только для разработки
+func ResetData(db *dbr.Connection) error {
+	truncate := `TRUNCATE USERS`
+	if db.Dialect == dialect.SQLite3 {
+		truncate = `DELETE FROM users`
+	}
+	_, err := db.Exec(truncate)
+	return err
+}
+
+// seedBatchSize - пользователей в одном INSERT при заполнении
+const seedBatchSize = 1000
+
+// Seed - создает count пользователей с балансом balance, если таблица users пуста, иначе ничего не делает.
+// Возвращает количество созданных пользователей
+func Seed(db *dbr.Connection, count int, balance int64) (int, error) {
+	tx, err := db.NewSession(nil).Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	var ids []int
+	if _, err := tx.Select("id").From("users").Limit(1).Load(&ids); err != nil {
+		return 0, err
+	}
+	if len(ids) > 0 {
+		return 0, nil
+	}
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	for start := 0; start < count; start += seedBatchSize {
+		stmt := tx.InsertInto("users").Columns("balance", "created_at", "updated_at")
+		for i := start; i < count && i < start+seedBatchSize; i++ {
+			stmt.Values(balance, now, now)
+		}
+		var ids []int
+		if err := stmt.Returning("id").Load(&ids); err != nil {
+			return 0, err
+		}
+		balances := make(map[int]int64, len(ids))
+		for _, id := range ids {
+			balances[id] = balance
+		}
+		if err := insertTransactions(context.Background(), tx, openingTransactions(balances, now)); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// LoadUser - читает пользователя из БД, nil без ошибки если такого нет
+func LoadUser(ctx context.Context, sess *dbr.Session, id int) (*User, error) {
+	user := &User{}
+	rowsCount, err := sess.Select(UserColumns...).From("users").Where("id = ?", id).LoadContext(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if rowsCount == 0 {
+		return nil, nil
+	}
+
+	return user.loaded(), nil
+}
+
+// LoadUsers - читает пользователей по списку id, отсутствующие пропускаются
+func LoadUsers(ctx context.Context, sess *dbr.Session, ids []int) ([]*User, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var users []*User
+	_, err := sess.Select(UserColumns...).From("users").Where("id IN ?", ids).LoadContext(ctx, &users)
+	for _, u := range users {
+		u.loaded()
+	}
+	return users, err
+}
+
+// RecentUserIDs - до limit пользователей с самыми недавними операциями в леджере, без удаленных
+func RecentUserIDs(ctx context.Context, sess *dbr.Session, limit int) ([]int, error) {
+	var ids []int
+	_, err := sess.Select("user_id").From("transactions").
+		Where("user_id NOT IN (SELECT id FROM users WHERE status = ?)", StatusDeleted).GroupBy("user_id").
+		OrderDesc("MAX(created_at)").Limit(uint64(limit)).LoadContext(ctx, &ids)
+	return ids, err
+}
+
+// UserVersion - версия строки пользователя и время ее последней записи
+type UserVersion struct {
+	ID        int       `db:"id"`
+	Version   int64     `db:"version"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// ChangedUsers - до limit последних пользователей, строки которых записаны не раньше since, от новых к старым
+func ChangedUsers(ctx context.Context, sess *dbr.Session, since time.Time, limit int) ([]UserVersion, error) {
+	var rows []UserVersion
+	_, err := sess.Select("id", "version", "updated_at").From("users").Where("updated_at >= ?", since.UTC()).
+		OrderDesc("updated_at").Limit(uint64(limit)).LoadContext(ctx, &rows)
+	return rows, err
+}
+
+// SavePending - в одной транзакции применяет изменение баланса (balance = balance + delta) и пишет записи леджера.
+// Такие записи коммутативны, поэтому параллельные писатели не затирают друг друга.
+// Вместе с ними сохраняется seq последней вошедшей записи журнала (0 - без журнала)
+func SavePending(ctx context.Context, sess *dbr.Session, userID int, p Pending) error {
+	tx, err := sess.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	if err := savePending(ctx, tx, userID, p); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// savePending - SavePending внутри уже открытой транзакции.
+// Изменения с seq журнала, который уже применен к пользователю, пропускаются, поэтому повторное сохранение безопасно.
+// С p.Version изменения применяются, только если версия строки та же, иначе - VersionConflict
+func savePending(ctx context.Context, tx *dbr.Tx, userID int, p Pending) error {
+	stmt := tx.Update("users").
+		Set("balance", dbr.Expr("balance + ?", p.Delta)).
+		Set("bonus", dbr.Expr("bonus + ?", p.BonusDelta())).
+		Set("pocketed", dbr.Expr("pocketed + ?", p.PocketDelta())).
+		Set("journal_seq", dbr.Expr(greatest(tx.Dialect)+"(journal_seq, ?)", p.Seq)).
+		Set("version", dbr.Expr("version + 1")).
+		Set("updated_at", dbr.Now).
+		Where("id = ?", userID)
+	if p.Seq > 0 {
+		stmt.Where("journal_seq < ?", p.Seq)
+	}
+	if p.Version > 0 {
+		stmt.Where("version = ?", p.Version)
+	}
+
+	res, err := stmt.ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		if p.Version > 0 {
+			return versionConflict(ctx, tx, userID, p)
+		}
+		return nil
+	}
+
+	if err := savePockets(ctx, tx, userID, p.Transactions); err != nil {
+		return err
+	}
+	return insertTransactions(ctx, tx, p.Transactions)
+}
+
+// versionConflict - почему версионное обновление не затронуло строку: ее нет или seq журнала уже применен
+// (тогда nil, как и без версии), иначе строку изменил другой писатель
+func versionConflict(ctx context.Context, tx *dbr.Tx, userID int, p Pending) error {
+	var row struct {
+		Balance     int64  `db:"balance"`
+		Bonus       int64  `db:"bonus"`
+		Pocketed    int64  `db:"pocketed"`
+		CreditLimit int64  `db:"credit_limit"`
+		MaxBalance  int64  `db:"max_balance"`
+		Frozen      bool   `db:"frozen"`
+		Status      string `db:"status"`
+		Version     int64  `db:"version"`
+		JournalSeq  int64  `db:"journal_seq"`
+	}
+	n, err := tx.Select("balance", "bonus", "pocketed", "credit_limit", "max_balance", "frozen", "status", "version", "journal_seq").From("users").
+		Where("id = ?", userID).LoadContext(ctx, &row)
+	if err != nil {
+		return err
+	}
+	if n == 0 || (p.Seq > 0 && row.JournalSeq >= p.Seq) {
+		return nil
+	}
+	return &VersionConflict{UserID: userID, Balance: row.Balance, Bonus: row.Bonus, Pocketed: row.Pocketed, CreditLimit: row.CreditLimit, MaxBalance: row.MaxBalance, Frozen: row.Frozen,
+		Status: row.Status, Version: row.Version}
+}
+
+// UserPending - несохраненные изменения конкретного пользователя для пакетного сохранения
+type UserPending struct {
+	UserID  int
+	Pending Pending
+}
+
+// SavePendingBatch - сохраняет изменения многих пользователей одной транзакцией:
+// балансы одним UPDATE ... FROM (VALUES ...), записи леджера одним multi-row INSERT.
+// Как и SavePending, пропускает изменения с уже примененным seq журнала
+func SavePendingBatch(ctx context.Context, sess *dbr.Session, batch []UserPending) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	tx, err := sess.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	var query strings.Builder
+	args := make([]interface{}, 0, len(batch)*5+1)
+	args = append(args, dbr.Now)
+	query.WriteString(`UPDATE users AS u SET balance = u.balance + v.delta, bonus = u.bonus + v.bonus, journal_seq = GREATEST(u.journal_seq, v.seq), version = u.version + 1, ` +
+		`updated_at = ? FROM (VALUES `)
+	for i, item := range batch {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString("(?::integer, ?::bigint, ?::bigint, ?::bigint, ?::bigint)")
+		args = append(args, item.UserID, item.Pending.Delta, item.Pending.BonusDelta(), item.Pending.Seq, item.Pending.Version)
+	}
+	query.WriteString(`) AS v(id, delta, bonus, seq, version) WHERE u.id = v.id AND (v.seq = 0 OR u.journal_seq < v.seq) ` +
+		`AND (v.version = 0 OR u.version = v.version) RETURNING u.id`)
+
+	var updated []int
+	if _, err := tx.SelectBySql(query.String(), args...).LoadContext(ctx, &updated); err != nil {
+		return err
+	}
+
+	applied, err := checkBatchVersions(batch, updated)
+	if err != nil {
+		return err
+	}
+
+	var txs []Transaction
+	for _, item := range batch {
+		if applied[item.UserID] {
+			txs = append(txs, item.Pending.Transactions...)
+		}
+	}
+
+	if err := insertTransactions(ctx, tx, txs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// checkBatchVersions - id, обновленные пачкой. Пропущенный пользователь с версией может быть конфликтом,
+// тогда пачка откатывается с ErrVersionConflict, и фоновое сохранение разбирается с ними по одному
+func checkBatchVersions(batch []UserPending, updated []int) (map[int]bool, error) {
+	applied := make(map[int]bool, len(updated))
+	for _, id := range updated {
+		applied[id] = true
+	}
+	for _, item := range batch {
+		if !applied[item.UserID] && item.Pending.Version > 0 {
+			return nil, fmt.Errorf("user %d: %w", item.UserID, ErrVersionConflict)
+		}
+	}
+	return applied, nil
+}
+
+// insertTransactions - пишет записи леджера одним запросом и их проводки вторым
+func insertTransactions(ctx context.Context, tx *dbr.Tx, txs []Transaction) error {
+	if len(txs) == 0 {
+		return nil
+	}
+
+	stmt := tx.InsertInto("transactions").Columns(TransactionColumns...)
+	for i := range txs {
+		stmt.Record(&txs[i])
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return err
+	}
+	return insertLedgerEntries(ctx, tx, ledgerEntries(txs))
+}
+
+// insertLedgerEntries - пишет проводки одним запросом
+func insertLedgerEntries(ctx context.Context, tx *dbr.Tx, entries []LedgerEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	stmt := tx.InsertInto("ledger_entries").Columns(LedgerEntryColumns...)
+	for i := range entries {
+		stmt.Record(&entries[i])
+	}
+	_, err := stmt.ExecContext(ctx)
+	return err
+}
+
+// greatest - функция максимума из двух значений: GREATEST в Postgres, скалярный MAX в SQLite
+func greatest(d dbr.Dialect) string {
+	if d == dialect.SQLite3 {
+		return "MAX"
+	}
+	return "GREATEST"
+}
+
+// JournalSeq - seq последней записи журнала, примененной к пользователю в БД
+func JournalSeq(ctx context.Context, sess *dbr.Session, userID int) (int64, error) {
+	var seq int64
+	err := sess.Select("journal_seq").From("users").Where("id = ?", userID).LoadOneContext(ctx, &seq)
+	return seq, err
+}
@@ -0,0 +1,213 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/gocraft/dbr/v2/dialect"
+)
+
+// ошибки погашения промокода
+var (
+	// ErrPromoNotFound - промокода нет
+	ErrPromoNotFound = errors.New("promo code not found")
+	// ErrPromoInactive - срок действия промокода еще не начался или уже закончился
+	ErrPromoInactive = errors.New("promo code is not active")
+	// ErrPromoExhausted - использования промокода закончились
+	ErrPromoExhausted = errors.New("promo code is exhausted")
+	// ErrPromoRedeemed - пользователь уже погасил этот промокод
+	ErrPromoRedeemed = errors.New("promo code is already redeemed by this user")
+	// ErrPromoExists - промокод с таким кодом уже есть
+	ErrPromoExists = errors.New("promo code already exists")
+)
+
+var promoCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{1,64}$`)
+
+// PromoCode - промокод на пополнение Amount: гасится не больше MaxUses раз (0 - без ограничения), каждым
+// пользователем один раз, с ValidFrom до ValidUntil (nil - бессрочно)
+type PromoCode struct {
+	Code       string     `db:"code" json:"code"`
+	Amount     int        `db:"amount" json:"amount"`
+	Tag        string     `db:"tag" json:"tag,omitempty"`
+	MaxUses    int        `db:"max_uses" json:"max_uses"`
+	Uses       int        `db:"uses" json:"uses"`
+	ValidFrom  time.Time  `db:"valid_from" json:"valid_from"`
+	ValidUntil *time.Time `db:"valid_until" json:"valid_until,omitempty"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+}
+
+var promoCodeColumns = []string{"code", "amount", "tag", "max_uses", "uses", "valid_from", "valid_until", "created_at"}
+
+// NormalizePromoCode - промокоды не различают регистр и хранятся в верхнем
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Validate - код из A-Z, 0-9, '_', '-', сумма и ограничения не отрицательные, срок не пустой
+func (p PromoCode) Validate() error {
+	if !promoCodePattern.MatchString(p.Code) {
+		return errors.New("invalid code: up to 64 chars of A-Z, 0-9, '_', '-'")
+	}
+	if p.Amount < 1 {
+		return errors.New("invalid amount")
+	}
+	if p.MaxUses < 0 {
+		return errors.New("max_uses must not be negative")
+	}
+	if p.ValidUntil != nil && !p.ValidUntil.After(p.ValidFrom) {
+		return errors.New("valid_until must be after valid_from")
+	}
+	return ValidateTag(p.Tag)
+}
+
+// active - промокод действует в момент now
+func (p PromoCode) active(now time.Time) bool {
+	return !now.Before(p.ValidFrom) && (p.ValidUntil == nil || now.Before(*p.ValidUntil))
+}
+
+// CreatePromoCode - сохраняет новый промокод, ErrPromoExists если код занят
+func CreatePromoCode(ctx context.Context, sess *dbr.Session, p PromoCode) error {
+	if _, err := LoadPromoCode(ctx, sess, p.Code); err == nil {
+		return ErrPromoExists
+	} else if !errors.Is(err, ErrPromoNotFound) {
+		return err
+	}
+
+	_, err := sess.InsertInto("promo_codes").Columns(promoCodeColumns...).
+		Values(p.Code, p.Amount, p.Tag, p.MaxUses, 0, p.ValidFrom.UTC(), utcPtr(p.ValidUntil), p.CreatedAt).ExecContext(ctx)
+	return err
+}
+
+// LoadPromoCode - промокод по коду, ErrPromoNotFound если его нет
+func LoadPromoCode(ctx context.Context, sess *dbr.Session, code string) (PromoCode, error) {
+	var p PromoCode
+	err := sess.Select(promoCodeColumns...).From("promo_codes").Where("code = ?", code).LoadOneContext(ctx, &p)
+	if errors.Is(err, dbr.ErrNotFound) {
+		return p, ErrPromoNotFound
+	}
+	return p, err
+}
+
+// ListPromoCodes - все промокоды, новые первыми
+func ListPromoCodes(ctx context.Context, sess *dbr.Session) ([]PromoCode, error) {
+	var codes []PromoCode
+	_, err := sess.Select(promoCodeColumns...).From("promo_codes").OrderDesc("created_at").LoadContext(ctx, &codes)
+	return codes, err
+}
+
+// DeletePromoCode - удаляет промокод, погашения остаются. ErrPromoNotFound если его нет
+func DeletePromoCode(ctx context.Context, sess *dbr.Session, code string) error {
+	res, err := sess.DeleteFrom("promo_codes").Where("code = ?", code).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return ErrPromoNotFound
+	}
+	return nil
+}
+
+// RedeemPromoCode - гасит промокод code пользователем u: пополнение на сумму промокода с его тегом, использование
+// промокода и запись о погашении пишутся одной транзакцией SQL хранилища под блокировкой пользователя,
+// поэтому пополнение без погашения и погашение без пополнения невозможны. opts.Save и opts.Journal заменяются
+func RedeemPromoCode(ctx context.Context, sess *dbr.Session, u *User, code string, opts CreditOptions) (Transaction, PromoCode, error) {
+	promo, err := LoadPromoCode(ctx, sess, code)
+	if err != nil {
+		return Transaction{}, promo, err
+	}
+	now := time.Now().UTC()
+	if !promo.active(now) {
+		return Transaction{}, promo, ErrPromoInactive
+	}
+
+	opts.Tag, opts.Partial, opts.Journal = promo.Tag, false, nil
+	opts.Save = saveWith(ctx, sess, u.ID, func(tx *dbr.Tx, p Pending) error {
+		return burnPromoCode(ctx, tx, promo.Code, u.ID, p.Transactions[0].ID, now)
+	})
+
+	t, err := u.ApplyCredit(promo.Amount, opts)
+	if err == nil {
+		promo.Uses++
+	}
+	return t, promo, err
+}
+
+// burnPromoCode - забирает одно использование промокода и записывает погашение пользователем userID
+func burnPromoCode(ctx context.Context, tx *dbr.Tx, code string, userID int, transactionID string, now time.Time) error {
+	var redeemed int
+	err := tx.Select("COUNT(*)").From("promo_redemptions").Where("code = ? AND user_id = ?", code, userID).
+		LoadOneContext(ctx, &redeemed)
+	if err != nil {
+		return err
+	}
+	if redeemed > 0 {
+		return ErrPromoRedeemed
+	}
+
+	res, err := tx.Update("promo_codes").Set("uses", dbr.Expr("uses + 1")).
+		Where("code = ? AND (max_uses = 0 OR uses < max_uses)", code).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return ErrPromoExhausted
+	}
+
+	_, err = tx.InsertInto("promo_redemptions").Columns("code", "user_id", "transaction_id", "created_at").
+		Values(code, userID, transactionID, now).ExecContext(ctx)
+	return err
+}
+
+// saveWith - синхронное сохранение изменений userID, при котором step выполняется в той же транзакции
+// SQL хранилища до них: ошибка step откатывает и изменения
+func saveWith(ctx context.Context, sess *dbr.Session, userID int, step func(tx *dbr.Tx, p Pending) error) func(p Pending) error {
+	return func(p Pending) error {
+		tx, err := sess.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.RollbackUnlessCommitted()
+
+		if err := step(tx, p); err != nil {
+			return err
+		}
+		if err := savePending(ctx, tx, userID, p); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+}
+
+// lockUserRow - блокирует строку пользователя userID до конца транзакции tx, чтобы проверки в ней не разошлись
+// с параллельными экземплярами. В SQLite писатель и так один, блокировка строк не нужна
+func lockUserRow(ctx context.Context, tx *dbr.Tx, userID int) error {
+	if tx.Dialect == dialect.SQLite3 {
+		return nil
+	}
+	var ids []int
+	_, err := tx.Select("id").From("users").Where("id = ?", userID).Suffix("FOR UPDATE").LoadContext(ctx, &ids)
+	return err
+}
+
+// pendingTransaction - запись операции operation из p: перед списанием в p могут быть записи переноса бонусов
+func pendingTransaction(p Pending, operation string) Transaction {
+	for _, t := range p.Transactions {
+		if t.Operation == operation {
+			return t
+		}
+	}
+	return Transaction{}
+}
+
+// utcPtr - t в UTC, nil остается nil
+func utcPtr(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
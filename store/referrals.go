@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// TagReferral - тег пополнений за приглашение
+const TagReferral = "referral"
+
+// стороны приглашения
+const (
+	ReferralReferrer = "referrer"
+	ReferralReferee  = "referee"
+)
+
+// ErrReferralExists - приглашенного уже пригласил другой пользователь
+var ErrReferralExists = errors.New("user is already referred by another user")
+
+// ErrSelfReferral - пользователь не может пригласить сам себя
+var ErrSelfReferral = errors.New("user cannot refer itself")
+
+// errReferralPaid - сторона приглашения уже получила выплату, см. PayReferral
+var errReferralPaid = errors.New("referral is already paid")
+
+// Referral - приглашение RefereeID пользователем ReferrerID. Каждого пользователя приглашают один раз,
+// ReferrerTransactionID и RefereeTransactionID - выплаты сторонам, пусто - еще не выплачено
+type Referral struct {
+	RefereeID             int       `db:"referee_id" json:"referee_id"`
+	ReferrerID            int       `db:"referrer_id" json:"referrer_id"`
+	ReferrerTransactionID string    `db:"referrer_transaction_id" json:"referrer_transaction_id,omitempty"`
+	RefereeTransactionID  string    `db:"referee_transaction_id" json:"referee_transaction_id,omitempty"`
+	CreatedAt             time.Time `db:"created_at" json:"created_at"`
+}
+
+var referralColumns = []string{"referee_id", "referrer_id", "referrer_transaction_id", "referee_transaction_id", "created_at"}
+
+// TransactionID - выплата стороне side, пусто - еще не выплачено
+func (r Referral) TransactionID(side string) string {
+	if side == ReferralReferrer {
+		return r.ReferrerTransactionID
+	}
+	return r.RefereeTransactionID
+}
+
+// UserID - пользователь стороны side
+func (r Referral) UserID(side string) int {
+	if side == ReferralReferrer {
+		return r.ReferrerID
+	}
+	return r.RefereeID
+}
+
+// RegisterReferral - сохраняет приглашение refereeID пользователем referrerID. Повтор того же приглашения
+// возвращает уже сохраненное со сделанными выплатами, приглашение другим пользователем - ErrReferralExists
+func RegisterReferral(ctx context.Context, sess *dbr.Session, referrerID, refereeID int) (Referral, error) {
+	if referrerID == refereeID {
+		return Referral{}, ErrSelfReferral
+	}
+
+	r := Referral{RefereeID: refereeID, ReferrerID: referrerID, CreatedAt: time.Now().UTC().Truncate(time.Microsecond)}
+	_, err := sess.InsertBySql(`INSERT INTO referrals (referee_id, referrer_id, referrer_transaction_id, referee_transaction_id, created_at)
+		VALUES (?, ?, '', '', ?) ON CONFLICT (referee_id) DO NOTHING`, r.RefereeID, r.ReferrerID, r.CreatedAt).ExecContext(ctx)
+	if err != nil {
+		return Referral{}, err
+	}
+
+	// вставленное или уже бывшее приглашение
+	if err := sess.Select(referralColumns...).From("referrals").Where("referee_id = ?", refereeID).LoadOneContext(ctx, &r); err != nil {
+		return Referral{}, err
+	}
+	if r.ReferrerID != referrerID {
+		return r, ErrReferralExists
+	}
+	return r, nil
+}
+
+// PayReferral - выплачивает amount стороне side приглашения r пользователю u этой стороны. Пополнение и отметка
+// о выплате пишутся одной транзакцией SQL хранилища, отметка ставится, только если выплаты еще не было,
+// поэтому повторы и параллельные запросы не платят дважды. Уже выплаченная сторона возвращает свою выплату
+// без пополнения (Transaction с одним ID). opts.Save и opts.Journal заменяются
+func PayReferral(ctx context.Context, sess *dbr.Session, u *User, r Referral, side string, amount int, opts CreditOptions) (Transaction, error) {
+	if id := r.TransactionID(side); id != "" {
+		return Transaction{ID: id, UserID: u.ID}, nil
+	}
+
+	column := side + "_transaction_id"
+	opts.Tag, opts.Partial, opts.Journal = TagReferral, false, nil
+	opts.Save = saveWith(ctx, sess, u.ID, func(tx *dbr.Tx, p Pending) error {
+		res, err := tx.Update("referrals").Set(column, p.Transactions[0].ID).
+			Where("referee_id = ? AND "+column+" = ''", r.RefereeID).ExecContext(ctx)
+		if err != nil {
+			return err
+		}
+		if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+			return errReferralPaid
+		}
+		return nil
+	})
+
+	t, err := u.ApplyCredit(amount, opts)
+	if errors.Is(err, errReferralPaid) {
+		// выплату успел сделать параллельный запрос
+		if err := sess.Select(referralColumns...).From("referrals").Where("referee_id = ?", r.RefereeID).LoadOneContext(ctx, &r); err != nil {
+			return Transaction{}, err
+		}
+		return Transaction{ID: r.TransactionID(side), UserID: u.ID}, nil
+	}
+	return t, err
+}
+
+// LoadReferrals - приглашения, сделанные пользователем referrerID, новые первыми
+func LoadReferrals(ctx context.Context, sess *dbr.Session, referrerID int) ([]Referral, error) {
+	var referrals []Referral
+	_, err := sess.Select(referralColumns...).From("referrals").Where("referrer_id = ?", referrerID).
+		OrderDesc("created_at").LoadContext(ctx, &referrals)
+	return referrals, err
+}
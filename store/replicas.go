@@ -0,0 +1,376 @@
+package store
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// ReadReplicas - Storage, который отправляет чтения на реплики Postgres, а записи - на primary.
+// Реплика, которая не отвечает или отстает больше MaxLag, исключается до следующей успешной проверки,
+// ее чтения выполняет primary. Пользователи, изменения которых этот экземпляр записал недавно,
+// читаются с primary, чтобы вытесненный из кеша пользователь не загрузился с реплики без своих списаний
+type ReadReplicas struct {
+	// MaxLag - максимальное отставание реплики
+	MaxLag time.Duration
+	// CheckInterval - как часто проверяются реплики
+	CheckInterval time.Duration
+
+	primary  Storage
+	replicas []*replica
+	next     uint32
+
+	mu sync.Mutex
+	// written - когда пользователь последний раз записывался на primary
+	written map[int]time.Time
+}
+
+// replica - реплика и ее состояние по последней проверке
+type replica struct {
+	id      int
+	db      *dbr.Connection
+	storage Storage
+	// healthy - 1, если реплика отвечает и отстает не больше MaxLag
+	healthy int32
+}
+
+// replicaLagQuery - отставание реплики в секундах, 0 для сервера не в режиме восстановления
+const replicaLagQuery = `SELECT CASE WHEN pg_is_in_recovery()
+	THEN COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) ELSE 0 END`
+
+func NewReadReplicas(primary Storage, replicas []*dbr.Connection, maxLag, checkInterval time.Duration) *ReadReplicas {
+	r := &ReadReplicas{
+		MaxLag:        maxLag,
+		CheckInterval: checkInterval,
+		primary:       primary,
+		written:       make(map[int]time.Time),
+	}
+	for i, db := range replicas {
+		r.replicas = append(r.replicas, &replica{id: i, db: db, storage: NewPostgres(db)})
+	}
+	return r
+}
+
+// Run - проверяет реплики раз в CheckInterval, пока не отменен ctx. Первая проверка - сразу
+func (r *ReadReplicas) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		r.check(ctx)
+		r.forget(time.Now().Add(-r.sticky()))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check - обновляет состояние реплик
+func (r *ReadReplicas) check(ctx context.Context) {
+	for _, rep := range r.replicas {
+		checkCtx, cancel := context.WithTimeout(ctx, r.CheckInterval)
+		var lag float64
+		err := rep.db.QueryRowContext(checkCtx, replicaLagQuery).Scan(&lag)
+		cancel()
+
+		healthy := err == nil && time.Duration(lag*float64(time.Second)) <= r.MaxLag
+		if was := atomic.SwapInt32(&rep.healthy, boolToInt32(healthy)) == 1; was != healthy {
+			if healthy {
+				log.Printf("read replica %d is back", rep.id)
+			} else {
+				log.Printf("read replica %d is unavailable (lag %.1fs): %v", rep.id, lag, err)
+			}
+		}
+	}
+}
+
+// sticky - сколько после записи читать пользователя с primary: реплика могла отстать на MaxLag к последней проверке
+// и еще на CheckInterval после нее
+func (r *ReadReplicas) sticky() time.Duration {
+	return r.MaxLag + r.CheckInterval
+}
+
+func (r *ReadReplicas) markWritten(ids ...int) {
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range ids {
+		r.written[id] = now
+	}
+}
+
+// forget - удаляет отметки о записях до before
+func (r *ReadReplicas) forget(before time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, at := range r.written {
+		if at.Before(before) {
+			delete(r.written, id)
+		}
+	}
+}
+
+func (r *ReadReplicas) recentlyWritten(ids []int) bool {
+	after := time.Now().Add(-r.sticky())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range ids {
+		if at, ok := r.written[id]; ok && at.After(after) {
+			return true
+		}
+	}
+	return false
+}
+
+// reader - здоровая реплика по кругу либо nil, если читать надо с primary
+func (r *ReadReplicas) reader(userIDs ...int) *replica {
+	if len(r.replicas) == 0 || r.recentlyWritten(userIDs) {
+		return nil
+	}
+
+	start := atomic.AddUint32(&r.next, 1)
+	for i := range r.replicas {
+		rep := r.replicas[(int(start)+i)%len(r.replicas)]
+		if atomic.LoadInt32(&rep.healthy) == 1 {
+			return rep
+		}
+	}
+	return nil
+}
+
+// failed - ошибка чтения с реплики: реплика исключается до следующей проверки, чтение повторяется на primary
+func (r *ReadReplicas) failed(rep *replica, err error) {
+	if atomic.CompareAndSwapInt32(&rep.healthy, 1, 0) {
+		log.Printf("read replica %d failed, reading from primary: %v", rep.id, err)
+	}
+}
+
+func (r *ReadReplicas) LoadUser(ctx context.Context, id int) (*User, error) {
+	if rep := r.reader(id); rep != nil {
+		user, err := rep.storage.LoadUser(ctx, id)
+		if err == nil && user != nil {
+			return user, nil
+		}
+		// пользователь мог еще не доехать до реплики
+		if err != nil {
+			r.failed(rep, err)
+		}
+	}
+	return r.primary.LoadUser(ctx, id)
+}
+
+func (r *ReadReplicas) LoadUsers(ctx context.Context, ids []int) ([]*User, error) {
+	if rep := r.reader(ids...); rep != nil {
+		users, err := rep.storage.LoadUsers(ctx, ids)
+		if err == nil {
+			return users, nil
+		}
+		r.failed(rep, err)
+	}
+	return r.primary.LoadUsers(ctx, ids)
+}
+
+func (r *ReadReplicas) RecentUserIDs(ctx context.Context, limit int) ([]int, error) {
+	if rep := r.reader(); rep != nil {
+		ids, err := rep.storage.RecentUserIDs(ctx, limit)
+		if err == nil {
+			return ids, nil
+		}
+		r.failed(rep, err)
+	}
+	return r.primary.RecentUserIDs(ctx, limit)
+}
+
+// ListUsers - с реплики: список может отставать на MaxLag, балансы пользователей в кеше все равно новее
+func (r *ReadReplicas) ListUsers(ctx context.Context, opts ListOptions) (UserPage, error) {
+	if rep := r.reader(); rep != nil {
+		page, err := rep.storage.ListUsers(ctx, opts)
+		if err == nil {
+			return page, nil
+		}
+		r.failed(rep, err)
+	}
+	return r.primary.ListUsers(ctx, opts)
+}
+
+// ListTransactions - с реплики: последние записи леджера могут на нее еще не доехать
+func (r *ReadReplicas) ListTransactions(ctx context.Context, f TransactionFilter) ([]Transaction, error) {
+	if rep := r.reader(f.UserID); rep != nil {
+		txs, err := rep.storage.ListTransactions(ctx, f)
+		if err == nil {
+			return txs, nil
+		}
+		r.failed(rep, err)
+	}
+	return r.primary.ListTransactions(ctx, f)
+}
+
+func (r *ReadReplicas) Statement(ctx context.Context, userID int, from, to time.Time, category string, tags []string, limit int) (Statement, error) {
+	if rep := r.reader(userID); rep != nil {
+		s, err := rep.storage.Statement(ctx, userID, from, to, category, tags, limit)
+		if err == nil {
+			return s, nil
+		}
+		// пользователь мог еще не доехать до реплики
+		if err != ErrNotFound && err != ErrTooManyTransactions {
+			r.failed(rep, err)
+		}
+	}
+	return r.primary.Statement(ctx, userID, from, to, category, tags, limit)
+}
+
+func (r *ReadReplicas) BalanceAt(ctx context.Context, userID int, at time.Time) (HistoricalBalance, error) {
+	if rep := r.reader(userID); rep != nil {
+		h, err := rep.storage.BalanceAt(ctx, userID, at)
+		if err == nil {
+			return h, nil
+		}
+		if err != ErrNotFound {
+			r.failed(rep, err)
+		}
+	}
+	return r.primary.BalanceAt(ctx, userID, at)
+}
+
+// TrialBalance - всегда с основной БД: на реплике ведомость может разойтись на еще не доехавшие операции
+func (r *ReadReplicas) TrialBalance(ctx context.Context) (TrialBalance, error) {
+	return r.primary.TrialBalance(ctx)
+}
+
+// CheckConsistency - с основной БД, как TrialBalance
+func (r *ReadReplicas) CheckConsistency(ctx context.Context, limit int) (ConsistencyReport, error) {
+	return r.primary.CheckConsistency(ctx, limit)
+}
+
+func (r *ReadReplicas) RepairConsistency(ctx context.Context, report ConsistencyReport, trust string) (RepairResult, error) {
+	for _, m := range report.Mismatches {
+		r.markWritten(m.UserID)
+	}
+	return r.primary.RepairConsistency(ctx, report, trust)
+}
+
+func (r *ReadReplicas) LoadTransaction(ctx context.Context, id string) (Transaction, error) {
+	if rep := r.reader(); rep != nil {
+		tx, err := rep.storage.LoadTransaction(ctx, id)
+		if err == nil {
+			return tx, nil
+		}
+		// запись могла еще не доехать до реплики
+		if err != ErrNotFound {
+			r.failed(rep, err)
+		}
+	}
+	return r.primary.LoadTransaction(ctx, id)
+}
+
+// JournalSeq - с primary: по нему решается, какие записи журнала еще не применены
+func (r *ReadReplicas) JournalSeq(ctx context.Context, userID int) (int64, error) {
+	return r.primary.JournalSeq(ctx, userID)
+}
+
+func (r *ReadReplicas) SavePending(ctx context.Context, userID int, p Pending) error {
+	r.markWritten(userID)
+	return r.primary.SavePending(ctx, userID, p)
+}
+
+func (r *ReadReplicas) SavePendingBatch(ctx context.Context, batch []UserPending) error {
+	r.markWritten(batchIDs(batch)...)
+	return r.primary.SavePendingBatch(ctx, batch)
+}
+
+// SavePendingBulk - через BulkSaver primary, если он есть
+func (r *ReadReplicas) SavePendingBulk(ctx context.Context, batch []UserPending) error {
+	bulk, ok := r.primary.(BulkSaver)
+	if !ok {
+		return r.SavePendingBatch(ctx, batch)
+	}
+	r.markWritten(batchIDs(batch)...)
+	return bulk.SavePendingBulk(ctx, batch)
+}
+
+func (r *ReadReplicas) MergeUsers(ctx context.Context, from, into *User) (int, error) {
+	r.markWritten(from.ID, into.ID)
+	return r.primary.MergeUsers(ctx, from, into)
+}
+
+func (r *ReadReplicas) DebitStrict(ctx context.Context, userID, amount, fee int, tag, category string, tags Tags) (Transaction, error) {
+	r.markWritten(userID)
+	return r.primary.DebitStrict(ctx, userID, amount, fee, tag, category, tags)
+}
+
+func (r *ReadReplicas) SetUserStatus(ctx context.Context, userID int, status string) error {
+	r.markWritten(userID)
+	return r.primary.SetUserStatus(ctx, userID, status)
+}
+
+// CreateUser - id нового пользователя неизвестен до записи, поэтому он отмечается записанным после нее
+func (r *ReadReplicas) CreateUser(ctx context.Context, balance int64, metadata Metadata) (*User, error) {
+	user, err := r.primary.CreateUser(ctx, balance, metadata)
+	if err == nil {
+		r.markWritten(user.ID)
+	}
+	return user, err
+}
+
+func (r *ReadReplicas) SetUserMetadata(ctx context.Context, userID int, metadata Metadata) error {
+	r.markWritten(userID)
+	return r.primary.SetUserMetadata(ctx, userID, metadata)
+}
+
+// ImportUsers - как CreateUser, отмечаются записанными только пользователи с заданными id:
+// остальные до этого никто не читал
+func (r *ReadReplicas) ImportUsers(ctx context.Context, users []ImportUser) error {
+	err := r.primary.ImportUsers(ctx, users)
+	if err == nil {
+		for _, u := range users {
+			if u.ID > 0 {
+				r.markWritten(u.ID)
+			}
+		}
+	}
+	return err
+}
+
+// SpentSince - с основной БД: реплика может еще не видеть последние списания, и лимит будет превышен
+func (r *ReadReplicas) SpentSince(ctx context.Context, userID int, since time.Time) (int64, error) {
+	return r.primary.SpentSince(ctx, userID, since)
+}
+
+func (r *ReadReplicas) SetUserFrozen(ctx context.Context, userID int, frozen bool) error {
+	r.markWritten(userID)
+	return r.primary.SetUserFrozen(ctx, userID, frozen)
+}
+
+func (r *ReadReplicas) SetUserCreditLimit(ctx context.Context, userID int, limit int64) error {
+	r.markWritten(userID)
+	return r.primary.SetUserCreditLimit(ctx, userID, limit)
+}
+
+func (r *ReadReplicas) SetUserMaxBalance(ctx context.Context, userID int, maxBalance int64) error {
+	r.markWritten(userID)
+	return r.primary.SetUserMaxBalance(ctx, userID, maxBalance)
+}
+
+func batchIDs(batch []UserPending) []int {
+	ids := make([]int, len(batch))
+	for i, item := range batch {
+		ids[i] = item.UserID
+	}
+	return ids
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
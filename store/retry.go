@@ -0,0 +1,362 @@
+package store
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// коды SQLSTATE Postgres, после которых транзакция гарантированно откачена
+const (
+	sqlStateSerializationFailure = "40001"
+	sqlStateDeadlockDetected     = "40P01"
+)
+
+// sqlState - код SQLSTATE ошибки Postgres (lib/pq или pgx), пусто для других ошибок
+func sqlState(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// IsRolledBack - транзакция не применилась из-за конфликта с параллельной (сериализация, дедлок, занятая база SQLite),
+// повтор безопасен для любого запроса
+func IsRolledBack(err error) bool {
+	switch sqlState(err) {
+	case sqlStateSerializationFailure, sqlStateDeadlockDetected:
+		return true
+	}
+
+	var liteErr sqlite3.Error
+	if errors.As(err, &liteErr) {
+		return liteErr.Code == sqlite3.ErrBusy || liteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// IsTransient - ошибка может пройти при повторе: конфликт транзакций, обрыв соединения или перезапуск сервера.
+// После обрыва соединения во время COMMIT неизвестно, применилась ли транзакция, поэтому повторять так можно
+// только идемпотентные запросы
+func IsTransient(err error) bool {
+	if IsRolledBack(err) {
+		return true
+	}
+
+	state := sqlState(err)
+	switch {
+	// connection exception
+	case len(state) == 5 && state[:2] == "08":
+		return true
+	// admin_shutdown, crash_shutdown, cannot_connect_now
+	case state == "57P01", state == "57P02", state == "57P03":
+		return true
+	case state != "":
+		return false
+	}
+
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		(errors.As(err, &netErr) && !errors.Is(err, context.DeadlineExceeded))
+}
+
+// Retry - Storage, который повторяет запросы после временных ошибок с экспоненциальной паузой со случайным разбросом.
+// Чтения повторяются при любой временной ошибке, записи - только если транзакция гарантированно откачена или
+// изменения идемпотентны по seq журнала. MergeUsers не повторяется
+type Retry struct {
+	// Attempts - сколько всего попыток, включая первую
+	Attempts int
+	// Base, Max - начальная и максимальная пауза перед повтором
+	Base time.Duration
+	Max  time.Duration
+
+	storage Storage
+
+	retries   int64
+	recovered int64
+	exhausted int64
+}
+
+// RetryStats - счетчики Retry для /debug/vars
+type RetryStats struct {
+	// Retries - сколько было повторов
+	Retries int64 `json:"retries"`
+	// Recovered - сколько запросов прошло после повтора
+	Recovered int64 `json:"recovered"`
+	// Exhausted - сколько запросов не прошло и после последней попытки
+	Exhausted int64 `json:"exhausted"`
+}
+
+func NewRetry(storage Storage, attempts int, base, max time.Duration) *Retry {
+	return &Retry{Attempts: attempts, Base: base, Max: max, storage: storage}
+}
+
+func (r *Retry) Stats() RetryStats {
+	return RetryStats{
+		Retries:   atomic.LoadInt64(&r.retries),
+		Recovered: atomic.LoadInt64(&r.recovered),
+		Exhausted: atomic.LoadInt64(&r.exhausted),
+	}
+}
+
+// do - выполняет fn, повторяя, пока retryable(err) и есть попытки. Пауза прерывается отменой ctx
+func (r *Retry) do(ctx context.Context, retryable func(error) bool, fn func() error) error {
+	err := fn()
+	for attempt := 1; err != nil && retryable(err); attempt++ {
+		if attempt >= r.Attempts {
+			atomic.AddInt64(&r.exhausted, 1)
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(r.backoff(attempt)):
+		}
+
+		atomic.AddInt64(&r.retries, 1)
+		if err = fn(); err == nil {
+			atomic.AddInt64(&r.recovered, 1)
+		}
+	}
+	return err
+}
+
+// backoff - пауза перед повтором номер attempt: случайная в [0, min(Max, Base*2^(attempt-1))]
+func (r *Retry) backoff(attempt int) time.Duration {
+	d := r.Base << (attempt - 1)
+	if d <= 0 || d > r.Max {
+		d = r.Max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// writeRetryable - когда можно повторить запись: ее изменения идемпотентны по seq журнала или она откачена
+func writeRetryable(idempotent bool) func(error) bool {
+	if idempotent {
+		return IsTransient
+	}
+	return IsRolledBack
+}
+
+func (r *Retry) LoadUser(ctx context.Context, id int) (user *User, err error) {
+	err = r.do(ctx, IsTransient, func() error {
+		user, err = r.storage.LoadUser(ctx, id)
+		return err
+	})
+	return user, err
+}
+
+func (r *Retry) LoadUsers(ctx context.Context, ids []int) (users []*User, err error) {
+	err = r.do(ctx, IsTransient, func() error {
+		users, err = r.storage.LoadUsers(ctx, ids)
+		return err
+	})
+	return users, err
+}
+
+func (r *Retry) RecentUserIDs(ctx context.Context, limit int) (ids []int, err error) {
+	err = r.do(ctx, IsTransient, func() error {
+		ids, err = r.storage.RecentUserIDs(ctx, limit)
+		return err
+	})
+	return ids, err
+}
+
+func (r *Retry) ListUsers(ctx context.Context, opts ListOptions) (page UserPage, err error) {
+	err = r.do(ctx, IsTransient, func() error {
+		page, err = r.storage.ListUsers(ctx, opts)
+		return err
+	})
+	return page, err
+}
+
+func (r *Retry) ListTransactions(ctx context.Context, f TransactionFilter) (txs []Transaction, err error) {
+	err = r.do(ctx, IsTransient, func() error {
+		txs, err = r.storage.ListTransactions(ctx, f)
+		return err
+	})
+	return txs, err
+}
+
+func (r *Retry) Statement(ctx context.Context, userID int, from, to time.Time, category string, tags []string, limit int) (s Statement, err error) {
+	err = r.do(ctx, IsTransient, func() error {
+		s, err = r.storage.Statement(ctx, userID, from, to, category, tags, limit)
+		return err
+	})
+	return s, err
+}
+
+func (r *Retry) BalanceAt(ctx context.Context, userID int, at time.Time) (h HistoricalBalance, err error) {
+	err = r.do(ctx, IsTransient, func() error {
+		h, err = r.storage.BalanceAt(ctx, userID, at)
+		return err
+	})
+	return h, err
+}
+
+func (r *Retry) TrialBalance(ctx context.Context) (t TrialBalance, err error) {
+	err = r.do(ctx, IsTransient, func() error {
+		t, err = r.storage.TrialBalance(ctx)
+		return err
+	})
+	return t, err
+}
+
+func (r *Retry) CheckConsistency(ctx context.Context, limit int) (report ConsistencyReport, err error) {
+	err = r.do(ctx, IsTransient, func() error {
+		report, err = r.storage.CheckConsistency(ctx, limit)
+		return err
+	})
+	return report, err
+}
+
+// RepairConsistency - повтор безопасен: расхождение, исправленное до обрыва соединения, пересчитывается и пропускается
+func (r *Retry) RepairConsistency(ctx context.Context, report ConsistencyReport, trust string) (res RepairResult, err error) {
+	err = r.do(ctx, IsTransient, func() error {
+		res, err = r.storage.RepairConsistency(ctx, report, trust)
+		return err
+	})
+	return res, err
+}
+
+func (r *Retry) JournalSeq(ctx context.Context, userID int) (seq int64, err error) {
+	err = r.do(ctx, IsTransient, func() error {
+		seq, err = r.storage.JournalSeq(ctx, userID)
+		return err
+	})
+	return seq, err
+}
+
+func (r *Retry) LoadTransaction(ctx context.Context, id string) (tx Transaction, err error) {
+	err = r.do(ctx, IsTransient, func() error {
+		tx, err = r.storage.LoadTransaction(ctx, id)
+		return err
+	})
+	return tx, err
+}
+
+func (r *Retry) SavePending(ctx context.Context, userID int, p Pending) error {
+	return r.do(ctx, writeRetryable(p.Seq > 0), func() error {
+		return r.storage.SavePending(ctx, userID, p)
+	})
+}
+
+func (r *Retry) SavePendingBatch(ctx context.Context, batch []UserPending) error {
+	return r.do(ctx, writeRetryable(journaled(batch)), func() error {
+		return r.storage.SavePendingBatch(ctx, batch)
+	})
+}
+
+// SavePendingBulk - через BulkSaver хранилища, если он есть
+func (r *Retry) SavePendingBulk(ctx context.Context, batch []UserPending) error {
+	bulk, ok := r.storage.(BulkSaver)
+	if !ok {
+		return r.SavePendingBatch(ctx, batch)
+	}
+	return r.do(ctx, writeRetryable(journaled(batch)), func() error {
+		return bulk.SavePendingBulk(ctx, batch)
+	})
+}
+
+// MergeUsers - без повторов: слияние меняет пользователей в памяти
+func (r *Retry) MergeUsers(ctx context.Context, from, into *User) (int, error) {
+	return r.storage.MergeUsers(ctx, from, into)
+}
+
+// DebitStrict - повторяется, только если транзакция откачена: после обрыва на COMMIT списание могло пройти
+func (r *Retry) DebitStrict(ctx context.Context, userID, amount, fee int, tag, category string, tags Tags) (tx Transaction, err error) {
+	err = r.do(ctx, IsRolledBack, func() error {
+		tx, err = r.storage.DebitStrict(ctx, userID, amount, fee, tag, category, tags)
+		return err
+	})
+	return tx, err
+}
+
+// SetUserStatus - повторяется при любой временной ошибке: повторная запись того же состояния ничего не меняет
+func (r *Retry) SetUserStatus(ctx context.Context, userID int, status string) error {
+	return r.do(ctx, IsTransient, func() error {
+		return r.storage.SetUserStatus(ctx, userID, status)
+	})
+}
+
+// CreateUser - повторяется, только если транзакция откачена: после обрыва на COMMIT пользователь мог появиться
+func (r *Retry) CreateUser(ctx context.Context, balance int64, metadata Metadata) (user *User, err error) {
+	err = r.do(ctx, IsRolledBack, func() error {
+		user, err = r.storage.CreateUser(ctx, balance, metadata)
+		return err
+	})
+	return user, err
+}
+
+// SetUserMetadata - повторяется при любой временной ошибке, как SetUserStatus
+func (r *Retry) SetUserMetadata(ctx context.Context, userID int, metadata Metadata) error {
+	return r.do(ctx, IsTransient, func() error {
+		return r.storage.SetUserMetadata(ctx, userID, metadata)
+	})
+}
+
+// ImportUsers - повторяется, только если транзакция откачена, как CreateUser
+func (r *Retry) ImportUsers(ctx context.Context, users []ImportUser) error {
+	return r.do(ctx, IsRolledBack, func() error {
+		return r.storage.ImportUsers(ctx, users)
+	})
+}
+
+func (r *Retry) SpentSince(ctx context.Context, userID int, since time.Time) (spent int64, err error) {
+	err = r.do(ctx, IsTransient, func() error {
+		spent, err = r.storage.SpentSince(ctx, userID, since)
+		return err
+	})
+	return spent, err
+}
+
+// SetUserFrozen - повторяется при любой временной ошибке, как SetUserStatus
+func (r *Retry) SetUserFrozen(ctx context.Context, userID int, frozen bool) error {
+	return r.do(ctx, IsTransient, func() error {
+		return r.storage.SetUserFrozen(ctx, userID, frozen)
+	})
+}
+
+// SetUserCreditLimit - повторяется при любой временной ошибке, как SetUserStatus
+func (r *Retry) SetUserCreditLimit(ctx context.Context, userID int, limit int64) error {
+	return r.do(ctx, IsTransient, func() error {
+		return r.storage.SetUserCreditLimit(ctx, userID, limit)
+	})
+}
+
+// SetUserMaxBalance - повторяется при любой временной ошибке, как SetUserStatus
+func (r *Retry) SetUserMaxBalance(ctx context.Context, userID int, maxBalance int64) error {
+	return r.do(ctx, IsTransient, func() error {
+		return r.storage.SetUserMaxBalance(ctx, userID, maxBalance)
+	})
+}
+
+// journaled - у всех изменений пачки есть seq журнала, повторное сохранение их не задвоит
+func journaled(batch []UserPending) bool {
+	for _, item := range batch {
+		if item.Pending.Seq == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// ErrReversed - операция уже отменена
+var ErrReversed = errors.New("transaction is already reversed")
+
+// ErrNotReversible - операцию нельзя отменить: отмены, переносы бонусов и между карманами, слияния и исправления
+// не отменяются, у эскроу и споров свои решения
+var ErrNotReversible = errors.New("transaction can not be reversed")
+
+// Reversal - отмена операции TransactionID пользователя UserID записью ReversalTransactionID
+// на Amount = -сумма операции
+type Reversal struct {
+	TransactionID         string    `db:"transaction_id" json:"transaction_id"`
+	ReversalTransactionID string    `db:"reversal_transaction_id" json:"reversal_transaction_id"`
+	UserID                int       `db:"user_id" json:"user_id"`
+	Amount                int       `db:"amount" json:"amount"`
+	Reason                string    `db:"reason" json:"reason,omitempty"`
+	ReversedBy            string    `db:"reversed_by" json:"reversed_by"`
+	CreatedAt             time.Time `db:"created_at" json:"created_at"`
+}
+
+var reversalColumns = []string{"transaction_id", "reversal_transaction_id", "user_id", "amount", "reason", "reversed_by", "created_at"}
+
+// Reversible - операцию operation можно отменить ReverseTransaction
+func Reversible(operation string) bool {
+	switch operation {
+	case OperationDebit, OperationCredit, OperationFee, OperationCashback, OperationInterest,
+		OperationTransferOut, OperationTransferIn:
+		return true
+	}
+	return false
+}
+
+// ReverseTransaction - отменяет операцию original пользователя u компенсирующей записью ReversalOperation
+// с ее тегом, категорией и тегами, которая встает на системный счет отмененной операции. Списание возвращается
+// пополнением как возврат (CreditOptions.Refund: без максимального баланса и проверки состояния счета), а то, что
+// было оплачено бонусами, - обратно в бонусную часть баланса; пополнение списывается только с основного баланса
+// (DebitOptions.MainOnly) без комиссии и лимитов трат (ErrNotEnoughMoney, если столько нет). Запись и отмена пишутся
+// одной транзакцией SQL хранилища, операция отменяется один раз (иначе ErrReversed). mark - как DebitOptions.Mark
+func ReverseTransaction(ctx context.Context, sess *dbr.Session, u *User, original Transaction, reason, by string, mark func(u *User)) (Reversal, error) {
+	if !Reversible(original.Operation) || original.Amount == 0 {
+		return Reversal{}, ErrNotReversible
+	}
+	rev := Reversal{TransactionID: original.ID, UserID: original.UserID, Amount: -original.Amount, Reason: reason, ReversedBy: by}
+	operation := ReversalOperation(original.Operation)
+
+	save := saveWith(ctx, sess, u.ID, func(tx *dbr.Tx, p Pending) error {
+		t := pendingTransaction(p, operation)
+		res, err := tx.InsertBySql(`INSERT INTO reversals (transaction_id, reversal_transaction_id, user_id, amount, reason, reversed_by, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (transaction_id) DO NOTHING`,
+			rev.TransactionID, t.ID, rev.UserID, rev.Amount, rev.Reason, rev.ReversedBy, t.CreatedAt).ExecContext(ctx)
+		if err != nil {
+			return err
+		}
+		if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+			return ErrReversed
+		}
+		return nil
+	})
+
+	var t Transaction
+	var err error
+	if rev.Amount > 0 {
+		var bonus int
+		if bonus, err = spentBonus(ctx, sess, original); err != nil {
+			return Reversal{}, err
+		}
+		t, err = u.ApplyCredit(rev.Amount, CreditOptions{Operation: operation, Tag: original.Tag, Category: original.Category,
+			Tags: original.Tags, Refund: true, BonusReturn: bonus, Save: save, Mark: mark})
+	} else {
+		t, err = u.ApplyDebit(-rev.Amount, DebitOptions{Operation: operation, Tag: original.Tag, Category: original.Category,
+			Tags: original.Tags, MainOnly: true, Save: save, Mark: mark})
+	}
+	if err != nil {
+		return Reversal{}, err
+	}
+	rev.ReversalTransactionID, rev.CreatedAt = t.ID, t.CreatedAt
+	return rev, nil
+}
+
+// spentBonus - сколько бонусов потрачено на списание original: запись OperationBonusOut пишется вместе со списанием
+// с его тегом и временем, см. bonusTransactions
+func spentBonus(ctx context.Context, sess *dbr.Session, original Transaction) (int, error) {
+	var spent int
+	err := sess.Select("COALESCE(-SUM(amount), 0)").From("transactions").
+		Where("user_id = ? AND operation = ? AND tag = ? AND created_at = ?", original.UserID, OperationBonusOut, original.Tag, original.CreatedAt).
+		LoadOneContext(ctx, &spent)
+	return spent, err
+}
+
+// LoadReversal - отмена операции transactionID, ErrNotFound если операция не отменена
+func LoadReversal(ctx context.Context, sess *dbr.Session, transactionID string) (Reversal, error) {
+	var rev Reversal
+	err := sess.Select(reversalColumns...).From("reversals").Where("transaction_id = ?", transactionID).LoadOneContext(ctx, &rev)
+	if errors.Is(err, dbr.ErrNotFound) {
+		return rev, ErrNotFound
+	}
+	return rev, err
+}
+
+// LoadReversals - до limit отмен операций пользователя userID, новые первыми
+func LoadReversals(ctx context.Context, sess *dbr.Session, userID int, limit int) ([]Reversal, error) {
+	var reversals []Reversal
+	_, err := sess.Select(reversalColumns...).From("reversals").Where("user_id = ?", userID).
+		OrderDesc("created_at").Limit(uint64(limit)).LoadContext(ctx, &reversals)
+	return reversals, err
+}
@@ -0,0 +1,228 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// виды отложенных операций
+const (
+	ScheduledDebit    = "debit"
+	ScheduledCredit   = "credit"
+	ScheduledTransfer = "transfer"
+)
+
+// состояния отложенной операции
+const (
+	// ScheduledPending - ждет ExecuteAt
+	ScheduledPending = "pending"
+	// ScheduledDebited - перевод списан у отправителя (TransactionID) и ждет пополнения получателя
+	ScheduledDebited = "debited"
+	// ScheduledDone - выполнена
+	ScheduledDone = "done"
+	// ScheduledFailed - не прошла (Reason); перевод, списанный у отправителя, возвращен ему (RefundTransactionID)
+	ScheduledFailed = "failed"
+	// ScheduledCancelled - отменена до выполнения
+	ScheduledCancelled = "cancelled"
+)
+
+// ErrScheduledStarted - отложенная операция уже выполняется или завершена, ее нельзя отменить
+var ErrScheduledStarted = errors.New("scheduled operation is already started or finished")
+
+// errScheduledTaken - шаг отложенной операции уже выполнил другой экземпляр
+var errScheduledTaken = errors.New("scheduled operation is already taken")
+
+// ScheduledOperation - списание, пополнение или перевод Amount пользователю ToUserID, которые выполнятся в ExecuteAt
+type ScheduledOperation struct {
+	ID       string `db:"id" json:"id"`
+	Kind     string `db:"kind" json:"kind"`
+	UserID   int    `db:"user_id" json:"user_id"`
+	ToUserID int    `db:"to_user_id" json:"to_user_id,omitempty"`
+	Amount   int    `db:"amount" json:"amount"`
+	Tag      string `db:"tag" json:"tag,omitempty"`
+	// ExecuteAt - когда выполнить
+	ExecuteAt time.Time `db:"execute_at" json:"execute_at"`
+	Status    string    `db:"status" json:"status"`
+	Reason    string    `db:"reason" json:"reason,omitempty"`
+	// TransactionID - списание или пополнение UserID, ToTransactionID - пополнение получателя перевода,
+	// RefundTransactionID - возврат отправителю не прошедшего перевода
+	TransactionID       string `db:"transaction_id" json:"transaction_id,omitempty"`
+	ToTransactionID     string `db:"to_transaction_id" json:"to_transaction_id,omitempty"`
+	RefundTransactionID string `db:"refund_transaction_id" json:"refund_transaction_id,omitempty"`
+	// CreatedBy - вызывающий, как в журнале аудита
+	CreatedBy  string     `db:"created_by" json:"created_by"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	ExecutedAt *time.Time `db:"executed_at" json:"executed_at,omitempty"`
+}
+
+var scheduledOperationColumns = []string{"id", "kind", "user_id", "to_user_id", "amount", "tag", "execute_at", "status",
+	"reason", "transaction_id", "to_transaction_id", "refund_transaction_id", "created_by", "created_at", "executed_at"}
+
+// Validate - известный вид, сумма положительная, у перевода есть другой получатель, тег допустимый
+func (op ScheduledOperation) Validate() error {
+	switch op.Kind {
+	case ScheduledDebit, ScheduledCredit:
+		if op.ToUserID != 0 {
+			return errors.New("to_user_id is only for transfers")
+		}
+	case ScheduledTransfer:
+		if op.ToUserID < 1 {
+			return errors.New("invalid to_user_id")
+		}
+		if op.ToUserID == op.UserID {
+			return errors.New("cannot transfer to the same user")
+		}
+	default:
+		return errors.New("kind must be debit, credit or transfer")
+	}
+	if op.Amount < 1 {
+		return errors.New("invalid amount")
+	}
+	return ValidateTag(op.Tag)
+}
+
+// CreateScheduledOperation - сохраняет новую отложенную операцию
+func CreateScheduledOperation(ctx context.Context, sess *dbr.Session, op ScheduledOperation) error {
+	_, err := sess.InsertInto("scheduled_operations").
+		Columns("id", "kind", "user_id", "to_user_id", "amount", "tag", "execute_at", "status", "reason",
+			"transaction_id", "to_transaction_id", "refund_transaction_id", "created_by", "created_at").
+		Values(op.ID, op.Kind, op.UserID, op.ToUserID, op.Amount, op.Tag, op.ExecuteAt, op.Status, "", "", "", "",
+			op.CreatedBy, op.CreatedAt).
+		ExecContext(ctx)
+	return err
+}
+
+// LoadScheduledOperations - до limit отложенных операций, в которых участвует userID, в состоянии status
+// (пусто - в любом), ближайшие первыми
+func LoadScheduledOperations(ctx context.Context, sess *dbr.Session, userID int, status string, limit int) ([]ScheduledOperation, error) {
+	stmt := sess.Select(scheduledOperationColumns...).From("scheduled_operations").
+		Where("(user_id = ? OR to_user_id = ?)", userID, userID).OrderBy("execute_at").Limit(uint64(limit))
+	if status != "" {
+		stmt.Where("status = ?", status)
+	}
+	var ops []ScheduledOperation
+	_, err := stmt.LoadContext(ctx, &ops)
+	return ops, err
+}
+
+// DueScheduledOperations - до limit отложенных операций, которые пора выполнить или довести до конца
+// (списанные переводы) в момент now, давние первыми. after - последняя операция предыдущей страницы, nil - первая
+// страница: операции, которые не прошли, не мешают выполнить следующие за ними
+func DueScheduledOperations(ctx context.Context, sess *dbr.Session, now time.Time, after *ScheduledOperation, limit int) ([]ScheduledOperation, error) {
+	stmt := sess.Select(scheduledOperationColumns...).From("scheduled_operations").
+		Where("status IN ? AND execute_at <= ?", []string{ScheduledPending, ScheduledDebited}, now.UTC())
+	if after != nil {
+		stmt.Where("(execute_at, id) > (?, ?)", after.ExecuteAt.UTC(), after.ID)
+	}
+	var ops []ScheduledOperation
+	_, err := stmt.OrderBy("execute_at").OrderBy("id").Limit(uint64(limit)).LoadContext(ctx, &ops)
+	return ops, err
+}
+
+// CancelScheduledOperation - отменяет ожидающую операцию id, в которой отправитель - userID. ErrNotFound,
+// если ее нет, ErrScheduledStarted, если она уже выполняется или завершена
+func CancelScheduledOperation(ctx context.Context, sess *dbr.Session, userID int, id string) (ScheduledOperation, error) {
+	res, err := sess.Update("scheduled_operations").Set("status", ScheduledCancelled).
+		Where("id = ? AND user_id = ? AND status = ?", id, userID, ScheduledPending).ExecContext(ctx)
+	if err != nil {
+		return ScheduledOperation{}, err
+	}
+
+	var op ScheduledOperation
+	err = sess.Select(scheduledOperationColumns...).From("scheduled_operations").
+		Where("id = ? AND user_id = ?", id, userID).LoadOneContext(ctx, &op)
+	if errors.Is(err, dbr.ErrNotFound) {
+		return op, ErrNotFound
+	}
+	if err != nil {
+		return op, err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 && op.Status != ScheduledCancelled {
+		return op, ErrScheduledStarted
+	}
+	return op, nil
+}
+
+// FailScheduledOperation - ожидающая операция id не прошла по причине reason
+func FailScheduledOperation(ctx context.Context, sess *dbr.Session, id, reason string) error {
+	_, err := sess.Update("scheduled_operations").Set("status", ScheduledFailed).Set("reason", reason).
+		Set("executed_at", time.Now().UTC()).Where("id = ? AND status = ?", id, ScheduledPending).ExecContext(ctx)
+	return err
+}
+
+// RunScheduledDebit - списывает с отправителя u отложенное списание или перевод op. Списание и перевод операции
+// в следующее состояние (ScheduledDone, у перевода - ScheduledDebited) пишутся одной транзакцией SQL хранилища,
+// поэтому операция не выполнится дважды ни после перезапуска, ни на нескольких экземплярах: выполненная другим
+// экземпляром возвращает false. Перевод пишется записью OperationTransferOut без комиссии и только из основного
+// баланса (DebitOptions.MainOnly). opts.Save и opts.Journal заменяются
+func RunScheduledDebit(ctx context.Context, sess *dbr.Session, u *User, op ScheduledOperation, opts DebitOptions) (Transaction, bool, error) {
+	next, operation := ScheduledDone, OperationDebit
+	if op.Kind == ScheduledTransfer {
+		next, operation = ScheduledDebited, OperationTransferOut
+		opts.Fee, opts.MainOnly = nil, true
+	}
+	opts.Operation, opts.Tag, opts.Partial, opts.Journal = operation, op.Tag, false, nil
+	opts.Save = saveWith(ctx, sess, u.ID, advanceScheduled(ctx, op.ID, ScheduledPending, next, "transaction_id", operation))
+	return runScheduled(u.ApplyDebit(op.Amount, opts))
+}
+
+// RunScheduledCredit - пополняет u по отложенному пополнению op, а у списанного перевода - получателя
+// (OperationTransferIn), как RunScheduledDebit. opts.Save и opts.Journal заменяются
+func RunScheduledCredit(ctx context.Context, sess *dbr.Session, u *User, op ScheduledOperation, opts CreditOptions) (Transaction, bool, error) {
+	from, column, operation := ScheduledPending, "transaction_id", OperationCredit
+	if op.Kind == ScheduledTransfer {
+		from, column, operation = ScheduledDebited, "to_transaction_id", OperationTransferIn
+	}
+	opts.Operation, opts.Tag, opts.Partial, opts.Journal = operation, op.Tag, false, nil
+	opts.Save = saveWith(ctx, sess, u.ID, advanceScheduled(ctx, op.ID, from, ScheduledDone, column, operation))
+	return runScheduled(u.ApplyCredit(op.Amount, opts))
+}
+
+// RefundScheduledTransfer - возвращает отправителю u списанный перевод op, пополнение получателя которого
+// не прошло по причине reason: операция становится ScheduledFailed. Возврат проходит и сверх максимального баланса,
+// и на замороженный или заблокированный счет (CreditOptions.Refund). opts.Save и opts.Journal заменяются
+func RefundScheduledTransfer(ctx context.Context, sess *dbr.Session, u *User, op ScheduledOperation, reason string, opts CreditOptions) (Transaction, bool, error) {
+	step := advanceScheduled(ctx, op.ID, ScheduledDebited, ScheduledFailed, "refund_transaction_id", OperationTransferIn)
+	opts.Operation, opts.Tag, opts.Partial, opts.Refund, opts.Journal = OperationTransferIn, op.Tag, false, true, nil
+	opts.Save = saveWith(ctx, sess, u.ID, func(tx *dbr.Tx, p Pending) error {
+		if _, err := tx.Update("scheduled_operations").Set("reason", reason).Where("id = ?", op.ID).ExecContext(ctx); err != nil {
+			return err
+		}
+		return step(tx, p)
+	})
+	return runScheduled(u.ApplyCredit(op.Amount, opts))
+}
+
+// runScheduled - результат шага отложенной операции: false без ошибки, если шаг уже выполнил другой экземпляр
+func runScheduled(t Transaction, err error) (Transaction, bool, error) {
+	if errors.Is(err, errScheduledTaken) {
+		return Transaction{}, false, nil
+	}
+	return t, err == nil, err
+}
+
+// advanceScheduled - шаг saveWith: переводит операцию id из from в to и записывает в column запись operation
+func advanceScheduled(ctx context.Context, id, from, to, column, operation string) func(tx *dbr.Tx, p Pending) error {
+	return func(tx *dbr.Tx, p Pending) error {
+		var transactionID string
+		for _, t := range p.Transactions {
+			if t.Operation == operation {
+				transactionID = t.ID
+				break
+			}
+		}
+
+		res, err := tx.Update("scheduled_operations").Set("status", to).Set(column, transactionID).
+			Set("executed_at", time.Now().UTC()).Where("id = ? AND status = ?", id, from).ExecContext(ctx)
+		if err != nil {
+			return err
+		}
+		if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+			return errScheduledTaken
+		}
+		return nil
+	}
+}
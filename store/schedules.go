@@ -0,0 +1,210 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// периоды регулярных списаний
+const (
+	PeriodDaily   = "daily"
+	PeriodWeekly  = "weekly"
+	PeriodMonthly = "monthly"
+)
+
+// состояния регулярного списания
+const (
+	// ScheduleActive - списывается по расписанию
+	ScheduleActive = "active"
+	// SchedulePaused - приостановлено вызывающим или после MaxFailures неудачных списаний подряд
+	SchedulePaused = "paused"
+	// ScheduleCancelled - отменено навсегда
+	ScheduleCancelled = "cancelled"
+)
+
+// ErrScheduleCancelled - регулярное списание отменено, его нельзя приостановить или возобновить
+var ErrScheduleCancelled = errors.New("schedule is cancelled")
+
+// Schedule - регулярное списание Amount с пользователя раз в Period начиная со StartAt. NextRunAt - когда
+// списать в следующий раз, Runs растет с каждым взятым в работу списанием, Failures - неудачные списания подряд
+type Schedule struct {
+	ID                string     `db:"id" json:"id"`
+	UserID            int        `db:"user_id" json:"user_id"`
+	Amount            int        `db:"amount" json:"amount"`
+	Tag               string     `db:"tag" json:"tag,omitempty"`
+	Period            string     `db:"period" json:"period"`
+	Status            string     `db:"status" json:"status"`
+	StartAt           time.Time  `db:"start_at" json:"start_at"`
+	NextRunAt         time.Time  `db:"next_run_at" json:"next_run_at"`
+	Runs              int        `db:"runs" json:"runs"`
+	Failures          int        `db:"failures" json:"failures"`
+	LastError         string     `db:"last_error" json:"last_error,omitempty"`
+	LastTransactionID string     `db:"last_transaction_id" json:"last_transaction_id,omitempty"`
+	LastRunAt         *time.Time `db:"last_run_at" json:"last_run_at,omitempty"`
+	CreatedAt         time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt         time.Time  `db:"updated_at" json:"updated_at"`
+}
+
+var scheduleColumns = []string{"id", "user_id", "amount", "tag", "period", "status", "start_at", "next_run_at", "runs",
+	"failures", "last_error", "last_transaction_id", "last_run_at", "created_at", "updated_at"}
+
+// ValidPeriod - известный период регулярного списания
+func ValidPeriod(period string) bool {
+	switch period {
+	case PeriodDaily, PeriodWeekly, PeriodMonthly:
+		return true
+	}
+	return false
+}
+
+// Validate - сумма положительная, период известный, тег допустимый
+func (s Schedule) Validate() error {
+	if s.Amount < 1 {
+		return errors.New("invalid amount")
+	}
+	if !ValidPeriod(s.Period) {
+		return errors.New("period must be daily, weekly or monthly")
+	}
+	return ValidateTag(s.Tag)
+}
+
+// NextAfter - первое списание по расписанию строго после t. Месячные списания идут в день StartAt, а в более
+// коротких месяцах - в последний день месяца
+func (s Schedule) NextAfter(t time.Time) time.Time {
+	start := s.StartAt.UTC()
+	if t.Before(start) {
+		return start
+	}
+
+	switch s.Period {
+	case PeriodMonthly:
+		k := (t.Year()-start.Year())*12 + int(t.Month()-start.Month())
+		next := addMonths(start, k)
+		for !next.After(t) {
+			k++
+			next = addMonths(start, k)
+		}
+		return next
+	default:
+		step := 24 * time.Hour
+		if s.Period == PeriodWeekly {
+			step *= 7
+		}
+		return start.Add((t.Sub(start)/step + 1) * step)
+	}
+}
+
+// addMonths - t через k месяцев в тот же день, а если его в месяце нет - в последний день месяца
+func addMonths(t time.Time, k int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(k), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	day := t.Day()
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// CreateSchedule - сохраняет новое регулярное списание
+func CreateSchedule(ctx context.Context, sess *dbr.Session, s Schedule) error {
+	_, err := sess.InsertInto("schedules").
+		Columns("id", "user_id", "amount", "tag", "period", "status", "start_at", "next_run_at", "runs", "failures",
+			"last_error", "last_transaction_id", "created_at", "updated_at").
+		Values(s.ID, s.UserID, s.Amount, s.Tag, s.Period, s.Status, s.StartAt, s.NextRunAt, 0, 0, "", "", s.CreatedAt, s.UpdatedAt).
+		ExecContext(ctx)
+	return err
+}
+
+// LoadSchedule - регулярное списание id пользователя userID, ErrNotFound если его нет
+func LoadSchedule(ctx context.Context, sess *dbr.Session, userID int, id string) (Schedule, error) {
+	var s Schedule
+	err := sess.Select(scheduleColumns...).From("schedules").Where("id = ? AND user_id = ?", id, userID).LoadOneContext(ctx, &s)
+	if errors.Is(err, dbr.ErrNotFound) {
+		return s, ErrNotFound
+	}
+	return s, err
+}
+
+// LoadSchedules - регулярные списания пользователя userID, новые первыми
+func LoadSchedules(ctx context.Context, sess *dbr.Session, userID int) ([]Schedule, error) {
+	var schedules []Schedule
+	_, err := sess.Select(scheduleColumns...).From("schedules").Where("user_id = ?", userID).
+		OrderDesc("created_at").LoadContext(ctx, &schedules)
+	return schedules, err
+}
+
+// SetScheduleStatus - приостанавливает (SchedulePaused), возобновляет (ScheduleActive) или отменяет
+// (ScheduleCancelled) регулярное списание id. Возобновление сбрасывает неудачи, пропущенное за паузу списание
+// выполняется сразу. Повтор в то же состояние ничего не меняет, из отмененного - ErrScheduleCancelled
+func SetScheduleStatus(ctx context.Context, sess *dbr.Session, userID int, id, status string) (Schedule, error) {
+	from := []string{ScheduleActive, SchedulePaused}
+	stmt := sess.Update("schedules").Set("status", status).Set("updated_at", time.Now().UTC())
+	switch status {
+	case SchedulePaused:
+		from = []string{ScheduleActive}
+	case ScheduleActive:
+		from = []string{SchedulePaused}
+		stmt.Set("failures", 0)
+	}
+
+	res, err := stmt.Where("id = ? AND user_id = ? AND status IN ?", id, userID, from).ExecContext(ctx)
+	if err != nil {
+		return Schedule{}, err
+	}
+	s, err := LoadSchedule(ctx, sess, userID, id)
+	if err != nil {
+		return s, err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 && s.Status != status {
+		return s, ErrScheduleCancelled
+	}
+	return s, nil
+}
+
+// DueSchedules - до limit активных регулярных списаний, которые пора выполнить в момент now, давние первыми
+func DueSchedules(ctx context.Context, sess *dbr.Session, now time.Time, limit int) ([]Schedule, error) {
+	var schedules []Schedule
+	_, err := sess.Select(scheduleColumns...).From("schedules").
+		Where("status = ? AND next_run_at <= ?", ScheduleActive, now.UTC()).
+		OrderBy("next_run_at").Limit(uint64(limit)).LoadContext(ctx, &schedules)
+	return schedules, err
+}
+
+// ClaimSchedule - берет в работу списание s, прочитанное DueSchedules, и сразу переносит следующее на next.
+// false - его уже взял другой экземпляр, приостановили или отменили. Взятое списание не выполняется повторно,
+// даже если экземпляр упал до списания
+func ClaimSchedule(ctx context.Context, sess *dbr.Session, s Schedule, next time.Time) (bool, error) {
+	res, err := sess.Update("schedules").Set("runs", dbr.Expr("runs + 1")).Set("next_run_at", next.UTC()).
+		Set("updated_at", time.Now().UTC()).
+		Where("id = ? AND status = ? AND runs = ?", s.ID, ScheduleActive, s.Runs).ExecContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows > 0, err
+}
+
+// CompleteScheduleRun - успешное списание transactionID по регулярному списанию id
+func CompleteScheduleRun(ctx context.Context, sess *dbr.Session, id, transactionID string) error {
+	now := time.Now().UTC()
+	_, err := sess.Update("schedules").Set("failures", 0).Set("last_error", "").
+		Set("last_transaction_id", transactionID).Set("last_run_at", now).Set("updated_at", now).
+		Where("id = ?", id).ExecContext(ctx)
+	return err
+}
+
+// FailScheduleRun - неудачное списание по регулярному списанию id: повтор в retryAt, а после maxFailures
+// неудач подряд (0 - без ограничения) списание приостанавливается
+func FailScheduleRun(ctx context.Context, sess *dbr.Session, id, reason string, retryAt time.Time, maxFailures int) error {
+	now := time.Now().UTC()
+	stmt := sess.Update("schedules").Set("failures", dbr.Expr("failures + 1")).Set("last_error", reason).
+		Set("last_run_at", now).Set("next_run_at", retryAt.UTC()).Set("updated_at", now)
+	if maxFailures > 0 {
+		stmt.Set("status", dbr.Expr("CASE WHEN status = ? AND failures + 1 >= ? THEN ? ELSE status END",
+			ScheduleActive, maxFailures, SchedulePaused))
+	}
+	_, err := stmt.Where("id = ?", id).ExecContext(ctx)
+	return err
+}
@@ -0,0 +1,169 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// скользящие окна лимитов трат
+const (
+	WindowDaily  = "daily"
+	WindowWeekly = "weekly"
+)
+
+// SegmentKey - ключ метаданных пользователя с его сегментом для лимитов трат
+const SegmentKey = "segment"
+
+// ErrSpendLimitExceeded - списание превысило бы лимит трат за окно
+var ErrSpendLimitExceeded = errors.New("spend limit exceeded")
+
+// SpendLimitError - списание превысило бы лимит Limit за окно Window, в котором уже потрачено Spent
+type SpendLimitError struct {
+	Window string
+	Limit  int64
+	Spent  int64
+}
+
+func (e *SpendLimitError) Error() string {
+	return fmt.Sprintf("%s %v: limit %d, spent %d", e.Window, ErrSpendLimitExceeded, e.Limit, e.Spent)
+}
+
+func (e *SpendLimitError) Is(target error) bool {
+	return target == ErrSpendLimitExceeded
+}
+
+// SpendLimit - лимиты трат пользователя ("user:{id}") или сегмента ("segment:{name}", см. SegmentKey)
+// за скользящие сутки и неделю, 0 - без лимита. Лимит пользователя заменяет лимит его сегмента целиком
+type SpendLimit struct {
+	Subject   string    `db:"subject" json:"subject"`
+	Daily     int64     `db:"daily" json:"daily"`
+	Weekly    int64     `db:"weekly" json:"weekly"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// UserSubject, SegmentSubject - Subject лимита пользователя и сегмента
+func UserSubject(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+func SegmentSubject(segment string) string {
+	return "segment:" + segment
+}
+
+// Validate - Subject в одном из форматов, лимиты не отрицательные
+func (l SpendLimit) Validate() error {
+	kind, name, _ := strings.Cut(l.Subject, ":")
+	switch kind {
+	case "user":
+		if id, err := strconv.Atoi(name); err != nil || id < 1 {
+			return errors.New("invalid user id in subject")
+		}
+	case "segment":
+		if name == "" {
+			return errors.New("empty segment in subject")
+		}
+	default:
+		return errors.New(`subject must be "user:{id}" or "segment:{name}"`)
+	}
+	if l.Daily < 0 || l.Weekly < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+// Windows - окна лимита с их длительностью и величиной, без неограниченных
+func (l SpendLimit) Windows() []SpendWindow {
+	var windows []SpendWindow
+	if l.Daily > 0 {
+		windows = append(windows, SpendWindow{Name: WindowDaily, Length: 24 * time.Hour, Limit: l.Daily})
+	}
+	if l.Weekly > 0 {
+		windows = append(windows, SpendWindow{Name: WindowWeekly, Length: 7 * 24 * time.Hour, Limit: l.Weekly})
+	}
+	return windows
+}
+
+// SpendWindow - одно окно лимита трат
+type SpendWindow struct {
+	Name   string
+	Length time.Duration
+	Limit  int64
+}
+
+// LoadSpendLimits - все лимиты трат
+func LoadSpendLimits(ctx context.Context, sess *dbr.Session) ([]SpendLimit, error) {
+	var limits []SpendLimit
+	_, err := sess.Select("subject", "daily", "weekly", "updated_at").From("spend_limits").
+		OrderBy("subject").LoadContext(ctx, &limits)
+	return limits, err
+}
+
+// SetSpendLimit - добавляет или заменяет лимит l.Subject
+func SetSpendLimit(ctx context.Context, sess *dbr.Session, l SpendLimit) error {
+	_, err := sess.InsertBySql(`INSERT INTO spend_limits (subject, daily, weekly, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (subject) DO UPDATE SET daily = excluded.daily, weekly = excluded.weekly, updated_at = excluded.updated_at`,
+		l.Subject, l.Daily, l.Weekly, time.Now().UTC()).ExecContext(ctx)
+	return err
+}
+
+// DeleteSpendLimit - удаляет лимит subject, ErrNotFound если его нет
+func DeleteSpendLimit(ctx context.Context, sess *dbr.Session, subject string) error {
+	res, err := sess.DeleteFrom("spend_limits").Where("subject = ?", subject).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// spentSince - сумма списаний пользователя по леджеру SQL хранилища начиная с since
+func spentSince(ctx context.Context, sess *dbr.Session, userID int, since time.Time) (int64, error) {
+	var spent int64
+	err := sess.Select("COALESCE(SUM(-amount), 0)").From("transactions").
+		Where("user_id = ? AND operation = ? AND created_at >= ?", userID, OperationDebit, since.UTC()).
+		LoadOneContext(ctx, &spent)
+	return spent, err
+}
+
+// UnsavedSpent - сумма несохраненных списаний пользователя начиная с since. Вызывается под блокировкой
+// пользователя, например из DebitOptions.Check
+func (u *User) UnsavedSpent(since time.Time) int64 {
+	var spent int64
+	for _, tx := range u.pending.Transactions {
+		if tx.Operation == OperationDebit && !tx.CreatedAt.Before(since) {
+			spent -= int64(tx.Amount)
+		}
+	}
+	return spent
+}
+
+// Segment - сегмент пользователя из метаданных (строковое значение SegmentKey), пусто - без сегмента.
+// Вызывается под блокировкой пользователя
+func (u *User) Segment() string {
+	return u.Metadata.String(SegmentKey)
+}
+
+// String - строковое значение key, пусто если его нет или оно не строка
+func (m Metadata) String(key string) string {
+	if len(m) == 0 {
+		return ""
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(m, &object); err != nil {
+		return ""
+	}
+	var value string
+	if err := json.Unmarshal(object[key], &value); err != nil {
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,369 @@
+package store
+
+import (
+	"context"
+
+	"github.com/gocraft/dbr/v2"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSchema - схема для SQLite, соответствует последней миграции Postgres в части таблиц users и transactions.
+// Проекции, выгрузка в ERP и задача снимков балансов на SQLite не поддерживаются, таблица снимков есть,
+// чтобы баланс на момент читался одинаково, и остается пустой
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		balance INTEGER NOT NULL,
+		frozen BOOLEAN NOT NULL DEFAULT 0,
+		journal_seq INTEGER NOT NULL DEFAULT 0,
+		version INTEGER NOT NULL DEFAULT 1,
+		created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+		updated_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+		status TEXT NOT NULL DEFAULT 'active',
+		metadata TEXT NOT NULL DEFAULT '{}'
+	)`,
+	`CREATE TABLE IF NOT EXISTS transactions (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		amount INTEGER NOT NULL,
+		operation TEXT NOT NULL,
+		tag TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS transactions_user_id_created_at ON transactions (user_id, created_at)`,
+	`CREATE INDEX IF NOT EXISTS transactions_created_at ON transactions (created_at)`,
+	`CREATE TABLE IF NOT EXISTS balance_snapshots (
+		day TIMESTAMP NOT NULL,
+		user_id INTEGER NOT NULL,
+		balance INTEGER NOT NULL,
+		PRIMARY KEY (day, user_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS balance_snapshots_user_id_day ON balance_snapshots (user_id, day)`,
+	`CREATE TABLE IF NOT EXISTS ledger_entries (
+		transaction_id TEXT NOT NULL,
+		account TEXT NOT NULL,
+		user_id INTEGER,
+		amount INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS ledger_entries_transaction_id ON ledger_entries (transaction_id)`,
+	`CREATE INDEX IF NOT EXISTS ledger_entries_user_id ON ledger_entries (user_id) WHERE user_id IS NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		name TEXT PRIMARY KEY,
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL DEFAULT 'service',
+		created_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS spend_limits (
+		subject TEXT PRIMARY KEY,
+		daily INTEGER NOT NULL DEFAULT 0,
+		weekly INTEGER NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS denylist (
+		kind TEXT NOT NULL,
+		value TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (kind, value)
+	)`,
+	`CREATE TABLE IF NOT EXISTS approvals (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		amount INTEGER NOT NULL,
+		tag TEXT NOT NULL DEFAULT '',
+		strict BOOLEAN NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		requested_by TEXT NOT NULL,
+		decided_by TEXT NOT NULL DEFAULT '',
+		reason TEXT NOT NULL DEFAULT '',
+		transaction_id TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		decided_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS approvals_status_created_at ON approvals (status, created_at)`,
+	`CREATE TABLE IF NOT EXISTS pending_debits (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		amount INTEGER NOT NULL,
+		tag TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS pending_debits_user_id_created_at ON pending_debits (user_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS bonus_grants (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		amount INTEGER NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS bonus_grants_user_id_expires_at ON bonus_grants (user_id, expires_at)`,
+	`CREATE INDEX IF NOT EXISTS bonus_grants_expires_at ON bonus_grants (expires_at)`,
+	`CREATE TABLE IF NOT EXISTS pockets (
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		balance INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS promo_codes (
+		code TEXT PRIMARY KEY,
+		amount INTEGER NOT NULL,
+		tag TEXT NOT NULL DEFAULT '',
+		max_uses INTEGER NOT NULL DEFAULT 0,
+		uses INTEGER NOT NULL DEFAULT 0,
+		valid_from TIMESTAMP NOT NULL,
+		valid_until TIMESTAMP,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS promo_redemptions (
+		code TEXT NOT NULL,
+		user_id INTEGER NOT NULL,
+		transaction_id TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (code, user_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS referrals (
+		referee_id INTEGER PRIMARY KEY,
+		referrer_id INTEGER NOT NULL,
+		referrer_transaction_id TEXT NOT NULL DEFAULT '',
+		referee_transaction_id TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS referrals_referrer_id ON referrals (referrer_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS cashback_rules (
+		subject TEXT PRIMARY KEY,
+		basis_points INTEGER NOT NULL,
+		monthly_cap INTEGER NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS cashback (
+		debit_transaction_id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		rule TEXT NOT NULL,
+		amount INTEGER NOT NULL,
+		transaction_id TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS cashback_user_id_rule_created_at ON cashback (user_id, rule, created_at)`,
+	`CREATE TABLE IF NOT EXISTS schedules (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		amount INTEGER NOT NULL,
+		tag TEXT NOT NULL DEFAULT '',
+		period TEXT NOT NULL,
+		status TEXT NOT NULL,
+		start_at TIMESTAMP NOT NULL,
+		next_run_at TIMESTAMP NOT NULL,
+		runs INTEGER NOT NULL DEFAULT 0,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		last_transaction_id TEXT NOT NULL DEFAULT '',
+		last_run_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS schedules_status_next_run_at ON schedules (status, next_run_at)`,
+	`CREATE INDEX IF NOT EXISTS schedules_user_id ON schedules (user_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS scheduled_operations (
+		id TEXT PRIMARY KEY,
+		kind TEXT NOT NULL,
+		user_id INTEGER NOT NULL,
+		to_user_id INTEGER NOT NULL DEFAULT 0,
+		amount INTEGER NOT NULL,
+		tag TEXT NOT NULL DEFAULT '',
+		execute_at TIMESTAMP NOT NULL,
+		status TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		transaction_id TEXT NOT NULL DEFAULT '',
+		to_transaction_id TEXT NOT NULL DEFAULT '',
+		refund_transaction_id TEXT NOT NULL DEFAULT '',
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		executed_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS scheduled_operations_status_execute_at ON scheduled_operations (status, execute_at)`,
+	`CREATE INDEX IF NOT EXISTS scheduled_operations_user_id ON scheduled_operations (user_id, execute_at)`,
+	`CREATE INDEX IF NOT EXISTS scheduled_operations_to_user_id ON scheduled_operations (to_user_id, execute_at)`,
+	`CREATE TABLE IF NOT EXISTS interest_accruals (
+		user_id INTEGER NOT NULL,
+		day TIMESTAMP NOT NULL,
+		balance INTEGER NOT NULL,
+		amount INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (user_id, day)
+	)`,
+	`CREATE INDEX IF NOT EXISTS interest_accruals_day ON interest_accruals (day)`,
+	`CREATE TABLE IF NOT EXISTS interest_payouts (
+		user_id INTEGER NOT NULL,
+		month TIMESTAMP NOT NULL,
+		amount INTEGER NOT NULL,
+		transaction_id TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (user_id, month)
+	)`,
+	`CREATE TABLE IF NOT EXISTS escrows (
+		id TEXT PRIMARY KEY,
+		payer_id INTEGER NOT NULL,
+		payee_id INTEGER NOT NULL,
+		amount INTEGER NOT NULL,
+		tag TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		on_timeout TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		transaction_id TEXT NOT NULL,
+		settle_transaction_id TEXT NOT NULL DEFAULT '',
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		settled_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS escrows_status_expires_at ON escrows (status, expires_at)`,
+	`CREATE INDEX IF NOT EXISTS escrows_payer_id ON escrows (payer_id, created_at)`,
+	`CREATE INDEX IF NOT EXISTS escrows_payee_id ON escrows (payee_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS disputes (
+		id TEXT PRIMARY KEY,
+		transaction_id TEXT NOT NULL UNIQUE,
+		user_id INTEGER NOT NULL,
+		amount INTEGER NOT NULL,
+		held INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		note TEXT NOT NULL DEFAULT '',
+		hold_transaction_id TEXT NOT NULL DEFAULT '',
+		release_transaction_id TEXT NOT NULL DEFAULT '',
+		opened_by TEXT NOT NULL DEFAULT '',
+		resolved_by TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		resolved_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS disputes_user_id ON disputes (user_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS reversals (
+		transaction_id TEXT PRIMARY KEY,
+		reversal_transaction_id TEXT NOT NULL,
+		user_id INTEGER NOT NULL,
+		amount INTEGER NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		reversed_by TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS reversals_user_id ON reversals (user_id, created_at)`,
+	// проводки операций файла, созданного до появления ledger_entries, как в миграции ledger_entries
+	`INSERT INTO ledger_entries (transaction_id, account, user_id, amount, created_at)
+		SELECT id, 'user', user_id, amount, created_at FROM transactions
+		WHERE NOT EXISTS (SELECT 1 FROM ledger_entries)
+		UNION ALL
+		SELECT id, CASE operation WHEN 'debit' THEN 'revenue' WHEN 'opening' THEN 'funding' ELSE 'suspense' END, NULL, -amount, created_at FROM transactions
+		WHERE NOT EXISTS (SELECT 1 FROM ledger_entries)`,
+}
+
+// sqliteColumns - колонки, появившиеся после первой версии схемы SQLite: в уже созданный файл
+// они добавляются ALTER TABLE, у которого в SQLite нет IF NOT EXISTS. Значение по умолчанию в ALTER TABLE
+// может быть только константой, поэтому существующие строки при необходимости заполняются выражением fill
+var sqliteColumns = []struct{ table, column, definition, fill string }{
+	{"users", "version", "INTEGER NOT NULL DEFAULT 1", ""},
+	{"users", "created_at", "TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00'", "strftime('%Y-%m-%d %H:%M:%f', 'now')"},
+	{"users", "updated_at", "TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00'", "strftime('%Y-%m-%d %H:%M:%f', 'now')"},
+	{"users", "status", "TEXT NOT NULL DEFAULT 'active'", ""},
+	{"users", "metadata", "TEXT NOT NULL DEFAULT '{}'", ""},
+	{"api_keys", "scopes", "TEXT NOT NULL DEFAULT 'service'", ""},
+	{"users", "credit_limit", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"users", "max_balance", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"users", "bonus", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"users", "pocketed", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"approvals", "pocket", "TEXT NOT NULL DEFAULT ''", ""},
+	{"transactions", "category", "TEXT NOT NULL DEFAULT ''", ""},
+	{"transactions", "tags", "TEXT NOT NULL DEFAULT '[]'", ""},
+	{"approvals", "category", "TEXT NOT NULL DEFAULT ''", ""},
+	{"approvals", "tags", "TEXT NOT NULL DEFAULT '[]'", ""},
+	{"pending_debits", "category", "TEXT NOT NULL DEFAULT ''", ""},
+	{"pending_debits", "tags", "TEXT NOT NULL DEFAULT '[]'", ""},
+}
+
+// sqliteIndexes - индексы по колонкам из sqliteColumns, создаются после них
+var sqliteIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS users_updated_at ON users (updated_at)`,
+	`CREATE INDEX IF NOT EXISTS users_balance_id ON users (balance, id)`,
+	`CREATE INDEX IF NOT EXISTS transactions_category ON transactions (category, created_at) WHERE category <> ''`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_external_ref ON users (json_extract(metadata, '$.external_ref'))
+		WHERE json_extract(metadata, '$.external_ref') IS NOT NULL`,
+}
+
+// OpenSQLite - открывает (и при необходимости создает) файл базы SQLite и ее схему.
+// SQLite разрешает одного писателя, поэтому соединение одно, а ожидание блокировки - busy_timeout
+func OpenSQLite(path string) (*dbr.Connection, error) {
+	db, err := dbr.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=1", nil)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range sqliteSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	for _, c := range sqliteColumns {
+		var exists int
+		if err := db.QueryRow(`SELECT count(*) FROM pragma_table_info(?) WHERE name = ?`, c.table, c.column).Scan(&exists); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if exists > 0 {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE ` + c.table + ` ADD COLUMN ` + c.column + ` ` + c.definition); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if c.fill == "" {
+			continue
+		}
+		if _, err := db.Exec(`UPDATE ` + c.table + ` SET ` + c.column + ` = ` + c.fill); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	for _, stmt := range sqliteIndexes {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+// SQLite - Storage поверх SQLite для локальной разработки и одного экземпляра сервиса
+type SQLite struct {
+	sqlStorage
+}
+
+func NewSQLite(db *dbr.Connection) *SQLite {
+	return &SQLite{sqlStorage{sess: db.NewSession(nil)}}
+}
+
+// SavePendingBatch - в SQLite нет UPDATE ... FROM (VALUES) с приведением типов, поэтому пользователи
+// обновляются по одному, но в одной транзакции
+func (s *SQLite) SavePendingBatch(ctx context.Context, batch []UserPending) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	tx, err := s.sess.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	for _, item := range batch {
+		if err := savePending(ctx, tx, item.UserID, item.Pending); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
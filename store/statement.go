@@ -0,0 +1,147 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// ErrTooManyTransactions - в периоде выписки больше записей леджера, чем разрешено
+var ErrTooManyTransactions = errors.New("too many transactions in the period")
+
+// Statement - выписка по счету за [From, To): баланс на начало и конец периода и все записи леджера в нем
+// (с фильтром по категории и тегам - только подходящие, балансы - по всему счету). Балансы считаются от баланса в БД назад по леджеру, поэтому выписка сходится с сохраненными операциями,
+// а несохраненные изменения из кеша в нее не попадают
+type Statement struct {
+	UserID         int           `json:"user_id"`
+	From           time.Time     `json:"from"`
+	To             time.Time     `json:"to"`
+	OpeningBalance int64         `json:"opening_balance"`
+	ClosingBalance int64         `json:"closing_balance"`
+	Transactions   []Transaction `json:"transactions"`
+}
+
+// close - балансы выписки по балансу сейчас, сумме записей леджера с To и сумме всех записей периода during: запись
+// каждой операции пишется вместе с изменением баланса, поэтому баланс на момент To - текущий без более поздних операций
+func (s *Statement) close(balance, after, during int64) {
+	s.ClosingBalance = balance - after
+	s.OpeningBalance = s.ClosingBalance - during
+}
+
+// loadStatement - выписка из SQL хранилища одной транзакцией с одним снимком данных, ErrNotFound если пользователя нет,
+// ErrTooManyTransactions если в периоде больше limit записей с категорией category (пусто - с любой) и тегами tags
+func loadStatement(ctx context.Context, sess *dbr.Session, userID int, from, to time.Time, category string, tags []string, limit int) (Statement, error) {
+	// в SQLite транзакция и так видит один снимок, уровни изоляции драйвер игнорирует
+	tx, err := sess.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return Statement{}, err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	var balances []int64
+	if _, err := tx.Select("balance").From("users").Where("id = ?", userID).LoadContext(ctx, &balances); err != nil {
+		return Statement{}, err
+	}
+	if len(balances) == 0 {
+		return Statement{}, ErrNotFound
+	}
+
+	var after int64
+	err = tx.Select("COALESCE(SUM(amount), 0)").From("transactions").
+		Where("user_id = ? AND created_at >= ?", userID, to.UTC()).LoadOneContext(ctx, &after)
+	if err != nil {
+		return Statement{}, err
+	}
+
+	s := Statement{UserID: userID, From: from.UTC(), To: to.UTC(), Transactions: []Transaction{}}
+	stmt := tx.Select(TransactionColumns...).From("transactions").
+		Where("user_id = ? AND created_at >= ? AND created_at < ?", userID, s.From, s.To)
+	filterLabels(stmt, tx.Dialect, category, tags)
+	_, err = stmt.OrderBy("created_at").OrderBy("id").Limit(uint64(limit+1)).LoadContext(ctx, &s.Transactions)
+	if err != nil {
+		return Statement{}, err
+	}
+	if len(s.Transactions) > limit {
+		return Statement{}, ErrTooManyTransactions
+	}
+
+	var during int64
+	if category == "" && len(tags) == 0 {
+		for _, t := range s.Transactions {
+			during += int64(t.Amount)
+		}
+	} else {
+		// в выписке не все записи периода, баланс на начало - по всем
+		err = tx.Select("COALESCE(SUM(amount), 0)").From("transactions").
+			Where("user_id = ? AND created_at >= ? AND created_at < ?", userID, s.From, s.To).LoadOneContext(ctx, &during)
+		if err != nil {
+			return Statement{}, err
+		}
+	}
+
+	s.close(balances[0], after, during)
+	return s, tx.Commit()
+}
+
+// HistoricalBalance - баланс пользователя на момент At по леджеру в БД
+type HistoricalBalance struct {
+	UserID  int       `json:"user_id"`
+	At      time.Time `json:"at"`
+	Balance int64     `json:"balance"`
+	// Snapshot - сутки снимка balance_snapshots, от которого пересчитан баланс, nil - пересчитан от текущего
+	Snapshot *time.Time `json:"snapshot,omitempty"`
+}
+
+// balanceSnapshot - строка balance_snapshots
+type balanceSnapshot struct {
+	Day     time.Time `db:"day"`
+	Balance int64     `db:"balance"`
+}
+
+// loadBalanceAt - баланс на момент at из SQL хранилища, ErrNotFound если пользователя нет. Если есть снимок
+// на конец суток до at, к нему прибавляются записи леджера от конца тех суток до at, иначе из текущего баланса
+// вычитаются записи с at: от снимка обычно читается меньше записей
+func loadBalanceAt(ctx context.Context, sess *dbr.Session, userID int, at time.Time) (HistoricalBalance, error) {
+	tx, err := sess.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return HistoricalBalance{}, err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	var balances []int64
+	if _, err := tx.Select("balance").From("users").Where("id = ?", userID).LoadContext(ctx, &balances); err != nil {
+		return HistoricalBalance{}, err
+	}
+	if len(balances) == 0 {
+		return HistoricalBalance{}, ErrNotFound
+	}
+
+	b := HistoricalBalance{UserID: userID, At: at.UTC()}
+	var snapshots []balanceSnapshot
+	_, err = tx.Select("day", "balance").From("balance_snapshots").
+		Where("user_id = ? AND day <= ?", userID, b.At.Add(-24*time.Hour)).
+		OrderDesc("day").Limit(1).LoadContext(ctx, &snapshots)
+	if err != nil {
+		return HistoricalBalance{}, err
+	}
+
+	var sum int64
+	if len(snapshots) > 0 {
+		day := snapshots[0].Day.UTC()
+		err = tx.Select("COALESCE(SUM(amount), 0)").From("transactions").
+			Where("user_id = ? AND created_at >= ? AND created_at < ?", userID, day.Add(24*time.Hour), b.At).
+			LoadOneContext(ctx, &sum)
+		b.Balance, b.Snapshot = snapshots[0].Balance+sum, &day
+	} else {
+		err = tx.Select("COALESCE(SUM(amount), 0)").From("transactions").
+			Where("user_id = ? AND created_at >= ?", userID, b.At).LoadOneContext(ctx, &sum)
+		b.Balance = balances[0] - sum
+	}
+	if err != nil {
+		return HistoricalBalance{}, err
+	}
+	return b, tx.Commit()
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// состояния пользователя
+const (
+	// StatusActive - обычный пользователь
+	StatusActive = "active"
+	// StatusBlocked - списания запрещены, пользователь остается в списках
+	StatusBlocked = "blocked"
+	// StatusDeleted - мягкое удаление: строка и леджер остаются, списания запрещены, в списки и прогрев кеша не попадает
+	StatusDeleted = "deleted"
+)
+
+// ErrBlocked - пользователь заблокирован
+var ErrBlocked = errors.New("user is blocked")
+
+// ErrDeleted - пользователь удален
+var ErrDeleted = errors.New("user is deleted")
+
+// ValidStatus - известное состояние пользователя
+func ValidStatus(status string) bool {
+	switch status {
+	case StatusActive, StatusBlocked, StatusDeleted:
+		return true
+	}
+	return false
+}
+
+// statusError - ошибка списания для состояния status, nil для активного
+func statusError(status string) error {
+	switch status {
+	case StatusBlocked:
+		return ErrBlocked
+	case StatusDeleted:
+		return ErrDeleted
+	}
+	return nil
+}
+
+// setUserStatus - меняет состояние пользователя в SQL хранилище
+func setUserStatus(ctx context.Context, sess *dbr.Session, userID int, status string) error {
+	res, err := sess.Update("users").Set("status", status).Set("version", dbr.Expr("version + 1")).
+		Set("updated_at", dbr.Now).Where("id = ?", userID).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetStatus - меняет состояние пользователя через storage.SetUserStatus. Если пользователь есть в кеше (cached != nil),
+// состояние в памяти меняется под его блокировкой, поэтому списания после ответа уже видят новое состояние
+func SetStatus(ctx context.Context, storage Storage, cached *User, userID int, status string) error {
+	if !ValidStatus(status) {
+		return fmt.Errorf("unknown user status %q", status)
+	}
+	if cached == nil {
+		return storage.SetUserStatus(ctx, userID, status)
+	}
+
+	l := cached.lock()
+	l.Lock()
+	defer l.Unlock()
+
+	if err := storage.SetUserStatus(ctx, userID, status); err != nil {
+		return err
+	}
+	cached.Status = status
+	return nil
+}
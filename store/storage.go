@@ -0,0 +1,187 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// ErrNotFound - запись не найдена; у Postgres совпадает с dbr.ErrNotFound
+var ErrNotFound = dbr.ErrNotFound
+
+// Storage - хранилище пользователей и леджера. Через него работают обработчики API и фоновое сохранение,
+// поэтому бэкенд можно заменить (другая БД, фейк в тестах). Миграции, проекции и выгрузка в ERP
+// остаются на Postgres
+type Storage interface {
+	// LoadUser - пользователь по id, nil без ошибки если его нет
+	LoadUser(ctx context.Context, id int) (*User, error)
+	// LoadUsers - пользователи по списку id, отсутствующие пропускаются
+	LoadUsers(ctx context.Context, ids []int) ([]*User, error)
+	// RecentUserIDs - до limit пользователей с самыми недавними операциями
+	RecentUserIDs(ctx context.Context, limit int) ([]int, error)
+	// SavePending - атомарно применяет изменение баланса и пишет записи леджера, идемпотентно по Pending.Seq
+	SavePending(ctx context.Context, userID int, p Pending) error
+	// SavePendingBatch - SavePending для нескольких пользователей одной транзакцией
+	SavePendingBatch(ctx context.Context, batch []UserPending) error
+	// JournalSeq - seq последней примененной записи журнала пользователя, ErrNotFound если его нет
+	JournalSeq(ctx context.Context, userID int) (int64, error)
+	// LoadTransaction - запись леджера по id, ErrNotFound если ее нет
+	LoadTransaction(ctx context.Context, id string) (Transaction, error)
+	// MergeUsers - переносит баланс from на into и замораживает from, см. MergeUsers
+	MergeUsers(ctx context.Context, from, into *User) (int, error)
+	// DebitStrict - списание amount с комиссией fee одной транзакцией с блокировкой строки, без кеша: ErrNotFound, ErrFrozen
+	// или ErrNotEnoughMoney по состоянию в хранилище, см. DebitStrict
+	DebitStrict(ctx context.Context, userID, amount, fee int, tag, category string, tags Tags) (Transaction, error)
+	// SetUserStatus - меняет состояние пользователя, ErrNotFound если его нет, см. SetStatus
+	SetUserStatus(ctx context.Context, userID int, status string) error
+	// CreateUser - добавляет пользователя с балансом balance и метаданными metadata
+	CreateUser(ctx context.Context, balance int64, metadata Metadata) (*User, error)
+	// SetUserMetadata - заменяет метаданные пользователя, ErrNotFound если его нет, см. SetMetadata
+	SetUserMetadata(ctx context.Context, userID int, metadata Metadata) error
+	// ListUsers - страница списка пользователей по курсору, см. ListOptions
+	ListUsers(ctx context.Context, opts ListOptions) (UserPage, error)
+	// ImportUsers - добавляет пользователей одной транзакцией, *ImportError если их id или external_ref заняты
+	ImportUsers(ctx context.Context, users []ImportUser) error
+	// ListTransactions - страница записей леджера по курсору, см. TransactionFilter
+	ListTransactions(ctx context.Context, f TransactionFilter) ([]Transaction, error)
+	// Statement - выписка за [from, to) не больше чем с limit записями с категорией category (пусто - с любой)
+	// и всеми тегами tags: ErrNotFound, ErrTooManyTransactions
+	Statement(ctx context.Context, userID int, from, to time.Time, category string, tags []string, limit int) (Statement, error)
+	// BalanceAt - баланс пользователя на момент at по леджеру, ErrNotFound если его нет
+	BalanceAt(ctx context.Context, userID int, at time.Time) (HistoricalBalance, error)
+	// TrialBalance - суммы проводок двойной записи по счетам
+	TrialBalance(ctx context.Context) (TrialBalance, error)
+	// CheckConsistency - до limit расхождений балансов с леджером и несбалансированных записей, см. ConsistencyReport
+	CheckConsistency(ctx context.Context, limit int) (ConsistencyReport, error)
+	// RepairConsistency - исправляет расхождения из report, trust - TrustBalance или TrustLedger
+	RepairConsistency(ctx context.Context, report ConsistencyReport, trust string) (RepairResult, error)
+	// SpentSince - сумма списаний пользователя по леджеру начиная с since, для лимитов трат
+	SpentSince(ctx context.Context, userID int, since time.Time) (int64, error)
+	// SetUserFrozen - замораживает или размораживает счет пользователя, ErrNotFound если его нет, см. SetFrozen
+	SetUserFrozen(ctx context.Context, userID int, frozen bool) error
+	// SetUserCreditLimit - меняет кредитный лимит пользователя, ErrNotFound если его нет, см. SetCreditLimit
+	SetUserCreditLimit(ctx context.Context, userID int, limit int64) error
+	// SetUserMaxBalance - меняет максимальный баланс пользователя, ErrNotFound если его нет, см. SetMaxBalance
+	SetUserMaxBalance(ctx context.Context, userID int, maxBalance int64) error
+}
+
+// BulkSaver - хранилище, у которого есть более быстрый способ сохранить большую пачку, чем SavePendingBatch
+type BulkSaver interface {
+	SavePendingBulk(ctx context.Context, batch []UserPending) error
+}
+
+// sqlStorage - общая для SQL бэкендов часть Storage, различия диалектов учитываются в самих запросах
+type sqlStorage struct {
+	sess *dbr.Session
+}
+
+// Postgres - Storage поверх dbr и Postgres
+type Postgres struct {
+	sqlStorage
+}
+
+func NewPostgres(db *dbr.Connection) *Postgres {
+	return &Postgres{sqlStorage{sess: db.NewSession(nil)}}
+}
+
+func (p *sqlStorage) LoadUser(ctx context.Context, id int) (*User, error) {
+	return LoadUser(ctx, p.sess, id)
+}
+
+func (p *sqlStorage) LoadUsers(ctx context.Context, ids []int) ([]*User, error) {
+	return LoadUsers(ctx, p.sess, ids)
+}
+
+func (p *sqlStorage) RecentUserIDs(ctx context.Context, limit int) ([]int, error) {
+	return RecentUserIDs(ctx, p.sess, limit)
+}
+
+func (p *sqlStorage) SavePending(ctx context.Context, userID int, pending Pending) error {
+	return SavePending(ctx, p.sess, userID, pending)
+}
+
+func (p *sqlStorage) JournalSeq(ctx context.Context, userID int) (int64, error) {
+	return JournalSeq(ctx, p.sess, userID)
+}
+
+func (p *sqlStorage) LoadTransaction(ctx context.Context, id string) (Transaction, error) {
+	return LoadTransaction(ctx, p.sess, id)
+}
+
+func (p *sqlStorage) MergeUsers(ctx context.Context, from, into *User) (int, error) {
+	return MergeUsers(ctx, p.sess, from, into)
+}
+
+func (p *sqlStorage) DebitStrict(ctx context.Context, userID, amount, fee int, tag, category string, tags Tags) (Transaction, error) {
+	return debitStrict(ctx, p.sess, userID, amount, fee, tag, category, tags)
+}
+
+func (p *sqlStorage) SetUserStatus(ctx context.Context, userID int, status string) error {
+	return setUserStatus(ctx, p.sess, userID, status)
+}
+
+func (p *sqlStorage) CreateUser(ctx context.Context, balance int64, metadata Metadata) (*User, error) {
+	return createUser(ctx, p.sess, balance, metadata)
+}
+
+func (p *sqlStorage) SetUserMetadata(ctx context.Context, userID int, metadata Metadata) error {
+	return setUserMetadata(ctx, p.sess, userID, metadata)
+}
+
+func (p *sqlStorage) ListUsers(ctx context.Context, opts ListOptions) (UserPage, error) {
+	return listUsers(ctx, p.sess, opts)
+}
+
+func (p *sqlStorage) ImportUsers(ctx context.Context, users []ImportUser) error {
+	return importUsers(ctx, p.sess, users)
+}
+
+func (p *sqlStorage) ListTransactions(ctx context.Context, f TransactionFilter) ([]Transaction, error) {
+	return listTransactions(ctx, p.sess, f)
+}
+
+func (p *sqlStorage) Statement(ctx context.Context, userID int, from, to time.Time, category string, tags []string, limit int) (Statement, error) {
+	return loadStatement(ctx, p.sess, userID, from, to, category, tags, limit)
+}
+
+func (p *sqlStorage) BalanceAt(ctx context.Context, userID int, at time.Time) (HistoricalBalance, error) {
+	return loadBalanceAt(ctx, p.sess, userID, at)
+}
+
+func (p *sqlStorage) TrialBalance(ctx context.Context) (TrialBalance, error) {
+	return loadTrialBalance(ctx, p.sess)
+}
+
+func (p *sqlStorage) CheckConsistency(ctx context.Context, limit int) (ConsistencyReport, error) {
+	return checkConsistency(ctx, p.sess, limit)
+}
+
+func (p *sqlStorage) RepairConsistency(ctx context.Context, report ConsistencyReport, trust string) (RepairResult, error) {
+	return repairConsistency(ctx, p.sess, report, trust)
+}
+
+func (p *sqlStorage) SpentSince(ctx context.Context, userID int, since time.Time) (int64, error) {
+	return spentSince(ctx, p.sess, userID, since)
+}
+
+func (p *sqlStorage) SetUserFrozen(ctx context.Context, userID int, frozen bool) error {
+	return setUserFrozen(ctx, p.sess, userID, frozen)
+}
+
+func (p *sqlStorage) SetUserCreditLimit(ctx context.Context, userID int, limit int64) error {
+	return setUserCreditLimit(ctx, p.sess, userID, limit)
+}
+
+func (p *sqlStorage) SetUserMaxBalance(ctx context.Context, userID int, maxBalance int64) error {
+	return setUserMaxBalance(ctx, p.sess, userID, maxBalance)
+}
+
+func (p *Postgres) SavePendingBatch(ctx context.Context, batch []UserPending) error {
+	return SavePendingBatch(ctx, p.sess, batch)
+}
+
+// SavePendingBulk - пачка через COPY, см. SavePendingCopy
+func (p *Postgres) SavePendingBulk(ctx context.Context, batch []UserPending) error {
+	return SavePendingCopy(ctx, p.sess, batch)
+}
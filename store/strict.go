@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/gocraft/dbr/v2/dialect"
+)
+
+// debitStrict - списание целиком в транзакции SQL хранилища: строка пользователя блокируется SELECT ... FOR UPDATE,
+// проверки идут по балансу в БД, баланс и записи леджера (списание и комиссия fee) пишутся до COMMIT
+func debitStrict(ctx context.Context, sess *dbr.Session, userID, amount, fee int, tag, category string, tags Tags) (Transaction, error) {
+	tx, err := sess.BeginTx(ctx, nil)
+	if err != nil {
+		return Transaction{}, err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	var row struct {
+		Balance     int64  `db:"balance"`
+		Bonus       int64  `db:"bonus"`
+		Pocketed    int64  `db:"pocketed"`
+		CreditLimit int64  `db:"credit_limit"`
+		Frozen      bool   `db:"frozen"`
+		Status      string `db:"status"`
+	}
+	stmt := tx.Select("balance", "bonus", "pocketed", "credit_limit", "frozen", "status").From("users").Where("id = ?", userID)
+	// в SQLite писатель и так один, блокировка строк не нужна
+	if tx.Dialect != dialect.SQLite3 {
+		stmt.Suffix("FOR UPDATE")
+	}
+	n, err := stmt.LoadContext(ctx, &row)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if n == 0 {
+		return Transaction{}, ErrNotFound
+	}
+	// именованные карманы строгое списание не тратит, как и списание через кеш
+	if err := checkStrictDebit(row.Balance, row.CreditLimit-row.Pocketed, row.Frozen, row.Status, amount+fee); err != nil {
+		return Transaction{}, err
+	}
+
+	t := newTransaction(userID, -amount, OperationDebit, tag)
+	t.Category, t.Tags = category, tags
+	txs := append(bonusTransactions(t, row.Bonus), debitTransactions(t, fee)...)
+	_, err = tx.Update("users").Set("balance", dbr.Expr("balance - ?", amount+fee)).Set("bonus", dbr.Expr("bonus + ?", bonusDelta(txs))).
+		Set("version", dbr.Expr("version + 1")).Set("updated_at", dbr.Now).Where("id = ?", userID).ExecContext(ctx)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if err := insertTransactions(ctx, tx, txs); err != nil {
+		return Transaction{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Transaction{}, err
+	}
+	return t, nil
+}
+
+// checkStrictDebit - те же проверки, что checkDebit, по строке из хранилища
+func checkStrictDebit(balance, creditLimit int64, frozen bool, status string, amount int) error {
+	if frozen {
+		return ErrFrozen
+	}
+	if err := statusError(status); err != nil {
+		return err
+	}
+	if !Covers(balance, amount, -creditLimit) {
+		return ErrNotEnoughMoney
+	}
+	return nil
+}
+
+// DebitStrict - строгое списание через storage.DebitStrict в обход кеша. Если пользователь есть в кеше (cached != nil),
+// все идет под его блокировкой: сначала сохраняются его несохраненные изменения, чтобы проверка по БД их учитывала,
+// а баланс проверяется и в памяти - в нем есть изменения, которые сохраняются прямо сейчас, и резервы Lockless списаний.
+// После списания баланс в памяти уменьшается на amount и комиссию fee, а бонусы - так же, как в БД
+func DebitStrict(ctx context.Context, storage Storage, cached *User, userID, amount, fee int, tag, category string, tags Tags) (Transaction, error) {
+	if cached == nil {
+		return storage.DebitStrict(ctx, userID, amount, fee, tag, category, tags)
+	}
+
+	l := cached.lock()
+	l.Lock()
+	defer l.Unlock()
+
+	if err := cached.checkDebit(amount+fee, cached.floor()); err != nil {
+		return Transaction{}, err
+	}
+	if err := cached.savePendingLocked(ctx, storage); err != nil {
+		return Transaction{}, err
+	}
+
+	tx, err := storage.DebitStrict(ctx, userID, amount, fee, tag, category, tags)
+	if err != nil {
+		return Transaction{}, err
+	}
+	atomic.AddInt64(&cached.Balance, -int64(amount+fee))
+	cached.saved -= int64(amount + fee)
+	// несохраненных изменений уже нет, поэтому бонусы в памяти те же, что в БД до списания
+	used := bonusDelta(bonusTransactions(tx, cached.Bonus))
+	cached.Bonus += used
+	cached.savedBonus += used
+	cached.UpdatedAt = tx.CreatedAt
+	return tx, nil
+}
+
+// savePendingLocked - сохраняет несохраненные изменения под уже взятой блокировкой, с проверкой версии как SaveVersioned.
+// Фоновое сохранение потом найдет у пользователя пустой Pending
+func (u *User) savePendingLocked(ctx context.Context, storage Storage) error {
+	p := u.pending
+	if p.Delta == 0 && len(p.Transactions) == 0 {
+		return nil
+	}
+	p.Version = u.Version
+
+	for rebases := 0; ; rebases++ {
+		err := storage.SavePending(ctx, u.ID, p)
+		var conflict *VersionConflict
+		if !errors.As(err, &conflict) || rebases == maxRebases {
+			if err != nil {
+				return err
+			}
+			u.pending = Pending{Seq: p.Seq}
+			u.savedLocked(p)
+			return nil
+		}
+		p.Version = u.rebaseLocked(conflict)
+	}
+}
@@ -0,0 +1,48 @@
+package store
+
+import "sync"
+
+// stripeBits - log2 количества блокировок в Stripes
+const stripeBits = 10
+
+const stripeCount = 1 << stripeBits
+
+// Stripes - фиксированный набор блокировок вместо мьютекса на каждого пользователя:
+// пользователь блокируется мьютексом, выбранным по хешу его id. Пользователи с общим мьютексом
+// ждут друг друга, зато память под блокировки не растет с количеством пользователей
+type Stripes struct {
+	mu [stripeCount]sync.Mutex
+}
+
+// userLocks - блокировки изменений пользователей
+var userLocks Stripes
+
+// For - блокировка пользователя id
+func (s *Stripes) For(id int) *sync.Mutex {
+	return &s.mu[stripeIndex(id)]
+}
+
+// LockPair - блокирует двух пользователей без взаимной блокировки встречных вызовов, возвращает разблокировку
+func (s *Stripes) LockPair(a, b int) (unlock func()) {
+	i, j := stripeIndex(a), stripeIndex(b)
+	if i == j {
+		s.mu[i].Lock()
+		return s.mu[i].Unlock
+	}
+
+	// блокируем всегда в порядке номера, чтобы два встречных вызова не заблокировали друг друга
+	if i > j {
+		i, j = j, i
+	}
+	s.mu[i].Lock()
+	s.mu[j].Lock()
+	return func() {
+		s.mu[j].Unlock()
+		s.mu[i].Unlock()
+	}
+}
+
+// stripeIndex - фибоначчиево хеширование, чтобы соседние id попадали в разные блокировки
+func stripeIndex(id int) uint32 {
+	return (uint32(id) * 2654435769) >> (32 - stripeBits)
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/gocraft/dbr/v2/dialect"
+)
+
+// MaxTags - сколько произвольных тегов может быть у операции
+const MaxTags = 10
+
+// ErrInvalidCategory - категория операции в недопустимом формате
+var ErrInvalidCategory = errors.New("invalid category: up to 64 chars of a-z, 0-9, '_', '-', '.'")
+
+// ErrInvalidTags - слишком много тегов операции, тег пустой, длинный, с пробелами по краям или повторяется
+var ErrInvalidTags = fmt.Errorf("invalid tags: up to %d distinct non-empty tags of up to %d chars without surrounding spaces", MaxTags, MaxTagLength)
+
+// Tags - произвольные теги операции (например "trip-2024", "Отпуск"), в Postgres - колонка jsonb с массивом,
+// в SQLite - TEXT. Пустое значение - пустой массив
+type Tags []string
+
+// emptyTags - значение колонки tags по умолчанию
+const emptyTags = "[]"
+
+// ValidateCategory - пустая категория допустима, иначе в формате тега
+func ValidateCategory(category string) error {
+	if ValidateTag(category) != nil {
+		return ErrInvalidCategory
+	}
+	return nil
+}
+
+// ValidateTags - не больше MaxTags разных тегов, каждый - непустая строка до MaxTagLength символов
+// без пробелов по краям. Пустой список допустим
+func ValidateTags(tags Tags) error {
+	if len(tags) > MaxTags {
+		return ErrInvalidTags
+	}
+	for i, tag := range tags {
+		if tag == "" || tag != strings.TrimSpace(tag) || utf8.RuneCountInString(tag) > MaxTagLength || tags[:i].Has(tag) {
+			return ErrInvalidTags
+		}
+	}
+	return nil
+}
+
+// Has - среди тегов есть все tags
+func (t Tags) Has(tags ...string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, have := range t {
+			if have == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Scan - из jsonb (драйверы отдают []byte или string) и TEXT SQLite
+func (t *Tags) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*t = nil
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into tags", src)
+	}
+	var tags Tags
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+	*t = tags
+	return nil
+}
+
+func (t Tags) Value() (driver.Value, error) {
+	return t.String(), nil
+}
+
+// String - JSON массив тегов, как в колонке tags
+func (t Tags) String() string {
+	if len(t) == 0 {
+		return emptyTags
+	}
+	data, _ := json.Marshal([]string(t))
+	return string(data)
+}
+
+// Matches - у записи категория category (пусто - любая) и все теги tags
+func (tx Transaction) Matches(category string, tags []string) bool {
+	return (category == "" || tx.Category == category) && tx.Tags.Has(tags...)
+}
+
+// filterLabels - условия на категорию (пусто - любая) и теги записей леджера. В Postgres все теги - одно условие
+// @>, которое использует GIN индекс transactions_tags
+func filterLabels(stmt *dbr.SelectStmt, d dbr.Dialect, category string, tags []string) {
+	if category != "" {
+		stmt.Where("category = ?", category)
+	}
+	if len(tags) == 0 {
+		return
+	}
+	if d == dialect.SQLite3 {
+		for _, tag := range tags {
+			stmt.Where("EXISTS (SELECT 1 FROM json_each(tags) WHERE value = ?)", tag)
+		}
+		return
+	}
+	stmt.Where("tags @> ?::jsonb", Tags(tags).String())
+}
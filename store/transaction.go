@@ -0,0 +1,142 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// операции леджера
+const (
+	OperationDebit = "debit"
+	// OperationCredit - пополнение баланса
+	OperationCredit = "credit"
+	// OperationFee - комиссия, списанная вместе с операцией отдельной записью
+	OperationFee = "fee"
+	// OperationBonusCredit, OperationBonusExpiry - начисление бонусов и списание сгоревших, см. User.Bonus
+	OperationBonusCredit = "bonus_credit"
+	OperationBonusExpiry = "bonus_expiry"
+	// OperationBonusOut, OperationBonusIn - перенос бонусов в основной баланс перед списанием: в сумме ноль,
+	// баланс не меняется, уменьшается только бонусная часть
+	OperationBonusOut = "bonus_out"
+	OperationBonusIn  = "bonus_in"
+	// OperationCashback - возврат части списания по правилам кешбэка, см. CreditCashback
+	OperationCashback = "cashback"
+	// OperationInterest - месячная выплата процентов на баланс, см. PayInterest
+	OperationInterest = "interest"
+	// OperationPocketOut, OperationPocketIn - перевод между карманами пользователя (Tag - имя кармана): в сумме ноль,
+	// баланс не меняется, см. User.Pocketed
+	OperationPocketOut = "pocket_out"
+	OperationPocketIn  = "pocket_in"
+	// OperationTransferOut, OperationTransferIn - перевод между пользователями: списание у отправителя и пополнение
+	// получателя (или возврат отправителю, если пополнение не прошло), см. RunScheduledDebit
+	OperationTransferOut = "transfer_out"
+	OperationTransferIn  = "transfer_in"
+	// OperationEscrowHold - списание плательщика на счет эскроу, OperationEscrowRelease и OperationEscrowReturn -
+	// выплата со счета эскроу получателю или возврат плательщику, см. HoldEscrow
+	OperationEscrowHold    = "escrow_hold"
+	OperationEscrowRelease = "escrow_release"
+	OperationEscrowReturn  = "escrow_return"
+	// OperationDisputeHold, OperationDisputeRelease - удержание суммы оспоренного пополнения и его возврат,
+	// если пополнение осталось в силе, см. OpenDispute
+	OperationDisputeHold    = "dispute_hold"
+	OperationDisputeRelease = "dispute_release"
+	// OperationMergeOut, OperationMergeIn - перенос баланса при слиянии пользователей
+	OperationMergeOut = "merge_out"
+	OperationMergeIn  = "merge_in"
+	// OperationOpening - начальный баланс пользователя при создании
+	OperationOpening = "opening"
+	// OperationAdjustment - исправление расхождения леджера с балансом, см. Repair
+	OperationAdjustment = "adjustment"
+	// OperationReversal - отмена операции оператором записью на противоположную сумму, см. ReverseTransaction.
+	// Запись отмены - OperationReversal с суффиксом отмененной операции, см. ReversalOperation
+	OperationReversal = "reversal"
+)
+
+// ReversalOperation - операция записи отмены операции operation, например "reversal_debit"
+func ReversalOperation(operation string) string {
+	return OperationReversal + "_" + operation
+}
+
+// ErrInvalidTag - тег операции в недопустимом формате
+var ErrInvalidTag = errors.New("invalid tag: up to 64 chars of a-z, 0-9, '_', '-', '.'")
+
+// MaxTagLength - максимальная длина тега операции
+const MaxTagLength = 64
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9_.-]{1,` + strconv.Itoa(MaxTagLength) + `}$`)
+
+// Transaction - запись леджера об изменении баланса пользователя
+type Transaction struct {
+	ID     string `db:"id" json:"id"`
+	UserID int    `db:"user_id" json:"user_id"`
+	// Amount - изменение баланса, отрицательное для списаний
+	Amount    int    `db:"amount" json:"amount"`
+	Operation string `db:"operation" json:"operation"`
+	// Tag - тег операции (например код услуги для биллинга), может быть пустым
+	Tag string `db:"tag" json:"tag,omitempty"`
+	// Category, Tags - необязательные категория операции в формате тега и произвольные теги для отчетов и фильтров
+	Category string `db:"category" json:"category,omitempty"`
+	Tags     Tags   `db:"tags" json:"tags,omitempty"`
+	// CreatedAt - время операции в UTC
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// TransactionColumns - колонки таблицы transactions, которые читает и пишет код.
+// Запросы перечисляют колонки явно, чтобы не зависеть от колонок новых версий схемы
+var TransactionColumns = []string{"id", "user_id", "amount", "operation", "tag", "category", "tags", "created_at"}
+
+// ValidateTag - пустой тег допустим
+func ValidateTag(tag string) error {
+	if tag != "" && !tagPattern.MatchString(tag) {
+		return ErrInvalidTag
+	}
+	return nil
+}
+
+// NewTransactionID - случайный идентификатор транзакции
+func NewTransactionID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// newTransaction - транзакция пользователя на amount
+func newTransaction(userID, amount int, operation, tag string) Transaction {
+	return Transaction{
+		ID:        NewTransactionID(),
+		UserID:    userID,
+		Amount:    amount,
+		Operation: operation,
+		Tag:       tag,
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+}
+
+// openingTransactions - записи начальных балансов созданных пользователей: balances по id, нулевые пропускаются
+func openingTransactions(balances map[int]int64, createdAt time.Time) []Transaction {
+	txs := make([]Transaction, 0, len(balances))
+	for id, balance := range balances {
+		if balance != 0 {
+			tx := newTransaction(id, int(balance), OperationOpening, "")
+			tx.CreatedAt = createdAt
+			txs = append(txs, tx)
+		}
+	}
+	return txs
+}
+
+// LoadTransaction - запись леджера по id, dbr.ErrNotFound если ее нет в БД
+func LoadTransaction(ctx context.Context, sess *dbr.Session, id string) (Transaction, error) {
+	var tx Transaction
+	err := sess.Select(TransactionColumns...).From("transactions").Where("id = ?", id).LoadOneContext(ctx, &tx)
+	return tx, err
+}
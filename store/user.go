@@ -0,0 +1,496 @@
+package store
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotEnoughMoney - на балансе недостаточно средств для списания
+var ErrNotEnoughMoney = errors.New("not enough money")
+
+// ErrFrozen - счет заморожен, операции по нему запрещены
+var ErrFrozen = errors.New("account is frozen")
+
+// UserColumns - колонки таблицы users, которые читаются в User
+var UserColumns = []string{"id", "balance", "frozen", "version", "created_at", "updated_at", "status", "metadata", "credit_limit",
+	"max_balance", "bonus", "pocketed"}
+
+type User struct {
+	ID int `db:"id"`
+	// Balance - читается и меняется только через atomic, см. reserve
+	Balance int64 `db:"balance"`
+	Frozen  bool  `db:"frozen"`
+	// Version - версия строки в БД, на которой основано состояние в памяти, меняется под блокировкой
+	Version int64 `db:"version"`
+	// CreatedAt - создание пользователя
+	CreatedAt time.Time `db:"created_at"`
+	// UpdatedAt - последнее изменение: из БД - последняя запись строки, в памяти - еще и несохраненные
+	// изменения этого экземпляра. Меняется под блокировкой
+	UpdatedAt time.Time `db:"updated_at"`
+	// Status - StatusActive, StatusBlocked или StatusDeleted, пусто - StatusActive. Меняется под блокировкой
+	Status string `db:"status"`
+	// Metadata - произвольные данные пользователя, см. Metadata. Меняется под блокировкой
+	Metadata Metadata `db:"metadata"`
+	// CreditLimit - овердрафт: списания могут увести баланс в минус до -CreditLimit. Читается через atomic
+	// (reserve берет его без блокировки), меняется под блокировкой, см. SetCreditLimit
+	CreditLimit int64 `db:"credit_limit"`
+	// MaxBalance - максимальный баланс, выше которого пополнения не проходят, 0 - общий по умолчанию
+	// (CreditOptions.MaxBalance). Меняется под блокировкой, см. SetMaxBalance
+	MaxBalance int64 `db:"max_balance"`
+	// Bonus - бонусная часть Balance, которая тратится раньше основной и сгорает, см. ExpireBonus.
+	// Меняется под блокировкой
+	Bonus int64 `db:"bonus"`
+	// Pocketed - сумма именованных карманов (см. TransferPocket), часть Balance, которую не тратят списания
+	// из основного кармана. Читается через atomic (reserve берет его без блокировки), меняется под блокировкой
+	Pocketed int64 `db:"pocketed"`
+	// merged - баланс перенесен слиянием, меняется под блокировкой
+	merged bool
+	// saved - баланс в БД при версии Version: загруженный плюс сохраненные с тех пор изменения, см. Rebase
+	saved int64
+	// savedBonus, savedPocketed - то же для Bonus и Pocketed
+	savedBonus    int64
+	savedPocketed int64
+
+	// pending - изменения, еще не записанные в БД
+	pending Pending
+	// queued - 1, пока пользователь стоит в очереди фонового сохранения
+	queued int32
+}
+
+// Pending - несохраненные изменения пользователя
+type Pending struct {
+	// Delta - суммарное изменение баланса (отрицательное для списаний)
+	Delta int `json:"delta"`
+	// Seq - номер последней записи журнала изменений, вошедшей в Delta
+	Seq int64 `json:"seq"`
+	// Transactions - записи леджера, из которых сложилась Delta
+	Transactions []Transaction `json:"transactions"`
+	// Version - версия строки, на которой основаны изменения: сохранение проходит, только если в БД она же.
+	// 0 - без проверки (журнал, DeadLetters, синхронный режим)
+	Version int64 `json:"-"`
+}
+
+// BonusDelta - изменение бонусной части баланса по записям Transactions
+func (p Pending) BonusDelta() int64 {
+	return bonusDelta(p.Transactions)
+}
+
+// bonusDelta - сумма записей txs, меняющих бонусную часть баланса
+func bonusDelta(txs []Transaction) int64 {
+	var delta int64
+	for _, tx := range txs {
+		switch tx.Operation {
+		case OperationBonusCredit, OperationBonusExpiry, OperationBonusOut:
+			delta += int64(tx.Amount)
+		}
+	}
+	return delta
+}
+
+// Journal - журнал, в который каждое изменение баланса записывается до подтверждения клиенту
+type Journal interface {
+	Append(tx Transaction) (seq int64, err error)
+}
+
+// SharedBalance - баланс, общий для нескольких экземпляров сервиса. Debit атомарно проверяет и списывает amount,
+// если баланс после списания не меньше floor (минус кредитный лимит), current - баланс из БД, если общего значения
+// еще нет. Возвращает баланс после списания
+type SharedBalance interface {
+	Debit(userID, amount, current, floor int) (balance int, err error)
+	Refund(userID, amount int) error
+}
+
+// UserState - снимок полей пользователя для ответа клиенту
+type UserState struct {
+	ID      int `json:"id"`
+	Balance int `json:"balance"`
+	// CreditLimit - на сколько баланс может уйти в минус, Overdrawn - на сколько ушел (0 при неотрицательном)
+	CreditLimit int `json:"credit_limit"`
+	Overdrawn   int `json:"overdrawn"`
+	// MaxBalance - свой максимальный баланс пользователя, 0 - общий
+	MaxBalance int64 `json:"max_balance"`
+	// Bonus - бонусная часть Balance, Pocketed - часть в именованных карманах
+	Bonus     int64     `json:"bonus"`
+	Pocketed  int64     `json:"pocketed"`
+	Frozen    bool      `json:"frozen"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Metadata  Metadata  `json:"metadata"`
+}
+
+// State - согласованный снимок полей пользователя
+func (u *User) State() UserState {
+	l := u.lock()
+	l.Lock()
+	defer l.Unlock()
+
+	balance := int(atomic.LoadInt64(&u.Balance))
+	return UserState{
+		ID:          u.ID,
+		Balance:     balance,
+		CreditLimit: int(atomic.LoadInt64(&u.CreditLimit)),
+		Overdrawn:   Overdrawn(balance),
+		MaxBalance:  u.MaxBalance,
+		Bonus:       u.Bonus,
+		Pocketed:    atomic.LoadInt64(&u.Pocketed),
+		Frozen:      u.Frozen,
+		Status:      u.status(),
+		CreatedAt:   u.CreatedAt,
+		UpdatedAt:   u.UpdatedAt,
+		Metadata:    u.Metadata,
+	}
+}
+
+// IsDirty - есть ли у пользователя несохраненные изменения
+func (u *User) IsDirty() bool {
+	l := u.lock()
+	l.Lock()
+	defer l.Unlock()
+	return u.pending.Delta != 0 || len(u.pending.Transactions) > 0
+}
+
+// TakePending - забирает накопленные несохраненные изменения
+func (u *User) TakePending() Pending {
+	l := u.lock()
+	l.Lock()
+	defer l.Unlock()
+
+	p := u.pending
+	p.Version = u.Version
+	u.pending = Pending{Seq: p.Seq}
+	return p
+}
+
+// RestorePending - возвращает изменения, которые не удалось сохранить
+func (u *User) RestorePending(p Pending) {
+	l := u.lock()
+	l.Lock()
+	defer l.Unlock()
+
+	u.pending.Delta += p.Delta
+	u.pending.Transactions = append(p.Transactions, u.pending.Transactions...)
+}
+
+// MarkQueued - отмечает пользователя поставленным в очередь сохранения, false - он уже в очереди
+func (u *User) MarkQueued() bool {
+	return atomic.CompareAndSwapInt32(&u.queued, 0, 1)
+}
+
+// Dequeued - пользователь вычитан из очереди сохранения, следующие изменения снова ставят его в очередь
+func (u *User) Dequeued() {
+	atomic.StoreInt32(&u.queued, 0)
+}
+
+// DecreaseBalance - списывает amount, баланс резервируется CAS без блокировки (см. DebitOptions.Lockless)
+func (u *User) DecreaseBalance(amount int) error {
+	_, err := u.ApplyDebit(amount, DebitOptions{Lockless: true})
+	return err
+}
+
+// DebitOptions - шаги, которые выполняются вместе со списанием одним шагом под блокировкой пользователя,
+// чтобы проверки, изменение баланса, запись в журнал и несохраненные изменения не перемежались
+// с другими изменениями и фоновым сохранением этого пользователя
+type DebitOptions struct {
+	Tag string
+	// Category, Tags - категория и теги записи списания, переходят и на запись комиссии
+	Category string
+	Tags     Tags
+	// Operation - операция записи, пусто - OperationDebit
+	Operation string
+	// Check - дополнительные проверки перед списанием (лимиты, место в очереди сохранения)
+	Check func(u *User) error
+	// Partial - при нехватке средств списать сколько есть (FundsPartial), Amount транзакции - списанная сумма.
+	// Только без Shared, ErrNotEnoughMoney - только если списать нечего
+	Partial bool
+	// Pocket - именованный карман, из которого идет списание, пусто или PocketMain - основной. Только с Save,
+	// без Shared и без Partial: карман проверяется при сохранении (см. savePockets), бонусы не тратятся
+	Pocket string
+	// MainOnly - списать только из основного баланса: бонусы не тратятся и не считаются доступными. Для переводов,
+	// эскроу, удержаний и отмен, чтобы бонусы не уходили другим пользователям основным балансом и не уходили от сгорания
+	MainOnly bool
+	// Fee - комиссия за списание суммы amount, списывается вместе с ним отдельной записью OperationFee
+	// и проверяется вместе с ним по балансу. nil - без комиссии
+	Fee func(amount int) int
+	// Shared - общий баланс: достаточность средств проверяется по нему, а не по локальному Balance, nil - только локальный
+	Shared SharedBalance
+	// Journal - журнал, в который транзакция пишется до изменения баланса, nil - без журнала
+	Journal Journal
+	// Save - синхронное сохранение изменения; если вернул ошибку, списание отменяется. nil - изменение копится в Pending
+	Save func(p Pending) error
+	// Lockless - баланс проверяется и уменьшается CAS до взятия блокировки, под ней остаются только Check,
+	// журнал и Pending, что снижает конкуренцию за очень активных пользователей. Только без Shared и Save,
+	// с ними списание целиком идет под блокировкой
+	Lockless bool
+	// Mark - вызывается после успешного списания, уже без блокировки: постановка в очередь сохранения
+	// может ждать места, а фоновое сохранение берет ту же блокировку. Изменение к этому моменту уже в Pending
+	Mark func(u *User)
+}
+
+// ApplyDebit - списывает amount со всеми шагами opts под блокировкой пользователя
+func (u *User) ApplyDebit(amount int, opts DebitOptions) (Transaction, error) {
+	tx, err := u.applyDebit(amount, opts)
+	if err == nil && opts.Mark != nil {
+		opts.Mark(u)
+	}
+	return tx, err
+}
+
+func (u *User) applyDebit(amount int, opts DebitOptions) (tx Transaction, err error) {
+	fee := opts.fee(amount)
+	// total - списание вместе с комиссией
+	total := amount + fee
+
+	pocket := opts.Pocket != "" && opts.Pocket != PocketMain
+	if pocket && (opts.Save == nil || opts.Shared != nil) {
+		return Transaction{}, ErrPocketNeedsSave
+	}
+
+	lockless := opts.Lockless && opts.Shared == nil && opts.Save == nil && !opts.MainOnly
+	// reserved - баланс уже уменьшен на total, при ошибке возвращается
+	reserved := lockless && u.reserve(total, u.floor())
+
+	l := u.lock()
+	l.Lock()
+	defer l.Unlock()
+
+	if pocket {
+		// деньги кармана переходят в основной до проверки баланса, при ошибке возвращаются
+		if atomic.LoadInt64(&u.Pocketed) < int64(total) {
+			return Transaction{}, ErrNotEnoughMoney
+		}
+		atomic.AddInt64(&u.Pocketed, -int64(total))
+		defer func() {
+			if err != nil {
+				atomic.AddInt64(&u.Pocketed, int64(total))
+			}
+		}()
+	}
+
+	// floor - до какого баланса можно списать, с MainOnly бонусы остаются нетронутыми
+	floor := u.floor()
+	if opts.MainOnly {
+		floor += u.Bonus
+	}
+
+	if reserved {
+		if err := u.checkState(); err != nil {
+			// резерв сделан до слияния, которое уже обнулило баланс вместе с ним
+			if !u.merged {
+				u.refund(total)
+			}
+			return Transaction{}, err
+		}
+	}
+
+	if !reserved {
+		if opts.Shared != nil {
+			if err := u.checkState(); err != nil {
+				return Transaction{}, err
+			}
+		} else {
+			// комиссия с доступной суммы не меньше комиссии с остатка после ее вычета, поэтому он с комиссией помещается
+			if available := u.available(total, floor); opts.Partial && available < total && available-opts.fee(available) > 0 {
+				amount = available - opts.fee(available)
+				fee = opts.fee(amount)
+				total = amount + fee
+			}
+			if err := u.checkDebit(total, floor); err != nil {
+				return Transaction{}, err
+			}
+		}
+	}
+
+	defer func() {
+		if err != nil && reserved {
+			u.refund(total)
+		}
+	}()
+
+	if opts.Check != nil {
+		if err := opts.Check(u); err != nil {
+			return Transaction{}, err
+		}
+	}
+
+	if opts.Shared != nil {
+		balance, err := opts.Shared.Debit(u.ID, total, int(atomic.LoadInt64(&u.Balance)), int(floor))
+		if err != nil {
+			return Transaction{}, err
+		}
+		// локальный баланс догоняет общий, в котором это списание уже учтено
+		atomic.StoreInt64(&u.Balance, int64(balance))
+		reserved = true
+
+		defer func() {
+			if err == nil {
+				return
+			}
+			if refundErr := opts.Shared.Refund(u.ID, total); refundErr != nil {
+				log.Printf("failed to refund shared balance of user %d: %v", u.ID, refundErr)
+			}
+		}()
+	} else if !reserved {
+		// в режиме Lockless баланс могли успеть уменьшить другие списания
+		if !u.reserve(total, floor) {
+			return Transaction{}, ErrNotEnoughMoney
+		}
+		reserved = true
+	}
+
+	operation := OperationDebit
+	if opts.Operation != "" {
+		operation = opts.Operation
+	}
+	tx = newTransaction(u.ID, -amount, operation, opts.Tag)
+	tx.Category, tx.Tags = opts.Category, opts.Tags
+	var txs []Transaction
+	if pocket {
+		txs = pocketTransactions(u.ID, opts.Pocket, PocketMain, total)
+		for i := range txs {
+			txs[i].CreatedAt = tx.CreatedAt
+		}
+	} else if !opts.MainOnly {
+		txs = bonusTransactions(tx, u.Bonus)
+	}
+	txs = append(txs, debitTransactions(tx, fee)...)
+	if opts.Save != nil {
+		p := Pending{Delta: -total, Transactions: txs}
+		if err := opts.Save(p); err != nil {
+			return Transaction{}, err
+		}
+		u.savedLocked(p)
+	} else {
+		if opts.Journal != nil {
+			for _, t := range txs {
+				seq, err := opts.Journal.Append(t)
+				if err != nil {
+					return Transaction{}, err
+				}
+				u.pending.Seq = seq
+			}
+		}
+
+		u.pending.Delta -= total
+		u.pending.Transactions = append(u.pending.Transactions, txs...)
+	}
+	u.Bonus += bonusDelta(txs)
+	u.UpdatedAt = tx.CreatedAt
+
+	return tx, nil
+}
+
+// fee - комиссия за списание amount, 0 без Fee
+func (opts DebitOptions) fee(amount int) int {
+	if opts.Fee == nil {
+		return 0
+	}
+	return opts.Fee(amount)
+}
+
+// debitTransactions - запись списания tx и, если fee не ноль, запись его комиссии с теми же тегом, категорией,
+// тегами и временем
+func debitTransactions(tx Transaction, fee int) []Transaction {
+	if fee == 0 {
+		return []Transaction{tx}
+	}
+	feeTx := newTransaction(tx.UserID, -fee, OperationFee, tx.Tag)
+	feeTx.Category, feeTx.Tags, feeTx.CreatedAt = tx.Category, tx.Tags, tx.CreatedAt
+	return []Transaction{tx, feeTx}
+}
+
+// bonusTransactions - перенос в основной баланс той части списания tx, которая покрывается бонусами bonus
+func bonusTransactions(tx Transaction, bonus int64) []Transaction {
+	used := -int64(tx.Amount)
+	if bonus < used {
+		used = bonus
+	}
+	if used <= 0 {
+		return nil
+	}
+	out := newTransaction(tx.UserID, -int(used), OperationBonusOut, tx.Tag)
+	in := newTransaction(tx.UserID, int(used), OperationBonusIn, tx.Tag)
+	out.CreatedAt, in.CreatedAt = tx.CreatedAt, tx.CreatedAt
+	return []Transaction{out, in}
+}
+
+// reserve - CAS-цикл: уменьшает баланс на amount, если после этого он не ниже floor. Не требует блокировки
+func (u *User) reserve(amount int, floor int64) bool {
+	for {
+		balance := atomic.LoadInt64(&u.Balance)
+		if !Covers(balance, amount, floor) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&u.Balance, balance, balance-int64(amount)) {
+			return true
+		}
+	}
+}
+
+// refund - возвращает зарезервированные amount
+func (u *User) refund(amount int) {
+	atomic.AddInt64(&u.Balance, int64(amount))
+}
+
+// Debit - списывает amount, предварительно записав транзакцию в journal (если не nil)
+func (u *User) Debit(amount int, tag string, journal Journal) (Transaction, error) {
+	return u.ApplyDebit(amount, DebitOptions{Tag: tag, Journal: journal})
+}
+
+// DebitAndSave - списывает amount и сразу сохраняет изменение через save, не отпуская блокировку.
+// Если save вернул ошибку, списание отменяется
+func (u *User) DebitAndSave(amount int, tag string, save func(p Pending) error) (Transaction, error) {
+	return u.ApplyDebit(amount, DebitOptions{Tag: tag, Save: save})
+}
+
+// lock - блокировка изменений пользователя из userLocks
+func (u *User) lock() *sync.Mutex {
+	return userLocks.For(u.ID)
+}
+
+// checkState - списания разрешены: счет не заморожен, пользователь активен
+func (u *User) checkState() error {
+	if u.Frozen {
+		return ErrFrozen
+	}
+	return statusError(u.Status)
+}
+
+// status - Status, пустое значение - StatusActive
+func (u *User) status() string {
+	if u.Status == "" {
+		return StatusActive
+	}
+	return u.Status
+}
+
+// checkDebit - можно ли списать amount так, чтобы баланс остался не ниже floor, вызывается под блокировкой
+func (u *User) checkDebit(amount int, floor int64) error {
+	if err := u.checkState(); err != nil {
+		return err
+	}
+
+	if !Covers(atomic.LoadInt64(&u.Balance), amount, floor) {
+		return ErrNotEnoughMoney
+	}
+
+	return nil
+}
+
+// Covers - после списания amount с balance остается не меньше floor. Сравнение без вычитания из balance,
+// которое переполнилось бы на больших суммах
+func Covers(balance int64, amount int, floor int64) bool {
+	if floor > 0 && int64(amount) > math.MaxInt64-floor {
+		return false
+	}
+	return balance >= floor+int64(amount)
+}
+
+// floor - до какого баланса можно списывать из основного кармана: минус кредитный лимит плюс именованные карманы
+func (u *User) floor() int64 {
+	return atomic.LoadInt64(&u.Pocketed) - atomic.LoadInt64(&u.CreditLimit)
+}
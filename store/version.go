@@ -0,0 +1,147 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrVersionConflict - строку пользователя изменил другой писатель после того, как она была прочитана
+var ErrVersionConflict = errors.New("user was changed by another writer")
+
+// maxRebases - сколько раз SaveVersioned догоняет БД, прежде чем вернуть конфликт
+const maxRebases = 3
+
+// VersionConflict - сохранение не прошло проверку версии, изменения не применены.
+// Balance, Bonus, Pocketed, CreditLimit, MaxBalance, Frozen, Status и Version - строка пользователя в БД на момент конфликта
+type VersionConflict struct {
+	UserID      int
+	Balance     int64
+	Bonus       int64
+	Pocketed    int64
+	CreditLimit int64
+	MaxBalance  int64
+	Frozen      bool
+	Status      string
+	Version     int64
+}
+
+func (c *VersionConflict) Error() string {
+	return fmt.Sprintf("user %d: %v (version %d)", c.UserID, ErrVersionConflict, c.Version)
+}
+
+func (c *VersionConflict) Is(target error) bool {
+	return target == ErrVersionConflict
+}
+
+// loaded - пользователь только что прочитан из хранилища: его баланс - это баланс в БД при версии Version
+func (u *User) loaded() *User {
+	u.saved = atomic.LoadInt64(&u.Balance)
+	u.savedBonus = u.Bonus
+	u.savedPocketed = atomic.LoadInt64(&u.Pocketed)
+	return u
+}
+
+// Saved - p, взятые через TakePending, записаны в БД
+func (u *User) Saved(p Pending) {
+	l := u.lock()
+	l.Lock()
+	defer l.Unlock()
+	u.savedLocked(p)
+}
+
+func (u *User) savedLocked(p Pending) {
+	u.saved += int64(p.Delta)
+	u.savedBonus += p.BonusDelta()
+	u.savedPocketed += p.PocketDelta()
+	// без проверки версии запись все равно ее увеличила, поэтому следующее версионное сохранение
+	// получит конфликт и догонит БД
+	if p.Version != 0 && p.Version == u.Version {
+		u.Version++
+	}
+}
+
+// Rebase - догоняет строку в БД после конфликта: к балансу в памяти добавляются чужие изменения,
+// то есть разница между балансом в БД и тем, который был в ней по мнению этого экземпляра.
+// Несохраненные и зарезервированные изменения в памяти остаются. Возвращает новую версию
+func (u *User) Rebase(c *VersionConflict) int64 {
+	l := u.lock()
+	l.Lock()
+	defer l.Unlock()
+	return u.rebaseLocked(c)
+}
+
+func (u *User) rebaseLocked(c *VersionConflict) int64 {
+	if !u.merged {
+		atomic.AddInt64(&u.Balance, c.Balance-u.saved)
+		u.Bonus += c.Bonus - u.savedBonus
+		atomic.AddInt64(&u.Pocketed, c.Pocketed-u.savedPocketed)
+	}
+	u.saved = c.Balance
+	u.savedBonus = c.Bonus
+	u.savedPocketed = c.Pocketed
+	u.Version = c.Version
+	// заморозку и разморозку с другого экземпляра (см. SetFrozen) кеш узнает отсюда
+	u.Frozen = c.Frozen
+	atomic.StoreInt64(&u.CreditLimit, c.CreditLimit)
+	u.MaxBalance = c.MaxBalance
+	if c.Status != "" {
+		u.Status = c.Status
+	}
+	return u.Version
+}
+
+// Outdated - строка в БД новее состояния в памяти (ее version больше), а несохраненных изменений нет
+func (u *User) Outdated(version int64) bool {
+	l := u.lock()
+	l.Lock()
+	defer l.Unlock()
+	return u.Version < version && u.pending.Delta == 0 && len(u.pending.Transactions) == 0
+}
+
+// SaveVersioned - сохраняет p, взятые из u через TakePending, с проверкой версии. Если пользователя успел изменить
+// другой писатель, u догоняет БД (Rebase) и сохранение повторяется с новой версией: изменения баланса коммутативны,
+// поэтому ни свои, ни чужие не теряются. Сохранения одного пользователя не должны идти параллельно
+func SaveVersioned(ctx context.Context, storage Storage, u *User, p Pending) error {
+	for rebases := 0; ; rebases++ {
+		err := storage.SavePending(ctx, u.ID, p)
+		var conflict *VersionConflict
+		if !errors.As(err, &conflict) || rebases == maxRebases {
+			if err == nil {
+				u.Saved(p)
+			}
+			return err
+		}
+		p.Version = u.Rebase(conflict)
+	}
+}
+
+// Drift - насколько баланс в памяти без несохраненных изменений отличается от balance, баланса строки в БД.
+// false - сравнивать нельзя: строка с version новее или старше состояния в памяти, либо баланс перенесен слиянием.
+// Пока изменения сохраняются или резервируются Lockless списанием, расхождение бывает и без ошибки
+func (u *User) Drift(balance, version int64) (int64, bool) {
+	l := u.lock()
+	l.Lock()
+	defer l.Unlock()
+
+	if u.merged || version != u.Version {
+		return 0, false
+	}
+	return atomic.LoadInt64(&u.Balance) - int64(u.pending.Delta) - balance, true
+}
+
+// Correct - исправляет расхождение drift, найденное Drift по той же строке: баланс в памяти становится балансом
+// строки с несохраненными изменениями. false - с тех пор состояние изменилось и исправлять нечего
+func (u *User) Correct(balance, version, drift int64) bool {
+	l := u.lock()
+	l.Lock()
+	defer l.Unlock()
+
+	if u.merged || version != u.Version || atomic.LoadInt64(&u.Balance)-int64(u.pending.Delta)-balance != drift {
+		return false
+	}
+	atomic.AddInt64(&u.Balance, -drift)
+	u.saved = balance
+	return true
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// DefaultWriterLockKey - ключ advisory lock фонового сохранения по умолчанию
+const DefaultWriterLockKey int64 = 0x62616c616e6365 // "balance"
+
+// WriterLock - право единственного писателя: сессионная advisory lock Postgres на отдельном соединении.
+// Пока блокировку держит другой экземпляр, Held возвращает false. Если соединение оборвалось, блокировка
+// считается потерянной до следующей успешной попытки; до обнаружения обрыва (не дольше Interval) писать
+// могут оба экземпляра, что безопасно благодаря дельтам и версиям строк, но не объединяет записи в одни пачки
+type WriterLock struct {
+	// Key - ключ pg_advisory_lock, общий для всех экземпляров одной БД
+	Key int64
+	// Interval - как часто пытаться взять блокировку и проверять соединение с ней
+	Interval time.Duration
+
+	db   *dbr.Connection
+	held int32
+}
+
+func NewWriterLock(db *dbr.Connection, key int64, interval time.Duration) *WriterLock {
+	return &WriterLock{Key: key, Interval: interval, db: db}
+}
+
+// Held - этот экземпляр сейчас держит блокировку
+func (l *WriterLock) Held() bool {
+	return atomic.LoadInt32(&l.held) == 1
+}
+
+// Run - берет и держит блокировку, пока не отменен ctx, затем отпускает ее
+func (l *WriterLock) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.Interval)
+	defer ticker.Stop()
+
+	var conn *sql.Conn
+	defer func() {
+		if conn != nil {
+			l.release(conn)
+		}
+	}()
+
+	waiting := false
+	for {
+		if conn == nil {
+			conn = l.acquire(ctx)
+			if conn != nil {
+				atomic.StoreInt32(&l.held, 1)
+				log.Printf("writer lock %d acquired, background save is enabled", l.Key)
+			} else if !waiting {
+				log.Printf("writer lock %d is held by another instance, background save is paused", l.Key)
+			}
+			waiting = conn == nil
+		} else if err := conn.PingContext(ctx); err != nil && ctx.Err() == nil {
+			atomic.StoreInt32(&l.held, 0)
+			discard(conn)
+			conn = nil
+			log.Printf("writer lock %d lost: %v", l.Key, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// acquire - соединение с взятой блокировкой, nil если ее держит другой или БД недоступна
+func (l *WriterLock) acquire(ctx context.Context) *sql.Conn {
+	checkCtx, cancel := context.WithTimeout(ctx, l.Interval)
+	defer cancel()
+
+	conn, err := l.db.Conn(checkCtx)
+	if err != nil {
+		return nil
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(checkCtx, `SELECT pg_try_advisory_lock($1)`, l.Key).Scan(&locked); err != nil || !locked {
+		conn.Close()
+		return nil
+	}
+	return conn
+}
+
+// release - отпускает блокировку; если не вышло, ее снимет закрытие соединения
+func (l *WriterLock) release(conn *sql.Conn) {
+	atomic.StoreInt32(&l.held, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.Interval)
+	defer cancel()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, l.Key); err != nil {
+		log.Printf("failed to release writer lock %d: %v", l.Key, err)
+		discard(conn)
+		return
+	}
+	conn.Close()
+}
+
+// discard - закрывает соединение, не возвращая его в пул: блокировка сессии уходит вместе с ним
+func discard(conn *sql.Conn) {
+	conn.Raw(func(dc interface{}) error {
+		// соединение pgx иначе вернулось бы в его пул вместе с блокировкой
+		if c, ok := dc.(*stdlib.Conn); ok {
+			c.Conn().Close(context.Background())
+		}
+		return driver.ErrBadConn
+	})
+	conn.Close()
+}
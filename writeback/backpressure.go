@@ -0,0 +1,81 @@
+package writeback
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// политики при заполненной очереди сохранения шарда
+const (
+	// BackpressureBlock - ждать места в очереди (по умолчанию)
+	BackpressureBlock = "block"
+	// BackpressureError - отклонять новые списания с ErrSaveQueueFull
+	BackpressureError = "error"
+	// BackpressureSpill - записывать id пользователя в файл шарда, шард дочитывает его на каждом сохранении
+	BackpressureSpill = "spill"
+)
+
+// ErrSaveQueueFull - очередь сохранения шарда заполнена
+var ErrSaveQueueFull = errors.New("save queue is full")
+
+// spillFile - переполнение очереди шарда на диске: id пользователей построчно.
+// Несохраненные изменения остаются в памяти у пользователя (и в журнале), в файле только очередь
+type spillFile struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openSpillFile(dir string, shard int) (*spillFile, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("spill-%d.ids", shard))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &spillFile{path: path, file: file}, nil
+}
+
+// Append - добавляет пользователя в очередь на диске
+func (f *spillFile) Append(userID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, err := f.file.WriteString(strconv.Itoa(userID) + "\n")
+	return err
+}
+
+// Take - забирает все id из файла и очищает его
+func (f *spillFile) Take() ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	scanner := bufio.NewScanner(f.file)
+	for scanner.Scan() {
+		if id, err := strconv.Atoi(scanner.Text()); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, f.file.Truncate(0)
+}
+
+func (f *spillFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,144 @@
+package writeback
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Skat712/test_balance/store"
+)
+
+// DeadLetter - изменения пользователя, которые не удалось сохранить после всех попыток
+type DeadLetter struct {
+	UserID   int           `json:"user_id"`
+	Pending  store.Pending `json:"pending"`
+	Error    string        `json:"error"`
+	Attempts int           `json:"attempts"`
+	FailedAt time.Time     `json:"failed_at"`
+}
+
+// DeadLetters - файл (JSON строки) с изменениями, которые не удалось сохранить в БД.
+// Хранится локально, потому что при недоступной БД записать их в таблицу тоже не выйдет
+type DeadLetters struct {
+	path string
+	mu   sync.Mutex
+}
+
+func OpenDeadLetters(path string) *DeadLetters {
+	return &DeadLetters{path: path}
+}
+
+// Add - дописывает запись и сбрасывает ее на диск
+func (d *DeadLetters) Add(dl DeadLetter) error {
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f, err := os.OpenFile(d.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(line); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// List - все записи
+func (d *DeadLetters) List() ([]DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.read()
+}
+
+// Redrive - повторно сохраняет все записи, в файле остаются только те, что снова не удалось сохранить.
+// Сохранение идемпотентно по seq журнала, поэтому запись, уже примененная при проигрывании журнала, не задвоится
+func (d *DeadLetters) Redrive(ctx context.Context, storage store.Storage) (int, []DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	letters, err := d.read()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var remaining []DeadLetter
+	for _, dl := range letters {
+		if err := storage.SavePending(ctx, dl.UserID, dl.Pending); err != nil {
+			dl.Error = err.Error()
+			dl.Attempts++
+			remaining = append(remaining, dl)
+		}
+	}
+
+	if err := d.write(remaining); err != nil {
+		return 0, nil, err
+	}
+
+	return len(letters) - len(remaining), remaining, nil
+}
+
+func (d *DeadLetters) read() ([]DeadLetter, error) {
+	f, err := os.Open(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var dl DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			return nil, err
+		}
+		letters = append(letters, dl)
+	}
+	return letters, scanner.Err()
+}
+
+// write - атомарно заменяет содержимое файла
+func (d *DeadLetters) write(letters []DeadLetter) error {
+	tmp := d.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, dl := range letters {
+		if err := enc.Encode(dl); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, d.path)
+}
@@ -0,0 +1,639 @@
+package writeback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/Skat712/test_balance/cache"
+	"github.com/Skat712/test_balance/journal"
+	"github.com/Skat712/test_balance/store"
+)
+
+// pendingEntrySize - примерный размер записи об ожидающем сохранения пользователе
+var pendingEntrySize = int64(unsafe.Sizeof(int(0))+unsafe.Sizeof(&pendingUser{})+unsafe.Sizeof(pendingUser{})) + cache.MapEntryOverhead
+
+// Config - настройки фонового сохранения
+type Config struct {
+	// Shards - количество шардов
+	Shards int
+	// FlushInterval - как часто проверять ожидающих сохранения пользователей
+	FlushInterval time.Duration
+	// Staleness - сохраняются пользователи, которые не обновлялись дольше этого времени
+	Staleness time.Duration
+	// FlushThreshold - сохранить всех ожидающих шарда после стольких обновлений, 0 - отключено
+	FlushThreshold int
+	// BatchSize - сколько пользователей сохранять одним запросом
+	BatchSize int
+	// CopyThreshold - если к сохранению готово не меньше стольких пользователей, все они пишутся
+	// одной пачкой через COPY во временную таблицу вместо пачек по BatchSize, 0 - отключено
+	CopyThreshold int
+	// Adaptive - подстраивать интервал сохранения под нагрузку в пределах [MinFlushInterval, Staleness/2]:
+	// при небольшом количестве изменений и быстрой БД сохранять чаще, под нагрузкой копить большие пачки.
+	// Staleness в этом режиме - верхняя граница задержки сохранения
+	Adaptive         bool
+	MinFlushInterval time.Duration
+	// QueueSize - емкость очереди сохранения шарда
+	QueueSize int
+	// Backpressure - что делать при заполненной очереди: BackpressureBlock, BackpressureError или BackpressureSpill
+	Backpressure string
+	// SpillDir - директория файлов переполнения для BackpressureSpill
+	SpillDir string
+	// Lookup - пользователь по id для очереди из файла переполнения, nil если его нет в памяти
+	Lookup func(id int) *store.User
+	// Journal - журнал изменений, в котором отмечаются сохраненные записи, nil - без журнала
+	Journal *journal.Journal
+	// Writer - может ли экземпляр сейчас писать в БД (например, держит store.WriterLock), nil - всегда.
+	// Пока нет, изменения копятся в очереди
+	Writer func() bool
+
+	// SaveTimeout - сколько ждать одного запроса сохранения, 0 - без ограничения
+	SaveTimeout time.Duration
+
+	// RetryBase, RetryMax - начальная и максимальная пауза между повторами неудачного сохранения
+	RetryBase time.Duration
+	RetryMax  time.Duration
+	// MaxAttempts - после стольких неудачных попыток изменения уходят в DeadLetters
+	MaxAttempts int
+	// DeadLetters - куда складывать изменения, которые не удалось сохранить, nil - повторять бесконечно
+	DeadLetters *DeadLetters
+}
+
+// DefaultConfig - настройки по умолчанию
+func DefaultConfig() Config {
+	return Config{
+		Shards:           4,
+		FlushInterval:    time.Minute,
+		Staleness:        2 * time.Minute,
+		BatchSize:        500,
+		QueueSize:        10000,
+		Backpressure:     BackpressureBlock,
+		MinFlushInterval: time.Second,
+		SaveTimeout:      30 * time.Second,
+		RetryBase:        time.Second,
+		RetryMax:         time.Minute,
+		MaxAttempts:      5,
+	}
+}
+
+// DelayedSave - фоновое сохранение, разбитое на независимые шарды.
+// Каждый шард владеет диапазоном кольца хешей id пользователей и имеет свой канал и цикл сохранения
+type DelayedSave struct {
+	shards []*saveShard
+	ring   hashRing
+}
+
+// saveShard - шард фонового сохранения
+type saveShard struct {
+	id        int
+	cfg       Config
+	storage   store.Storage
+	mainChan  chan *store.User
+	stopChan  chan context.Context
+	doneChan  chan bool
+	flushChan chan flushRequest
+	spill     *spillFile
+
+	// pending - количество пользователей, ожидающих сохранения
+	pending int64
+	// saved - количество записанных в БД пользователей
+	saved int64
+	// retries - количество неудачных попыток сохранения
+	retries int64
+	// deadLetters - количество пользователей, чьи изменения ушли в DeadLetters
+	deadLetters int64
+	// rejected - количество списаний, отклоненных из-за заполненной очереди
+	rejected int64
+	// spilled - количество пользователей, ушедших в файл переполнения
+	spilled int64
+	// coalesced - количество сохранений, объединенных с уже стоящим в очереди пользователем
+	coalesced int64
+	// interval - текущий интервал сохранения, в наносекундах
+	interval int64
+	// flushDuration - длительность последнего непустого сохранения, в наносекундах
+	flushDuration int64
+	// updates - количество обновлений с последнего сохранения по порогу
+	updates int
+}
+
+// flushRequest - запрос немедленного сохранения всех ожидающих пользователей шарда
+type flushRequest struct {
+	ctx    context.Context
+	result chan FlushResult
+}
+
+// FlushResult - итог немедленного сохранения
+type FlushResult struct {
+	// Written - сколько пользователей записано в БД
+	Written int `json:"written"`
+	// Pending - сколько пользователей сохранить не удалось, они останутся в очереди на повтор
+	Pending int `json:"pending"`
+}
+
+// pendingUser - пользователь, ожидающий сохранения, и время его последнего обновления
+type pendingUser struct {
+	user       *store.User
+	updateTime time.Time
+
+	// attempts - неудачные попытки сохранения подряд, nextAttempt - когда пробовать снова
+	attempts    int
+	nextAttempt time.Time
+}
+
+// NewDelayedSave - создает и запускает фоновое сохранение
+func NewDelayedSave(storage store.Storage, cfg Config) (*DelayedSave, error) {
+	if cfg.Shards < 1 {
+		cfg.Shards = 1
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultConfig().FlushInterval
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+	if cfg.MinFlushInterval <= 0 {
+		cfg.MinFlushInterval = DefaultConfig().MinFlushInterval
+	}
+	if cfg.QueueSize < 1 {
+		cfg.QueueSize = DefaultConfig().QueueSize
+	}
+	switch cfg.Backpressure {
+	case "":
+		cfg.Backpressure = BackpressureBlock
+	case BackpressureBlock, BackpressureError:
+	case BackpressureSpill:
+		if cfg.SpillDir == "" || cfg.Lookup == nil {
+			return nil, errors.New("spill backpressure requires spill dir and user lookup")
+		}
+	default:
+		return nil, fmt.Errorf("unknown backpressure policy %q", cfg.Backpressure)
+	}
+
+	ds := &DelayedSave{
+		shards: make([]*saveShard, cfg.Shards),
+		ring:   newHashRing(cfg.Shards, ringReplicas),
+	}
+	for i := range ds.shards {
+		ds.shards[i] = &saveShard{
+			id:        i,
+			cfg:       cfg,
+			storage:   storage,
+			stopChan:  make(chan context.Context),
+			doneChan:  make(chan bool),
+			flushChan: make(chan flushRequest),
+			mainChan:  make(chan *store.User, cfg.QueueSize),
+		}
+
+		if cfg.Backpressure == BackpressureSpill {
+			spill, err := openSpillFile(cfg.SpillDir, i)
+			if err != nil {
+				return nil, err
+			}
+			ds.shards[i].spill = spill
+		}
+	}
+	ds.Start()
+	return ds, nil
+}
+
+// Close - останавливает сохранение в фоне, предварительно записывая в БД всех ожидающих пользователей.
+// Если запись не укладывается в timeout, оставшиеся изменения теряются
+func (ds *DelayedSave) Close(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, shard := range ds.shards {
+		select {
+		case shard.stopChan <- ctx:
+		case <-ctx.Done():
+		}
+	}
+
+	for _, shard := range ds.shards {
+		select {
+		case <-shard.doneChan:
+		case <-ctx.Done():
+			log.Printf("bg save shutdown deadline exceeded, unsaved users: %d", ds.Pending())
+			return
+		}
+	}
+}
+
+// Flush - синхронно записывает в БД всех ожидающих пользователей всех шардов, включая еще не вычитанных из очереди
+func (ds *DelayedSave) Flush(ctx context.Context) (FlushResult, error) {
+	var total FlushResult
+	for _, shard := range ds.shards {
+		req := flushRequest{ctx: ctx, result: make(chan FlushResult, 1)}
+		select {
+		case shard.flushChan <- req:
+		case <-ctx.Done():
+			return total, ctx.Err()
+		}
+
+		select {
+		case res := <-req.result:
+			total.Written += res.Written
+			total.Pending += res.Pending
+		case <-ctx.Done():
+			return total, ctx.Err()
+		}
+	}
+	return total, nil
+}
+
+// Admit - проверка перед списанием: ErrSaveQueueFull, если политика BackpressureError и очередь шарда пользователя заполнена
+func (ds *DelayedSave) Admit(userID int) error {
+	shard := ds.shard(userID)
+	if shard.cfg.Backpressure == BackpressureError && len(shard.mainChan) >= cap(shard.mainChan) {
+		atomic.AddInt64(&shard.rejected, 1)
+		return ErrSaveQueueFull
+	}
+	return nil
+}
+
+// Save - ставит пользователя в очередь на сохранение накопленного изменения баланса.
+// Пользователь, который уже стоит в очереди, повторно не ставится: его изменения копятся в одной Pending.
+// При заполненной очереди с BackpressureSpill пользователь записывается в файл переполнения,
+// иначе Save ждет места: для BackpressureError списания отсекаются заранее в Admit
+func (ds *DelayedSave) Save(user *store.User) {
+	shard := ds.shard(user.ID)
+	if !user.MarkQueued() {
+		atomic.AddInt64(&shard.coalesced, 1)
+		return
+	}
+
+	if shard.spill == nil {
+		shard.mainChan <- user
+		return
+	}
+
+	select {
+	case shard.mainChan <- user:
+	default:
+		if err := shard.spill.Append(user.ID); err != nil {
+			log.Printf("failed to spill user %d, waiting for save queue: %v", user.ID, err)
+			shard.mainChan <- user
+			return
+		}
+		atomic.AddInt64(&shard.spilled, 1)
+	}
+}
+
+// shard - шард, которому принадлежит пользователь
+func (ds *DelayedSave) shard(userId int) *saveShard {
+	return ds.shards[ds.ring.Get(userId)]
+}
+
+// Pending - количество пользователей, ожидающих сохранения
+func (ds *DelayedSave) Pending() int64 {
+	var pending int64
+	for _, shard := range ds.shards {
+		pending += atomic.LoadInt64(&shard.pending)
+	}
+	return pending
+}
+
+// MemoryUsage - примерный объем памяти под очередь и ожидающих сохранения пользователей
+func (ds *DelayedSave) MemoryUsage() int64 {
+	var size int64
+	for _, shard := range ds.shards {
+		size += atomic.LoadInt64(&shard.pending)*pendingEntrySize + int64(cap(shard.mainChan))*int64(unsafe.Sizeof(&store.User{}))
+	}
+	return size
+}
+
+// ShardStats - состояние каждого шарда
+func (ds *DelayedSave) ShardStats() []map[string]int64 {
+	stats := make([]map[string]int64, 0, len(ds.shards))
+	for _, shard := range ds.shards {
+		stats = append(stats, map[string]int64{
+			"shard":        int64(shard.id),
+			"queue":        int64(len(shard.mainChan)),
+			"queue_cap":    int64(cap(shard.mainChan)),
+			"rejected":     atomic.LoadInt64(&shard.rejected),
+			"spilled":      atomic.LoadInt64(&shard.spilled),
+			"coalesced":    atomic.LoadInt64(&shard.coalesced),
+			"pending":      atomic.LoadInt64(&shard.pending),
+			"saved":        atomic.LoadInt64(&shard.saved),
+			"retries":      atomic.LoadInt64(&shard.retries),
+			"dead_letters": atomic.LoadInt64(&shard.deadLetters),
+			"interval_ms":  time.Duration(atomic.LoadInt64(&shard.interval)).Milliseconds(),
+			"flush_ms":     time.Duration(atomic.LoadInt64(&shard.flushDuration)).Milliseconds(),
+		})
+	}
+	return stats
+}
+
+func (ds *DelayedSave) Start() {
+	for _, shard := range ds.shards {
+		go shard.run()
+	}
+}
+
+func (s *saveShard) run() {
+	interval, staleness := s.cfg.FlushInterval, s.cfg.Staleness
+	if s.cfg.Adaptive {
+		interval = s.cfg.MinFlushInterval
+		staleness = interval
+	}
+	atomic.StoreInt64(&s.interval, int64(interval))
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	users := make(map[int]*pendingUser)
+	log.Printf("start bg save shard %d", s.id)
+
+	for {
+		select {
+		case <-timer.C:
+			s.unspill(users)
+			// сохраняем юзеров, которых последний раз обновляли раньше окна staleness
+			dirty := len(users)
+			start := time.Now()
+			batches := s.flush(context.Background(), users, staleness, true)
+
+			if s.cfg.Adaptive {
+				interval = s.nextInterval(interval, dirty, batches, time.Since(start))
+				staleness = interval
+				atomic.StoreInt64(&s.interval, int64(interval))
+			}
+			timer.Reset(interval)
+
+		case user := <-s.mainChan:
+			// сохраняем время когда юзер пришел для обновления
+			s.add(users, user)
+			// по порогу сохраняются все, но без повторов раньше паузы: иначе при недоступной БД каждое следующее
+			// обновление повторяло бы все неудачные сохранения сразу
+			if s.cfg.FlushThreshold > 0 && s.updates >= s.cfg.FlushThreshold {
+				s.flush(context.Background(), users, 0, true)
+				s.updates = 0
+			}
+		case req := <-s.flushChan:
+			s.drain(users)
+			s.unspill(users)
+			saved := atomic.LoadInt64(&s.saved)
+			s.flush(req.ctx, users, 0, false)
+			req.result <- FlushResult{Written: int(atomic.LoadInt64(&s.saved) - saved), Pending: len(users)}
+		case ctx := <-s.stopChan:
+			// забираем все, что осталось в канале, и сохраняем всех без учета времени обновления
+			s.drain(users)
+			s.unspill(users)
+			s.flush(ctx, users, 0, false)
+			s.deadLetterAll(users, errors.New("not saved before shutdown"))
+			if s.spill != nil {
+				s.spill.Close()
+			}
+			log.Printf("stop bg save shard %d", s.id)
+			close(s.doneChan)
+			return
+		}
+	}
+}
+
+// add - запоминает пользователя и время его обновления
+func (s *saveShard) add(users map[int]*pendingUser, user *store.User) {
+	user.Dequeued()
+	if item, ok := users[user.ID]; ok {
+		item.updateTime = time.Now()
+	} else {
+		users[user.ID] = &pendingUser{user: user, updateTime: time.Now()}
+	}
+	s.updates++
+	atomic.StoreInt64(&s.pending, int64(len(users)))
+}
+
+// unspill - переносит в users пользователей из файла переполнения
+func (s *saveShard) unspill(users map[int]*pendingUser) {
+	if s.spill == nil {
+		return
+	}
+
+	ids, err := s.spill.Take()
+	if err != nil {
+		log.Printf("failed to read spill file of shard %d: %v", s.id, err)
+		return
+	}
+
+	for _, id := range ids {
+		// пользователя без несохраненных изменений кеш мог вытеснить - сохранять нечего
+		if user := s.cfg.Lookup(id); user != nil {
+			s.add(users, user)
+		}
+	}
+}
+
+// drain - переносит в users все, что накопилось в канале
+func (s *saveShard) drain(users map[int]*pendingUser) {
+	for {
+		select {
+		case user := <-s.mainChan:
+			s.add(users, user)
+		default:
+			return
+		}
+	}
+}
+
+// flush - записывает в БД пользователей, которые не обновлялись дольше staleness (0 - всех). С backoff пропускает
+// тех, чье повторное сохранение еще рано (nextAttempt), без него - сохраняет сразу (остановка, /admin/flush).
+// Пользователи сохраняются пачками по BatchSize или одним COPY от CopyThreshold, возвращает количество пачек
+func (s *saveShard) flush(ctx context.Context, users map[int]*pendingUser, staleness time.Duration, backoff bool) int {
+	if s.cfg.Writer != nil && !s.cfg.Writer() {
+		return 0
+	}
+
+	now := time.Now()
+	due := make([]*pendingUser, 0, len(users))
+	for _, item := range users {
+		if now.Sub(item.updateTime) < staleness || (backoff && now.Before(item.nextAttempt)) {
+			continue
+		}
+		due = append(due, item)
+	}
+
+	batches := 0
+	if bulk, ok := s.storage.(store.BulkSaver); ok && s.cfg.CopyThreshold > 0 && len(due) >= s.cfg.CopyThreshold {
+		s.saveBatch(ctx, users, due, bulk.SavePendingBulk)
+		batches++
+	} else {
+		for start := 0; start < len(due) && ctx.Err() == nil; start += s.cfg.BatchSize {
+			end := start + s.cfg.BatchSize
+			if end > len(due) {
+				end = len(due)
+			}
+			s.saveBatch(ctx, users, due[start:end], s.storage.SavePendingBatch)
+			batches++
+		}
+	}
+
+	if len(users) == 0 {
+		s.updates = 0
+	}
+	atomic.StoreInt64(&s.pending, int64(len(users)))
+	if len(due) > 0 {
+		atomic.StoreInt64(&s.flushDuration, int64(time.Since(now)))
+	}
+	return batches
+}
+
+// busyBatchLatency - если пачка пишется дольше, БД считается нагруженной
+const busyBatchLatency = 100 * time.Millisecond
+
+// nextInterval - следующий интервал адаптивного режима: вдвое реже, если изменений больше пачки или БД
+// отвечает медленно, иначе вдвое чаще. dirty - сколько пользователей ожидало, took - сколько заняло сохранение
+func (s *saveShard) nextInterval(interval time.Duration, dirty, batches int, took time.Duration) time.Duration {
+	busy := dirty > s.cfg.BatchSize
+	if batches > 0 && took/time.Duration(batches) > busyBatchLatency {
+		busy = true
+	}
+
+	if busy {
+		interval *= 2
+	} else {
+		interval /= 2
+	}
+
+	// пользователь ждет сохранения не дольше двух интервалов, поэтому интервал не больше половины Staleness
+	max := s.cfg.Staleness / 2
+	if interval > max {
+		interval = max
+	}
+	if interval < s.cfg.MinFlushInterval {
+		interval = s.cfg.MinFlushInterval
+	}
+	return interval
+}
+
+// saveBatch - сохраняет пачку пользователей одним вызовом save. Если пачка не сохранилась,
+// пользователи сохраняются по одному, чтобы ошибка одной строки не блокировала остальные
+func (s *saveShard) saveBatch(ctx context.Context, users map[int]*pendingUser, items []*pendingUser,
+	save func(ctx context.Context, batch []store.UserPending) error) {
+	log.Printf("Updating %d users", len(items))
+
+	batch := make([]store.UserPending, 0, len(items))
+	taken := make([]store.Pending, len(items))
+	for i, item := range items {
+		taken[i] = item.user.TakePending()
+		if taken[i].Delta != 0 || len(taken[i].Transactions) > 0 {
+			batch = append(batch, store.UserPending{UserID: item.user.ID, Pending: taken[i]})
+		}
+	}
+
+	saveCtx, cancel := s.saveContext(ctx)
+	err := save(saveCtx, batch)
+	cancel()
+	if err != nil {
+		log.Printf("failed to save batch of %d users, saving one by one: %v", len(batch), err)
+	}
+
+	for i, item := range items {
+		p := taken[i]
+		empty := p.Delta == 0 && len(p.Transactions) == 0
+		if err != nil && !empty {
+			// по одному - с проверкой версии: пользователь, которого изменил другой экземпляр, догоняет БД
+			saveCtx, cancel := s.saveContext(ctx)
+			err := store.SaveVersioned(saveCtx, s.storage, item.user, p)
+			cancel()
+			if err != nil {
+				s.failed(users, item, p, err)
+				continue
+			}
+		} else if !empty {
+			item.user.Saved(p)
+		}
+		s.applied(item.user.ID, p.Seq)
+		delete(users, item.user.ID)
+		atomic.AddInt64(&s.saved, 1)
+	}
+}
+
+// saveContext - контекст одного запроса сохранения, не дольше SaveTimeout
+func (s *saveShard) saveContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.cfg.SaveTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.cfg.SaveTimeout)
+}
+
+// failed - неудачная попытка сохранения: повтор с экспоненциальной паузой, либо в DeadLetters после MaxAttempts
+func (s *saveShard) failed(users map[int]*pendingUser, item *pendingUser, p store.Pending, err error) {
+	atomic.AddInt64(&s.retries, 1)
+	// хранилище недоступно и запрос не выполнялся: попытка не считается, чтобы изменения не ушли в DeadLetters,
+	// пока оно не отвечает
+	if !errors.Is(err, store.ErrUnavailable) {
+		item.attempts++
+	}
+	log.Printf("failed to save user %d (attempt %d): %v", item.user.ID, item.attempts, err)
+
+	if s.cfg.DeadLetters != nil && s.cfg.MaxAttempts > 0 && item.attempts >= s.cfg.MaxAttempts {
+		if s.deadLetter(item, p, err) {
+			delete(users, item.user.ID)
+			return
+		}
+	}
+
+	item.user.RestorePending(p)
+
+	backoff := s.cfg.RetryBase
+	if item.attempts > 1 {
+		backoff <<= item.attempts - 1
+	}
+	if backoff <= 0 || backoff > s.cfg.RetryMax {
+		backoff = s.cfg.RetryMax
+	}
+	item.nextAttempt = time.Now().Add(backoff)
+}
+
+// deadLetter - складывает изменения пользователя в DeadLetters, false - если и это не удалось
+func (s *saveShard) deadLetter(item *pendingUser, p store.Pending, cause error) bool {
+	err := s.cfg.DeadLetters.Add(DeadLetter{
+		UserID:   item.user.ID,
+		Pending:  p,
+		Error:    cause.Error(),
+		Attempts: item.attempts,
+		FailedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("failed to dead-letter user %d: %v", item.user.ID, err)
+		return false
+	}
+
+	log.Printf("user %d changes moved to dead letters after %d attempts", item.user.ID, item.attempts)
+	atomic.AddInt64(&s.deadLetters, 1)
+	// изменения теперь сохранены в DeadLetters, журнал по ним больше не нужен
+	s.applied(item.user.ID, p.Seq)
+	return true
+}
+
+// deadLetterAll - при остановке складывает в DeadLetters все, что так и не удалось сохранить
+func (s *saveShard) deadLetterAll(users map[int]*pendingUser, cause error) {
+	if s.cfg.DeadLetters == nil {
+		return
+	}
+
+	for userId, item := range users {
+		p := item.user.TakePending()
+		if p.Delta == 0 && len(p.Transactions) == 0 {
+			delete(users, userId)
+			continue
+		}
+		if s.deadLetter(item, p, cause) {
+			delete(users, userId)
+		} else {
+			item.user.RestorePending(p)
+		}
+	}
+	atomic.StoreInt64(&s.pending, int64(len(users)))
+}
+
+// applied - отмечает в журнале, что изменения пользователя до seq сохранены
+func (s *saveShard) applied(userID int, seq int64) {
+	if s.cfg.Journal != nil {
+		s.cfg.Journal.Applied(userID, seq)
+	}
+}
@@ -0,0 +1,2 @@
+// Package writeback - отложенное сохранение измененных пользователей в БД в фоне.
+package writeback
@@ -0,0 +1,54 @@
+package writeback
+
+import (
+	"context"
+
+	"github.com/Skat712/test_balance/journal"
+	"github.com/Skat712/test_balance/store"
+)
+
+// ReplayJournal - применяет в БД записи журнала, которые не успели сохраниться до падения, и очищает журнал.
+// Записи с seq не больше сохраненного в БД journal_seq пользователя уже применены и пропускаются.
+// Возвращает количество пользователей, у которых были применены изменения
+func ReplayJournal(ctx context.Context, storage store.Storage, j *journal.Journal) (int, error) {
+	entries := make(map[int][]journal.Entry)
+	err := j.Replay(func(e journal.Entry) error {
+		userID := e.Transaction.UserID
+		entries[userID] = append(entries[userID], e)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for userID, userEntries := range entries {
+		applied, err := storage.JournalSeq(ctx, userID)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		var p store.Pending
+		for _, e := range userEntries {
+			if e.Seq <= applied {
+				continue
+			}
+			p.Delta += e.Transaction.Amount
+			p.Seq = e.Seq
+			p.Transactions = append(p.Transactions, e.Transaction)
+		}
+		if p.Seq == 0 {
+			continue
+		}
+
+		if err := storage.SavePending(ctx, userID, p); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+
+	return replayed, j.Reset()
+}
@@ -0,0 +1,49 @@
+package writeback
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas - количество виртуальных узлов на один шард в кольце хешей
+const ringReplicas = 64
+
+// hashRing - кольцо консистентного хеширования id пользователей по шардам
+type hashRing struct {
+	hashes []uint32
+	shards map[uint32]int
+}
+
+func newHashRing(shardsCount, replicas int) hashRing {
+	ring := hashRing{
+		hashes: make([]uint32, 0, shardsCount*replicas),
+		shards: make(map[uint32]int, shardsCount*replicas),
+	}
+	for shard := 0; shard < shardsCount; shard++ {
+		for i := 0; i < replicas; i++ {
+			h := hashKey(fmt.Sprintf("shard-%d-%d", shard, i))
+			ring.hashes = append(ring.hashes, h)
+			ring.shards[h] = shard
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+	return ring
+}
+
+// Get - номер шарда, которому принадлежит id пользователя
+func (r hashRing) Get(userId int) int {
+	h := hashKey(strconv.Itoa(userId))
+	idx := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if idx == len(r.hashes) {
+		idx = 0
+	}
+	return r.shards[r.hashes[idx]]
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}